@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+)
+
+// adminClient is a backend reached through the admin API of a server
+type adminClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newAdminClient(baseURL, token string) *adminClient {
+	return &adminClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// stateResponse is the JSON form of a key's state in the admin API
+type stateResponse struct {
+	Key       string    `json:"key"`
+	Policy    string    `json:"policy"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Window    string    `json:"window"`
+	ResetTime time.Time `json:"reset_time"`
+	Blocked   bool      `json:"blocked"`
+}
+
+func (s stateResponse) keyState() limiter.KeyState {
+	window, _ := time.ParseDuration(s.Window)
+	return limiter.KeyState{
+		Key:       s.Key,
+		Policy:    s.Policy,
+		Limit:     s.Limit,
+		Remaining: s.Remaining,
+		Window:    window,
+		ResetTime: s.ResetTime,
+		Blocked:   s.Blocked,
+	}
+}
+
+// Inspect posts the subject, as a token must not be sent in the URL
+func (c *adminClient) Inspect(ctx context.Context, subject limiter.Subject) (limiter.KeyState, error) {
+	var state stateResponse
+	if err := c.do(ctx, http.MethodPost, "/admin/state", subjectValues(subject), &state); err != nil {
+		return limiter.KeyState{}, err
+	}
+	return state.keyState(), nil
+}
+
+func (c *adminClient) Reset(ctx context.Context, subject limiter.Subject) (string, error) {
+	var result struct{ Key string }
+	err := c.do(ctx, http.MethodPost, "/admin/reset", subjectValues(subject), &result)
+	return result.Key, err
+}
+
+func (c *adminClient) Unblock(ctx context.Context, subject limiter.Subject) (string, error) {
+	var result struct{ Key string }
+	err := c.do(ctx, http.MethodPost, "/admin/unblock", subjectValues(subject), &result)
+	return result.Key, err
+}
+
+func (c *adminClient) Block(ctx context.Context, subject limiter.Subject, d time.Duration) (string, error) {
+	values := subjectValues(subject)
+	values.Set("duration", d.String())
+	var result struct{ Key string }
+	err := c.do(ctx, http.MethodPost, "/admin/block", values, &result)
+	return result.Key, err
+}
+
+func (c *adminClient) BlockedKeys(ctx context.Context) ([]limiter.BlockedKey, error) {
+	var result struct {
+		Blocked []struct {
+			Key       string    `json:"key"`
+			ResetTime time.Time `json:"reset_time"`
+		} `json:"blocked"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/blocked", nil, &result); err != nil {
+		return nil, err
+	}
+	blocked := make([]limiter.BlockedKey, 0, len(result.Blocked))
+	for _, b := range result.Blocked {
+		blocked = append(blocked, limiter.BlockedKey{Key: b.Key, ResetTime: b.ResetTime})
+	}
+	return blocked, nil
+}
+
+func (c *adminClient) TopConsumers(ctx context.Context, n int) ([]limiter.KeyState, error) {
+	var result struct {
+		Keys []stateResponse `json:"keys"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/top", url.Values{"n": {strconv.Itoa(n)}}, &result); err != nil {
+		return nil, err
+	}
+	states := make([]limiter.KeyState, 0, len(result.Keys))
+	for _, state := range result.Keys {
+		states = append(states, state.keyState())
+	}
+	return states, nil
+}
+
+// do calls the admin API, decoding its response into v
+// Parameters go in the query string of GET requests and in a form body
+// otherwise, which keeps tokens out of access logs
+func (c *adminClient) do(ctx context.Context, method, path string, values url.Values, v interface{}) error {
+	target := c.baseURL + path
+	var body *strings.Reader
+	if method == http.MethodGet {
+		if len(values) > 0 {
+			target += "?" + values.Encode()
+		}
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(values.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("admin API: %s: %s", resp.Status, failure.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// subjectValues returns the admin API parameters naming subject
+func subjectValues(subject limiter.Subject) url.Values {
+	values := url.Values{}
+	for name, value := range map[string]string{
+		"ip":       subject.IP,
+		"token":    subject.Token,
+		"token_id": subject.TokenID,
+		"key":      subject.Key,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/handlers"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func TestAdminClient_Inspect(t *testing.T) {
+	store := storage.NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	service := limiter.NewService(store, &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenLimits:            map[string]config.TokenLimit{"premium-token": {MaxRequests: 100}},
+	})
+
+	var urls []string
+	handler := handlers.StateHandler(service)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urls = append(urls, r.URL.String())
+		handler(w, r)
+	}))
+	defer server.Close()
+
+	client := newAdminClient(server.URL, "")
+	ctx := context.Background()
+	for subject, limit := range map[limiter.Subject]int{{Token: "premium-token"}: 100, {IP: "192.168.1.1"}: 5} {
+		if state, err := client.Inspect(ctx, subject); err != nil || state.Limit != limit {
+			t.Errorf("Expected a limit of %d for %+v, got %+v, %v", limit, subject, state, err)
+		}
+	}
+
+	for _, u := range urls {
+		if strings.Contains(u, "premium-token") {
+			t.Errorf("Expected the token to stay out of the URL, got %s", u)
+		}
+	}
+}
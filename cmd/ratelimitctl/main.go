@@ -0,0 +1,213 @@
+// Command ratelimitctl inspects and manages the state of the rate limiter
+//
+// It works on the configured storage directly, or on a running server
+// through its admin API with -admin, and validates and simulates policies
+// offline. Run ratelimitctl -h for the commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+const usage = `Usage: ratelimitctl [-admin URL] <command> [flags]
+
+Commands:
+  state     show the limit, remaining requests and reset time of a client
+  reset     clear a client's counters and any block
+  unblock   lift a client's block, keeping its counters
+  ban       block a client for -duration
+  blocked   list the blocked keys
+  top       list the clients that used the most of their limit
+  token     list, create, revoke and re-tier registered tokens
+  validate  validate a policy file
+  simulate  replay a sequence of requests against the policy
+
+Clients are named by -ip, -token, -token-id or -key (a raw storage key).
+The configuration is read like the server's, from the environment and .env.
+With -admin, state, reset, unblock, ban, blocked, top and token go through
+the admin API of a running server, authenticated with ADMIN_TOKEN.
+`
+
+// backend is where the state of the rate limiter is read and changed: the
+// storage through a limiter.Service, or a server's admin API
+type backend interface {
+	Inspect(ctx context.Context, subject limiter.Subject) (limiter.KeyState, error)
+	Reset(ctx context.Context, subject limiter.Subject) (string, error)
+	Unblock(ctx context.Context, subject limiter.Subject) (string, error)
+	Block(ctx context.Context, subject limiter.Subject, d time.Duration) (string, error)
+	BlockedKeys(ctx context.Context) ([]limiter.BlockedKey, error)
+	TopConsumers(ctx context.Context, n int) ([]limiter.KeyState, error)
+	Tokens(ctx context.Context) ([]*registry.Token, error)
+	CreateToken(ctx context.Context, owner, tier string) (*registry.Token, string, error)
+	RevokeToken(ctx context.Context, id string) (*registry.Token, error)
+	SetTokenTier(ctx context.Context, id, tier string) (*registry.Token, error)
+}
+
+func main() {
+	flags := flag.NewFlagSet("ratelimitctl", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	adminURL := flags.String("admin", "", "base URL of the admin API, e.g. http://localhost:9090")
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(context.Background(), os.Stdout, *adminURL, flags.Arg(0), flags.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "ratelimitctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run executes command with its arguments, writing its output to w
+func run(ctx context.Context, w io.Writer, adminURL, command string, args []string) error {
+	switch command {
+	case "validate":
+		return validate(w, args)
+	case "simulate":
+		return simulate(ctx, w, args)
+	case "token":
+		return tokens(ctx, w, adminURL, args)
+	case "state", "reset", "unblock", "ban", "blocked", "top":
+	default:
+		return fmt.Errorf("unknown command %q, see ratelimitctl -h", command)
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	var subject limiter.Subject
+	flags.StringVar(&subject.IP, "ip", "", "client IP")
+	flags.StringVar(&subject.Token, "token", "", "client token")
+	flags.StringVar(&subject.TokenID, "token-id", "", "ID of a registered token")
+	flags.StringVar(&subject.Key, "key", "", "raw storage key")
+	duration := flags.Duration("duration", 0, "how long to ban the client")
+	n := flags.Int("n", 10, "number of clients to list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	b, closeBackend, err := newBackend(adminURL)
+	if err != nil {
+		return err
+	}
+	defer closeBackend()
+
+	switch command {
+	case "state":
+		state, err := b.Inspect(ctx, subject)
+		if err != nil {
+			return err
+		}
+		printState(w, state)
+	case "reset":
+		key, err := b.Reset(ctx, subject)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reset %s\n", key)
+	case "unblock":
+		key, err := b.Unblock(ctx, subject)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "unblocked %s\n", key)
+	case "ban":
+		if *duration <= 0 {
+			return errors.New("ban requires a positive -duration, e.g. -duration 1h")
+		}
+		key, err := b.Block(ctx, subject, *duration)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "banned %s for %v\n", key, *duration)
+	case "blocked":
+		blocked, err := b.BlockedKeys(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tBLOCKED UNTIL")
+		for _, key := range blocked {
+			fmt.Fprintf(tw, "%s\t%s\n", key.Key, key.ResetTime.Format(time.RFC3339))
+		}
+		tw.Flush()
+	case "top":
+		top, err := b.TopConsumers(ctx, *n)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tPOLICY\tUSED\tLIMIT\tWINDOW\tRESET\tBLOCKED")
+		for _, state := range top {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%v\t%s\t%v\n", state.Key, state.Policy, state.Limit-state.Remaining, state.Limit, state.Window, state.ResetTime.Format(time.RFC3339), state.Blocked)
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+// newBackend returns the admin API at adminURL, or the configured storage
+// when adminURL is empty, with the function releasing it
+func newBackend(adminURL string) (backend, func(), error) {
+	if adminURL != "" {
+		return newAdminClient(adminURL, os.Getenv("ADMIN_TOKEN")), func() {}, nil
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if cfg.StorageBackend == config.StorageBackendMemory {
+		return nil, nil, errors.New("the memory storage lives in the server process, use -admin to reach it")
+	}
+
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize %s storage: %w", cfg.StorageBackend, err)
+	}
+	service := limiter.NewService(store, cfg)
+	if cfg.TokenRegistry != "" {
+		tokenRegistry, err := registry.New(cfg, store)
+		if err != nil {
+			store.Close()
+			return nil, nil, fmt.Errorf("failed to load token registry: %w", err)
+		}
+		service.SetTokenRegistry(tokenRegistry)
+	}
+	return service, func() { store.Close() }, nil
+}
+
+// validate checks the policy file named by the first argument
+func validate(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: ratelimitctl validate <policy file>")
+	}
+	if _, err := config.LoadPolicyFile(args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s is valid\n", args[0])
+	return nil
+}
+
+func printState(w io.Writer, state limiter.KeyState) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "key\t%s\n", state.Key)
+	fmt.Fprintf(tw, "policy\t%s\n", state.Policy)
+	fmt.Fprintf(tw, "limit\t%d per %v\n", state.Limit, state.Window)
+	fmt.Fprintf(tw, "remaining\t%d\n", state.Remaining)
+	fmt.Fprintf(tw, "reset\t%s (in %v)\n", state.ResetTime.Format(time.RFC3339), max(time.Until(state.ResetTime), 0).Round(time.Second))
+	fmt.Fprintf(tw, "blocked\t%v\n", state.Blocked)
+	tw.Flush()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+// simulatedRequest is a request replayed by simulate, at offset from the
+// start of the simulation
+type simulatedRequest struct {
+	at     time.Duration
+	ip     string
+	token  string
+	method string
+	host   string
+	path   string
+}
+
+// simulate replays the requests read from -f, or stdin, against the policy
+// in a fresh in-memory storage whose clock follows the requests' offsets,
+// and reports which of them are admitted
+func simulate(ctx context.Context, w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	policyFile := flags.String("policy", "", "policy file to simulate, instead of POLICY_FILE")
+	requestsFile := flags.String("f", "", "file listing the requests, - or empty for stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *policyFile != "" {
+		os.Setenv("POLICY_FILE", *policyFile)
+	}
+	// The simulation counts in memory whatever storage the server uses, so
+	// neither Redis settings nor TOKEN_HASH_SECRET are needed
+	os.Setenv("STORAGE_BACKEND", config.StorageBackendMemory)
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	in := io.Reader(os.Stdin)
+	if *requestsFile != "" && *requestsFile != "-" {
+		f, err := os.Open(*requestsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	requests, err := parseRequests(in)
+	if err != nil {
+		return err
+	}
+
+	return replay(ctx, w, cfg, requests)
+}
+
+// replay runs requests against cfg and writes one line per request
+func replay(ctx context.Context, w io.Writer, cfg *config.Config, requests []simulatedRequest) error {
+	store := storage.NewMemoryStorage(0, 0)
+	defer store.Close()
+	start := time.Now()
+	var now time.Time
+	store.SetClock(func() time.Time { return now })
+
+	service := limiter.NewService(store, cfg)
+	if cfg.TokenRegistry != "" {
+		tokenRegistry, err := registry.New(cfg, store)
+		if err != nil {
+			return fmt.Errorf("failed to load token registry: %w", err)
+		}
+		service.SetTokenRegistry(tokenRegistry)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tAT\tIP\tTOKEN\tROUTE\tRESULT\tREMAINING\tPOLICY")
+	admitted := 0
+	for i, req := range requests {
+		now = start.Add(req.at)
+		route := service.MatchRoute(req.method, req.host, req.path)
+		decision, err := route.CheckAndIncrement(ctx, req.ip, req.token)
+
+		var result string
+		switch {
+		case err == nil:
+			result = "allowed"
+			admitted++
+		case errors.Is(err, limiter.ErrLimitExceeded):
+			result = "limited (429)"
+		case errors.Is(err, limiter.ErrAccessDenied):
+			result = "denied (403)"
+		case errors.Is(err, limiter.ErrInvalidToken):
+			result = "invalid token (401)"
+		default:
+			return fmt.Errorf("request %d: %w", i+1, err)
+		}
+
+		token := "-"
+		if req.token != "" {
+			token = config.RedactToken(req.token)
+		}
+		remaining := "-"
+		if decision.Limit > 0 {
+			remaining = fmt.Sprintf("%d/%d", decision.Remaining, decision.Limit)
+		}
+		fmt.Fprintf(tw, "%d\t%v\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, req.at, req.ip, token, route.Name(), result, remaining, decision.Policy)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d admitted, %d rejected\n", admitted, len(requests)-admitted)
+	return nil
+}
+
+// parseRequests reads one request per line as space separated key=value
+// fields; blank lines and lines starting with # are skipped
+//
+//	at=1.5s ip=10.0.0.1 token=abc method=POST path=/login repeat=5 every=100ms
+//
+// at is the offset from the start of the simulation and defaults to the
+// previous line's; repeat sends the request that many times, every apart
+func parseRequests(r io.Reader) ([]simulatedRequest, error) {
+	var requests []simulatedRequest
+	var at time.Duration
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		req := simulatedRequest{at: at, method: "GET", path: "/"}
+		repeat, every := 1, time.Duration(0)
+		for _, field := range strings.Fields(text) {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: %q is not a key=value field", line, field)
+			}
+
+			var err error
+			switch name {
+			case "at":
+				req.at, err = time.ParseDuration(value)
+				if err == nil && req.at < at {
+					err = fmt.Errorf("%v is before the previous request at %v", req.at, at)
+				}
+			case "ip":
+				req.ip = value
+			case "token":
+				req.token = value
+			case "method":
+				req.method = strings.ToUpper(value)
+			case "host":
+				req.host = value
+			case "path":
+				req.path = value
+			case "repeat":
+				repeat, err = strconv.Atoi(value)
+				if err == nil && repeat < 1 {
+					err = errors.New("must be at least 1")
+				}
+			case "every":
+				every, err = time.ParseDuration(value)
+				if err == nil && every < 0 {
+					err = errors.New("must not be negative")
+				}
+			default:
+				err = errors.New("unknown field")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s: %w", line, name, err)
+			}
+		}
+		if req.ip == "" {
+			return nil, fmt.Errorf("line %d: ip is required", line)
+		}
+
+		for i := 0; i < repeat; i++ {
+			requests = append(requests, req)
+			req.at += every
+		}
+		at = req.at - every
+	}
+	return requests, scanner.Err()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+func TestParseRequests(t *testing.T) {
+	requests, err := parseRequests(strings.NewReader(`
+# two quick requests, then one after a second
+ip=10.0.0.1 repeat=2 every=100ms
+at=1s ip=10.0.0.1 token=abc method=post path=/login
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(requests))
+	}
+	if requests[0].at != 0 || requests[1].at != 100*time.Millisecond || requests[2].at != time.Second {
+		t.Errorf("Unexpected offsets: %+v", requests)
+	}
+	if last := requests[2]; last.method != "POST" || last.path != "/login" || last.token != "abc" {
+		t.Errorf("Unexpected request: %+v", last)
+	}
+
+	invalid := []string{
+		"10.0.0.1",
+		"token=abc",
+		"ip=10.0.0.1 repeat=0",
+		"ip=10.0.0.1 port=80",
+		"at=2s ip=10.0.0.1\nat=1s ip=10.0.0.1",
+	}
+	for _, input := range invalid {
+		if _, err := parseRequests(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	cfg := &config.Config{
+		MaxRequestsPerSecond: 2,
+		RateLimitWindow:      time.Second,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		TokenMode:            config.TokenModeFallback,
+		UnknownTokenAction:   config.UnknownTokenIP,
+	}
+	requests, _ := parseRequests(strings.NewReader("ip=10.0.0.1 repeat=3\nat=2s ip=10.0.0.1"))
+
+	var out bytes.Buffer
+	if err := replay(context.Background(), &out, cfg, requests); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// The third request is over the limit; the window has passed by the fourth
+	if !strings.Contains(out.String(), "3 admitted, 1 rejected") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+	if strings.Count(out.String(), "limited (429)") != 1 {
+		t.Errorf("Expected one limited request, got:\n%s", out.String())
+	}
+}
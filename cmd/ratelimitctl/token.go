@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+)
+
+const tokenUsage = `usage: ratelimitctl token <list|create|revoke|tier> [flags]
+
+  list                         list the registered tokens
+  create -owner O [-tier T]    register a new token and print its secret
+  revoke -id ID                disable a token, keeping its record
+  tier -id ID [-tier T]        move a token to a tier, or to the default limit`
+
+// tokens runs the token subcommand in args, managing the token registry
+func tokens(ctx context.Context, w io.Writer, adminURL string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(tokenUsage)
+	}
+	command := args[0]
+	switch command {
+	case "list", "create", "revoke", "tier":
+	default:
+		return fmt.Errorf("unknown token command %q\n%s", command, tokenUsage)
+	}
+
+	flags := flag.NewFlagSet("token "+command, flag.ContinueOnError)
+	id := flags.String("id", "", "ID of the registered token")
+	owner := flags.String("owner", "", "owner of the new token")
+	tier := flags.String("tier", "", "tier of the token, empty for the default token limit")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if (command == "revoke" || command == "tier") && *id == "" {
+		return fmt.Errorf("token %s requires -id", command)
+	}
+
+	b, closeBackend, err := newBackend(adminURL)
+	if err != nil {
+		return err
+	}
+	defer closeBackend()
+
+	switch command {
+	case "list":
+		list, err := b.Tokens(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tOWNER\tTIER\tSTATUS\tCREATED")
+		for _, token := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", token.ID, token.Owner, token.Tier, tokenStatus(token), token.CreatedAt.Format(time.RFC3339))
+		}
+		tw.Flush()
+	case "create":
+		token, secret, err := b.CreateToken(ctx, *owner, *tier)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "created %s\nsecret %s\n", token.ID, secret)
+		fmt.Fprintln(w, "The secret is shown only once; only its hash is kept.")
+	case "revoke":
+		token, err := b.RevokeToken(ctx, *id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "revoked %s\n", token.ID)
+	case "tier":
+		token, err := b.SetTokenTier(ctx, *id, *tier)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "moved %s to tier %q\n", token.ID, token.Tier)
+	}
+	return nil
+}
+
+// tokenStatus describes whether token may be used
+func tokenStatus(token *registry.Token) string {
+	switch {
+	case token.Disabled:
+		return "revoked"
+	case !token.Active(time.Now()):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+func (c *adminClient) Tokens(ctx context.Context) ([]*registry.Token, error) {
+	var result struct {
+		Tokens []*registry.Token `json:"tokens"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/tokens", nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Tokens, nil
+}
+
+func (c *adminClient) CreateToken(ctx context.Context, owner, tier string) (*registry.Token, string, error) {
+	var result struct {
+		Token  *registry.Token `json:"token"`
+		Secret string          `json:"secret"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/admin/tokens", url.Values{"owner": {owner}, "tier": {tier}}, &result); err != nil {
+		return nil, "", err
+	}
+	return result.Token, result.Secret, nil
+}
+
+func (c *adminClient) RevokeToken(ctx context.Context, id string) (*registry.Token, error) {
+	var token registry.Token
+	if err := c.do(ctx, http.MethodPost, "/admin/tokens/revoke", url.Values{"id": {id}}, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (c *adminClient) SetTokenTier(ctx context.Context, id, tier string) (*registry.Token, error) {
+	var token registry.Token
+	if err := c.do(ctx, http.MethodPost, "/admin/tokens/tier", url.Values{"id": {id}, "tier": {tier}}, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
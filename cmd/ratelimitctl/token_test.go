@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/handlers"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func TestTokens_Admin(t *testing.T) {
+	store := storage.NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	service := limiter.NewService(store, &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        time.Minute,
+		EnableTokenRateLimiter: true,
+		Tiers:                  map[string]config.TokenLimit{"pro": {MaxRequests: 50}},
+	})
+	service.SetTokenRegistry(registry.NewMemoryRegistry())
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/tokens", handlers.TokensHandler(service))
+	mux.Handle("/admin/tokens/revoke", handlers.RevokeTokenHandler(service))
+	mux.Handle("/admin/tokens/tier", handlers.TokenTierHandler(service))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := tokens(ctx, &out, server.URL, args)
+		return out.String(), err
+	}
+
+	out, err := run("create", "-owner", "acme", "-tier", "pro")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	id := regexp.MustCompile(`created (tok_\w+)`).FindStringSubmatch(out)
+	if id == nil || !strings.Contains(out, "secret rl_") {
+		t.Fatalf("Expected the new token and its secret, got %q", out)
+	}
+
+	if out, err := run("tier", "-id", id[1]); err != nil || !strings.Contains(out, `tier ""`) {
+		t.Errorf("Expected the token to leave its tier, got %q, %v", out, err)
+	}
+	if out, err := run("revoke", "-id", id[1]); err != nil || out != "revoked "+id[1]+"\n" {
+		t.Errorf("Expected the token to be revoked, got %q, %v", out, err)
+	}
+	if out, err := run("list"); err != nil || !strings.Contains(out, id[1]) || !strings.Contains(out, "revoked") {
+		t.Errorf("Expected the revoked token to be listed, got %q, %v", out, err)
+	}
+
+	if _, err := run("create", "-owner", "acme", "-tier", "gold"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected the server to reject an unknown tier, got %v", err)
+	}
+	if _, err := run("revoke"); err == nil {
+		t.Error("Expected revoke to require -id")
+	}
+	if _, err := run("rotate"); err == nil {
+		t.Error("Expected an unknown token command to fail")
+	}
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -12,18 +16,329 @@ import (
 
 type Config struct {
 	ServerPort              string
+	StorageBackend          string
+	MemoryMaxKeys           int
+	MemoryCleanupInterval   time.Duration
 	RedisHost               string
 	RedisPort               string
+	RedisMode               string
+	RedisURL                string
+	RedisAddrs              []string
+	RedisUsername           string
+	RedisPassword           string
+	RedisDB                 int
+	RedisSentinelMaster     string
+	RedisSentinelUsername   string
+	RedisSentinelPassword   string
+	RedisTLS                bool
+	RedisTLSCAFile          string
+	RedisTLSCertFile        string
+	RedisTLSKeyFile         string
+	RedisTLSServerName      string
+	RedisTLSSkipVerify      bool
+	RedisPoolSize           int
+	RedisMinIdleConns       int
+	RedisDialTimeout        time.Duration
+	RedisReadTimeout        time.Duration
+	RedisWriteTimeout       time.Duration
 	MaxRequestsPerSecond    int
+	RateLimitWindow         time.Duration
 	BlockingTime            time.Duration
+	RateLimitAlgorithm      string
+	RateLimitBurst          int
 	TokenLimits             map[string]TokenLimit
 	EnableIPRateLimiter     bool
 	EnableTokenRateLimiter  bool
+	TokenMode               string
+	Tiers                   map[string]TokenLimit
+	TokenRegistry           string
+	TokenRegistryFile       string
+	TokenRegistryCacheTTL   time.Duration
+	UnknownTokenAction      string
+	TokenHashSecret         string
+	PolicyFile              string
+	PolicyReloadInterval    time.Duration
+	AdminToken              string
+	AdminPort               string
+	DecisionToken           string
+	DecisionPort            string
+	LegacyRateLimitHeaders  bool
+	TrustedProxies          []*net.IPNet
+	TrustedProxyHeader      string
+	IPv4PrefixLength        int
+	IPv6PrefixLength        int
+	KeySource               *KeySource
+	Routes                  []RouteRule
+	AllowIPs                []*net.IPNet
+	DenyIPs                 []*net.IPNet
+	AllowTokens             []string
+	DenyTokens              []string
+	FailureMode             string
+	FailureLocalInstances   int
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+	Upstreams               map[string]Upstream
+	UpstreamTimeout         time.Duration
+	Descriptors             []DescriptorRule
+	RLSPort                 string
 }
 
+// TokenLimit holds the limits for a specific token: at most MaxRequests per
+// Window, after which the token is blocked for BlockingTime
+// Algorithm falls back to the global setting when empty; Burst defaults to
+// MaxRequests. IPMaxRequests, when set, caps the requests each IP may make
+// with the token per Window
 type TokenLimit struct {
-	MaxRequests int
-	TTL         time.Duration
+	MaxRequests   int
+	Window        time.Duration
+	BlockingTime  time.Duration
+	Algorithm     string
+	Burst         int
+	IPMaxRequests int
+}
+
+// RouteRule applies its own limit to the requests matching Pattern
+// Pattern uses the http.ServeMux syntax, e.g. "GET /users/{id}"
+// Rules are evaluated in order and the first match wins; Exempt rules are
+// not rate limited and Key, when set, overrides the policy's key source
+// FailureMode, when set, overrides the policy's failure mode
+// Upstream names the upstream the requests are proxied to; a rule without a
+// limit of its own only picks the upstream and applies the default limits
+type RouteRule struct {
+	Name        string
+	Pattern     string
+	Limit       TokenLimit
+	Exempt      bool
+	Key         *KeySource
+	FailureMode string
+	Upstream    string
+}
+
+// AppliesDefaultLimits reports whether the rule applies the default limits
+// rather than its own
+func (r RouteRule) AppliesDefaultLimits() bool {
+	return !r.Exempt && r.Limit.MaxRequests == 0
+}
+
+// String describes the rule without its secrets
+func (r RouteRule) String() string {
+	var s string
+	switch {
+	case r.Exempt:
+		s = fmt.Sprintf("%s (exempt)", r.Pattern)
+	case r.AppliesDefaultLimits():
+		s = fmt.Sprintf("%s (default limits)", r.Pattern)
+	default:
+		s = fmt.Sprintf("%s %+v", r.Pattern, r.Limit)
+	}
+	if r.Key != nil && !r.Exempt {
+		s += fmt.Sprintf(" by %s", r.Key)
+	}
+	if r.FailureMode != "" && !r.Exempt {
+		s += fmt.Sprintf(" failing %s", r.FailureMode)
+	}
+	if r.Upstream != "" {
+		s += fmt.Sprintf(" to %s", r.Upstream)
+	}
+	return s
+}
+
+// KeySource describes how the rate limiting key of a request is extracted,
+// in place of the API token headers; see the Key* constants for the types
+// Name is the header, query parameter or cookie to read, Prefix is stripped
+// from header values and Sources are combined by KeyFirst and KeyComposite
+// A JWT claim is verified with Secret (HMAC) or PublicKey (RSA, ECDSA) when
+// set and read unverified otherwise
+type KeySource struct {
+	Type      string
+	Name      string
+	Prefix    string
+	Claim     string
+	Segment   int
+	Secret    []byte
+	PublicKey crypto.PublicKey
+	Sources   []KeySource
+}
+
+// String describes the key source without its secrets, e.g. "first(header API_KEY, jwt_claim sub)"
+func (k *KeySource) String() string {
+	if k == nil {
+		return "API token headers"
+	}
+	switch k.Type {
+	case KeyJWTClaim:
+		return fmt.Sprintf("%s %s", k.Type, k.Claim)
+	case KeyPathSegment:
+		return fmt.Sprintf("%s %d", k.Type, k.Segment)
+	case KeyFirst, KeyComposite:
+		sources := make([]string, 0, len(k.Sources))
+		for i := range k.Sources {
+			sources = append(sources, k.Sources[i].String())
+		}
+		return fmt.Sprintf("%s(%s)", k.Type, strings.Join(sources, ", "))
+	default:
+		return fmt.Sprintf("%s %s", k.Type, k.Name)
+	}
+}
+
+// Key source types
+const (
+	KeyHeader      = "header"
+	KeyQuery       = "query"
+	KeyCookie      = "cookie"
+	KeyJWTClaim    = "jwt_claim"
+	KeyPathSegment = "path_segment"
+	KeyFirst       = "first"     // the first source that yields a key
+	KeyComposite   = "composite" // every source's key, joined
+)
+
+// KeyTypes lists every supported key source type
+var KeyTypes = []string{KeyHeader, KeyQuery, KeyCookie, KeyJWTClaim, KeyPathSegment, KeyFirst, KeyComposite}
+
+// Token modes: how the limits of requests carrying a token combine with the
+// IP limit
+const (
+	TokenModeOverride = "override" // any token is limited by its own limit instead of the IP
+	TokenModeFallback = "fallback" // tokens without a limit of their own are limited by IP
+	TokenModeBoth     = "both"     // requests with a token are limited by both the token and the IP
+)
+
+// TokenModes lists every supported token mode
+var TokenModes = []string{TokenModeOverride, TokenModeFallback, TokenModeBoth}
+
+// Token registry backends
+const (
+	TokenRegistryStorage = "storage" // the configured storage backend
+	TokenRegistryFile    = "file"    // a JSON file, TOKEN_REGISTRY_FILE
+)
+
+// Actions taken on tokens that aren't configured, registered and active
+// when a token registry is used
+const (
+	UnknownTokenIP     = "ip"     // limited by IP like requests without a token
+	UnknownTokenReject = "reject" // rejected with 401 Unauthorized
+)
+
+// TokenHashPrefix marks a token declared by the hex SHA-256 digest of its
+// secret rather than the secret itself, e.g. "sha256:9f86d0..."
+const TokenHashPrefix = "sha256:"
+
+// HashToken returns the declaration of token by digest, as accepted in
+// token limits and allow and deny lists
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return TokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// IsTokenHash reports whether token is a declaration by digest
+func IsTokenHash(token string) bool {
+	digest, ok := strings.CutPrefix(token, TokenHashPrefix)
+	if !ok || len(digest) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// RedactToken returns a short fingerprint of token for logs: the start of
+// its digest, enough to tell tokens apart without revealing them
+func RedactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if !IsTokenHash(token) {
+		token = HashToken(token)
+	}
+	return token[:len(TokenHashPrefix)+12]
+}
+
+// Failure modes: how requests are handled when the storage fails
+const (
+	FailureModeOpen   = "open"   // requests are allowed without a limit
+	FailureModeClosed = "closed" // requests are rejected with 503 Service Unavailable
+	FailureModeLocal  = "local"  // requests are limited in memory, by this instance's share of the limit
+)
+
+// FailureModes lists every supported failure mode
+var FailureModes = []string{FailureModeOpen, FailureModeClosed, FailureModeLocal}
+
+// IsValidFailureMode reports whether mode is a supported failure mode
+func IsValidFailureMode(mode string) bool {
+	for _, valid := range FailureModes {
+		if valid == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Storage backends
+const (
+	StorageBackendRedis  = "redis"
+	StorageBackendMemory = "memory"
+)
+
+// Redis deployments
+const (
+	RedisModeStandalone = "standalone" // a single server, REDIS_HOST:REDIS_PORT
+	RedisModeSentinel   = "sentinel"   // the master of REDIS_SENTINEL_MASTER, found through the REDIS_ADDRS sentinels
+	RedisModeCluster    = "cluster"    // a Redis Cluster, discovered from the REDIS_ADDRS nodes
+)
+
+// Rate limiting algorithms
+const (
+	AlgorithmFixedWindow          = "fixed_window"
+	AlgorithmTokenBucket          = "token_bucket"
+	AlgorithmSlidingWindowLog     = "sliding_window_log"
+	AlgorithmSlidingWindowCounter = "sliding_window_counter"
+	AlgorithmGCRA                 = "gcra"
+)
+
+// Algorithms lists every supported rate limiting algorithm
+var Algorithms = []string{
+	AlgorithmFixedWindow,
+	AlgorithmTokenBucket,
+	AlgorithmSlidingWindowLog,
+	AlgorithmSlidingWindowCounter,
+	AlgorithmGCRA,
+}
+
+// IsValidAlgorithm reports whether name is a supported algorithm
+func IsValidAlgorithm(name string) bool {
+	for _, algorithm := range Algorithms {
+		if algorithm == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers trusted proxies report the client IP in
+const (
+	TrustedProxyHeaderXForwardedFor = "x-forwarded-for"
+	TrustedProxyHeaderForwarded     = "forwarded" // RFC 7239
+	TrustedProxyHeaderXRealIP       = "x-real-ip"
+)
+
+// TrustedProxyHeaders lists every supported trusted proxy header
+var TrustedProxyHeaders = []string{TrustedProxyHeaderXForwardedFor, TrustedProxyHeaderForwarded, TrustedProxyHeaderXRealIP}
+
+func IsValidTrustedProxyHeader(header string) bool {
+	for _, valid := range TrustedProxyHeaders {
+		if valid == header {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidTokenMode(mode string) bool {
+	for _, valid := range TokenModes {
+		if valid == mode {
+			return true
+		}
+	}
+	return false
 }
 
 func LoadConfig() (*Config, error) {
@@ -36,22 +351,230 @@ func LoadConfig() (*Config, error) {
 
 	config := &Config{
 		ServerPort:              getEnv("SERVER_PORT", "8080"),
+		StorageBackend:          getEnv("STORAGE_BACKEND", StorageBackendRedis),
+		MemoryMaxKeys:           getEnvAsInt("MEMORY_MAX_KEYS", 100000),
+		MemoryCleanupInterval:   getEnvAsDuration("MEMORY_CLEANUP_INTERVAL_SECONDS", "60"), // 1 minute default
 		RedisHost:               getEnv("REDIS_HOST", "localhost"),
 		RedisPort:               getEnv("REDIS_PORT", "6379"),
+		RedisMode:               getEnv("REDIS_MODE", RedisModeStandalone),
+		RedisURL:                getEnv("REDIS_URL", ""),
+		RedisUsername:           getEnv("REDIS_USERNAME", ""),
+		RedisPassword:           getEnv("REDIS_PASSWORD", ""),
+		RedisDB:                 getEnvAsInt("REDIS_DB", 0),
+		RedisSentinelMaster:     getEnv("REDIS_SENTINEL_MASTER", ""),
+		RedisSentinelUsername:   getEnv("REDIS_SENTINEL_USERNAME", ""),
+		RedisSentinelPassword:   getEnv("REDIS_SENTINEL_PASSWORD", ""),
+		RedisTLS:                getEnvAsBool("REDIS_TLS", false),
+		RedisTLSCAFile:          getEnv("REDIS_TLS_CA_FILE", ""),
+		RedisTLSCertFile:        getEnv("REDIS_TLS_CERT_FILE", ""),
+		RedisTLSKeyFile:         getEnv("REDIS_TLS_KEY_FILE", ""),
+		RedisTLSServerName:      getEnv("REDIS_TLS_SERVER_NAME", ""),
+		RedisTLSSkipVerify:      getEnvAsBool("REDIS_TLS_SKIP_VERIFY", false),
+		RedisPoolSize:           getEnvAsInt("REDIS_POOL_SIZE", 0), // 0 uses the client default, 10 per CPU
+		RedisMinIdleConns:       getEnvAsInt("REDIS_MIN_IDLE_CONNS", 0),
+		RedisDialTimeout:        getEnvAsMilliseconds("REDIS_DIAL_TIMEOUT_MS", "0"), // 0 uses the client default, 5s
+		RedisReadTimeout:        getEnvAsMilliseconds("REDIS_READ_TIMEOUT_MS", "0"), // 0 uses the client default, 3s
+		RedisWriteTimeout:       getEnvAsMilliseconds("REDIS_WRITE_TIMEOUT_MS", "0"),
 		MaxRequestsPerSecond:    getEnvAsInt("MAX_REQUESTS_PER_SECOND", 10),
+		RateLimitWindow:         getEnvAsDuration("RATE_LIMIT_WINDOW_SECONDS", "1"), // 1 second default
 		BlockingTime:            getEnvAsDuration("BLOCKING_TIME_SECONDS", "300"), // 5 minutes default
+		RateLimitAlgorithm:      getEnv("RATE_LIMIT_ALGORITHM", AlgorithmFixedWindow),
+		RateLimitBurst:          getEnvAsInt("RATE_LIMIT_BURST", 0), // defaults to the max requests
 		EnableIPRateLimiter:     getEnvAsBool("ENABLE_IP_RATE_LIMITER", true),
 		EnableTokenRateLimiter:  getEnvAsBool("ENABLE_TOKEN_RATE_LIMITER", true),
+		TokenMode:               getEnv("TOKEN_MODE", TokenModeFallback),
+		TokenRegistry:           getEnv("TOKEN_REGISTRY", ""), // disabled by default
+		TokenRegistryFile:       getEnv("TOKEN_REGISTRY_FILE", ""),
+		TokenRegistryCacheTTL:   getEnvAsDuration("TOKEN_REGISTRY_CACHE_SECONDS", "5"), // 0 disables the cache
+		UnknownTokenAction:      getEnv("UNKNOWN_TOKEN_ACTION", UnknownTokenIP),
+		TokenHashSecret:         getEnv("TOKEN_HASH_SECRET", ""),
 		TokenLimits:             make(map[string]TokenLimit),
+		PolicyFile:              getEnv("POLICY_FILE", ""),
+		PolicyReloadInterval:    getEnvAsDuration("POLICY_RELOAD_INTERVAL_SECONDS", "5"), // 0 disables watching
+		AdminToken:              getEnv("ADMIN_TOKEN", ""),
+		AdminPort:               getEnv("ADMIN_PORT", "9090"),
+		DecisionToken:           getEnv("DECISION_TOKEN", ""),
+		DecisionPort:            getEnv("DECISION_PORT", ""), // disabled by default
+		RLSPort:                 getEnv("RLS_PORT", ""),
+		LegacyRateLimitHeaders:  getEnvAsBool("RATE_LIMIT_LEGACY_HEADERS", false),
+		IPv4PrefixLength:        getEnvAsInt("IPV4_PREFIX_LENGTH", 32),
+		IPv6PrefixLength:        getEnvAsInt("IPV6_PREFIX_LENGTH", 64), // a /64 is usually a single subscriber
+		FailureMode:             getEnv("FAILURE_MODE", FailureModeClosed),
+		FailureLocalInstances:   getEnvAsInt("FAILURE_LOCAL_INSTANCES", 1),
+		CircuitBreakerThreshold: getEnvAsInt("CIRCUIT_BREAKER_THRESHOLD", 5), // 0 disables the breaker
+		CircuitBreakerCooldown:  getEnvAsDuration("CIRCUIT_BREAKER_COOLDOWN_SECONDS", "5"),
+		UpstreamTimeout:         getEnvAsDuration("UPSTREAM_TIMEOUT_SECONDS", "30"),
+		TrustedProxyHeader:      strings.ToLower(getEnv("TRUSTED_PROXY_HEADER", TrustedProxyHeaderXForwardedFor)),
+	}
+
+	// Forwarding headers are only trusted from these proxies
+	// Format: TRUSTED_PROXIES=10.0.0.0/8,192.168.1.10
+	if proxies := getEnv("TRUSTED_PROXIES", ""); proxies != "" {
+		for _, proxy := range strings.Split(proxies, ",") {
+			ipNet, err := ParseIPNet(strings.TrimSpace(proxy))
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+			}
+			config.TrustedProxies = append(config.TrustedProxies, ipNet)
+		}
+	}
+
+	// Sentinels or cluster nodes; a single node defaults to REDIS_HOST:REDIS_PORT
+	// Format: REDIS_ADDRS=redis-1:26379,redis-2:26379
+	if addrs := getEnv("REDIS_ADDRS", ""); addrs != "" {
+		for _, addr := range strings.Split(addrs, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				config.RedisAddrs = append(config.RedisAddrs, addr)
+			}
+		}
+	} else {
+		config.RedisAddrs = []string{net.JoinHostPort(config.RedisHost, config.RedisPort)}
 	}
 
-	// Parse token limits from environment
-	// Format: TOKEN_LIMIT_<TOKEN>=MAX_REQUESTS:TTL_SECONDS
-	parseTokenLimits(config)
+	// Load the policy file; env vars set above take precedence over it
+	if config.PolicyFile != "" {
+		policy, err := LoadPolicyFile(config.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy file:\n%w", err)
+		}
+		policy.Apply(config)
+	}
+
+	// Parse token limits from environment, overriding the policy file
+	// Format: TOKEN_LIMIT_<TOKEN>=MAX_REQUESTS:BLOCKING_TIME_SECONDS[:WINDOW_SECONDS[:ALGORITHM]]
+	if err := parseTokenLimits(config); err != nil {
+		return nil, err
+	}
+
+	// Proxy requests to the default upstream, overriding the policy file's
+	// Format: UPSTREAM_URLS=http://app-1:8080,http://app-2:8080
+	if err := parseUpstreams(config); err != nil {
+		return nil, err
+	}
+
+	if config.StorageBackend != StorageBackendRedis && config.StorageBackend != StorageBackendMemory {
+		return nil, fmt.Errorf("invalid STORAGE_BACKEND %q (valid: %s, %s)", config.StorageBackend, StorageBackendRedis, StorageBackendMemory)
+	}
+	if err := validateRedis(config); err != nil {
+		return nil, err
+	}
+	// Token and descriptor counters shared in Redis must be keyed the same by
+	// every instance, and not by a key anyone can guess
+	if config.EnableTokenRateLimiter && config.TokenHashSecret == "" && config.StorageBackend == StorageBackendRedis {
+		return nil, fmt.Errorf("TOKEN_HASH_SECRET is required with ENABLE_TOKEN_RATE_LIMITER=true and STORAGE_BACKEND=%s", StorageBackendRedis)
+	}
+	if len(config.Descriptors) > 0 && config.TokenHashSecret == "" && config.StorageBackend == StorageBackendRedis {
+		return nil, fmt.Errorf("TOKEN_HASH_SECRET is required with descriptor rules and STORAGE_BACKEND=%s", StorageBackendRedis)
+	}
+	// The decision API counts against any key it is sent, so it is never
+	// served without authentication
+	if config.DecisionPort != "" && config.DecisionToken == "" {
+		return nil, fmt.Errorf("DECISION_TOKEN is required with DECISION_PORT")
+	}
+	if config.IPv4PrefixLength < 1 || config.IPv4PrefixLength > 32 {
+		return nil, fmt.Errorf("invalid IPV4_PREFIX_LENGTH %d (valid: 1-32)", config.IPv4PrefixLength)
+	}
+	if config.IPv6PrefixLength < 1 || config.IPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid IPV6_PREFIX_LENGTH %d (valid: 1-128)", config.IPv6PrefixLength)
+	}
+	switch config.TokenRegistry {
+	case "", TokenRegistryStorage:
+	case TokenRegistryFile:
+		if config.TokenRegistryFile == "" {
+			return nil, fmt.Errorf("TOKEN_REGISTRY_FILE is required with TOKEN_REGISTRY=%s", TokenRegistryFile)
+		}
+	default:
+		return nil, fmt.Errorf("invalid TOKEN_REGISTRY %q (valid: %s, %s)", config.TokenRegistry, TokenRegistryStorage, TokenRegistryFile)
+	}
+	if config.UnknownTokenAction != UnknownTokenIP && config.UnknownTokenAction != UnknownTokenReject {
+		return nil, fmt.Errorf("invalid UNKNOWN_TOKEN_ACTION %q (valid: %s, %s)", config.UnknownTokenAction, UnknownTokenIP, UnknownTokenReject)
+	}
+	if !IsValidTrustedProxyHeader(config.TrustedProxyHeader) {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXY_HEADER %q (valid: %s)", config.TrustedProxyHeader, strings.Join(TrustedProxyHeaders, ", "))
+	}
+	if !isValidTokenMode(config.TokenMode) {
+		return nil, fmt.Errorf("invalid TOKEN_MODE %q (valid: %s)", config.TokenMode, strings.Join(TokenModes, ", "))
+	}
+	if !IsValidFailureMode(config.FailureMode) {
+		return nil, fmt.Errorf("invalid FAILURE_MODE %q (valid: %s)", config.FailureMode, strings.Join(FailureModes, ", "))
+	}
+	if config.FailureLocalInstances < 1 {
+		return nil, fmt.Errorf("invalid FAILURE_LOCAL_INSTANCES %d (must be at least 1)", config.FailureLocalInstances)
+	}
+	if !IsValidAlgorithm(config.RateLimitAlgorithm) {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_ALGORITHM %q (valid: %s)", config.RateLimitAlgorithm, strings.Join(Algorithms, ", "))
+	}
+	for token, limit := range config.TokenLimits {
+		if limit.Algorithm != "" && !IsValidAlgorithm(limit.Algorithm) {
+			return nil, fmt.Errorf("invalid algorithm %q for token %s (valid: %s)", limit.Algorithm, RedactToken(token), strings.Join(Algorithms, ", "))
+		}
+	}
 
 	return config, nil
 }
 
+// validateRedis checks the Redis connection settings that don't depend on
+// the server
+func validateRedis(config *Config) error {
+	switch config.RedisMode {
+	case RedisModeStandalone, RedisModeCluster:
+	case RedisModeSentinel:
+		if config.RedisSentinelMaster == "" && config.RedisURL == "" {
+			return fmt.Errorf("REDIS_SENTINEL_MASTER is required with REDIS_MODE=%s", RedisModeSentinel)
+		}
+	default:
+		return fmt.Errorf("invalid REDIS_MODE %q (valid: %s, %s, %s)", config.RedisMode, RedisModeStandalone, RedisModeSentinel, RedisModeCluster)
+	}
+	if config.RedisDB != 0 && config.RedisMode == RedisModeCluster {
+		return fmt.Errorf("REDIS_DB must be 0 with REDIS_MODE=%s", RedisModeCluster)
+	}
+	if (config.RedisTLSCertFile == "") != (config.RedisTLSKeyFile == "") {
+		return fmt.Errorf("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+	if config.RedisPoolSize < 0 || config.RedisMinIdleConns < 0 {
+		return fmt.Errorf("REDIS_POOL_SIZE and REDIS_MIN_IDLE_CONNS can't be negative")
+	}
+	return nil
+}
+
+// parseUpstreams sets the default upstream from UPSTREAM_URLS, gives every
+// upstream without a timeout UPSTREAM_TIMEOUT_SECONDS and checks that the
+// upstreams routes name exist
+func parseUpstreams(config *Config) error {
+	if urls := getEnv("UPSTREAM_URLS", ""); urls != "" {
+		upstream := config.Upstreams[DefaultUpstream]
+		upstream.Targets = nil
+		for _, raw := range strings.Split(urls, ",") {
+			target, err := ParseUpstreamURL(strings.TrimSpace(raw))
+			if err != nil {
+				return fmt.Errorf("invalid UPSTREAM_URLS: %w", err)
+			}
+			upstream.Targets = append(upstream.Targets, target)
+		}
+		if config.Upstreams == nil {
+			config.Upstreams = make(map[string]Upstream)
+		}
+		config.Upstreams[DefaultUpstream] = upstream
+	}
+
+	if config.UpstreamTimeout <= 0 {
+		return fmt.Errorf("invalid UPSTREAM_TIMEOUT_SECONDS %v (must be positive)", config.UpstreamTimeout)
+	}
+	for name, upstream := range config.Upstreams {
+		if upstream.Timeout == 0 {
+			upstream.Timeout = config.UpstreamTimeout
+			config.Upstreams[name] = upstream
+		}
+	}
+
+	for _, rule := range config.Routes {
+		if _, exists := config.Upstreams[rule.Upstream]; rule.Upstream != "" && !exists {
+			return fmt.Errorf("route %q: unknown upstream %q", rule.Name, rule.Upstream)
+		}
+	}
+	return nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -90,32 +613,64 @@ func getEnvAsDuration(name string, defaultValueSeconds string) time.Duration {
 	}
 	seconds, err := strconv.Atoi(valueStr)
 	if err != nil {
-		seconds = 300 // 5 minutes default
+		seconds, _ = strconv.Atoi(defaultValueSeconds)
 	}
 	return time.Duration(seconds) * time.Second
 }
 
-func parseTokenLimits(config *Config) {
+func getEnvAsMilliseconds(name string, defaultValueMilliseconds string) time.Duration {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		valueStr = defaultValueMilliseconds
+	}
+	milliseconds, err := strconv.Atoi(valueStr)
+	if err != nil {
+		milliseconds, _ = strconv.Atoi(defaultValueMilliseconds)
+	}
+	return time.Duration(milliseconds) * time.Millisecond
+}
+
+func parseTokenLimits(config *Config) error {
 	for _, env := range os.Environ() {
 		if len(env) > 12 && env[:12] == "TOKEN_LIMIT_" {
 			key := env[:strings.Index(env, "=")]
 			value := env[strings.Index(env, "=")+1:]
 			
 			tokenKey := key[12:] // Remove "TOKEN_LIMIT_" prefix
+			// TOKEN_LIMIT_SHA256_<HEX> declares the token by its digest
+			if digest, ok := strings.CutPrefix(tokenKey, "SHA256_"); ok && IsTokenHash(TokenHashPrefix+strings.ToLower(digest)) {
+				tokenKey = TokenHashPrefix + strings.ToLower(digest)
+			}
 			
-			// Format: MAX_REQUESTS:TTL_SECONDS
+			// Format: MAX_REQUESTS:BLOCKING_TIME_SECONDS[:WINDOW_SECONDS[:ALGORITHM]]
+			// The window defaults to the global RATE_LIMIT_WINDOW_SECONDS
 			parts := strings.Split(value, ":")
-			if len(parts) == 2 {
-				maxRequests, err1 := strconv.Atoi(parts[0])
-				ttl, err2 := strconv.Atoi(parts[1])
-				if err1 == nil && err2 == nil {
-					config.TokenLimits[tokenKey] = TokenLimit{
-						MaxRequests: maxRequests,
-						TTL:         time.Duration(ttl) * time.Second,
-					}
-				}
+			if len(parts) < 2 || len(parts) > 4 {
+				return fmt.Errorf("invalid TOKEN_LIMIT_ for token %s (%q): expected MAX_REQUESTS:BLOCKING_TIME_SECONDS[:WINDOW_SECONDS[:ALGORITHM]]", RedactToken(tokenKey), value)
+			}
+			maxRequests, err1 := strconv.Atoi(parts[0])
+			blockingTime, err2 := strconv.Atoi(parts[1])
+			window := config.RateLimitWindow
+			var err3 error
+			if len(parts) >= 3 {
+				var windowSeconds int
+				windowSeconds, err3 = strconv.Atoi(parts[2])
+				window = time.Duration(windowSeconds) * time.Second
+			}
+			algorithm := ""
+			if len(parts) == 4 {
+				algorithm = parts[3]
+			}
+			if err1 != nil || err2 != nil || err3 != nil {
+				return fmt.Errorf("invalid TOKEN_LIMIT_ for token %s (%q): limits must be integers", RedactToken(tokenKey), value)
+			}
+			config.TokenLimits[tokenKey] = TokenLimit{
+				MaxRequests:  maxRequests,
+				Window:       window,
+				BlockingTime: time.Duration(blockingTime) * time.Second,
+				Algorithm:    algorithm,
 			}
 		}
 	}
+	return nil
 }
-
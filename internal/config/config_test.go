@@ -0,0 +1,137 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig_Redis(t *testing.T) {
+	t.Setenv("REDIS_HOST", "redis")
+	t.Setenv("REDIS_READ_TIMEOUT_MS", "250")
+	t.Setenv("TOKEN_HASH_SECRET", "pepper")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.RedisMode != RedisModeStandalone || len(cfg.RedisAddrs) != 1 || cfg.RedisAddrs[0] != "redis:6379" {
+		t.Errorf("Expected a standalone Redis at redis:6379, got %s %v", cfg.RedisMode, cfg.RedisAddrs)
+	}
+	if cfg.RedisReadTimeout != 250*time.Millisecond {
+		t.Errorf("Expected a read timeout of 250ms, got %v", cfg.RedisReadTimeout)
+	}
+
+	t.Setenv("REDIS_MODE", RedisModeSentinel)
+	t.Setenv("REDIS_ADDRS", "sentinel-1:26379, sentinel-2:26379")
+	t.Setenv("REDIS_SENTINEL_MASTER", "mymaster")
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if len(cfg.RedisAddrs) != 2 || cfg.RedisAddrs[1] != "sentinel-2:26379" {
+		t.Errorf("Expected two sentinels, got %v", cfg.RedisAddrs)
+	}
+}
+
+func TestLoadConfig_InvalidRedis(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"unknown mode", map[string]string{"REDIS_MODE": "replica"}, "invalid REDIS_MODE"},
+		{"sentinel without master", map[string]string{"REDIS_MODE": RedisModeSentinel}, "REDIS_SENTINEL_MASTER is required"},
+		{"database in a cluster", map[string]string{"REDIS_MODE": RedisModeCluster, "REDIS_DB": "2"}, "REDIS_DB must be 0"},
+		{"certificate without key", map[string]string{"REDIS_TLS_CERT_FILE": "client.pem"}, "must be set together"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_TokenHashSecret(t *testing.T) {
+	// Redis counters need the secret every instance keys tokens with
+	t.Setenv("TOKEN_HASH_SECRET", "")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "TOKEN_HASH_SECRET is required") {
+		t.Errorf("Expected an error for a missing TOKEN_HASH_SECRET, got %v", err)
+	}
+
+	// Counters kept in memory, or no token counters, don't
+	for name, value := range map[string]string{"STORAGE_BACKEND": StorageBackendMemory, "ENABLE_TOKEN_RATE_LIMITER": "false"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := LoadConfig(); err != nil {
+				t.Errorf("Failed to load config: %v", err)
+			}
+		})
+	}
+
+	// Descriptor values are hashed with it too
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(policyFile, []byte(`{"descriptors": [{"name": "per-user", "entries": [{"key": "user_id"}], "max_requests": 10}]}`), 0o644)
+	t.Setenv("ENABLE_TOKEN_RATE_LIMITER", "false")
+	t.Setenv("POLICY_FILE", policyFile)
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "TOKEN_HASH_SECRET is required with descriptor rules") {
+		t.Errorf("Expected an error for descriptors without TOKEN_HASH_SECRET, got %v", err)
+	}
+}
+
+func TestLoadConfig_DecisionToken(t *testing.T) {
+	t.Setenv("TOKEN_HASH_SECRET", "pepper")
+	t.Setenv("DECISION_PORT", "9091")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "DECISION_TOKEN is required") {
+		t.Errorf("Expected an error for a missing DECISION_TOKEN, got %v", err)
+	}
+
+	t.Setenv("DECISION_TOKEN", "secret")
+	if cfg, err := LoadConfig(); err != nil || cfg.DecisionPort != "9091" || cfg.DecisionToken != "secret" {
+		t.Errorf("Expected the decision API on port 9091, got %+v, %v", cfg, err)
+	}
+}
+
+func TestLoadConfig_Upstreams(t *testing.T) {
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.json")
+	os.WriteFile(policyFile, []byte(`{
+  "upstreams": {
+    "default": {"targets": ["http://app:8080"], "strip_prefix": "/api"},
+    "auth": {"targets": ["http://auth:8080"], "timeout": "5s"}
+  },
+  "routes": [{"name": "login", "pattern": "POST /login", "upstream": "auth"}]
+}`), 0o600)
+	t.Setenv("POLICY_FILE", policyFile)
+	t.Setenv("UPSTREAM_URLS", "http://app-1:8080, http://app-2:8080")
+	t.Setenv("UPSTREAM_TIMEOUT_SECONDS", "10")
+	t.Setenv("TOKEN_HASH_SECRET", "pepper")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	def := cfg.Upstreams[DefaultUpstream]
+	if len(def.Targets) != 2 || def.Targets[1].Host != "app-2:8080" || def.StripPrefix != "/api" {
+		t.Errorf("Expected UPSTREAM_URLS to replace the default targets only, got %v", def)
+	}
+	if def.Timeout != 10*time.Second || cfg.Upstreams["auth"].Timeout != 5*time.Second {
+		t.Errorf("Expected timeouts of 10s and 5s, got %v and %v", def.Timeout, cfg.Upstreams["auth"].Timeout)
+	}
+	if login := cfg.Routes[0]; login.Upstream != "auth" || !login.AppliesDefaultLimits() {
+		t.Errorf("Expected the login route to use the auth upstream with the default limits, got %v", login)
+	}
+
+	t.Setenv("UPSTREAM_URLS", "app:8080")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "invalid UPSTREAM_URLS") {
+		t.Errorf("Expected an error for a target without scheme, got %v", err)
+	}
+}
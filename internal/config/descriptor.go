@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RemoteAddressKey is the descriptor entry Envoy's remote_address action
+// sets to the client IP
+const RemoteAddressKey = "remote_address"
+
+// DescriptorRule applies its own limit to the Envoy rate limit descriptors
+// it matches: those of Domain, or of any domain when Domain is empty, made
+// of exactly Entries, in order
+// Rules are evaluated in order and the first match wins
+type DescriptorRule struct {
+	Name    string
+	Domain  string
+	Entries []DescriptorEntry
+	Limit   TokenLimit
+}
+
+// DescriptorEntry is an entry of a descriptor: its key and, in a rule, the
+// value it must have, any value when empty
+type DescriptorEntry struct {
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// Matches reports whether the rule applies to the descriptor entries of
+// domain
+func (r DescriptorRule) Matches(domain string, entries []DescriptorEntry) bool {
+	if (r.Domain != "" && r.Domain != domain) || len(r.Entries) != len(entries) {
+		return false
+	}
+	for i, entry := range r.Entries {
+		if entry.Key != entries[i].Key || (entry.Value != "" && entry.Value != entries[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the rule
+func (r DescriptorRule) String() string {
+	entries := make([]string, len(r.Entries))
+	for i, entry := range r.Entries {
+		entries[i] = entry.Key
+		if entry.Value != "" {
+			entries[i] += "=" + entry.Value
+		}
+	}
+	s := fmt.Sprintf("[%s] %+v", strings.Join(entries, ", "), r.Limit)
+	if r.Domain != "" {
+		s = r.Domain + " " + s
+	}
+	return s
+}
@@ -0,0 +1,1027 @@
+package config
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/route"
+)
+
+// Policy is the declarative rate limiting policy loaded from POLICY_FILE
+// The file is JSON, or YAML when its extension is .yaml or .yml
+// Durations are Go duration strings such as "500ms", "1s" or "5m"
+//
+//	{
+//	  "default": {"max_requests": 10, "window": "1s", "blocking_time": "5m", "algorithm": "fixed_window"},
+//	  "tokens": {"premium-token": {"max_requests": 100, "window": "1s", "algorithm": "token_bucket", "burst": 200, "ip_max_requests": 20}},
+//	  "token_mode": "fallback",
+//	  "routes": [{"name": "login", "pattern": "POST /login", "max_requests": 5, "window": "1m", "failure_mode": "closed", "upstream": "auth"}],
+//	  "allow": {"ips": ["10.0.0.0/8"], "tokens": ["internal-token"]},
+//	  "deny": {"ips": ["203.0.113.7"]},
+//	  "key": {"type": "jwt_claim", "claim": "tenant_id", "secret": "..."},
+//	  "failure_mode": "local",
+//	  "upstreams": {"default": {"targets": ["http://app:8080"]}, "auth": {"targets": ["http://auth:8080"], "timeout": "5s"}},
+//	  "descriptors": [{"name": "per-user", "domain": "mesh", "entries": [{"key": "user_id"}], "max_requests": 100, "window": "1m"}]
+//	}
+type Policy struct {
+	Default     LimitPolicy               `json:"default" yaml:"default"`
+	Tokens      map[string]LimitPolicy    `json:"tokens" yaml:"tokens"`
+	Routes      []RoutePolicy             `json:"routes" yaml:"routes"`
+	Allow       AccessPolicy              `json:"allow" yaml:"allow"`
+	Deny        AccessPolicy              `json:"deny" yaml:"deny"`
+	Key         *KeyPolicy                `json:"key" yaml:"key"`
+	TokenMode   string                    `json:"token_mode" yaml:"token_mode"`
+	Tiers       map[string]LimitPolicy    `json:"tiers" yaml:"tiers"`
+	FailureMode string                    `json:"failure_mode" yaml:"failure_mode"`
+	Upstreams   map[string]UpstreamPolicy `json:"upstreams" yaml:"upstreams"`
+	Descriptors []DescriptorPolicy        `json:"descriptors" yaml:"descriptors"`
+}
+
+// LimitPolicy describes a limit in the policy file
+// IPMaxRequests is the per-IP ceiling of a token and only valid in tokens
+// and tiers
+type LimitPolicy struct {
+	MaxRequests   int    `json:"max_requests" yaml:"max_requests"`
+	Window        string `json:"window" yaml:"window"`
+	BlockingTime  string `json:"blocking_time" yaml:"blocking_time"`
+	Algorithm     string `json:"algorithm" yaml:"algorithm"`
+	Burst         int    `json:"burst" yaml:"burst"`
+	IPMaxRequests int    `json:"ip_max_requests" yaml:"ip_max_requests"`
+}
+
+// RoutePolicy describes a per-route rule in the policy file
+// Pattern uses the http.ServeMux syntax, e.g. "GET /users/{id}"; exempt
+// routes need no limit
+type RoutePolicy struct {
+	Name        string     `json:"name" yaml:"name"`
+	Pattern     string     `json:"pattern" yaml:"pattern"`
+	Exempt      bool       `json:"exempt" yaml:"exempt"`
+	Key         *KeyPolicy `json:"key" yaml:"key"`
+	FailureMode string     `json:"failure_mode" yaml:"failure_mode"`
+	Upstream    string     `json:"upstream" yaml:"upstream"`
+	LimitPolicy `yaml:",inline"`
+}
+
+// UpstreamPolicy describes an upstream in the policy file; timeout defaults
+// to UPSTREAM_TIMEOUT_SECONDS
+type UpstreamPolicy struct {
+	Targets         []string      `json:"targets" yaml:"targets"`
+	Timeout         string        `json:"timeout" yaml:"timeout"`
+	StripPrefix     string        `json:"strip_prefix" yaml:"strip_prefix"`
+	RequestHeaders  HeaderRewrite `json:"request_headers" yaml:"request_headers"`
+	ResponseHeaders HeaderRewrite `json:"response_headers" yaml:"response_headers"`
+}
+
+// DescriptorPolicy describes a rule for Envoy rate limit descriptors in the
+// policy file; an entry without a value matches any value
+type DescriptorPolicy struct {
+	Name        string            `json:"name" yaml:"name"`
+	Domain      string            `json:"domain" yaml:"domain"`
+	Entries     []DescriptorEntry `json:"entries" yaml:"entries"`
+	LimitPolicy `yaml:",inline"`
+}
+
+// AccessPolicy lists IPs (addresses or CIDRs) and tokens
+type AccessPolicy struct {
+	IPs    []string `json:"ips" yaml:"ips"`
+	Tokens []string `json:"tokens" yaml:"tokens"`
+}
+
+// KeyPolicy describes the source of the rate limiting key in the policy file
+type KeyPolicy struct {
+	Type          string      `json:"type" yaml:"type"`
+	Name          string      `json:"name" yaml:"name"`
+	Prefix        string      `json:"prefix" yaml:"prefix"`
+	Claim         string      `json:"claim" yaml:"claim"`
+	Segment       int         `json:"segment" yaml:"segment"`
+	Secret        string      `json:"secret" yaml:"secret"`
+	PublicKeyFile string      `json:"public_key_file" yaml:"public_key_file"`
+	Sources       []KeyPolicy `json:"sources" yaml:"sources"`
+}
+
+// PolicyError describes a problem at a position in the policy file
+type PolicyError struct {
+	File   string
+	Line   int
+	Column int
+	Path   string
+	Msg    string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, e.Path, e.Msg)
+}
+
+// LoadPolicyFile reads and validates the policy file at path
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	return ParsePolicy(path, data)
+}
+
+// ParsePolicy decodes and validates a policy document
+// YAML is expected when name ends in .yaml or .yml, JSON otherwise
+// Every problem found is reported as a *PolicyError carrying its line and
+// column; multiple problems are joined into a single error
+func ParsePolicy(name string, data []byte) (*Policy, error) {
+	var (
+		policy    *Policy
+		positions map[string]position
+		err       error
+	)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		policy, positions, err = decodeYAMLPolicy(name, data)
+	default:
+		policy, positions, err = decodeJSONPolicy(name, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, problem := range policy.validate() {
+		errs = append(errs, newPolicyError(name, lookupPosition(positions, problem.path), problem.path, problem.msg))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return policy, nil
+}
+
+// Apply copies the policy into cfg
+// Settings whose environment variable is set are left untouched, so env vars
+// override the policy file
+func (p *Policy) Apply(cfg *Config) {
+	p.apply(cfg, isEnvSet)
+}
+
+// ApplyAll copies the whole policy into cfg, whatever the environment, for
+// limiters embedded in other programs
+func (p *Policy) ApplyAll(cfg *Config) {
+	p.apply(cfg, func(string) bool { return false })
+}
+
+// apply copies the policy into cfg, leaving the settings isSet reports alone
+func (p *Policy) apply(cfg *Config, isSet func(name string) bool) {
+	if !isSet("MAX_REQUESTS_PER_SECOND") && p.Default.MaxRequests > 0 {
+		cfg.MaxRequestsPerSecond = p.Default.MaxRequests
+	}
+	if !isSet("RATE_LIMIT_WINDOW_SECONDS") && p.Default.Window != "" {
+		cfg.RateLimitWindow, _ = time.ParseDuration(p.Default.Window)
+	}
+	if !isSet("BLOCKING_TIME_SECONDS") && p.Default.BlockingTime != "" {
+		cfg.BlockingTime, _ = time.ParseDuration(p.Default.BlockingTime)
+	}
+	if !isSet("RATE_LIMIT_ALGORITHM") && p.Default.Algorithm != "" {
+		cfg.RateLimitAlgorithm = p.Default.Algorithm
+	}
+	if !isSet("RATE_LIMIT_BURST") && p.Default.Burst > 0 {
+		cfg.RateLimitBurst = p.Default.Burst
+	}
+	if !isSet("TOKEN_MODE") && p.TokenMode != "" {
+		cfg.TokenMode = p.TokenMode
+	}
+	if !isSet("FAILURE_MODE") && p.FailureMode != "" {
+		cfg.FailureMode = p.FailureMode
+	}
+
+	if cfg.TokenLimits == nil {
+		cfg.TokenLimits = make(map[string]TokenLimit)
+	}
+	for token, limit := range p.Tokens {
+		cfg.TokenLimits[token] = limit.TokenLimit()
+	}
+
+	cfg.Tiers = make(map[string]TokenLimit, len(p.Tiers))
+	for tier, limit := range p.Tiers {
+		cfg.Tiers[tier] = limit.TokenLimit()
+	}
+
+	cfg.Routes = nil
+	for _, route := range p.Routes {
+		rule := RouteRule{
+			Name:        route.Name,
+			Pattern:     route.Pattern,
+			Limit:       route.LimitPolicy.TokenLimit(),
+			Exempt:      route.Exempt,
+			FailureMode: route.FailureMode,
+			Upstream:    route.Upstream,
+		}
+		if route.Key != nil {
+			source := route.Key.keySource()
+			rule.Key = &source
+		}
+		cfg.Routes = append(cfg.Routes, rule)
+	}
+
+	cfg.Descriptors = nil
+	for _, descriptor := range p.Descriptors {
+		cfg.Descriptors = append(cfg.Descriptors, DescriptorRule{
+			Name:    descriptor.Name,
+			Domain:  descriptor.Domain,
+			Entries: descriptor.Entries,
+			Limit:   descriptor.LimitPolicy.TokenLimit(),
+		})
+	}
+
+	cfg.Upstreams = make(map[string]Upstream, len(p.Upstreams))
+	for name, upstream := range p.Upstreams {
+		cfg.Upstreams[name] = upstream.upstream()
+	}
+
+	cfg.KeySource = nil
+	if p.Key != nil {
+		source := p.Key.keySource()
+		cfg.KeySource = &source
+	}
+
+	cfg.AllowIPs = parseIPNets(p.Allow.IPs)
+	cfg.DenyIPs = parseIPNets(p.Deny.IPs)
+	cfg.AllowTokens = p.Allow.Tokens
+	cfg.DenyTokens = p.Deny.Tokens
+}
+
+// EffectivePolicy returns the limits in effect in cfg in the policy file
+// format, for display: tokens are redacted and key secrets left out
+func EffectivePolicy(cfg *Config) *Policy {
+	p := &Policy{
+		Default: LimitPolicy{
+			MaxRequests:  cfg.MaxRequestsPerSecond,
+			Window:       durationString(cfg.RateLimitWindow),
+			BlockingTime: durationString(cfg.BlockingTime),
+			Algorithm:    cfg.RateLimitAlgorithm,
+			Burst:        cfg.RateLimitBurst,
+		},
+		Tokens:      make(map[string]LimitPolicy, len(cfg.TokenLimits)),
+		Tiers:       make(map[string]LimitPolicy, len(cfg.Tiers)),
+		TokenMode:   cfg.TokenMode,
+		Allow:       AccessPolicy{IPs: ipNetStrings(cfg.AllowIPs), Tokens: redactTokens(cfg.AllowTokens)},
+		Deny:        AccessPolicy{IPs: ipNetStrings(cfg.DenyIPs), Tokens: redactTokens(cfg.DenyTokens)},
+		Key:         keyPolicy(cfg.KeySource),
+		FailureMode: cfg.FailureMode,
+	}
+	for token, limit := range cfg.TokenLimits {
+		p.Tokens[RedactToken(token)] = limitPolicy(limit)
+	}
+	for tier, limit := range cfg.Tiers {
+		p.Tiers[tier] = limitPolicy(limit)
+	}
+	for _, rule := range cfg.Routes {
+		p.Routes = append(p.Routes, RoutePolicy{
+			Name:        rule.Name,
+			Pattern:     rule.Pattern,
+			Exempt:      rule.Exempt,
+			Key:         keyPolicy(rule.Key),
+			FailureMode: rule.FailureMode,
+			Upstream:    rule.Upstream,
+			LimitPolicy: limitPolicy(rule.Limit),
+		})
+	}
+	for _, rule := range cfg.Descriptors {
+		p.Descriptors = append(p.Descriptors, DescriptorPolicy{
+			Name:        rule.Name,
+			Domain:      rule.Domain,
+			Entries:     rule.Entries,
+			LimitPolicy: limitPolicy(rule.Limit),
+		})
+	}
+	if len(cfg.Upstreams) > 0 {
+		p.Upstreams = make(map[string]UpstreamPolicy, len(cfg.Upstreams))
+		for name, upstream := range cfg.Upstreams {
+			p.Upstreams[name] = upstreamPolicy(upstream)
+		}
+	}
+	return p
+}
+
+// upstreamPolicy converts an upstream back to its policy file form, with
+// the values of the headers it sets redacted
+func upstreamPolicy(upstream Upstream) UpstreamPolicy {
+	u := UpstreamPolicy{
+		Timeout:         durationString(upstream.Timeout),
+		StripPrefix:     upstream.StripPrefix,
+		RequestHeaders:  upstream.RequestHeaders.redacted(),
+		ResponseHeaders: upstream.ResponseHeaders.redacted(),
+	}
+	for _, target := range upstream.Targets {
+		u.Targets = append(u.Targets, target.String())
+	}
+	return u
+}
+
+// redacted returns hr with the values it sets replaced
+func (hr HeaderRewrite) redacted() HeaderRewrite {
+	r := HeaderRewrite{Remove: hr.Remove}
+	if len(hr.Set) > 0 {
+		r.Set = make(map[string]string, len(hr.Set))
+		for name := range hr.Set {
+			r.Set[name] = "[redacted]"
+		}
+	}
+	return r
+}
+
+// upstream converts a validated upstream policy
+func (u UpstreamPolicy) upstream() Upstream {
+	timeout, _ := time.ParseDuration(u.Timeout)
+	upstream := Upstream{
+		Timeout:         timeout,
+		StripPrefix:     u.StripPrefix,
+		RequestHeaders:  u.RequestHeaders,
+		ResponseHeaders: u.ResponseHeaders,
+	}
+	for _, raw := range u.Targets {
+		target, _ := ParseUpstreamURL(raw)
+		upstream.Targets = append(upstream.Targets, target)
+	}
+	return upstream
+}
+
+// limitPolicy converts a limit back to its policy file form
+func limitPolicy(limit TokenLimit) LimitPolicy {
+	return LimitPolicy{
+		MaxRequests:   limit.MaxRequests,
+		Window:        durationString(limit.Window),
+		BlockingTime:  durationString(limit.BlockingTime),
+		Algorithm:     limit.Algorithm,
+		Burst:         limit.Burst,
+		IPMaxRequests: limit.IPMaxRequests,
+	}
+}
+
+// keyPolicy converts a key source back to its policy file form, without its
+// secrets
+func keyPolicy(source *KeySource) *KeyPolicy {
+	if source == nil {
+		return nil
+	}
+	k := &KeyPolicy{
+		Type:    source.Type,
+		Name:    source.Name,
+		Prefix:  source.Prefix,
+		Claim:   source.Claim,
+		Segment: source.Segment,
+	}
+	for i := range source.Sources {
+		k.Sources = append(k.Sources, *keyPolicy(&source.Sources[i]))
+	}
+	return k
+}
+
+// durationString formats d as a policy file duration, empty when unset
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// TokenLimit converts a validated limit policy
+func (l LimitPolicy) TokenLimit() TokenLimit {
+	window, _ := time.ParseDuration(l.Window)
+	blockingTime, _ := time.ParseDuration(l.BlockingTime)
+	return TokenLimit{
+		MaxRequests:   l.MaxRequests,
+		Window:        window,
+		BlockingTime:  blockingTime,
+		Algorithm:     l.Algorithm,
+		Burst:         l.Burst,
+		IPMaxRequests: l.IPMaxRequests,
+	}
+}
+
+// keySource converts a validated key policy
+func (k KeyPolicy) keySource() KeySource {
+	source := KeySource{
+		Type:    k.Type,
+		Name:    k.Name,
+		Prefix:  k.Prefix,
+		Claim:   k.Claim,
+		Segment: k.Segment,
+	}
+	if k.Secret != "" {
+		source.Secret = []byte(k.Secret)
+	}
+	if k.PublicKeyFile != "" {
+		source.PublicKey, _ = LoadPublicKey(k.PublicKeyFile)
+	}
+	for _, child := range k.Sources {
+		source.Sources = append(source.Sources, child.keySource())
+	}
+	return source
+}
+
+// policyProblem is a validation failure at a JSON path
+type policyProblem struct {
+	path string
+	msg  string
+}
+
+// validate checks the semantic rules the JSON schema cannot express
+func (p *Policy) validate() []policyProblem {
+	var problems []policyProblem
+
+	problems = append(problems, p.Default.validate("default", false)...)
+	if p.Default.IPMaxRequests != 0 {
+		problems = append(problems, policyProblem{"default.ip_max_requests", "only supported for tokens"})
+	}
+	if p.TokenMode != "" && !isValidTokenMode(p.TokenMode) {
+		problems = append(problems, policyProblem{"token_mode", fmt.Sprintf("unknown token mode %q (valid: %s)", p.TokenMode, strings.Join(TokenModes, ", "))})
+	}
+	if p.FailureMode != "" && !IsValidFailureMode(p.FailureMode) {
+		problems = append(problems, policyProblem{"failure_mode", fmt.Sprintf("unknown failure mode %q (valid: %s)", p.FailureMode, strings.Join(FailureModes, ", "))})
+	}
+
+	for token, limit := range p.Tokens {
+		path := joinPath("tokens", token)
+		if token == "" {
+			problems = append(problems, policyProblem{path, "token must not be empty"})
+		}
+		if strings.HasPrefix(token, TokenHashPrefix) && !IsTokenHash(token) {
+			problems = append(problems, policyProblem{path, "invalid SHA-256 digest (expected 64 hex characters)"})
+		}
+		problems = append(problems, limit.validate(path, true)...)
+	}
+
+	for tier, limit := range p.Tiers {
+		path := joinPath("tiers", tier)
+		if tier == "" {
+			problems = append(problems, policyProblem{path, "tier must not be empty"})
+		}
+		problems = append(problems, limit.validate(path, true)...)
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range p.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		switch {
+		case rule.Name == "":
+			problems = append(problems, policyProblem{joinPath(path, "name"), "name is required"})
+		case names[rule.Name]:
+			problems = append(problems, policyProblem{joinPath(path, "name"), fmt.Sprintf("duplicate route name %q", rule.Name)})
+		}
+		names[rule.Name] = true
+
+		if rule.Pattern == "" {
+			problems = append(problems, policyProblem{joinPath(path, "pattern"), "pattern is required"})
+		} else if _, err := route.Compile(rule.Pattern); err != nil {
+			problems = append(problems, policyProblem{joinPath(path, "pattern"), fmt.Sprintf("invalid pattern: %v", err)})
+		}
+		problems = append(problems, rule.LimitPolicy.validate(path, !rule.Exempt && rule.Upstream == "")...)
+		if rule.IPMaxRequests != 0 {
+			problems = append(problems, policyProblem{joinPath(path, "ip_max_requests"), "only supported for tokens"})
+		}
+		if rule.Key != nil {
+			problems = append(problems, rule.Key.validate(joinPath(path, "key"))...)
+		}
+		if rule.FailureMode != "" && !IsValidFailureMode(rule.FailureMode) {
+			problems = append(problems, policyProblem{joinPath(path, "failure_mode"), fmt.Sprintf("unknown failure mode %q (valid: %s)", rule.FailureMode, strings.Join(FailureModes, ", "))})
+		}
+		if _, exists := p.Upstreams[rule.Upstream]; rule.Upstream != "" && rule.Upstream != DefaultUpstream && !exists {
+			problems = append(problems, policyProblem{joinPath(path, "upstream"), fmt.Sprintf("unknown upstream %q", rule.Upstream)})
+		}
+	}
+
+	for name, upstream := range p.Upstreams {
+		problems = append(problems, upstream.validate(joinPath("upstreams", name))...)
+	}
+
+	descriptorNames := make(map[string]bool)
+	for i, rule := range p.Descriptors {
+		path := fmt.Sprintf("descriptors[%d]", i)
+		switch {
+		case rule.Name == "":
+			problems = append(problems, policyProblem{joinPath(path, "name"), "name is required"})
+		case descriptorNames[rule.Name]:
+			problems = append(problems, policyProblem{joinPath(path, "name"), fmt.Sprintf("duplicate descriptor name %q", rule.Name)})
+		}
+		descriptorNames[rule.Name] = true
+
+		if len(rule.Entries) == 0 {
+			problems = append(problems, policyProblem{joinPath(path, "entries"), "at least one entry is required"})
+		}
+		for j, entry := range rule.Entries {
+			if entry.Key == "" {
+				problems = append(problems, policyProblem{fmt.Sprintf("%s[%d].key", joinPath(path, "entries"), j), "key is required"})
+			}
+		}
+		problems = append(problems, rule.LimitPolicy.validate(path, true)...)
+		if rule.IPMaxRequests != 0 {
+			problems = append(problems, policyProblem{joinPath(path, "ip_max_requests"), "only supported for tokens"})
+		}
+	}
+
+	problems = append(problems, p.Allow.validate("allow")...)
+	problems = append(problems, p.Deny.validate("deny")...)
+	if p.Key != nil {
+		problems = append(problems, p.Key.validate("key")...)
+	}
+
+	return problems
+}
+
+// Validate checks a limit defined outside the policy file, such as the
+// limit of a registered token
+func (l LimitPolicy) Validate() error {
+	problems := l.validate("", true)
+	if len(problems) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", problem.path, problem.msg))
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// validate checks a limit; required limits must set max_requests
+func (l LimitPolicy) validate(path string, required bool) []policyProblem {
+	var problems []policyProblem
+
+	if l.MaxRequests < 0 || (required && l.MaxRequests == 0) {
+		problems = append(problems, policyProblem{joinPath(path, "max_requests"), "must be greater than zero"})
+	}
+	if l.Window != "" {
+		if d, err := time.ParseDuration(l.Window); err != nil || d <= 0 {
+			problems = append(problems, policyProblem{joinPath(path, "window"), fmt.Sprintf("invalid duration %q (must be positive, e.g. \"1s\")", l.Window)})
+		}
+	}
+	if l.BlockingTime != "" {
+		if d, err := time.ParseDuration(l.BlockingTime); err != nil || d < 0 {
+			problems = append(problems, policyProblem{joinPath(path, "blocking_time"), fmt.Sprintf("invalid duration %q (e.g. \"5m\")", l.BlockingTime)})
+		}
+	}
+	if l.Algorithm != "" && !IsValidAlgorithm(l.Algorithm) {
+		problems = append(problems, policyProblem{joinPath(path, "algorithm"), fmt.Sprintf("unknown algorithm %q (valid: %s)", l.Algorithm, strings.Join(Algorithms, ", "))})
+	}
+	if l.Burst < 0 {
+		problems = append(problems, policyProblem{joinPath(path, "burst"), "must not be negative"})
+	}
+	if l.IPMaxRequests < 0 {
+		problems = append(problems, policyProblem{joinPath(path, "ip_max_requests"), "must not be negative"})
+	}
+
+	return problems
+}
+
+// validate checks an upstream's targets, timeout and headers
+func (u UpstreamPolicy) validate(path string) []policyProblem {
+	var problems []policyProblem
+
+	if len(u.Targets) == 0 {
+		problems = append(problems, policyProblem{joinPath(path, "targets"), "at least one target is required"})
+	}
+	for i, target := range u.Targets {
+		if _, err := ParseUpstreamURL(target); err != nil {
+			problems = append(problems, policyProblem{fmt.Sprintf("%s[%d]", joinPath(path, "targets"), i), err.Error()})
+		}
+	}
+	if u.Timeout != "" {
+		if d, err := time.ParseDuration(u.Timeout); err != nil || d <= 0 {
+			problems = append(problems, policyProblem{joinPath(path, "timeout"), fmt.Sprintf("invalid duration %q (must be positive, e.g. \"30s\")", u.Timeout)})
+		}
+	}
+	if u.StripPrefix != "" && !strings.HasPrefix(u.StripPrefix, "/") {
+		problems = append(problems, policyProblem{joinPath(path, "strip_prefix"), "must start with /"})
+	}
+	for field, headers := range map[string]HeaderRewrite{"request_headers": u.RequestHeaders, "response_headers": u.ResponseHeaders} {
+		for name := range headers.Set {
+			if !isValidHeaderName(name) {
+				problems = append(problems, policyProblem{joinPath(joinPath(path, field), "set"), fmt.Sprintf("invalid header name %q", name)})
+			}
+		}
+		for i, name := range headers.Remove {
+			if !isValidHeaderName(name) {
+				problems = append(problems, policyProblem{fmt.Sprintf("%s[%d]", joinPath(joinPath(path, field), "remove"), i), fmt.Sprintf("invalid header name %q", name)})
+			}
+		}
+	}
+
+	return problems
+}
+
+// validate checks every IP and token of an access list
+func (a AccessPolicy) validate(path string) []policyProblem {
+	var problems []policyProblem
+	for i, ip := range a.IPs {
+		if _, err := ParseIPNet(ip); err != nil {
+			problems = append(problems, policyProblem{fmt.Sprintf("%s[%d]", joinPath(path, "ips"), i), err.Error()})
+		}
+	}
+	for i, token := range a.Tokens {
+		if token == "" {
+			problems = append(problems, policyProblem{fmt.Sprintf("%s[%d]", joinPath(path, "tokens"), i), "token must not be empty"})
+		}
+		if strings.HasPrefix(token, TokenHashPrefix) && !IsTokenHash(token) {
+			problems = append(problems, policyProblem{fmt.Sprintf("%s[%d]", joinPath(path, "tokens"), i), "invalid SHA-256 digest (expected 64 hex characters)"})
+		}
+	}
+	return problems
+}
+
+// validate checks a key source and the sources it combines
+func (k KeyPolicy) validate(path string) []policyProblem {
+	var problems []policyProblem
+	required := func(field, value string) {
+		if value == "" {
+			problems = append(problems, policyProblem{joinPath(path, field), fmt.Sprintf("%s is required for %s keys", field, k.Type)})
+		}
+	}
+
+	switch k.Type {
+	case KeyHeader, KeyQuery, KeyCookie:
+		required("name", k.Name)
+	case KeyJWTClaim:
+		required("claim", k.Claim)
+		if k.Secret != "" && k.PublicKeyFile != "" {
+			problems = append(problems, policyProblem{joinPath(path, "public_key_file"), "secret and public_key_file are mutually exclusive"})
+		} else if k.PublicKeyFile != "" {
+			if _, err := LoadPublicKey(k.PublicKeyFile); err != nil {
+				problems = append(problems, policyProblem{joinPath(path, "public_key_file"), err.Error()})
+			}
+		}
+	case KeyPathSegment:
+		if k.Segment < 0 {
+			problems = append(problems, policyProblem{joinPath(path, "segment"), "must not be negative"})
+		}
+	case KeyFirst, KeyComposite:
+		if len(k.Sources) == 0 {
+			problems = append(problems, policyProblem{joinPath(path, "sources"), fmt.Sprintf("sources are required for %s keys", k.Type)})
+		}
+		for i, source := range k.Sources {
+			problems = append(problems, source.validate(fmt.Sprintf("%s[%d]", joinPath(path, "sources"), i))...)
+		}
+	case "":
+		problems = append(problems, policyProblem{joinPath(path, "type"), "type is required"})
+	default:
+		problems = append(problems, policyProblem{joinPath(path, "type"), fmt.Sprintf("unknown key type %q (valid: %s)", k.Type, strings.Join(KeyTypes, ", "))})
+	}
+
+	return problems
+}
+
+// LoadPublicKey reads a PEM encoded RSA or ECDSA public key used to verify JWTs
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %w", path, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T in %s (valid: RSA, ECDSA)", key, path)
+	}
+}
+
+// ParseIPNet parses an IP address or CIDR; a single address becomes a full-length network
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseIPNets parses a validated list of IPs and CIDRs
+func parseIPNets(values []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, value := range values {
+		if ipNet, err := ParseIPNet(value); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+func isEnvSet(name string) bool {
+	return os.Getenv(name) != ""
+}
+
+// position is a 1-based line and column in the policy file
+type position struct {
+	line   int
+	column int
+}
+
+func newPolicyError(name string, pos position, path, msg string) *PolicyError {
+	return &PolicyError{File: name, Line: pos.line, Column: pos.column, Path: redactPath(path), Msg: msg}
+}
+
+// limitFields are the fields of a LimitPolicy, which end the paths below "tokens"
+var limitFields = map[string]bool{
+	"max_requests": true, "window": true, "blocking_time": true,
+	"algorithm": true, "burst": true, "ip_max_requests": true,
+}
+
+// redactPath hides the token in a path below "tokens", since policy errors
+// end up in logs; tokens may contain dots, so only a known field is split off
+func redactPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "tokens.")
+	if !ok {
+		return path
+	}
+	token, field := rest, ""
+	if i := strings.LastIndex(rest, "."); i >= 0 && limitFields[rest[i+1:]] {
+		token, field = rest[:i], rest[i:]
+	}
+	return "tokens." + RedactToken(token) + field
+}
+
+// decodeJSONPolicy strictly decodes a JSON policy and maps every path to its position
+func decodeJSONPolicy(name string, data []byte) (*Policy, map[string]position, error) {
+	var policy Policy
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&policy); err != nil {
+		return nil, nil, decodeError(name, data, dec, err)
+	}
+	trailing := skipSeparators(data, dec.InputOffset())
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, nil, positionError(name, data, trailing, "", "unexpected data after the policy document")
+	}
+
+	positions := make(map[string]position)
+	for path, offset := range jsonPositions(data) {
+		positions[path] = offsetPosition(data, offset)
+	}
+	return &policy, positions, nil
+}
+
+// decodeError converts a JSON decoding error into a positioned PolicyError
+func decodeError(name string, data []byte, dec *json.Decoder, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// Offset points just past the offending byte
+		return positionError(name, data, syntaxErr.Offset-1, "", syntaxErr.Error())
+	case errors.As(err, &typeErr):
+		return positionError(name, data, typeErr.Offset, typeErr.Field, fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value))
+	case errors.Is(err, io.EOF):
+		return positionError(name, data, 0, "", "empty policy document")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return positionError(name, data, int64(len(data)), "", "unexpected end of policy document")
+	default:
+		// Unknown fields are reported without a path or offset, so locate the key in the document
+		msg := strings.TrimPrefix(err.Error(), "json: ")
+		if field, ok := strings.CutPrefix(msg, "unknown field "); ok {
+			if path, offset, found := findUnknownField(data, strings.Trim(field, `"`)); found {
+				return positionError(name, data, offset, path, msg)
+			}
+		}
+		return positionError(name, data, dec.InputOffset(), "", msg)
+	}
+}
+
+// findUnknownField returns the first object key named field outside the token map,
+// whose keys are free-form
+func findUnknownField(data []byte, field string) (string, int64, bool) {
+	var (
+		match  string
+		offset int64 = -1
+	)
+	for path, start := range jsonPositions(data) {
+		parent, key := "", path
+		if i := strings.LastIndex(path, "."); i >= 0 {
+			parent, key = path[:i], path[i+1:]
+		}
+		if key != field || parent == "tokens" {
+			continue
+		}
+		if offset < 0 || start < offset {
+			match, offset = path, start
+		}
+	}
+	return match, offset, offset >= 0
+}
+
+// positionError builds a PolicyError for a byte offset in data
+func positionError(name string, data []byte, offset int64, path, msg string) *PolicyError {
+	return newPolicyError(name, offsetPosition(data, offset), path, msg)
+}
+
+// offsetPosition converts a byte offset in data to a line and column
+func offsetPosition(data []byte, offset int64) position {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return position{line: line, column: column}
+}
+
+func joinPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// lookupPosition returns the position of path, falling back to its closest ancestor
+func lookupPosition(positions map[string]position, path string) position {
+	for path != "" {
+		if pos, exists := positions[path]; exists {
+			return pos
+		}
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	return position{line: 1, column: 1}
+}
+
+// jsonPositions maps the path of every key and array element in data to its byte offset
+func jsonPositions(data []byte) map[string]int64 {
+	positions := make(map[string]int64)
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		start := skipSeparators(data, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if _, exists := positions[path]; !exists {
+			positions[path] = start
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				keyStart := skipSeparators(data, dec.InputOffset())
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child := joinPath(path, fmt.Sprint(key))
+				positions[child] = keyStart
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+
+	walk("")
+	return positions
+}
+
+// skipSeparators advances offset past whitespace and JSON separators
+func skipSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// yamlErrorLine matches the line prefix of yaml.v3 error messages
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// decodeYAMLPolicy strictly decodes a YAML policy and maps every path to its position
+func decodeYAMLPolicy(name string, data []byte) (*Policy, map[string]position, error) {
+	var root yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&root); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, newPolicyError(name, position{line: 1, column: 1}, "", "empty policy document")
+		}
+		return nil, nil, yamlError(name, nil, err)
+	}
+	var next yaml.Node
+	if err := dec.Decode(&next); !errors.Is(err, io.EOF) {
+		return nil, nil, newPolicyError(name, position{line: next.Line, column: next.Column}, "", "unexpected data after the policy document")
+	}
+
+	positions := make(map[string]position)
+	yamlPositions(&root, "", positions)
+
+	var policy Policy
+	strict := yaml.NewDecoder(bytes.NewReader(data))
+	strict.KnownFields(true)
+	if err := strict.Decode(&policy); err != nil {
+		return nil, nil, yamlError(name, positions, err)
+	}
+	return &policy, positions, nil
+}
+
+// yamlError converts a yaml.v3 error into positioned PolicyErrors
+// yaml.v3 only reports lines, so the column and path come from the key on that line
+func yamlError(name string, positions map[string]position, err error) error {
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+
+	var errs []error
+	for _, msg := range messages {
+		match := yamlErrorLine.FindStringSubmatch(msg)
+		if match == nil {
+			errs = append(errs, newPolicyError(name, position{line: 1, column: 1}, "", strings.TrimPrefix(msg, "yaml: ")))
+			continue
+		}
+		line, _ := strconv.Atoi(match[1])
+		path, pos := pathAtLine(positions, line)
+		errs = append(errs, newPolicyError(name, pos, path, match[2]))
+	}
+	return errors.Join(errs...)
+}
+
+// pathAtLine returns the first path positioned on line
+func pathAtLine(positions map[string]position, line int) (string, position) {
+	match, found := "", position{line: line, column: 1}
+	for path, pos := range positions {
+		if pos.line != line || path == "" {
+			continue
+		}
+		if match == "" || pos.column < found.column || (pos.column == found.column && len(path) > len(match)) {
+			match, found = path, pos
+		}
+	}
+	return match, found
+}
+
+// yamlPositions maps the path of every key and sequence item under node to its position
+func yamlPositions(node *yaml.Node, path string, positions map[string]position) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			yamlPositions(child, path, positions)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			child := joinPath(path, key.Value)
+			positions[child] = position{line: key.Line, column: key.Column}
+			yamlPositions(value, child, positions)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			positions[child] = position{line: item.Line, column: item.Column}
+			yamlPositions(item, child, positions)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validPolicy = `{
+  "default": {
+    "max_requests": 20,
+    "window": "2s",
+    "blocking_time": "1m",
+    "algorithm": "sliding_window_counter"
+  },
+  "tokens": {
+    "key=with-dashes": {"max_requests": 100, "window": "1s", "algorithm": "token_bucket", "burst": 150, "ip_max_requests": 20}
+  },
+  "token_mode": "both",
+  "tiers": {
+    "free": {"max_requests": 10, "window": "1m"},
+    "pro": {"max_requests": 1000, "window": "1m", "ip_max_requests": 100}
+  },
+  "routes": [
+    {"name": "login", "pattern": "POST /login", "max_requests": 5, "window": "1m"},
+    {"name": "health", "pattern": "GET /health", "exempt": true},
+    {"name": "tenants", "pattern": "/tenants/{tenant}/", "max_requests": 50, "key": {"type": "path_segment", "segment": 1}}
+  ],
+  "allow": {"ips": ["10.0.0.0/8"], "tokens": ["internal"]},
+  "deny": {"ips": ["203.0.113.7", "2001:db8::/32"]},
+  "key": {"type": "composite", "sources": [
+    {"type": "header", "name": "X-Tenant"},
+    {"type": "jwt_claim", "claim": "sub", "secret": "s3cret"}
+  ]}
+}`
+
+func TestParsePolicy_Valid(t *testing.T) {
+	policy, err := ParsePolicy("policy.json", []byte(validPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cfg := &Config{MaxRequestsPerSecond: 10, RateLimitWindow: time.Second, BlockingTime: 5 * time.Minute, RateLimitAlgorithm: AlgorithmFixedWindow}
+	policy.Apply(cfg)
+
+	if cfg.MaxRequestsPerSecond != 20 || cfg.RateLimitWindow != 2*time.Second || cfg.BlockingTime != time.Minute {
+		t.Errorf("Default limits not applied: %+v", cfg)
+	}
+	if cfg.RateLimitAlgorithm != AlgorithmSlidingWindowCounter {
+		t.Errorf("Expected algorithm %s, got %s", AlgorithmSlidingWindowCounter, cfg.RateLimitAlgorithm)
+	}
+
+	// Tokens may contain characters env var names cannot
+	limit, exists := cfg.TokenLimits["key=with-dashes"]
+	if !exists {
+		t.Fatal("Expected token limit for key=with-dashes")
+	}
+	if limit.MaxRequests != 100 || limit.Window != time.Second || limit.Algorithm != AlgorithmTokenBucket || limit.Burst != 150 || limit.IPMaxRequests != 20 {
+		t.Errorf("Unexpected token limit: %+v", limit)
+	}
+	if cfg.TokenMode != TokenModeBoth {
+		t.Errorf("Expected token mode %s, got %s", TokenModeBoth, cfg.TokenMode)
+	}
+	if pro := cfg.Tiers["pro"]; len(cfg.Tiers) != 2 || pro.MaxRequests != 1000 || pro.Window != time.Minute || pro.IPMaxRequests != 100 {
+		t.Errorf("Unexpected tiers: %+v", cfg.Tiers)
+	}
+
+	if len(cfg.Routes) != 3 || cfg.Routes[0].Name != "login" || cfg.Routes[0].Pattern != "POST /login" || cfg.Routes[0].Limit.MaxRequests != 5 {
+		t.Fatalf("Unexpected routes: %+v", cfg.Routes)
+	}
+	if !cfg.Routes[1].Exempt || cfg.Routes[1].Key != nil {
+		t.Errorf("Expected exempt health route, got %+v", cfg.Routes[1])
+	}
+	if key := cfg.Routes[2].Key; key == nil || key.Type != KeyPathSegment || key.Segment != 1 {
+		t.Errorf("Expected path segment key on tenants route, got %+v", cfg.Routes[2])
+	}
+	if cfg.KeySource == nil || cfg.KeySource.Type != KeyComposite || len(cfg.KeySource.Sources) != 2 || string(cfg.KeySource.Sources[1].Secret) != "s3cret" {
+		t.Errorf("Unexpected key source: %+v", cfg.KeySource)
+	}
+	if len(cfg.AllowIPs) != 1 || len(cfg.DenyIPs) != 2 || len(cfg.AllowTokens) != 1 {
+		t.Errorf("Unexpected access lists: allow=%v deny=%v tokens=%v", cfg.AllowIPs, cfg.DenyIPs, cfg.AllowTokens)
+	}
+}
+
+func TestParsePolicy_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   []string
+	}{
+		{
+			name:   "syntax error",
+			policy: "{\n  \"default\": {\n    \"max_requests\": 10,\n  }\n}",
+			want:   []string{"policy.json:4:3:"},
+		},
+		{
+			name:   "unknown field",
+			policy: "{\n  \"default\": {\n    \"max_request\": 10\n  }\n}",
+			want:   []string{"policy.json:3:", `unknown field "max_request"`},
+		},
+		{
+			name:   "wrong type",
+			policy: "{\n  \"default\": {\n    \"max_requests\": \"ten\"\n  }\n}",
+			want:   []string{"policy.json:3:", "default.max_requests"},
+		},
+		{
+			name:   "unknown algorithm",
+			policy: "{\n  \"tokens\": {\n    \"abc\": {\n      \"max_requests\": 5,\n      \"algorithm\": \"leaky\"\n    }\n  }\n}",
+			want:   []string{"policy.json:5:7: tokens.sha256:ba7816bf8f01.algorithm: unknown algorithm \"leaky\""},
+		},
+		{
+			name:   "invalid duration and missing limit",
+			policy: "{\n  \"tokens\": {\n    \"abc\": {\"window\": \"soon\"}\n  }\n}",
+			want:   []string{"policy.json:3:", "tokens.sha256:ba7816bf8f01.window: invalid duration", "tokens.sha256:ba7816bf8f01.max_requests: must be greater than zero"},
+		},
+		{
+			name:   "invalid route",
+			policy: "{\n  \"routes\": [\n    {\"name\": \"a\", \"pattern\": \"GET /x\", \"max_requests\": 1},\n    {\"name\": \"a\", \"pattern\": \"/{bad\", \"max_requests\": 1}\n  ]\n}",
+			want:   []string{"policy.json:4:", "routes[1].name: duplicate route name", "routes[1].pattern: invalid pattern"},
+		},
+		{
+			name:   "invalid token mode and ceiling",
+			policy: "{\n  \"token_mode\": \"ip\",\n  \"default\": {\"ip_max_requests\": 5}\n}",
+			want:   []string{"policy.json:2:", "token_mode: unknown token mode \"ip\"", "policy.json:3:", "default.ip_max_requests: only supported for tokens"},
+		},
+		{
+			name:   "invalid failure mode",
+			policy: "{\n  \"failure_mode\": \"retry\",\n  \"routes\": [\n    {\"name\": \"a\", \"pattern\": \"GET /x\", \"max_requests\": 1, \"failure_mode\": \"fallback\"}\n  ]\n}",
+			want:   []string{"policy.json:2:", "failure_mode: unknown failure mode \"retry\"", "policy.json:4:", "routes[0].failure_mode: unknown failure mode \"fallback\""},
+		},
+		{
+			name:   "invalid token digest",
+			policy: "{\n  \"tokens\": {\n    \"sha256:abc\": {\"max_requests\": 5}\n  },\n  \"deny\": {\"tokens\": [\"sha256:xyz\"]}\n}",
+			want:   []string{"policy.json:3:", "invalid SHA-256 digest", "policy.json:5:", "deny.tokens[0]: invalid SHA-256 digest"},
+		},
+		{
+			name:   "invalid tier",
+			policy: "{\n  \"tiers\": {\n    \"free\": {\"max_requests\": 0}\n  }\n}",
+			want:   []string{"policy.json:3:", "tiers.free.max_requests: must be greater than zero"},
+		},
+		{
+			name:   "invalid IP",
+			policy: "{\n  \"deny\": {\n    \"ips\": [\n      \"1.2.3.4\",\n      \"not-an-ip\"\n    ]\n  }\n}",
+			want:   []string{"policy.json:5:7: deny.ips[1]: invalid IP address"},
+		},
+		{
+			name:   "invalid key",
+			policy: "{\n  \"key\": {\n    \"type\": \"first\",\n    \"sources\": [\n      {\"type\": \"header\"},\n      {\"type\": \"jwt_claim\", \"claim\": \"sub\", \"public_key_file\": \"/nonexistent.pem\"},\n      {\"type\": \"ip\"}\n    ]\n  }\n}",
+			want: []string{
+				"policy.json:5:7: key.sources[0].name: name is required for header keys",
+				"policy.json:6:", "key.sources[1].public_key_file: failed to read public key",
+				"policy.json:7:", "key.sources[2].type: unknown key type \"ip\"",
+			},
+		},
+		{
+			name:   "invalid upstream",
+			policy: "{\n  \"routes\": [\n    {\"name\": \"a\", \"pattern\": \"GET /x\", \"upstream\": \"api\"}\n  ],\n  \"upstreams\": {\n    \"default\": {\"targets\": [\"app:8080\"], \"strip_prefix\": \"api\", \"request_headers\": {\"set\": {\"Bad Header\": \"x\"}}}\n  }\n}",
+			want: []string{
+				"policy.json:3:", "routes[0].upstream: unknown upstream \"api\"",
+				"upstreams.default.targets[0]: invalid URL", "upstreams.default.strip_prefix: must start with /",
+				"upstreams.default.request_headers.set: invalid header name \"Bad Header\"",
+			},
+		},
+		{
+			name:   "invalid descriptor",
+			policy: "{\n  \"descriptors\": [\n    {\"name\": \"a\", \"entries\": [{\"key\": \"user_id\"}], \"max_requests\": 1},\n    {\"name\": \"a\", \"entries\": [{\"value\": \"x\"}]}\n  ]\n}",
+			want:   []string{"policy.json:4:", "descriptors[1].name: duplicate descriptor name", "descriptors[1].entries[0].key: key is required", "descriptors[1].max_requests: must be greater than zero"},
+		},
+		{
+			name:   "trailing data",
+			policy: "{}\n{}",
+			want:   []string{"policy.json:2:1:", "unexpected data"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePolicy("policy.json", []byte(tt.policy))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Errorf("Expected a *PolicyError, got %T", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Error %q should contain %q", err.Error(), want)
+				}
+			}
+		})
+	}
+}
+
+const validYAMLPolicy = `default:
+  max_requests: 20
+  window: 2s
+  algorithm: gcra
+tokens:
+  key=with-dashes:
+    max_requests: 100
+    window: 1s
+    burst: 150
+routes:
+  - name: login
+    pattern: POST /login
+    max_requests: 5
+    window: 1m
+allow:
+  ips: [10.0.0.0/8]
+`
+
+func TestParsePolicy_YAML(t *testing.T) {
+	policy, err := ParsePolicy("policy.yaml", []byte(validYAMLPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cfg := &Config{}
+	policy.Apply(cfg)
+
+	if cfg.MaxRequestsPerSecond != 20 || cfg.RateLimitWindow != 2*time.Second || cfg.RateLimitAlgorithm != AlgorithmGCRA {
+		t.Errorf("Default limits not applied: %+v", cfg)
+	}
+	if limit := cfg.TokenLimits["key=with-dashes"]; limit.MaxRequests != 100 || limit.Burst != 150 {
+		t.Errorf("Unexpected token limit: %+v", limit)
+	}
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Pattern != "POST /login" || cfg.Routes[0].Limit.Window != time.Minute {
+		t.Errorf("Unexpected routes: %+v", cfg.Routes)
+	}
+	if len(cfg.AllowIPs) != 1 {
+		t.Errorf("Unexpected allow list: %v", cfg.AllowIPs)
+	}
+}
+
+func TestParsePolicy_YAMLErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   []string
+	}{
+		{
+			name:   "syntax error",
+			policy: "default:\n  max_requests: [10\n",
+			want:   []string{"policy.yml:"},
+		},
+		{
+			name:   "unknown field",
+			policy: "default:\n  max_request: 10\n",
+			want:   []string{"policy.yml:2:3: default.max_request:", "max_request not found"},
+		},
+		{
+			name:   "wrong type",
+			policy: "default:\n  max_requests: ten\n",
+			want:   []string{"policy.yml:2:3: default.max_requests:"},
+		},
+		{
+			name:   "unknown algorithm",
+			policy: "tokens:\n  abc:\n    max_requests: 5\n    algorithm: leaky\n",
+			want:   []string{"policy.yml:4:5: tokens.sha256:ba7816bf8f01.algorithm: unknown algorithm \"leaky\""},
+		},
+		{
+			name:   "multiple documents",
+			policy: "default:\n  max_requests: 5\n---\ndefault: {}\n",
+			want:   []string{"policy.yml:3:1:", "unexpected data"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePolicy("policy.yml", []byte(tt.policy))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Errorf("Expected a *PolicyError, got %T", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Error %q should contain %q", err.Error(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfig_PolicyFileWithEnvOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(validPolicy), 0o644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+
+	t.Setenv("POLICY_FILE", path)
+	t.Setenv("MAX_REQUESTS_PER_SECOND", "7")
+	t.Setenv("TOKEN_LIMIT_internal", "50:60")
+	t.Setenv("TOKEN_HASH_SECRET", "pepper")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Env vars win over the policy file
+	if cfg.MaxRequestsPerSecond != 7 {
+		t.Errorf("Expected env override of 7, got %d", cfg.MaxRequestsPerSecond)
+	}
+	if cfg.RateLimitWindow != 2*time.Second {
+		t.Errorf("Expected window from policy file, got %v", cfg.RateLimitWindow)
+	}
+	if cfg.TokenLimits["internal"].MaxRequests != 50 {
+		t.Errorf("Expected token limit from env, got %+v", cfg.TokenLimits["internal"])
+	}
+	if cfg.TokenLimits["key=with-dashes"].MaxRequests != 100 {
+		t.Errorf("Expected token limit from policy file, got %+v", cfg.TokenLimits["key=with-dashes"])
+	}
+}
+
+func TestPolicy_ApplyAll(t *testing.T) {
+	policy, err := ParsePolicy("policy.json", []byte(validPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Setenv("MAX_REQUESTS_PER_SECOND", "7")
+
+	cfg := &Config{MaxRequestsPerSecond: 10}
+	policy.ApplyAll(cfg)
+	if cfg.MaxRequestsPerSecond != 20 || cfg.TokenMode != TokenModeBoth {
+		t.Errorf("Expected the policy to ignore the environment, got %d requests in %q mode", cfg.MaxRequestsPerSecond, cfg.TokenMode)
+	}
+}
+
+func TestLoadConfig_InvalidPolicyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"default": {"algorithm": "leaky"}}`), 0o644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	t.Setenv("POLICY_FILE", path)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), path+":1:") {
+		t.Errorf("Expected a positioned policy error, got %v", err)
+	}
+}
+
+func TestLoadConfig_MalformedTokenLimit(t *testing.T) {
+	t.Setenv("TOKEN_LIMIT_bad", "ten:60")
+
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), RedactToken("bad")) {
+		t.Errorf("Expected an error naming the redacted token, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "bad") {
+		t.Errorf("Expected the token to be redacted, got %v", err)
+	}
+}
+
+func TestLoadConfig_TokenLimitByHash(t *testing.T) {
+	digest := strings.TrimPrefix(HashToken("secret"), TokenHashPrefix)
+	t.Setenv("TOKEN_LIMIT_SHA256_"+strings.ToUpper(digest), "7:60")
+	t.Setenv("TOKEN_HASH_SECRET", "pepper")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if limit, exists := cfg.TokenLimits[HashToken("secret")]; !exists || limit.MaxRequests != 7 {
+		t.Errorf("Expected a limit declared by digest, got %+v", cfg.TokenLimits)
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	redacted := RedactToken("my-secret-token")
+	if strings.Contains(redacted, "secret") || !strings.HasPrefix(HashToken("my-secret-token"), redacted) {
+		t.Errorf("Expected a prefix of the token's digest, got %q", redacted)
+	}
+	if declared := RedactToken(HashToken("my-secret-token")); declared != redacted {
+		t.Errorf("Expected a declared digest to redact like its token, got %q", declared)
+	}
+	if RedactToken("") != "" {
+		t.Error("Expected no token to stay empty")
+	}
+}
+
+func TestEffectivePolicy(t *testing.T) {
+	policy, err := ParsePolicy("policy.json", []byte(validPolicy))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg := &Config{MaxRequestsPerSecond: 10, RateLimitWindow: time.Second, BlockingTime: 5 * time.Minute, RateLimitAlgorithm: AlgorithmFixedWindow}
+	policy.Apply(cfg)
+
+	effective := EffectivePolicy(cfg)
+	if effective.Default.MaxRequests != 20 || effective.Default.Window != "2s" || effective.Default.BlockingTime != "1m0s" {
+		t.Errorf("Unexpected default limit: %+v", effective.Default)
+	}
+	if limit, exists := effective.Tokens[RedactToken("key=with-dashes")]; !exists || limit.Burst != 150 || limit.IPMaxRequests != 20 {
+		t.Errorf("Expected the token limit under the redacted token, got %+v", effective.Tokens)
+	}
+	if len(effective.Routes) != 3 || effective.Routes[0].MaxRequests != 5 || effective.Routes[0].Window != "1m0s" || effective.Routes[2].Key == nil {
+		t.Errorf("Unexpected routes: %+v", effective.Routes)
+	}
+	if tokens := effective.Allow.Tokens; len(tokens) != 1 || tokens[0] != RedactToken("internal") {
+		t.Errorf("Expected redacted allowed tokens, got %v", tokens)
+	}
+
+	data, err := json.Marshal(effective)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, secret := range []string{"key=with-dashes", "internal", "s3cret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Expected %q to be left out, got %s", secret, data)
+		}
+	}
+}
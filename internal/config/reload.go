@@ -0,0 +1,240 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// Diff describes every setting that differs between old and new, one entry per change
+// Settings that only take effect on restart are marked as such
+func Diff(old, new *Config) []string {
+	var changes []string
+	// Values are compared as printed, so nil and empty lists are equal
+	changed := func(name string, oldValue, newValue interface{}) {
+		if fmt.Sprint(oldValue) != fmt.Sprint(newValue) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, oldValue, newValue))
+		}
+	}
+	restart := func(name string, oldValue, newValue interface{}) {
+		if fmt.Sprint(oldValue) != fmt.Sprint(newValue) {
+			changes = append(changes, fmt.Sprintf("%s changed (requires restart, ignored)", name))
+		}
+	}
+
+	changed("max requests", old.MaxRequestsPerSecond, new.MaxRequestsPerSecond)
+	changed("window", old.RateLimitWindow, new.RateLimitWindow)
+	changed("blocking time", old.BlockingTime, new.BlockingTime)
+	changed("algorithm", old.RateLimitAlgorithm, new.RateLimitAlgorithm)
+	changed("burst", old.RateLimitBurst, new.RateLimitBurst)
+	changed("IP rate limiter", old.EnableIPRateLimiter, new.EnableIPRateLimiter)
+	changed("token rate limiter", old.EnableTokenRateLimiter, new.EnableTokenRateLimiter)
+	changed("token mode", old.TokenMode, new.TokenMode)
+	changed("unknown token action", old.UnknownTokenAction, new.UnknownTokenAction)
+	changed("legacy rate limit headers", old.LegacyRateLimitHeaders, new.LegacyRateLimitHeaders)
+	changed("failure mode", old.FailureMode, new.FailureMode)
+	changed("local failure instances", old.FailureLocalInstances, new.FailureLocalInstances)
+
+	for _, token := range sortedKeys(old.TokenLimits, new.TokenLimits) {
+		oldLimit, inOld := old.TokenLimits[token]
+		newLimit, inNew := new.TokenLimits[token]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("token %s added: %+v", RedactToken(token), newLimit))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("token %s removed", RedactToken(token)))
+		case oldLimit != newLimit:
+			changes = append(changes, fmt.Sprintf("token %s: %+v -> %+v", RedactToken(token), oldLimit, newLimit))
+		}
+	}
+
+	for _, tier := range sortedKeys(old.Tiers, new.Tiers) {
+		oldLimit, inOld := old.Tiers[tier]
+		newLimit, inNew := new.Tiers[tier]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("tier %q added: %+v", tier, newLimit))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("tier %q removed", tier))
+		case oldLimit != newLimit:
+			changes = append(changes, fmt.Sprintf("tier %q: %+v -> %+v", tier, oldLimit, newLimit))
+		}
+	}
+
+	oldRoutes, newRoutes := routesByName(old.Routes), routesByName(new.Routes)
+	for _, name := range sortedKeys(oldRoutes, newRoutes) {
+		oldRoute, inOld := oldRoutes[name]
+		newRoute, inNew := newRoutes[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("route %q added: %s", name, newRoute))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("route %q removed", name))
+		case oldRoute.String() != newRoute.String():
+			changes = append(changes, fmt.Sprintf("route %q: %s -> %s", name, oldRoute, newRoute))
+		}
+	}
+
+	oldDescriptors, newDescriptors := descriptorsByName(old.Descriptors), descriptorsByName(new.Descriptors)
+	for _, name := range sortedKeys(oldDescriptors, newDescriptors) {
+		oldRule, inOld := oldDescriptors[name]
+		newRule, inNew := newDescriptors[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("descriptor %q added: %s", name, newRule))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("descriptor %q removed", name))
+		case oldRule.String() != newRule.String():
+			changes = append(changes, fmt.Sprintf("descriptor %q: %s -> %s", name, oldRule, newRule))
+		}
+	}
+
+	for _, name := range sortedKeys(old.Upstreams, new.Upstreams) {
+		oldUpstream, inOld := old.Upstreams[name]
+		newUpstream, inNew := new.Upstreams[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("upstream %q added: %s", name, newUpstream))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("upstream %q removed", name))
+		case oldUpstream.String() != newUpstream.String():
+			changes = append(changes, fmt.Sprintf("upstream %q: %s -> %s", name, oldUpstream, newUpstream))
+		case !maps.Equal(oldUpstream.RequestHeaders.Set, newUpstream.RequestHeaders.Set) || !maps.Equal(oldUpstream.ResponseHeaders.Set, newUpstream.ResponseHeaders.Set):
+			changes = append(changes, fmt.Sprintf("upstream %q: header values changed", name))
+		}
+	}
+
+	changed("allowed IPs", ipNetStrings(old.AllowIPs), ipNetStrings(new.AllowIPs))
+	changed("denied IPs", ipNetStrings(old.DenyIPs), ipNetStrings(new.DenyIPs))
+	changed("allowed tokens", redactTokens(old.AllowTokens), redactTokens(new.AllowTokens))
+	changed("denied tokens", redactTokens(old.DenyTokens), redactTokens(new.DenyTokens))
+	changed("trusted proxies", ipNetStrings(old.TrustedProxies), ipNetStrings(new.TrustedProxies))
+	changed("trusted proxy header", old.TrustedProxyHeader, new.TrustedProxyHeader)
+	changed("IPv4 prefix length", old.IPv4PrefixLength, new.IPv4PrefixLength)
+	changed("IPv6 prefix length", old.IPv6PrefixLength, new.IPv6PrefixLength)
+	changed("key", old.KeySource.String(), new.KeySource.String())
+
+	restart("SERVER_PORT", old.ServerPort, new.ServerPort)
+	restart("STORAGE_BACKEND", old.StorageBackend, new.StorageBackend)
+	restart("MEMORY_MAX_KEYS", old.MemoryMaxKeys, new.MemoryMaxKeys)
+	restart("MEMORY_CLEANUP_INTERVAL_SECONDS", old.MemoryCleanupInterval, new.MemoryCleanupInterval)
+	restart("REDIS_HOST", old.RedisHost, new.RedisHost)
+	restart("REDIS_PORT", old.RedisPort, new.RedisPort)
+	restart("REDIS_MODE", old.RedisMode, new.RedisMode)
+	restart("REDIS_URL", old.RedisURL, new.RedisURL)
+	restart("REDIS_ADDRS", old.RedisAddrs, new.RedisAddrs)
+	restart("REDIS_USERNAME", old.RedisUsername, new.RedisUsername)
+	restart("REDIS_PASSWORD", old.RedisPassword, new.RedisPassword)
+	restart("REDIS_DB", old.RedisDB, new.RedisDB)
+	restart("REDIS_SENTINEL_MASTER", old.RedisSentinelMaster, new.RedisSentinelMaster)
+	restart("REDIS_SENTINEL_USERNAME", old.RedisSentinelUsername, new.RedisSentinelUsername)
+	restart("REDIS_SENTINEL_PASSWORD", old.RedisSentinelPassword, new.RedisSentinelPassword)
+	restart("REDIS_TLS", old.RedisTLS, new.RedisTLS)
+	restart("REDIS_TLS_CA_FILE", old.RedisTLSCAFile, new.RedisTLSCAFile)
+	restart("REDIS_TLS_CERT_FILE", old.RedisTLSCertFile, new.RedisTLSCertFile)
+	restart("REDIS_TLS_KEY_FILE", old.RedisTLSKeyFile, new.RedisTLSKeyFile)
+	restart("REDIS_TLS_SERVER_NAME", old.RedisTLSServerName, new.RedisTLSServerName)
+	restart("REDIS_TLS_SKIP_VERIFY", old.RedisTLSSkipVerify, new.RedisTLSSkipVerify)
+	restart("REDIS_POOL_SIZE", old.RedisPoolSize, new.RedisPoolSize)
+	restart("REDIS_MIN_IDLE_CONNS", old.RedisMinIdleConns, new.RedisMinIdleConns)
+	restart("REDIS_DIAL_TIMEOUT_MS", old.RedisDialTimeout, new.RedisDialTimeout)
+	restart("REDIS_READ_TIMEOUT_MS", old.RedisReadTimeout, new.RedisReadTimeout)
+	restart("REDIS_WRITE_TIMEOUT_MS", old.RedisWriteTimeout, new.RedisWriteTimeout)
+	restart("proxy mode", len(old.Upstreams) > 0, len(new.Upstreams) > 0)
+	restart("POLICY_FILE", old.PolicyFile, new.PolicyFile)
+	restart("POLICY_RELOAD_INTERVAL_SECONDS", old.PolicyReloadInterval, new.PolicyReloadInterval)
+	restart("ADMIN_TOKEN", old.AdminToken, new.AdminToken)
+	restart("ADMIN_PORT", old.AdminPort, new.AdminPort)
+	restart("DECISION_TOKEN", old.DecisionToken, new.DecisionToken)
+	restart("DECISION_PORT", old.DecisionPort, new.DecisionPort)
+	restart("RLS_PORT", old.RLSPort, new.RLSPort)
+	restart("TOKEN_REGISTRY", old.TokenRegistry, new.TokenRegistry)
+	restart("TOKEN_REGISTRY_FILE", old.TokenRegistryFile, new.TokenRegistryFile)
+	restart("TOKEN_REGISTRY_CACHE_SECONDS", old.TokenRegistryCacheTTL, new.TokenRegistryCacheTTL)
+	restart("TOKEN_HASH_SECRET", old.TokenHashSecret, new.TokenHashSecret)
+	restart("CIRCUIT_BREAKER_THRESHOLD", old.CircuitBreakerThreshold, new.CircuitBreakerThreshold)
+	restart("CIRCUIT_BREAKER_COOLDOWN_SECONDS", old.CircuitBreakerCooldown, new.CircuitBreakerCooldown)
+
+	return changes
+}
+
+// WatchFile polls path every interval and calls onChange whenever its
+// modification time or size changes, until ctx is done
+// Polling follows symlinks, so files swapped atomically by a rename or a
+// Kubernetes ConfigMap update are picked up too
+func WatchFile(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	if interval <= 0 {
+		return
+	}
+
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current, err := os.Stat(path)
+			if err != nil {
+				// Keep the last state so the file reappearing unchanged is not a change
+				continue
+			}
+			if last == nil || !current.ModTime().Equal(last.ModTime()) || current.Size() != last.Size() {
+				last = current
+				onChange()
+			}
+		}
+	}
+}
+
+func sortedKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, exists := a[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func routesByName(routes []RouteRule) map[string]RouteRule {
+	byName := make(map[string]RouteRule, len(routes))
+	for _, route := range routes {
+		byName[route.Name] = route
+	}
+	return byName
+}
+
+func descriptorsByName(rules []DescriptorRule) map[string]DescriptorRule {
+	byName := make(map[string]DescriptorRule, len(rules))
+	for _, rule := range rules {
+		byName[rule.Name] = rule
+	}
+	return byName
+}
+
+func redactTokens(tokens []string) []string {
+	redacted := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		redacted = append(redacted, RedactToken(token))
+	}
+	return redacted
+}
+
+func ipNetStrings(nets []*net.IPNet) []string {
+	values := make([]string, 0, len(nets))
+	for _, ipNet := range nets {
+		values = append(values, ipNet.String())
+	}
+	return values
+}
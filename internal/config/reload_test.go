@@ -0,0 +1,98 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	old := &Config{
+		MaxRequestsPerSecond: 10,
+		RateLimitWindow:      time.Second,
+		TokenLimits: map[string]TokenLimit{
+			"kept":    {MaxRequests: 5},
+			"changed": {MaxRequests: 5},
+			"removed": {MaxRequests: 5},
+		},
+		Tiers:      map[string]TokenLimit{"pro": {MaxRequests: 100}},
+		Routes:     []RouteRule{{Name: "login", Pattern: "POST /login", Limit: TokenLimit{MaxRequests: 5}}},
+		RedisHost:  "localhost",
+		AdminToken: "secret",
+		AdminPort:  "9090",
+	}
+	new := &Config{
+		MaxRequestsPerSecond: 20,
+		RateLimitWindow:      time.Second,
+		TokenLimits: map[string]TokenLimit{
+			"kept":    {MaxRequests: 5},
+			"changed": {MaxRequests: 50},
+			"added":   {MaxRequests: 5},
+		},
+		Tiers:       map[string]TokenLimit{"pro": {MaxRequests: 200}},
+		Routes:      []RouteRule{{Name: "login", Pattern: "POST /login", Limit: TokenLimit{MaxRequests: 5}}},
+		AllowTokens: []string{},
+		RedisHost:   "redis",
+		AdminToken:  "other-secret",
+		AdminPort:   "9091",
+	}
+
+	changes := strings.Join(Diff(old, new), "\n")
+	for _, want := range []string{
+		"max requests: 10 -> 20",
+		"token " + RedactToken("added") + " added",
+		"token " + RedactToken("changed") + ":",
+		"token " + RedactToken("removed") + " removed",
+		`tier "pro":`,
+		"REDIS_HOST changed (requires restart, ignored)",
+		"ADMIN_TOKEN changed",
+		"ADMIN_PORT changed",
+	} {
+		if !strings.Contains(changes, want) {
+			t.Errorf("Changes should contain %q, got:\n%s", want, changes)
+		}
+	}
+	for _, unwanted := range []string{"kept", `"added"`, `"changed"`, `"removed"`, "window", "route", "allowed tokens", "secret"} {
+		if strings.Contains(changes, unwanted) {
+			t.Errorf("Changes should not mention %q, got:\n%s", unwanted, changes)
+		}
+	}
+
+	if changes := Diff(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0o644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go WatchFile(ctx, path, 10*time.Millisecond, func() {
+		changed <- struct{}{}
+	})
+
+	select {
+	case <-changed:
+		t.Fatal("Unchanged file should not trigger a reload")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(path, []byte(`{"default": {}}`), 0o644); err != nil {
+		t.Fatalf("Failed to update policy: %v", err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a change notification")
+	}
+}
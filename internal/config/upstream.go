@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultUpstream is the upstream of the requests whose route names none
+const DefaultUpstream = "default"
+
+// Upstream is a service requests are proxied to, spread round-robin across
+// Targets
+// Each request must be answered within Timeout; StripPrefix is removed from
+// the request path before it is appended to the target's
+type Upstream struct {
+	Targets         []*url.URL
+	Timeout         time.Duration
+	StripPrefix     string
+	RequestHeaders  HeaderRewrite
+	ResponseHeaders HeaderRewrite
+}
+
+// HeaderRewrite removes headers and then sets others to fixed values
+type HeaderRewrite struct {
+	Set    map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+}
+
+// Apply rewrites h
+func (hr HeaderRewrite) Apply(h http.Header) {
+	for _, name := range hr.Remove {
+		h.Del(name)
+	}
+	for name, value := range hr.Set {
+		h.Set(name, value)
+	}
+}
+
+// String describes the upstream without its header values, which may hold
+// credentials
+func (u Upstream) String() string {
+	targets := make([]string, len(u.Targets))
+	for i, target := range u.Targets {
+		targets[i] = target.String()
+	}
+	s := fmt.Sprintf("%s timeout %v", strings.Join(targets, ","), u.Timeout)
+	if u.StripPrefix != "" {
+		s += fmt.Sprintf(" strip %s", u.StripPrefix)
+	}
+	if names := u.RequestHeaders.names(); names != "" {
+		s += " request headers " + names
+	}
+	if names := u.ResponseHeaders.names(); names != "" {
+		s += " response headers " + names
+	}
+	return s
+}
+
+// names lists the headers hr rewrites, in order
+func (hr HeaderRewrite) names() string {
+	var names []string
+	for _, name := range hr.Remove {
+		names = append(names, "-"+name)
+	}
+	for name := range hr.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// ParseUpstreamURL parses the URL of an upstream target, which must be an
+// absolute http or https URL without query
+func ParseUpstreamURL(raw string) (*url.URL, error) {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %v", raw, err)
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q (expected http:// or https:// and a host)", raw)
+	}
+	if target.RawQuery != "" || target.Fragment != "" {
+		return nil, fmt.Errorf("invalid URL %q (query and fragment are not supported)", raw)
+	}
+	return target, nil
+}
+
+// isValidHeaderName reports whether name is a valid HTTP header name, only
+// made of token characters
+func isValidHeaderName(name string) bool {
+	for _, c := range name {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+)
+
+// The admin handlers name the client they act on with one of the ip, token,
+// token_id or key parameters, read from the query string or a form body;
+// token is only read from a form body, so tokens stay out of access logs
+
+// StateHandler reports the count, remaining requests and reset time of a
+// client's limit on GET, or on POST to name a token, without counting a
+// request
+func StateHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+
+		subj, err := subject(r)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		state, err := service.Inspect(r.Context(), subj)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stateJSON(state))
+	}
+}
+
+// TopHandler lists the keys that used the most of their limit on GET, at most
+// n of them (10 by default)
+func TopHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		n := 10
+		if value := r.FormValue("n"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{
+					"error": "n must be a positive number",
+				})
+				return
+			}
+			n = parsed
+		}
+
+		top, err := service.TopConsumers(r.Context(), n)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		keys := make([]map[string]interface{}, 0, len(top))
+		for _, state := range top {
+			keys = append(keys, stateJSON(state))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"keys": keys,
+		})
+	}
+}
+
+// ResetHandler clears the counters and any block of a client's key on POST
+func ResetHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		subj, err := subject(r)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		key, err := service.Reset(r.Context(), subj)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API: reset %s", subj)
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status": "reset",
+			"key":    key,
+		})
+	}
+}
+
+// UnblockHandler lifts the block of a client's key on POST, keeping its
+// counters
+func UnblockHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		subj, err := subject(r)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		key, err := service.Unblock(r.Context(), subj)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API: unblocked %s", subj)
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status": "unblocked",
+			"key":    key,
+		})
+	}
+}
+
+// BlockHandler blocks a client's key for the duration parameter, e.g. "10m",
+// on POST
+func BlockHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		duration, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil || duration <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "duration must be a positive duration such as 10m",
+			})
+			return
+		}
+
+		subj, err := subject(r)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		key, err := service.Block(r.Context(), subj, duration)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API: blocked %s for %v", subj, duration)
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status":     "blocked",
+			"key":        key,
+			"reset_time": time.Now().Add(duration).Format(time.RFC3339),
+		})
+	}
+}
+
+// BlockedHandler lists the keys currently blocked on GET
+func BlockedHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		blocked, err := service.BlockedKeys(r.Context())
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		keys := make([]map[string]string, 0, len(blocked))
+		for _, b := range blocked {
+			keys = append(keys, map[string]string{
+				"key":        b.Key,
+				"reset_time": b.ResetTime.Format(time.RFC3339),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"blocked": keys,
+		})
+	}
+}
+
+// PolicyHandler reports the policy in effect on GET, in the policy file
+// format with tokens redacted and secrets left out
+func PolicyHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		cfg := service.Config()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ip_rate_limiter":    cfg.EnableIPRateLimiter,
+			"token_rate_limiter": cfg.EnableTokenRateLimiter,
+			"policy":             config.EffectivePolicy(cfg),
+		})
+	}
+}
+
+// TokensHandler lists the tokens of the token registry on GET, and on POST
+// registers a new token of the owner parameter on the tier parameter,
+// returning its secret, which isn't kept anywhere
+func TokensHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			tokens, err := service.Tokens(r.Context())
+			if err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"tokens": tokens,
+			})
+		case http.MethodPost:
+			token, secret, err := service.CreateToken(r.Context(), r.FormValue("owner"), r.FormValue("tier"))
+			if err != nil {
+				writeAdminError(w, err)
+				return
+			}
+			log.Printf("Admin API: created token %s for %q on tier %q", token.ID, token.Owner, token.Tier)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"token":  token,
+				"secret": secret,
+			})
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+				"error": "Method not allowed",
+			})
+		}
+	}
+}
+
+// RevokeTokenHandler disables the registered token named by the id
+// parameter on POST
+func RevokeTokenHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		token, err := service.RevokeToken(r.Context(), r.FormValue("id"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API: revoked token %s", token.ID)
+		writeJSON(w, http.StatusOK, token)
+	}
+}
+
+// TokenTierHandler moves the registered token named by the id parameter to
+// the tier parameter on POST; an empty tier is the default token limit
+func TokenTierHandler(service *limiter.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		token, err := service.SetTokenTier(r.Context(), r.FormValue("id"), r.FormValue("tier"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		log.Printf("Admin API: moved token %s to tier %q", token.ID, token.Tier)
+		writeJSON(w, http.StatusOK, token)
+	}
+}
+
+// stateJSON is the JSON form of a key's state
+func stateJSON(state limiter.KeyState) map[string]interface{} {
+	return map[string]interface{}{
+		"key":        state.Key,
+		"policy":     state.Policy,
+		"limit":      state.Limit,
+		"remaining":  state.Remaining,
+		"window":     state.Window.String(),
+		"reset_time": state.ResetTime.Format(time.RFC3339),
+		"blocked":    state.Blocked,
+	}
+}
+
+// subject reads the client an admin request acts on
+func subject(r *http.Request) (limiter.Subject, error) {
+	if r.URL.Query().Has("token") {
+		return limiter.Subject{}, fmt.Errorf("%w: send the token in a POST form body, not the URL", limiter.ErrInvalidSubject)
+	}
+	return limiter.Subject{
+		IP:      r.FormValue("ip"),
+		Token:   r.PostFormValue("token"),
+		TokenID: r.FormValue("token_id"),
+		Key:     r.FormValue("key"),
+	}, nil
+}
+
+// writeAdminError reports err: 400 for an invalid subject or tier or without
+// a token registry, 404 for an unknown token and 500 otherwise
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, limiter.ErrInvalidSubject), errors.Is(err, limiter.ErrUnknownTier), errors.Is(err, limiter.ErrNoTokenRegistry):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, limiter.ErrInvalidToken), errors.Is(err, registry.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Unknown token"})
+	default:
+		log.Printf("Admin API error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+}
+
+// allowMethod rejects requests using none of methods with 405
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if slices.Contains(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+		"error": "Method not allowed",
+	})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
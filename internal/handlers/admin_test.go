@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func newAdminService(t *testing.T) *limiter.Service {
+	store := storage.NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	return limiter.NewService(store, &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        time.Minute,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeFallback,
+		UnknownTokenAction:     config.UnknownTokenIP,
+		TokenLimits: map[string]config.TokenLimit{
+			"premium-token": {MaxRequests: 100},
+		},
+	})
+}
+
+func serve(handler http.Handler, method, target string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+	var body map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	return rr, body
+}
+
+// postForm serves a POST of form, in the request body
+func postForm(handler http.Handler, target string, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var body map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	return rr, body
+}
+
+func TestStateHandler(t *testing.T) {
+	service := newAdminService(t)
+	service.CheckAndIncrement(context.Background(), "192.168.1.1", "")
+
+	rr, body := serve(StateHandler(service), http.MethodGet, "/admin/state?ip=192.168.1.1")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	if body["key"] != "ip:192.168.1.1" || body["limit"] != float64(5) || body["remaining"] != float64(4) || body["blocked"] != false {
+		t.Errorf("Unexpected state: %v", body)
+	}
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/admin/state", http.StatusBadRequest},
+		{"/admin/state?token_id=tok_1", http.StatusBadRequest},
+		// Tokens in the URL would end up in access logs
+		{"/admin/state?token=premium-token", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rr, _ := serve(StateHandler(service), http.MethodGet, tt.target); rr.Code != tt.status {
+			t.Errorf("%s: Expected status %d, got %d: %s", tt.target, tt.status, rr.Code, rr.Body)
+		}
+	}
+
+	rr, body = postForm(StateHandler(service), "/admin/state", url.Values{"token": {"premium-token"}})
+	if rr.Code != http.StatusOK || body["limit"] != float64(100) {
+		t.Errorf("Expected the state of the token posted, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr, _ := postForm(StateHandler(service), "/admin/state", url.Values{"ip": {"192.168.1.1"}, "token": {"premium-token"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for two clients, got %d", rr.Code)
+	}
+
+	if rr, _ := serve(StateHandler(service), http.MethodDelete, "/admin/state?ip=192.168.1.1"); rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("Expected status 405 allowing GET and POST, got %d %q", rr.Code, rr.Header().Get("Allow"))
+	}
+}
+
+func TestBlockAndResetHandlers(t *testing.T) {
+	ctx := context.Background()
+	service := newAdminService(t)
+
+	if rr, _ := serve(BlockHandler(service), http.MethodPost, "/admin/block?ip=10.0.0.1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a duration, got %d", rr.Code)
+	}
+	rr, body := serve(BlockHandler(service), http.MethodPost, "/admin/block?ip=10.0.0.1&duration=10m")
+	if rr.Code != http.StatusOK || body["key"] != "ip:10.0.0.1" {
+		t.Fatalf("Expected the IP to be blocked, got %d: %s", rr.Code, rr.Body)
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "10.0.0.1", ""); decision.Allowed {
+		t.Error("Expected a blocked IP to be rejected")
+	}
+
+	rr, body = serve(BlockedHandler(service), http.MethodGet, "/admin/blocked")
+	if blocked, _ := body["blocked"].([]interface{}); rr.Code != http.StatusOK || len(blocked) != 1 {
+		t.Errorf("Expected one blocked key, got %d: %s", rr.Code, rr.Body)
+	}
+
+	if rr, _ := serve(ResetHandler(service), http.MethodPost, "/admin/reset?key=ip:10.0.0.1"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "10.0.0.1", ""); !decision.Allowed {
+		t.Error("Expected a reset IP to be allowed")
+	}
+}
+
+func TestTopHandler(t *testing.T) {
+	service := newAdminService(t)
+	for i := 0; i < 3; i++ {
+		service.CheckAndIncrement(context.Background(), "10.0.0.1", "")
+	}
+	service.CheckAndIncrement(context.Background(), "10.0.0.2", "")
+
+	rr, body := serve(TopHandler(service), http.MethodGet, "/admin/top?n=1")
+	keys, _ := body["keys"].([]interface{})
+	if rr.Code != http.StatusOK || len(keys) != 1 || keys[0].(map[string]interface{})["key"] != "ip:10.0.0.1" {
+		t.Errorf("Expected the top consumer ip:10.0.0.1, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr, _ := serve(TopHandler(service), http.MethodGet, "/admin/top?n=0"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for n=0, got %d", rr.Code)
+	}
+}
+
+func TestPolicyHandler(t *testing.T) {
+	rr, body := serve(PolicyHandler(newAdminService(t)), http.MethodGet, "/admin/policy")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	if body["ip_rate_limiter"] != true {
+		t.Errorf("Expected the IP rate limiter to be reported, got %v", body)
+	}
+	if strings.Contains(rr.Body.String(), "premium-token") || !strings.Contains(rr.Body.String(), config.RedactToken("premium-token")) {
+		t.Errorf("Expected the token to be redacted, got %s", rr.Body)
+	}
+}
+
+func TestTokenHandlers(t *testing.T) {
+	ctx := context.Background()
+	service := newAdminService(t)
+	if rr, _ := serve(TokensHandler(service), http.MethodGet, "/admin/tokens"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a token registry, got %d", rr.Code)
+	}
+
+	cfg := *service.Config()
+	cfg.Tiers = map[string]config.TokenLimit{"pro": {MaxRequests: 50}}
+	service.Reload(&cfg)
+	service.SetTokenRegistry(registry.NewMemoryRegistry())
+
+	rr, body := serve(TokensHandler(service), http.MethodPost, "/admin/tokens?owner=acme&tier=pro")
+	token, _ := body["token"].(map[string]interface{})
+	secret, _ := body["secret"].(string)
+	if rr.Code != http.StatusOK || secret == "" || token["owner"] != "acme" || token["tier"] != "pro" {
+		t.Fatalf("Expected a token of acme on pro with its secret, got %d: %s", rr.Code, rr.Body)
+	}
+	id := token["id"].(string)
+	if decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", secret); err != nil || decision.Policy != "pro" {
+		t.Errorf("Expected the new token to be limited by its tier, got %+v, %v", decision, err)
+	}
+	if rr, _ := serve(TokensHandler(service), http.MethodPost, "/admin/tokens?owner=acme&tier=gold"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown tier, got %d", rr.Code)
+	}
+
+	rr, body = serve(TokenTierHandler(service), http.MethodPost, "/admin/tokens/tier?id="+id)
+	if rr.Code != http.StatusOK || body["tier"] != nil {
+		t.Errorf("Expected the token to leave its tier, got %d: %s", rr.Code, rr.Body)
+	}
+
+	rr, body = serve(RevokeTokenHandler(service), http.MethodPost, "/admin/tokens/revoke?id="+id)
+	if rr.Code != http.StatusOK || body["disabled"] != true {
+		t.Errorf("Expected the token to be revoked, got %d: %s", rr.Code, rr.Body)
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", secret); decision.Policy != limiter.PolicyDefault {
+		t.Errorf("Expected a revoked token to be limited by IP, got %+v", decision)
+	}
+	if rr, _ := serve(RevokeTokenHandler(service), http.MethodPost, "/admin/tokens/revoke?id=tok_unknown"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown token, got %d", rr.Code)
+	}
+
+	rr, body = serve(TokensHandler(service), http.MethodGet, "/admin/tokens")
+	tokens, _ := body["tokens"].([]interface{})
+	if rr.Code != http.StatusOK || len(tokens) != 1 || strings.Contains(rr.Body.String(), secret) {
+		t.Errorf("Expected the token listed without its secret, got %d: %s", rr.Code, rr.Body)
+	}
+}
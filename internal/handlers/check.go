@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/pkg/ratelimit/api"
+)
+
+// Paths of the decision API
+const (
+	CheckPath      = api.CheckPath
+	CheckBatchPath = api.CheckBatchPath
+)
+
+// MaxBatchChecks is the largest number of checks a batch may carry
+const MaxBatchChecks = api.MaxBatchChecks
+
+// maxCheckBodyBytes bounds the body of a decision API request
+const maxCheckBodyBytes = 1 << 20
+
+// Observer is notified of the decisions of the decision API, e.g. to export
+// metrics
+type Observer interface {
+	ObserveDecision(rule string, decision limiter.Decision, err error)
+}
+
+// checkJSON is a check of the decision API: cost requests of key, counted by
+// dimension (ip, token or key) against the limit of policy
+type checkJSON struct {
+	Key       string `json:"key"`
+	Dimension string `json:"dimension"`
+	Policy    string `json:"policy"`
+	Cost      int    `json:"cost"`
+}
+
+func (c checkJSON) request() limiter.CheckRequest {
+	return limiter.CheckRequest{Key: c.Key, Dimension: c.Dimension, Policy: c.Policy, Cost: c.Cost}
+}
+
+// CheckHandler decides a single check on POST, for callers that aren't HTTP
+// requests: {"key", "dimension", "policy", "cost"}, with "peek": true to
+// report the decision without counting anything
+// A decision is answered with 200 whether or not it allows the request; an
+// invalid check gets 400 and a storage failure the failure mode doesn't
+// absorb gets 503
+func CheckHandler(service *limiter.Service, observers ...Observer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		var body struct {
+			checkJSON
+			Peek bool `json:"peek"`
+		}
+		if !readCheckBody(w, r, &body) {
+			return
+		}
+
+		decisions, errs := service.Check(r.Context(), []limiter.CheckRequest{body.request()}, body.Peek)
+		decision, err := decisions[0], errs[0]
+		if !body.Peek {
+			observeCheck(observers, decision, err)
+		}
+
+		switch {
+		case errors.Is(err, limiter.ErrInvalidCheck):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "code": api.CodeInvalidCheck})
+		case errors.Is(err, limiter.ErrUnavailable):
+			log.Printf("Rate limiter unavailable: %v (decision API)", err)
+			writeJSON(w, http.StatusServiceUnavailable, decisionJSON(decision, err))
+		case isDecided(err):
+			writeJSON(w, http.StatusOK, decisionJSON(decision, err))
+		default:
+			log.Printf("Decision API error: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error", "code": api.CodeInternal})
+		}
+	}
+}
+
+// CheckBatchHandler decides many checks in one call on POST:
+// {"checks": [...], "peek": false}, each check as for CheckHandler
+// Checks are decided on their own with a single storage round trip; the
+// response lists a decision per check, in order, with the error of the
+// checks that couldn't be decided
+func CheckBatchHandler(service *limiter.Service, observers ...Observer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		var body struct {
+			Checks []checkJSON `json:"checks"`
+			Peek   bool        `json:"peek"`
+		}
+		if !readCheckBody(w, r, &body) {
+			return
+		}
+		if len(body.Checks) == 0 || len(body.Checks) > MaxBatchChecks {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("A batch must carry between 1 and %d checks", MaxBatchChecks),
+				"code":  api.CodeInvalidCheck,
+			})
+			return
+		}
+
+		requests := make([]limiter.CheckRequest, len(body.Checks))
+		for i, check := range body.Checks {
+			requests[i] = check.request()
+		}
+		decisions, errs := service.Check(r.Context(), requests, body.Peek)
+
+		results := make([]map[string]interface{}, len(decisions))
+		var failed error
+		for i, decision := range decisions {
+			if !body.Peek {
+				observeCheck(observers, decision, errs[i])
+			}
+			if !isDecided(errs[i]) && !errors.Is(errs[i], limiter.ErrInvalidCheck) {
+				failed = errs[i]
+			}
+			results[i] = decisionJSON(decision, errs[i])
+		}
+		if failed != nil {
+			// The storage fails the whole batch at once
+			log.Printf("Decision API error: %v (batch of %d checks)", failed, len(requests))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"decisions": results,
+		})
+	}
+}
+
+// readCheckBody decodes the JSON body of a decision API request into v,
+// answering 400 when it can't
+func readCheckBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCheckBodyBytes)).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid JSON body",
+			"code":  api.CodeInvalidCheck,
+		})
+		return false
+	}
+	return true
+}
+
+// isDecided reports whether err leaves a decision on the request: admitted,
+// limited, denied or carrying an unknown token
+func isDecided(err error) bool {
+	return err == nil || errors.Is(err, limiter.ErrLimitExceeded) || errors.Is(err, limiter.ErrAccessDenied) || errors.Is(err, limiter.ErrInvalidToken)
+}
+
+func observeCheck(observers []Observer, decision limiter.Decision, err error) {
+	if errors.Is(err, limiter.ErrInvalidCheck) {
+		return
+	}
+	rule := decision.Policy
+	if rule == "" {
+		rule = limiter.PolicyDefault
+	}
+	for _, observer := range observers {
+		observer.ObserveDecision(rule, decision, err)
+	}
+}
+
+// decisionJSON is the JSON form of a decision, with the reason it was not
+// allowed: a message for people and a code for programs; the limit is only
+// reported when one applies
+func decisionJSON(decision limiter.Decision, err error) map[string]interface{} {
+	body := map[string]interface{}{
+		"allowed":  decision.Allowed,
+		"degraded": decision.Degraded,
+	}
+	if decision.Limit > 0 {
+		body["policy"] = decision.Policy
+		body["dimension"] = decision.Dimension
+		body["limit"] = decision.Limit
+		body["remaining"] = decision.Remaining
+		body["window"] = decision.Window.String()
+	}
+	if !decision.ResetTime.IsZero() {
+		body["reset_time"] = decision.ResetTime.Format(time.RFC3339)
+		body["reset_after_ms"] = decision.ResetAfter(time.Now()).Milliseconds()
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, limiter.ErrLimitExceeded):
+		body["error"] = "Rate limit exceeded"
+	case errors.Is(err, limiter.ErrAccessDenied):
+		body["error"] = "Access denied"
+	case errors.Is(err, limiter.ErrInvalidToken):
+		body["error"] = "Invalid token"
+	case errors.Is(err, limiter.ErrInvalidCheck):
+		body["error"] = err.Error()
+	case errors.Is(err, limiter.ErrUnavailable):
+		body["error"] = "Rate limiter unavailable"
+	default:
+		body["error"] = "Internal server error"
+	}
+	if err != nil {
+		body["code"] = api.ErrorCode(err)
+	}
+	return body
+}
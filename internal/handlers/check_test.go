@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/middleware"
+)
+
+func post(handler http.Handler, target, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	var decoded map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &decoded)
+	return rr, decoded
+}
+
+func TestCheckHandler(t *testing.T) {
+	handler := CheckHandler(newAdminService(t))
+
+	rr, body := post(handler, CheckPath, `{"key": "192.168.1.1", "dimension": "ip", "cost": 2}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	if body["allowed"] != true || body["limit"] != float64(5) || body["remaining"] != float64(3) || body["policy"] != "default" || body["dimension"] != "ip" {
+		t.Errorf("Unexpected decision: %v", body)
+	}
+
+	_, body = post(handler, CheckPath, `{"key": "192.168.1.1", "dimension": "ip", "cost": 3, "peek": true}`)
+	if body["allowed"] != true || body["remaining"] != float64(3) {
+		t.Errorf("Expected peeking to report 3 requests left, got %v", body)
+	}
+
+	rr, body = post(handler, CheckPath, `{"key": "192.168.1.1", "dimension": "ip", "cost": 4}`)
+	if rr.Code != http.StatusOK || body["allowed"] != false || body["error"] != "Rate limit exceeded" || body["code"] != "limit_exceeded" || body["reset_after_ms"] == nil {
+		t.Errorf("Expected a limited decision, got %d: %v", rr.Code, body)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"invalid JSON", `{"key": `, http.StatusBadRequest},
+		{"no key", `{"dimension": "ip"}`, http.StatusBadRequest},
+		{"no policy for a key", `{"key": "acme"}`, http.StatusBadRequest},
+		{"cost over the limit", `{"key": "192.168.1.2", "dimension": "ip", "cost": 6}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rr, _ := post(handler, CheckPath, tt.body); rr.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.status, rr.Code, rr.Body)
+		}
+	}
+
+	if rr, _ := serve(handler, http.MethodGet, CheckPath); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, got %d", rr.Code)
+	}
+}
+
+func TestCheckHandler_Unauthenticated(t *testing.T) {
+	handler := middleware.BearerAuthMiddleware("secret")(CheckHandler(newAdminService(t)))
+	check := `{"key": "192.168.1.1", "dimension": "ip", "cost": 5}`
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, CheckPath, strings.NewReader(check))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 with %q, got %d", auth, rr.Code)
+		}
+	}
+
+	// Rejected callers didn't count against the key
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, CheckPath, strings.NewReader(check))
+	req.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"allowed":true`) {
+		t.Errorf("Expected an authenticated check to be allowed, got %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestCheckBatchHandler(t *testing.T) {
+	handler := CheckBatchHandler(newAdminService(t))
+
+	rr, body := post(handler, CheckBatchPath, `{"checks": [
+		{"key": "192.168.1.1", "dimension": "ip", "cost": 5},
+		{"key": "192.168.1.1", "dimension": "ip"},
+		{"key": "premium-token", "dimension": "token"},
+		{"key": "acme"}
+	]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	decisions, _ := body["decisions"].([]interface{})
+	if len(decisions) != 4 {
+		t.Fatalf("Expected 4 decisions, got %v", body)
+	}
+	expected := []struct {
+		allowed bool
+		error   interface{}
+	}{
+		{true, nil},
+		{false, "Rate limit exceeded"},
+		{true, nil},
+		{false, "invalid check: keys must name the rule whose limit applies"},
+	}
+	for i, want := range expected {
+		decision := decisions[i].(map[string]interface{})
+		if decision["allowed"] != want.allowed || decision["error"] != want.error {
+			t.Errorf("Decision %d: expected allowed %v with error %v, got %v", i, want.allowed, want.error, decision)
+		}
+	}
+
+	for _, batch := range []string{`{"checks": []}`, `{"checks": [` + strings.Repeat(`{"key": "a"},`, MaxBatchChecks) + `{"key": "a"}]}`} {
+		if rr, _ := post(handler, CheckBatchPath, batch); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for a batch of the wrong size, got %d", rr.Code)
+		}
+	}
+}
@@ -24,4 +24,29 @@ func TestHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ReloadHandler reloads the rate limiting policy on POST
+// The response lists the changes applied; an invalid policy is rejected with
+// 422 and the current limits stay in effect
+func ReloadHandler(reload func() ([]string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
 
+		changes, err := reload()
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		if changes == nil {
+			changes = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "reloaded",
+			"changes": changes,
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+var (
+	ErrAlgorithmNotSupported  = errors.New("algorithm not supported by storage")
+	ErrMultiLimitNotSupported = errors.New("several limits per request not supported by storage")
+)
+
+// Algorithm decides whether a request for a key is admitted under a limit
+// Implementations evaluate and record the request in a single atomic storage
+// operation
+type Algorithm interface {
+	// Name returns the configuration name of the algorithm
+	Name() string
+
+	// Allow evaluates the limit for key and records the request if allowed
+	Allow(ctx context.Context, key string, limit storage.Limit) (*storage.RateLimitResult, error)
+}
+
+// NewAlgorithm creates the algorithm registered under name, backed by store
+// Every algorithm other than the fixed window requires store to implement
+// storage.AlgorithmStorage
+func NewAlgorithm(name string, store storage.Storage) (Algorithm, error) {
+	if name == "" || name == config.AlgorithmFixedWindow {
+		return &fixedWindow{storage: store}, nil
+	}
+
+	if !config.IsValidAlgorithm(name) {
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q", name)
+	}
+
+	algorithmStorage, ok := store.(storage.AlgorithmStorage)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrAlgorithmNotSupported)
+	}
+
+	switch name {
+	case config.AlgorithmTokenBucket:
+		return &storageAlgorithm{name: name, allow: algorithmStorage.TokenBucket}, nil
+	case config.AlgorithmSlidingWindowLog:
+		return &storageAlgorithm{name: name, allow: algorithmStorage.SlidingWindowLog}, nil
+	case config.AlgorithmSlidingWindowCounter:
+		return &storageAlgorithm{name: name, allow: algorithmStorage.SlidingWindowCounter}, nil
+	default:
+		return &storageAlgorithm{name: name, allow: algorithmStorage.GCRA}, nil
+	}
+}
+
+// fixedWindow counts requests per window using Storage.CheckAndIncrement, so it
+// works with any storage
+type fixedWindow struct {
+	storage storage.Storage
+}
+
+func (a *fixedWindow) Name() string {
+	return config.AlgorithmFixedWindow
+}
+
+func (a *fixedWindow) Allow(ctx context.Context, key string, limit storage.Limit) (*storage.RateLimitResult, error) {
+	return a.storage.CheckAndIncrement(ctx, key, limit.MaxRequests, limit.Window, limit.BlockTime)
+}
+
+// storageAlgorithm delegates to one of the storage.AlgorithmStorage methods
+type storageAlgorithm struct {
+	name  string
+	allow func(ctx context.Context, key string, limit storage.Limit) (*storage.RateLimitResult, error)
+}
+
+func (a *storageAlgorithm) Name() string {
+	return a.name
+}
+
+func (a *storageAlgorithm) Allow(ctx context.Context, key string, limit storage.Limit) (*storage.RateLimitResult, error) {
+	return a.allow(ctx, key, limit)
+}
+
+// failedAlgorithm reports a construction error on every request, so a
+// misconfigured limiter fails loudly instead of silently admitting traffic
+type failedAlgorithm struct {
+	name string
+	err  error
+}
+
+func (a *failedAlgorithm) Name() string {
+	return a.name
+}
+
+func (a *failedAlgorithm) Allow(ctx context.Context, key string, limit storage.Limit) (*storage.RateLimitResult, error) {
+	return nil, a.err
+}
@@ -0,0 +1,245 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage/storagetest"
+)
+
+// algorithmBackends returns the storages every algorithm is exercised against
+// Redis is the server at REDIS_ADDR when set, otherwise an in-process one
+func algorithmBackends(t *testing.T) map[string]func(t *testing.T) storage.Storage {
+	backends := map[string]func(t *testing.T) storage.Storage{
+		"memory": func(t *testing.T) storage.Storage {
+			store := storage.NewMemoryStorage(0, 0)
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	}
+
+	backends["redis"] = func(t *testing.T) storage.Storage {
+		host, port := storagetest.RedisAddr(t)
+		store, err := storage.NewRedisStorage(host, port)
+		if err != nil {
+			t.Fatalf("Failed to connect to Redis: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+
+	return backends
+}
+
+// algorithmScenarios is the behavioral suite every algorithm must pass
+var algorithmScenarios = []struct {
+	name string
+	run  func(t *testing.T, algorithm Algorithm, store storage.Storage, key string)
+}{
+	{"AdmitsUpToLimit", testAlgorithmAdmitsUpToLimit},
+	{"RecoversAfterWindow", testAlgorithmRecoversAfterWindow},
+	{"BlocksAfterLimit", testAlgorithmBlocksAfterLimit},
+	{"SeparateKeys", testAlgorithmSeparateKeys},
+	{"ClearResetsState", testAlgorithmClearResetsState},
+	{"ConcurrentRequests", testAlgorithmConcurrentRequests},
+}
+
+func TestAlgorithms(t *testing.T) {
+	for backendName, newStore := range algorithmBackends(t) {
+		for _, name := range config.Algorithms {
+			for _, scenario := range algorithmScenarios {
+				t.Run(fmt.Sprintf("%s/%s/%s", backendName, name, scenario.name), func(t *testing.T) {
+					store := newStore(t)
+					algorithm, err := NewAlgorithm(name, store)
+					if err != nil {
+						t.Fatalf("Failed to create algorithm: %v", err)
+					}
+					if algorithm.Name() != name {
+						t.Errorf("Expected algorithm name %s, got %s", name, algorithm.Name())
+					}
+
+					key := fmt.Sprintf("test:%s:%s:%d", name, scenario.name, time.Now().UnixNano())
+					t.Cleanup(func() { store.Clear(context.Background(), key) })
+					scenario.run(t, algorithm, store, key)
+				})
+			}
+		}
+	}
+}
+
+func TestNewAlgorithm_Errors(t *testing.T) {
+	store := storage.NewMemoryStorage(0, 0)
+	defer store.Close()
+
+	if _, err := NewAlgorithm("leaky", store); err == nil {
+		t.Error("Expected error for unknown algorithm")
+	}
+
+	// The test mock only supports the fixed window
+	if _, err := NewAlgorithm(config.AlgorithmFixedWindow, newMockStorage()); err != nil {
+		t.Errorf("Fixed window should work with any storage, got: %v", err)
+	}
+	if _, err := NewAlgorithm(config.AlgorithmGCRA, newMockStorage()); err == nil {
+		t.Error("Expected ErrAlgorithmNotSupported for storage without algorithm support")
+	}
+}
+
+// allowN sends n requests and returns how many were admitted
+func allowN(t *testing.T, algorithm Algorithm, key string, limit storage.Limit, n int) int {
+	t.Helper()
+	allowed := 0
+	for i := 0; i < n; i++ {
+		result, err := algorithm.Allow(context.Background(), key, limit)
+		if err != nil {
+			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
+		}
+		if result.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func testAlgorithmAdmitsUpToLimit(t *testing.T, algorithm Algorithm, store storage.Storage, key string) {
+	limit := storage.Limit{MaxRequests: 5, Window: 1 * time.Minute}
+
+	for i := 0; i < 5; i++ {
+		result, err := algorithm.Allow(context.Background(), key, limit)
+		if err != nil {
+			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Request %d should be allowed", i+1)
+		}
+		if result.Count != i+1 {
+			t.Errorf("Request %d: expected count %d, got %d", i+1, i+1, result.Count)
+		}
+		if !result.ResetTime.After(time.Now()) {
+			t.Errorf("Request %d: reset time should be in the future, got %v", i+1, result.ResetTime)
+		}
+	}
+
+	result, err := algorithm.Allow(context.Background(), key, limit)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Request over the limit should be rejected")
+	}
+	if result.Blocked {
+		t.Error("Request should not be blocked without a blocking time")
+	}
+	if !result.ResetTime.After(time.Now()) {
+		t.Errorf("Reset time should be in the future, got %v", result.ResetTime)
+	}
+}
+
+func testAlgorithmRecoversAfterWindow(t *testing.T, algorithm Algorithm, store storage.Storage, key string) {
+	limit := storage.Limit{MaxRequests: 2, Window: 100 * time.Millisecond}
+
+	if allowed := allowN(t, algorithm, key, limit, 3); allowed != 2 {
+		t.Fatalf("Expected 2 allowed requests, got %d", allowed)
+	}
+
+	// Two full windows guarantee every algorithm has forgotten the burst
+	time.Sleep(2*limit.Window + 20*time.Millisecond)
+
+	if allowed := allowN(t, algorithm, key, limit, 2); allowed != 2 {
+		t.Errorf("Expected limit to be restored after the window, got %d allowed", allowed)
+	}
+}
+
+func testAlgorithmBlocksAfterLimit(t *testing.T, algorithm Algorithm, store storage.Storage, key string) {
+	limit := storage.Limit{MaxRequests: 1, Window: 50 * time.Millisecond, BlockTime: 1 * time.Minute}
+
+	if allowed := allowN(t, algorithm, key, limit, 1); allowed != 1 {
+		t.Fatal("First request should be allowed")
+	}
+
+	result, err := algorithm.Allow(context.Background(), key, limit)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Allowed || !result.Blocked {
+		t.Fatalf("Request over the limit should be blocked, got %+v", result)
+	}
+	if time.Until(result.ResetTime) < 59*time.Second {
+		t.Errorf("Reset time should be the end of the blocking period, got %v", result.ResetTime)
+	}
+
+	// The block outlives the window
+	time.Sleep(3 * limit.Window)
+	result, err = algorithm.Allow(context.Background(), key, limit)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Allowed || !result.Blocked {
+		t.Errorf("Request should still be blocked after the window, got %+v", result)
+	}
+}
+
+func testAlgorithmSeparateKeys(t *testing.T, algorithm Algorithm, store storage.Storage, key string) {
+	limit := storage.Limit{MaxRequests: 2, Window: 1 * time.Minute}
+	other := key + ":other"
+	t.Cleanup(func() { store.Clear(context.Background(), other) })
+
+	if allowed := allowN(t, algorithm, key, limit, 3); allowed != 2 {
+		t.Fatalf("Expected 2 allowed requests, got %d", allowed)
+	}
+	if allowed := allowN(t, algorithm, other, limit, 2); allowed != 2 {
+		t.Errorf("Other key should have its own limit, got %d allowed", allowed)
+	}
+}
+
+func testAlgorithmClearResetsState(t *testing.T, algorithm Algorithm, store storage.Storage, key string) {
+	limit := storage.Limit{MaxRequests: 2, Window: 1 * time.Minute, BlockTime: 1 * time.Minute}
+
+	if allowed := allowN(t, algorithm, key, limit, 3); allowed != 2 {
+		t.Fatalf("Expected 2 allowed requests, got %d", allowed)
+	}
+
+	if err := store.Clear(context.Background(), key); err != nil {
+		t.Fatalf("Failed to clear key: %v", err)
+	}
+
+	if allowed := allowN(t, algorithm, key, limit, 2); allowed != 2 {
+		t.Errorf("Expected limit to be restored after Clear, got %d allowed", allowed)
+	}
+}
+
+func testAlgorithmConcurrentRequests(t *testing.T, algorithm Algorithm, store storage.Storage, key string) {
+	limit := storage.Limit{MaxRequests: 10, Window: 1 * time.Minute}
+
+	const requests = 100
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	wg.Add(requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			defer wg.Done()
+			result, err := algorithm.Allow(context.Background(), key, limit)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if result.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != limit.MaxRequests {
+		t.Errorf("Expected exactly %d allowed requests, got %d", limit.MaxRequests, allowed)
+	}
+}
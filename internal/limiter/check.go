@@ -0,0 +1,221 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/pkg/ratelimit/api"
+)
+
+// ErrInvalidCheck is returned for a check request without a key, with an
+// unknown dimension or policy, or costing more than its limit ever admits
+var ErrInvalidCheck = api.ErrInvalidCheck
+
+// CheckRequest asks to count Cost requests of Key against a limit, for
+// callers that aren't HTTP requests, see api.CheckRequest
+type CheckRequest = api.CheckRequest
+
+// Check decides every request on its own, as if made by separate callers,
+// evaluating the whole batch in a single storage operation
+// When peek is set nothing is recorded: the decisions tell how the requests
+// would be judged and the quota remaining before them
+// Keys limited by a route rule share their count with the HTTP requests the
+// rule keys the same way. A decision and an error are returned per request,
+// as CheckDescriptors does
+func (s *Service) Check(ctx context.Context, requests []CheckRequest, peek bool) ([]Decision, []error) {
+	return s.policy.Load().check(ctx, requests, peek)
+}
+
+// check decides requests, applying the failure mode of their rule when the
+// storage fails
+func (p *policy) check(ctx context.Context, requests []CheckRequest, peek bool) ([]Decision, []error) {
+	decisions := make([]Decision, len(requests))
+	errs := make([]error, len(requests))
+
+	var checks []limitCheck
+	var costs, indexes []int
+	for i, request := range requests {
+		check, err := p.requestCheck(ctx, request)
+		switch {
+		case err != nil:
+			errs[i] = err
+		case check.limiter == nil:
+			decisions[i] = Decision{Allowed: true}
+		default:
+			cost := max(request.Cost, 1)
+			if capacity, _ := check.limiter.capacity(); cost > capacity {
+				errs[i] = fmt.Errorf("%w: a cost of %d exceeds the limit of %d", ErrInvalidCheck, cost, capacity)
+				continue
+			}
+			checks = append(checks, check)
+			costs = append(costs, cost)
+			indexes = append(indexes, i)
+		}
+	}
+
+	results, err := evaluateEach(ctx, checks, costs, peek)
+	for j, i := range indexes {
+		if err != nil {
+			decisions[i], errs[i] = p.failWith(p.checkFailureMode(requests[i].Policy), err, func(fallback *policy) (Decision, error) {
+				decisions, errs := fallback.check(ctx, requests[i:i+1], peek)
+				return decisions[0], errs[0]
+			})
+			continue
+		}
+		decisions[i], errs[i] = checks[j].checkDecision(results[j], costs[j], peek)
+	}
+	return decisions, errs
+}
+
+// requestCheck returns the limit a check request is counted against; the
+// limiter is nil when no limit applies
+func (p *policy) requestCheck(ctx context.Context, request CheckRequest) (limitCheck, error) {
+	if request.Key == "" {
+		return limitCheck{}, fmt.Errorf("%w: a key is required", ErrInvalidCheck)
+	}
+	if request.Cost < 0 {
+		return limitCheck{}, fmt.Errorf("%w: the cost must not be negative", ErrInvalidCheck)
+	}
+
+	var ip, token string
+	dimension := request.Dimension
+	switch dimension {
+	case DimensionIP:
+		ip = request.Key
+	case DimensionToken:
+		token = request.Key
+	case "", DimensionKey:
+		dimension = DimensionKey
+	default:
+		return limitCheck{}, fmt.Errorf("%w: unknown dimension %q", ErrInvalidCheck, request.Dimension)
+	}
+	if p.isDenied(ip, token) {
+		return limitCheck{}, ErrAccessDenied
+	}
+	if p.isAllowListed(ip, token) {
+		return limitCheck{}, nil
+	}
+
+	// Keys are hashed like the keys route rules extract from requests
+	key := p.tokenKey(request.Key)
+	var resolved *resolvedToken
+	switch dimension {
+	case DimensionIP:
+		if !p.config.EnableIPRateLimiter {
+			return limitCheck{}, nil
+		}
+		key = p.ipKey(ip)
+	case DimensionToken:
+		if !p.config.EnableTokenRateLimiter {
+			return limitCheck{}, nil
+		}
+		var err error
+		if resolved, err = p.resolveToken(ctx, token); err != nil {
+			return limitCheck{}, err
+		}
+		if resolved == nil {
+			// Only registered tokens are counted when a registry is used
+			return limitCheck{}, ErrInvalidToken
+		}
+		key = resolved.key
+	}
+
+	name := request.Policy
+	rl, dl := p.namedRoute(name), p.namedDescriptor(name)
+	switch {
+	case rl != nil && rl.rule.Exempt:
+		return limitCheck{}, nil
+	case rl != nil && !rl.rule.AppliesDefaultLimits():
+		return limitCheck{limiter: rl.limiter, key: "route:" + name + ":" + key, policy: name, dimension: dimension}, nil
+	case rl == nil && dl != nil:
+		return limitCheck{limiter: dl.limiter, key: "check:" + url.QueryEscape(name) + ":" + key, policy: name, dimension: dimension}, nil
+	case rl == nil && name != "" && name != PolicyDefault:
+		return limitCheck{}, fmt.Errorf("%w: no route or descriptor rule is named %q", ErrInvalidCheck, name)
+	}
+
+	switch dimension {
+	case DimensionIP:
+		return limitCheck{limiter: p.ipLimiter, key: key, policy: PolicyDefault, dimension: dimension}, nil
+	case DimensionToken:
+		return limitCheck{limiter: resolved.limiter, key: key, policy: resolved.policy, dimension: dimension}, nil
+	default:
+		return limitCheck{}, fmt.Errorf("%w: keys must name the rule whose limit applies", ErrInvalidCheck)
+	}
+}
+
+// namedRoute returns the route limiter of the rule named name, if any
+func (p *policy) namedRoute(name string) *routeLimiter {
+	for i := range p.routes {
+		if p.routes[i].rule.Name == name {
+			return &p.routes[i]
+		}
+	}
+	return nil
+}
+
+// namedDescriptor returns the descriptor limiter of the rule named name, if
+// any
+func (p *policy) namedDescriptor(name string) *descriptorLimiter {
+	for i := range p.descriptors {
+		if p.descriptors[i].rule.Name == name {
+			return &p.descriptors[i]
+		}
+	}
+	return nil
+}
+
+// checkFailureMode returns the failure mode of a check request naming the
+// rule policyName
+func (p *policy) checkFailureMode(policyName string) string {
+	if rl := p.namedRoute(policyName); rl != nil && rl.rule.FailureMode != "" {
+		return rl.rule.FailureMode
+	}
+	return p.config.FailureMode
+}
+
+// evaluateEach evaluates checks as separate requests of cost requests each,
+// in a single storage operation; they are recorded unless peek is set
+func evaluateEach(ctx context.Context, checks []limitCheck, costs []int, peek bool) ([]*storage.RateLimitResult, error) {
+	if len(checks) == 0 {
+		return nil, nil
+	}
+	multi, ok := checks[0].limiter.storage.(storage.MultiStorage)
+	if !ok {
+		return nil, fmt.Errorf("batch checks: %w", ErrAlgorithmNotSupported)
+	}
+
+	storageChecks := make([]storage.Check, len(checks))
+	for i, check := range checks {
+		storageChecks[i] = storage.Check{
+			Key:       check.key,
+			Algorithm: check.limiter.algorithm.Name(),
+			Limit:     check.limiter.Limit(),
+			Cost:      costs[i],
+		}
+	}
+	if peek {
+		return multi.PeekEach(ctx, storageChecks)
+	}
+	return multi.CheckEach(ctx, storageChecks)
+}
+
+// checkDecision reports the result of a check request costing cost
+// requests; a rejected request reports the quota it didn't fit in
+func (c limitCheck) checkDecision(result *storage.RateLimitResult, cost int, peek bool) (Decision, error) {
+	decision := c.limiter.decision(result)
+	decision.Policy, decision.Dimension = c.policy, c.dimension
+	switch {
+	case !result.Allowed && !result.Blocked && result.Count < decision.Limit:
+		decision.Remaining = decision.Limit - result.Count
+	case result.Allowed && peek:
+		// The result counts the requests that were only evaluated
+		decision.Remaining = min(decision.Remaining+cost, decision.Limit)
+	}
+
+	if !decision.Allowed {
+		return decision, ErrLimitExceeded
+	}
+	return decision, nil
+}
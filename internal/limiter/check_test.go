@@ -0,0 +1,133 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func TestService_Check(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage(0, time.Minute)
+	defer store.Close()
+
+	service := NewService(store, &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        time.Minute,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenLimits: map[string]config.TokenLimit{
+			"premium-token": {MaxRequests: 100},
+		},
+		Routes: []config.RouteRule{
+			{Name: "exports", Pattern: "/exports/", Limit: config.TokenLimit{MaxRequests: 10}, Key: &config.KeySource{Type: config.KeyHeader, Name: "X-Tenant"}},
+		},
+		Descriptors: []config.DescriptorRule{
+			{Name: "emails", Entries: []config.DescriptorEntry{{Key: "tenant"}}, Limit: config.TokenLimit{MaxRequests: 3}},
+		},
+	})
+
+	decisions, errs := service.Check(ctx, []CheckRequest{
+		{Key: "acme", Policy: "exports", Cost: 4},
+		{Key: "acme", Policy: "emails"},
+		{Key: "192.0.2.1", Dimension: DimensionIP},
+		{Key: "premium-token", Dimension: DimensionToken},
+	}, false)
+	for i, err := range errs {
+		if err != nil || !decisions[i].Allowed {
+			t.Fatalf("Expected check %d to be allowed, got %+v, %v", i, decisions[i], err)
+		}
+	}
+	if decisions[0].Policy != "exports" || decisions[0].Dimension != DimensionKey || decisions[0].Remaining != 6 {
+		t.Errorf("Expected 6 requests left on the exports rule, got %+v", decisions[0])
+	}
+	if decisions[1].Policy != "emails" || decisions[1].Remaining != 2 {
+		t.Errorf("Expected 2 requests left on the emails rule, got %+v", decisions[1])
+	}
+	if decisions[2].Policy != PolicyDefault || decisions[2].Remaining != 4 {
+		t.Errorf("Expected the default IP limit, got %+v", decisions[2])
+	}
+	if decisions[3].Policy != PolicyToken || decisions[3].Limit != 100 {
+		t.Errorf("Expected the premium token limit, got %+v", decisions[3])
+	}
+
+	// Keys of a route rule share their count with its HTTP requests
+	route := service.MatchRoute("GET", "", "/exports/1")
+	if decision, _ := route.CheckAndIncrement(ctx, "192.0.2.1", "acme"); decision.Remaining != 5 {
+		t.Errorf("Expected the HTTP request to count against the key, got %+v", decision)
+	}
+
+	// Peeking reports the quota left without consuming it
+	for i := 0; i < 2; i++ {
+		decisions, errs = service.Check(ctx, []CheckRequest{{Key: "acme", Policy: "exports", Cost: 5}}, true)
+		if errs[0] != nil || !decisions[0].Allowed || decisions[0].Remaining != 5 {
+			t.Errorf("Peek %d: expected 5 requests left, got %+v, %v", i, decisions[0], errs[0])
+		}
+	}
+
+	// Each check of a batch is decided on its own
+	decisions, errs = service.Check(ctx, []CheckRequest{
+		{Key: "acme", Policy: "exports", Cost: 4},
+		{Key: "acme", Policy: "exports", Cost: 4},
+		{Key: "acme", Policy: "exports", Cost: 1},
+	}, false)
+	if errs[0] != nil || !errors.Is(errs[1], ErrLimitExceeded) || errs[2] != nil {
+		t.Errorf("Expected only the second check to be limited, got %v", errs)
+	}
+	if decisions[1].Remaining != 1 {
+		t.Errorf("Expected the limited check to report the request left, got %+v", decisions[1])
+	}
+
+	_, errs = service.Check(ctx, []CheckRequest{
+		{Key: ""},
+		{Key: "acme"},
+		{Key: "acme", Policy: "unknown"},
+		{Key: "acme", Dimension: "tenant", Policy: "exports"},
+		{Key: "acme", Policy: "emails", Cost: 4},
+		{Key: "acme", Policy: "emails", Cost: -1},
+	}, false)
+	for i, err := range errs {
+		if !errors.Is(err, ErrInvalidCheck) {
+			t.Errorf("Expected check %d to be invalid, got %v", i, err)
+		}
+	}
+}
+
+func TestService_Check_FailureMode(t *testing.T) {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	defer store.Close()
+	failing := storage.Intercept(store, func(operation string, call func() error) error {
+		return errors.New("connection refused")
+	})
+	cfg := &config.Config{
+		MaxRequestsPerSecond: 1,
+		RateLimitWindow:      time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		FailureMode:          config.FailureModeClosed,
+		Routes: []config.RouteRule{
+			{Name: "jobs", Pattern: "/jobs", Limit: config.TokenLimit{MaxRequests: 1}, FailureMode: config.FailureModeOpen},
+		},
+	}
+	ip := CheckRequest{Key: "192.0.2.1", Dimension: DimensionIP}
+	job := CheckRequest{Key: "nightly", Policy: "jobs"}
+
+	decisions, errs := NewService(failing, cfg).Check(context.Background(), []CheckRequest{ip, job}, false)
+	if !errors.Is(errs[0], ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable when failing closed, got %v", errs[0])
+	}
+	if errs[1] != nil || !decisions[1].Allowed || !decisions[1].Degraded {
+		t.Errorf("Expected the rule failing open to allow the job, got %+v, %v", decisions[1], errs[1])
+	}
+
+	cfg.FailureMode = config.FailureModeLocal
+	decisions, errs = NewService(failing, cfg).Check(context.Background(), []CheckRequest{ip, ip}, false)
+	if errs[0] != nil || !decisions[0].Degraded || !errors.Is(errs[1], ErrLimitExceeded) {
+		t.Errorf("Expected the local limits to apply, got %+v, %v", decisions, errs)
+	}
+}
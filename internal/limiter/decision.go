@@ -0,0 +1,23 @@
+package limiter
+
+import (
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/pkg/ratelimit/api"
+)
+
+// Policy names reported in decisions
+const (
+	PolicyDefault = "default"
+	PolicyToken   = "token"
+	PolicyTokenIP = "token_ip" // the per-IP ceiling of a token
+)
+
+// Dimensions a decision's limit counts requests by
+const (
+	DimensionIP    = api.DimensionIP
+	DimensionToken = api.DimensionToken
+	DimensionKey   = api.DimensionKey // any key of the caller's, see Service.Check
+)
+
+// Decision is the outcome of checking a request against a rate limit, see
+// api.Decision
+type Decision = api.Decision
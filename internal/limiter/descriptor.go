@@ -0,0 +1,121 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+// descriptorLimiter is a compiled descriptor rule
+type descriptorLimiter struct {
+	rule    *config.DescriptorRule
+	limiter *RateLimiter
+}
+
+// CheckDescriptors checks and records a request against each of the Envoy
+// rate limit descriptors Envoy sent for it in domain, returning a decision
+// and an error per descriptor, as Route.CheckAndIncrement does for HTTP
+// requests; as with Envoy's own service, every descriptor is counted
+// whether or not the others admit the request
+// A descriptor is limited by the first descriptor rule it matches; one made
+// of a remote_address entry alone falls back to the default IP limit, and
+// any other is not limited. The deny and allow lists apply to the
+// remote_address entry
+// hits[i] is the number of requests descriptor i counts, Envoy's
+// hits_addend; it is one when zero or missing
+func (s *Service) CheckDescriptors(ctx context.Context, domain string, descriptors [][]config.DescriptorEntry, hits []int) ([]Decision, []error) {
+	p := s.policy.Load()
+	decisions := make([]Decision, len(descriptors))
+	errs := make([]error, len(descriptors))
+	for i, entries := range descriptors {
+		cost := 1
+		if i < len(hits) {
+			cost = max(hits[i], 1)
+		}
+		decisions[i], errs[i] = p.checkDescriptor(ctx, domain, entries, cost)
+	}
+	return decisions, errs
+}
+
+// checkDescriptor decides a descriptor, falling back to the failure mode
+// when the storage fails
+func (p *policy) checkDescriptor(ctx context.Context, domain string, entries []config.DescriptorEntry, cost int) (Decision, error) {
+	decision, err := p.decideDescriptor(ctx, domain, entries, cost)
+	switch {
+	case err == nil, errors.Is(err, ErrLimitExceeded), errors.Is(err, ErrAccessDenied):
+		return decision, err
+	default:
+		return p.failWith(p.config.FailureMode, err, func(fallback *policy) (Decision, error) {
+			return fallback.decideDescriptor(ctx, domain, entries, cost)
+		})
+	}
+}
+
+// decideDescriptor checks and records cost requests of a descriptor
+func (p *policy) decideDescriptor(ctx context.Context, domain string, entries []config.DescriptorEntry, cost int) (Decision, error) {
+	ip, hasIP := remoteAddress(entries)
+	if hasIP {
+		if p.isDenied(ip, "") {
+			return Decision{}, ErrAccessDenied
+		}
+		if p.isAllowListed(ip, "") {
+			return Decision{Allowed: true}, nil
+		}
+	}
+
+	for i := range p.descriptors {
+		dl := &p.descriptors[i]
+		if dl.rule.Matches(domain, entries) {
+			return decideCost(ctx, limitCheck{limiter: dl.limiter, key: p.descriptorKey(dl.rule, entries), policy: dl.rule.Name}, cost)
+		}
+	}
+
+	if hasIP && len(entries) == 1 && p.config.EnableIPRateLimiter {
+		return decideCost(ctx, limitCheck{limiter: p.ipLimiter, key: p.ipKey(ip), policy: PolicyDefault, dimension: DimensionIP}, cost)
+	}
+	return Decision{Allowed: true}, nil
+}
+
+// decideCost checks and records cost requests against check, as a single
+// request when cost is one
+func decideCost(ctx context.Context, check limitCheck, cost int) (Decision, error) {
+	if cost <= 1 {
+		return decideAll(ctx, []limitCheck{check})
+	}
+	results, err := evaluateEach(ctx, []limitCheck{check}, []int{cost}, false)
+	if err != nil {
+		return Decision{}, err
+	}
+	return check.checkDecision(results[0], cost, false)
+}
+
+// descriptorKey returns the storage key of a descriptor matching rule: the
+// rule's name followed by the descriptor's entries, with the client IP
+// aggregated like the IP limit's
+// Other values, e.g. user IDs or API keys taken from request headers, are
+// hashed like tokens
+func (p *policy) descriptorKey(rule *config.DescriptorRule, entries []config.DescriptorEntry) string {
+	var key strings.Builder
+	key.WriteString("rls:" + url.QueryEscape(rule.Name))
+	for _, entry := range entries {
+		value := p.hashValue(entry.Value)
+		if entry.Key == config.RemoteAddressKey {
+			value = url.QueryEscape(NormalizeIP(entry.Value, p.config.IPv4PrefixLength, p.config.IPv6PrefixLength))
+		}
+		key.WriteString(":" + url.QueryEscape(entry.Key) + "=" + value)
+	}
+	return key.String()
+}
+
+// remoteAddress returns the value of the remote_address entry, if any
+func remoteAddress(entries []config.DescriptorEntry) (string, bool) {
+	for _, entry := range entries {
+		if entry.Key == config.RemoteAddressKey {
+			return entry.Value, true
+		}
+	}
+	return "", false
+}
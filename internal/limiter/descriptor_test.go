@@ -0,0 +1,132 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func TestService_CheckDescriptors(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage(0, time.Minute)
+	defer store.Close()
+	_, denied, _ := net.ParseCIDR("203.0.113.0/24")
+
+	service := NewService(store, &config.Config{
+		MaxRequestsPerSecond: 2,
+		RateLimitWindow:      time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		DenyIPs:              []*net.IPNet{denied},
+		Descriptors: []config.DescriptorRule{
+			{
+				Name:    "login",
+				Domain:  "edge",
+				Entries: []config.DescriptorEntry{{Key: "header_match", Value: "login"}, {Key: config.RemoteAddressKey}},
+				Limit:   config.TokenLimit{MaxRequests: 1},
+			},
+			{
+				Name:    "per-user",
+				Entries: []config.DescriptorEntry{{Key: "user_id"}},
+				Limit:   config.TokenLimit{MaxRequests: 3},
+			},
+		},
+	})
+
+	login := func(ip string) []config.DescriptorEntry {
+		return []config.DescriptorEntry{{Key: "header_match", Value: "login"}, {Key: config.RemoteAddressKey, Value: ip}}
+	}
+	user := []config.DescriptorEntry{{Key: "user_id", Value: "alice"}}
+	remote := []config.DescriptorEntry{{Key: config.RemoteAddressKey, Value: "192.0.2.1"}}
+	unknown := []config.DescriptorEntry{{Key: "generic_key", Value: "anything"}}
+
+	decisions, errs := service.CheckDescriptors(ctx, "edge", [][]config.DescriptorEntry{login("192.0.2.1"), user, remote, unknown}, nil)
+	for i, err := range errs {
+		if err != nil || !decisions[i].Allowed {
+			t.Fatalf("Expected descriptor %d to be allowed, got %+v, %v", i, decisions[i], err)
+		}
+	}
+	if decisions[0].Policy != "login" || decisions[0].Limit != 1 {
+		t.Errorf("Expected the login rule, got %+v", decisions[0])
+	}
+	if decisions[1].Policy != "per-user" || decisions[1].Remaining != 2 {
+		t.Errorf("Expected the per-user rule with 2 requests remaining, got %+v", decisions[1])
+	}
+	if decisions[2].Policy != PolicyDefault || decisions[2].Dimension != DimensionIP || decisions[2].Limit != 2 {
+		t.Errorf("Expected a remote_address descriptor to use the default IP limit, got %+v", decisions[2])
+	}
+	if decisions[3].Limit != 0 {
+		t.Errorf("Expected an unknown descriptor not to be limited, got %+v", decisions[3])
+	}
+
+	// Each descriptor is counted on its own
+	decisions, errs = service.CheckDescriptors(ctx, "edge", [][]config.DescriptorEntry{login("192.0.2.1"), login("192.0.2.2"), user}, nil)
+	if !errors.Is(errs[0], ErrLimitExceeded) || decisions[0].Allowed {
+		t.Errorf("Expected the second login of 192.0.2.1 to be limited, got %+v, %v", decisions[0], errs[0])
+	}
+	if errs[1] != nil || errs[2] != nil {
+		t.Errorf("Expected the other descriptors to be allowed, got %v and %v", errs[1], errs[2])
+	}
+
+	// Rules only match their domain
+	decisions, _ = service.CheckDescriptors(ctx, "internal", [][]config.DescriptorEntry{login("192.0.2.1")}, nil)
+	if !decisions[0].Allowed || decisions[0].Limit != 0 {
+		t.Errorf("Expected the login rule not to apply in another domain, got %+v", decisions[0])
+	}
+
+	_, errs = service.CheckDescriptors(ctx, "edge", [][]config.DescriptorEntry{login("203.0.113.7")}, nil)
+	if !errors.Is(errs[0], ErrAccessDenied) {
+		t.Errorf("Expected a denied IP to be rejected, got %v", errs[0])
+	}
+
+	// Values are stored hashed, except for the client IP
+	keys, err := store.Keys(ctx, "rls:*")
+	if err != nil || len(keys) == 0 {
+		t.Fatalf("Expected descriptor keys, got %v, %v", keys, err)
+	}
+	for _, key := range keys {
+		if strings.Contains(key, "alice") || strings.Contains(key, "=login") {
+			t.Errorf("Expected descriptor values to be hashed, got %s", key)
+		}
+		if strings.HasPrefix(key, "rls:login:") && !strings.Contains(key, ":remote_address=192.0.2.") {
+			t.Errorf("Expected the client IP in the clear, got %s", key)
+		}
+	}
+}
+
+func TestService_CheckDescriptors_FailureMode(t *testing.T) {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	defer store.Close()
+	failing := storage.Intercept(store, func(operation string, call func() error) error {
+		return errors.New("connection refused")
+	})
+	cfg := &config.Config{
+		MaxRequestsPerSecond: 1,
+		RateLimitWindow:      time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		FailureMode:          config.FailureModeClosed,
+		Descriptors: []config.DescriptorRule{
+			{Name: "per-user", Entries: []config.DescriptorEntry{{Key: "user_id"}}, Limit: config.TokenLimit{MaxRequests: 1}},
+		},
+	}
+	user := []config.DescriptorEntry{{Key: "user_id", Value: "alice"}}
+
+	_, errs := NewService(failing, cfg).CheckDescriptors(context.Background(), "edge", [][]config.DescriptorEntry{user}, nil)
+	if !errors.Is(errs[0], ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable when failing closed, got %v", errs[0])
+	}
+
+	cfg.FailureMode = config.FailureModeLocal
+	service := NewService(failing, cfg)
+	decisions, errs := service.CheckDescriptors(context.Background(), "edge", [][]config.DescriptorEntry{user, user}, nil)
+	if errs[0] != nil || !decisions[0].Degraded || !errors.Is(errs[1], ErrLimitExceeded) {
+		t.Errorf("Expected the local limits to apply, got %+v, %v", decisions, errs)
+	}
+}
@@ -0,0 +1,354 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+// ErrInvalidSubject is returned for a subject that doesn't name exactly one
+// client, or one the current policy doesn't limit
+var ErrInvalidSubject = errors.New("invalid subject")
+
+// Subject names the client whose limiter state is inspected or reset: an IP,
+// a token, the ID of a registered token or a raw storage key
+// Exactly one of the fields must be set; a raw Key can only be inspected when
+// the policy tells which limit it is counted against
+type Subject struct {
+	IP      string
+	Token   string
+	TokenID string
+	Key     string
+}
+
+// String describes the subject without its secrets
+func (s Subject) String() string {
+	switch {
+	case s.IP != "":
+		return "ip " + s.IP
+	case s.Token != "":
+		return "token " + config.RedactToken(s.Token)
+	case s.TokenID != "":
+		return "token id " + s.TokenID
+	default:
+		return "key " + s.Key
+	}
+}
+
+// KeyState is the state of a client's limit in storage
+// Remaining requests are left until ResetTime; a blocked key is rejected
+// until ResetTime whatever its count
+type KeyState struct {
+	Key       string
+	Policy    string
+	Limit     int
+	Remaining int
+	Window    time.Duration
+	ResetTime time.Time
+	Blocked   bool
+}
+
+// BlockedKey is a key rejected until ResetTime
+type BlockedKey struct {
+	Key       string
+	ResetTime time.Time
+}
+
+// Inspect reports the state of the subject's own limit without counting a
+// request: the IP limit of an IP and the token limit of a token
+func (s *Service) Inspect(ctx context.Context, subject Subject) (KeyState, error) {
+	p := s.policy.Load()
+	check, err := p.subjectCheck(ctx, subject)
+	if err != nil {
+		return KeyState{}, err
+	}
+	if check.limiter == nil {
+		return KeyState{}, fmt.Errorf("%w: no limit of the policy applies to key %s", ErrInvalidSubject, subject.Key)
+	}
+	return check.peek(ctx)
+}
+
+// Reset clears the counters and any block of the subject's key, returning the
+// key cleared
+func (s *Service) Reset(ctx context.Context, subject Subject) (string, error) {
+	check, err := s.policy.Load().subjectCheck(ctx, subject)
+	if err != nil {
+		return "", err
+	}
+	if err := s.storage.Clear(ctx, check.key); err != nil {
+		return "", err
+	}
+	return check.key, nil
+}
+
+// Block rejects every request counted against the subject's key for d,
+// returning the key blocked
+func (s *Service) Block(ctx context.Context, subject Subject, d time.Duration) (string, error) {
+	if d <= 0 {
+		return "", fmt.Errorf("invalid block duration %v", d)
+	}
+	check, err := s.policy.Load().subjectCheck(ctx, subject)
+	if err != nil {
+		return "", err
+	}
+	if err := s.storage.Set(ctx, storage.BlockKey(check.key), 1, d); err != nil {
+		return "", err
+	}
+	return check.key, nil
+}
+
+// Unblock lifts the block of the subject's key, keeping its counters, and
+// returns the key unblocked
+func (s *Service) Unblock(ctx context.Context, subject Subject) (string, error) {
+	check, err := s.policy.Load().subjectCheck(ctx, subject)
+	if err != nil {
+		return "", err
+	}
+	if err := s.storage.Clear(ctx, storage.BlockKey(check.key)); err != nil {
+		return "", err
+	}
+	return check.key, nil
+}
+
+// BlockedKeys lists the keys currently blocked, whether by exceeding their
+// limit or by Block, sorted by key
+func (s *Service) BlockedKeys(ctx context.Context) ([]BlockedKey, error) {
+	blockKeys, err := s.storage.Keys(ctx, storage.BlockKey("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := make([]BlockedKey, 0, len(blockKeys))
+	for _, blockKey := range blockKeys {
+		key, ok := storage.BlockedKey(blockKey)
+		if !ok {
+			continue
+		}
+		info, err := s.storage.Get(ctx, blockKey)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			// The block ended while listing
+			continue
+		}
+		blocked = append(blocked, BlockedKey{Key: key, ResetTime: info.ResetTime})
+	}
+	slices.SortFunc(blocked, func(a, b BlockedKey) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return blocked, nil
+}
+
+// TopConsumers reports the n keys that used the most of their limit, blocked
+// keys first; n <= 0 reports every key in use
+// Every key in storage is enumerated, so this is meant for occasional
+// inspection rather than monitoring
+func (s *Service) TopConsumers(ctx context.Context, n int) ([]KeyState, error) {
+	p := s.policy.Load()
+	keys, err := s.storage.Keys(ctx, "*")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(keys))
+	var states []KeyState
+	for _, key := range keys {
+		key = storage.OwnerKey(key)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		check, ok := p.keyCheck(ctx, key)
+		if !ok {
+			continue
+		}
+		state, err := check.peek(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if state.Blocked || state.Remaining < state.Limit {
+			states = append(states, state)
+		}
+	}
+
+	slices.SortFunc(states, func(a, b KeyState) int {
+		switch {
+		case a.Blocked != b.Blocked:
+			if a.Blocked {
+				return -1
+			}
+			return 1
+		case a.Limit-a.Remaining != b.Limit-b.Remaining:
+			return (b.Limit - b.Remaining) - (a.Limit - a.Remaining)
+		default:
+			return strings.Compare(a.Key, b.Key)
+		}
+	})
+	if n > 0 && len(states) > n {
+		states = states[:n]
+	}
+	return states, nil
+}
+
+// subjectCheck returns the limit subject is counted against and its key; the
+// limiter is nil for a raw key no limit of the policy applies to
+func (p *policy) subjectCheck(ctx context.Context, subject Subject) (limitCheck, error) {
+	set := 0
+	for _, field := range []string{subject.IP, subject.Token, subject.TokenID, subject.Key} {
+		if field != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return limitCheck{}, fmt.Errorf("%w: exactly one of ip, token, token id or key is required", ErrInvalidSubject)
+	}
+
+	switch {
+	case subject.IP != "":
+		if !p.config.EnableIPRateLimiter {
+			return limitCheck{}, fmt.Errorf("%w: the IP rate limiter is disabled", ErrInvalidSubject)
+		}
+		return limitCheck{limiter: p.ipLimiter, key: p.ipKey(subject.IP), policy: PolicyDefault}, nil
+
+	case subject.Token != "":
+		if !p.config.EnableTokenRateLimiter {
+			return limitCheck{}, fmt.Errorf("%w: the token rate limiter is disabled", ErrInvalidSubject)
+		}
+		resolved, err := p.resolveToken(ctx, subject.Token)
+		if err != nil {
+			return limitCheck{}, err
+		}
+		if resolved == nil {
+			// Only registered tokens are counted when a registry is used
+			return limitCheck{}, ErrInvalidToken
+		}
+		return limitCheck{limiter: resolved.limiter, key: resolved.key, policy: resolved.policy}, nil
+
+	case subject.TokenID != "":
+		if p.registry == nil {
+			return limitCheck{}, fmt.Errorf("%w: no token registry is configured", ErrInvalidSubject)
+		}
+		record, err := p.registry.Get(ctx, subject.TokenID)
+		if err != nil {
+			return limitCheck{}, err
+		}
+		resolved := p.registered(record)
+		return limitCheck{limiter: resolved.limiter, key: resolved.key, policy: resolved.policy}, nil
+
+	default:
+		if check, ok := p.keyCheck(ctx, subject.Key); ok {
+			return check, nil
+		}
+		return limitCheck{key: subject.Key}, nil
+	}
+}
+
+// keyCheck returns the limit a storage key is counted against: route keys
+// by their rule, IP keys by the IP limit and token keys by the token's limit,
+// registered tokens being looked up by ID
+// Tokens declared by digest can't be told from their key, so they are
+// reported under the default token limit
+func (p *policy) keyCheck(ctx context.Context, key string) (limitCheck, bool) {
+	if rest, ok := strings.CutPrefix(key, "route:"); ok {
+		for i := range p.routes {
+			if rl := &p.routes[i]; strings.HasPrefix(rest, rl.rule.Name+":") {
+				return limitCheck{limiter: rl.limiter, key: key, policy: rl.rule.Name}, true
+			}
+		}
+		return limitCheck{}, false
+	}
+	if strings.HasPrefix(key, "ip:") {
+		return limitCheck{limiter: p.ipLimiter, key: key, policy: PolicyDefault}, true
+	}
+	if !strings.HasPrefix(key, "token:") {
+		return limitCheck{}, false
+	}
+
+	// The per-IP ceiling of a token is counted under the token key and the IP key
+	tokenKey, _, ceiling := strings.Cut(key, ":ip:")
+	tl, policyName := p.tokenKeyLimiter(ctx, tokenKey)
+	if ceiling {
+		if tl.ceiling == nil {
+			return limitCheck{}, false
+		}
+		return limitCheck{limiter: tl.ceiling, key: key, policy: PolicyTokenIP}, true
+	}
+	return limitCheck{limiter: tl.limiter, key: key, policy: policyName}, true
+}
+
+// tokenKeyLimiter returns the limits of the token stored under key
+func (p *policy) tokenKeyLimiter(ctx context.Context, key string) (tokenLimiter, string) {
+	if id, ok := strings.CutPrefix(key, "token:id:"); ok && p.registry != nil {
+		if record, err := p.registry.Get(ctx, id); err == nil {
+			resolved := p.registered(record)
+			return resolved.tokenLimiter, resolved.policy
+		}
+	}
+	for token, tl := range p.tokens {
+		if p.tokenKey(token) == key {
+			return tl, PolicyToken
+		}
+	}
+	return tokenLimiter{limiter: p.tokenLimiter}, PolicyDefault
+}
+
+// peek evaluates the check without counting a request
+// Storages implementing storage.MultiStorage evaluate any algorithm; others
+// only support the fixed window, read from the counter
+func (c limitCheck) peek(ctx context.Context) (KeyState, error) {
+	store := c.limiter.storage
+	state := KeyState{Key: c.key, Policy: c.policy}
+
+	if multi, ok := store.(storage.MultiStorage); ok {
+		results, err := multi.PeekAll(ctx, []storage.Check{{
+			Key:       c.key,
+			Algorithm: c.limiter.algorithm.Name(),
+			Limit:     c.limiter.Limit(),
+		}})
+		if err != nil {
+			return KeyState{}, err
+		}
+		decision := c.limiter.decision(results[0])
+		state.Limit, state.Window, state.ResetTime = decision.Limit, decision.Window, decision.ResetTime
+		state.Blocked = results[0].Blocked
+		if decision.Allowed {
+			// The result counts the request that was only evaluated
+			state.Remaining = min(decision.Remaining+1, decision.Limit)
+		}
+		return state, nil
+	}
+
+	if name := c.limiter.algorithm.Name(); name != config.AlgorithmFixedWindow {
+		return KeyState{}, fmt.Errorf("inspecting %s: %w", name, ErrAlgorithmNotSupported)
+	}
+	limit := c.limiter.Limit()
+	state.Limit, state.Window, state.Remaining = limit.MaxRequests, limit.Window, limit.MaxRequests
+	state.ResetTime = time.Now().Add(limit.Window)
+
+	block, err := store.Get(ctx, storage.BlockKey(c.key))
+	if err != nil {
+		return KeyState{}, err
+	}
+	if block != nil {
+		state.Blocked, state.Remaining, state.ResetTime = true, 0, block.ResetTime
+		return state, nil
+	}
+
+	info, err := store.Get(ctx, c.key)
+	if err != nil {
+		return KeyState{}, err
+	}
+	if info != nil && info.ResetTime.After(time.Now()) {
+		state.Remaining = max(limit.MaxRequests-info.Count, 0)
+		state.ResetTime = info.ResetTime
+	}
+	return state, nil
+}
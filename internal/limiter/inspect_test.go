@@ -0,0 +1,186 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func newInspectService(t *testing.T, algorithm string) *Service {
+	store := storage.NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	return NewService(store, &config.Config{
+		MaxRequestsPerSecond:   3,
+		RateLimitWindow:        1 * time.Minute,
+		BlockingTime:           1 * time.Minute,
+		RateLimitAlgorithm:     algorithm,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeFallback,
+		TokenLimits: map[string]config.TokenLimit{
+			"premium": {MaxRequests: 10},
+		},
+	})
+}
+
+func TestService_Inspect(t *testing.T) {
+	ctx := context.Background()
+
+	for _, algorithm := range config.Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			service := newInspectService(t, algorithm)
+			ip := Subject{IP: "192.168.1.1"}
+
+			state, err := service.Inspect(ctx, ip)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if state.Key != "ip:192.168.1.1" || state.Limit != 3 || state.Remaining != 3 || state.Blocked {
+				t.Errorf("Expected a fresh IP with 3 requests left, got %+v", state)
+			}
+
+			service.CheckAndIncrement(ctx, "192.168.1.1", "")
+			// Inspecting doesn't count a request
+			for i := 0; i < 2; i++ {
+				if state, _ := service.Inspect(ctx, ip); state.Remaining != 2 {
+					t.Errorf("Expected 2 requests left, got %+v", state)
+				}
+			}
+
+			for i := 0; i < 3; i++ {
+				service.CheckAndIncrement(ctx, "192.168.1.1", "")
+			}
+			if state, _ := service.Inspect(ctx, ip); !state.Blocked || state.Remaining != 0 {
+				t.Errorf("Expected the IP to be blocked, got %+v", state)
+			}
+
+			// Tokens report their own limit
+			state, err = service.Inspect(ctx, Subject{Token: "premium"})
+			if err != nil || state.Limit != 10 || state.Policy != PolicyToken {
+				t.Errorf("Expected the premium token's limit, got %+v, %v", state, err)
+			}
+		})
+	}
+}
+
+func TestService_ResetAndBlock(t *testing.T) {
+	ctx := context.Background()
+	service := newInspectService(t, config.AlgorithmFixedWindow)
+
+	key, err := service.Block(ctx, Subject{IP: "10.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if key != "ip:10.0.0.1" {
+		t.Errorf("Expected the IP's key, got %s", key)
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "10.0.0.1", ""); decision.Allowed {
+		t.Error("Expected a blocked IP to be rejected")
+	}
+
+	blocked, err := service.BlockedKeys(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(blocked) != 1 || blocked[0].Key != key || time.Until(blocked[0].ResetTime) < 59*time.Minute {
+		t.Errorf("Expected %s blocked for an hour, got %+v", key, blocked)
+	}
+
+	// Unblocking keeps the count, reset clears it
+	for i := 0; i < 3; i++ {
+		service.Unblock(ctx, Subject{IP: "10.0.0.1"})
+		service.CheckAndIncrement(ctx, "10.0.0.1", "")
+	}
+	if _, err := service.Unblock(ctx, Subject{IP: "10.0.0.1"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if state, _ := service.Inspect(ctx, Subject{IP: "10.0.0.1"}); state.Blocked || state.Remaining != 0 {
+		t.Errorf("Expected an unblocked IP with no requests left, got %+v", state)
+	}
+
+	if _, err := service.Reset(ctx, Subject{Key: key}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "10.0.0.1", ""); !decision.Allowed {
+		t.Error("Expected a reset IP to be allowed")
+	}
+	if blocked, _ := service.BlockedKeys(ctx); len(blocked) != 0 {
+		t.Errorf("Expected no blocked keys, got %+v", blocked)
+	}
+
+	if _, err := service.Block(ctx, Subject{IP: "10.0.0.1"}, 0); err == nil {
+		t.Error("Expected an error for a non-positive duration")
+	}
+}
+
+func TestService_Inspect_InvalidSubjects(t *testing.T) {
+	ctx := context.Background()
+	service := newInspectService(t, config.AlgorithmFixedWindow)
+
+	invalid := []Subject{
+		{},
+		{IP: "10.0.0.1", Token: "premium"},
+		{Key: "registry:token:tok_1"},
+		{TokenID: "tok_1"}, // no registry
+	}
+	for _, subject := range invalid {
+		if _, err := service.Inspect(ctx, subject); !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("Expected ErrInvalidSubject for %+v, got %v", subject, err)
+		}
+	}
+
+	tokens := registry.NewMemoryRegistry()
+	tokens.Put(ctx, &registry.Token{ID: "tok_1", Hash: registry.HashSecret("secret")})
+	service.SetTokenRegistry(tokens)
+
+	if state, err := service.Inspect(ctx, Subject{TokenID: "tok_1"}); err != nil || state.Key != "token:id:tok_1" {
+		t.Errorf("Expected the registered token's state, got %+v, %v", state, err)
+	}
+	if _, err := service.Inspect(ctx, Subject{TokenID: "tok_2"}); !errors.Is(err, registry.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown token ID, got %v", err)
+	}
+	if _, err := service.Inspect(ctx, Subject{Token: "unregistered"}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for an unregistered token, got %v", err)
+	}
+}
+
+func TestService_TopConsumers(t *testing.T) {
+	ctx := context.Background()
+	service := newInspectService(t, config.AlgorithmSlidingWindowCounter)
+
+	for i := 0; i < 2; i++ {
+		service.CheckAndIncrement(ctx, "10.0.0.1", "")
+	}
+	service.CheckAndIncrement(ctx, "10.0.0.2", "")
+	service.CheckAndIncrement(ctx, "10.0.0.3", "premium")
+	service.Block(ctx, Subject{IP: "10.0.0.4"}, time.Minute)
+
+	top, err := service.TopConsumers(ctx, 3)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := []string{"ip:10.0.0.4", "ip:10.0.0.1", "ip:10.0.0.2"}
+	if len(top) != len(want) {
+		t.Fatalf("Expected %d keys, got %+v", len(want), top)
+	}
+	for i, key := range want {
+		if top[i].Key != key {
+			t.Errorf("Expected %s at %d, got %+v", key, i, top[i])
+		}
+	}
+
+	// Raw keys are inspected under the limit they are counted against
+	all, _ := service.TopConsumers(ctx, 0)
+	premium := all[len(all)-1]
+	if len(all) != 4 || premium.Policy != PolicyToken || premium.Limit != 10 || premium.Remaining != 9 {
+		t.Errorf("Expected the premium token last with its own limit, got %+v", all)
+	}
+	if state, err := service.Inspect(ctx, Subject{Key: premium.Key}); err != nil || state.Policy != premium.Policy || state.Remaining != premium.Remaining {
+		t.Errorf("Expected the token key to be inspected like the token, got %+v, %v", state, err)
+	}
+}
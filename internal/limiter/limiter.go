@@ -2,32 +2,70 @@ package limiter
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"time"
 
-	"fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/pkg/ratelimit/api"
 )
 
 var (
-	ErrLimitExceeded = errors.New("rate limit exceeded")
+	ErrLimitExceeded = api.ErrLimitExceeded
+	ErrAccessDenied  = api.ErrAccessDenied
+	ErrInvalidToken  = api.ErrInvalidToken
+	ErrUnavailable   = api.ErrUnavailable
 )
 
+// DefaultWindow is the counting window used when none is configured
+const DefaultWindow = time.Second
+
 // RateLimiter handles rate limiting logic
+// It allows maxReqs requests per window as evaluated by its algorithm; once
+// exceeded, the identifier is blocked for blockTime
 type RateLimiter struct {
 	storage   storage.Storage
+	algorithm Algorithm
 	maxReqs   int
+	window    time.Duration
 	blockTime time.Duration
+	burst     int
 }
 
 // NewRateLimiter creates a new rate limiter instance
-func NewRateLimiter(storage storage.Storage, maxRequests int, blockTime time.Duration) *RateLimiter {
+// A non-positive window falls back to DefaultWindow
+func NewRateLimiter(storage storage.Storage, maxRequests int, window, blockTime time.Duration) *RateLimiter {
+	if window <= 0 {
+		window = DefaultWindow
+	}
 	return &RateLimiter{
 		storage:   storage,
+		algorithm: &fixedWindow{storage: storage},
 		maxReqs:   maxRequests,
+		window:    window,
 		blockTime: blockTime,
 	}
 }
 
+// NewAlgorithmRateLimiter creates a rate limiter that evaluates limit with algorithm
+// A non-positive window falls back to DefaultWindow
+func NewAlgorithmRateLimiter(store storage.Storage, algorithm Algorithm, limit storage.Limit) *RateLimiter {
+	rl := NewRateLimiter(store, limit.MaxRequests, limit.Window, limit.BlockTime)
+	rl.algorithm = algorithm
+	rl.burst = limit.Burst
+	return rl
+}
+
+// Limit returns the limit enforced by the rate limiter
+func (rl *RateLimiter) Limit() storage.Limit {
+	return storage.Limit{
+		MaxRequests: rl.maxReqs,
+		Window:      rl.window,
+		Burst:       rl.burst,
+		BlockTime:   rl.blockTime,
+	}
+}
+
 // Check checks if a request is allowed for the given identifier
 // Returns: (allowed bool, resetTime time.Time, err error)
 func (rl *RateLimiter) Check(ctx context.Context, identifier string) (bool, time.Time, error) {
@@ -39,7 +77,7 @@ func (rl *RateLimiter) Check(ctx context.Context, identifier string) (bool, time
 
 	// If no info exists, first request is allowed
 	if info == nil {
-		return true, time.Now().Add(rl.blockTime), nil
+		return true, time.Now().Add(rl.window), nil
 	}
 
 	// Check if blocked period has expired
@@ -48,7 +86,7 @@ func (rl *RateLimiter) Check(ctx context.Context, identifier string) (bool, time
 		if err := rl.storage.Clear(ctx, identifier); err != nil {
 			return false, time.Time{}, err
 		}
-		return true, time.Now().Add(rl.blockTime), nil
+		return true, time.Now().Add(rl.window), nil
 	}
 
 	// Check if limit is exceeded
@@ -62,7 +100,156 @@ func (rl *RateLimiter) Check(ctx context.Context, identifier string) (bool, time
 
 // Increment increments the request count for the given identifier
 func (rl *RateLimiter) Increment(ctx context.Context, identifier string) (int, time.Time, error) {
-	return rl.storage.Increment(ctx, identifier, rl.blockTime)
+	return rl.storage.Increment(ctx, identifier, rl.window)
 }
 
+// Allow checks and records a request for the given identifier in a single
+// atomic storage operation, using the limiter's algorithm
+// Returns: (allowed bool, resetTime time.Time, err error)
+func (rl *RateLimiter) Allow(ctx context.Context, identifier string) (bool, time.Time, error) {
+	decision, err := rl.Decide(ctx, identifier)
+	return decision.Allowed, decision.ResetTime, err
+}
+
+// Decide checks and records a request like Allow, also reporting the
+// limit and the remaining quota
+// A rejected request returns its decision along with ErrLimitExceeded
+func (rl *RateLimiter) Decide(ctx context.Context, identifier string) (Decision, error) {
+	result, err := rl.algorithm.Allow(ctx, identifier, rl.Limit())
+	if err != nil {
+		return Decision{}, err
+	}
+
+	decision := rl.decision(result)
+	if !result.Allowed {
+		return decision, ErrLimitExceeded
+	}
+	return decision, nil
+}
+
+// capacity returns the number of requests the limiter admits at once and the
+// window they are reported over
+// Bucket algorithms admit up to their burst at once and refill it at
+// MaxRequests per Window
+func (rl *RateLimiter) capacity() (int, time.Duration) {
+	limit := rl.Limit()
+	capacity, window := limit.MaxRequests, limit.Window
+	if name := rl.algorithm.Name(); name == config.AlgorithmTokenBucket || name == config.AlgorithmGCRA {
+		capacity = limit.BurstOrMax()
+		if limit.MaxRequests > 0 {
+			window = limit.Window * time.Duration(capacity) / time.Duration(limit.MaxRequests)
+		}
+	}
+	return capacity, window
+}
+
+// decision reports a storage result under the limiter's limit
+func (rl *RateLimiter) decision(result *storage.RateLimitResult) Decision {
+	capacity, window := rl.capacity()
+	decision := Decision{
+		Allowed:   result.Allowed,
+		Limit:     capacity,
+		Window:    window,
+		ResetTime: result.ResetTime,
+	}
+	if result.Allowed && result.Count < capacity {
+		decision.Remaining = capacity - result.Count
+	}
+	return decision
+}
+
+// limitCheck is a rate limiter applied to a key, reported under policy and
+// dimension
+type limitCheck struct {
+	limiter   *RateLimiter
+	key       string
+	policy    string
+	dimension string
+}
 
+// decideAll checks and records a request against every check
+// The request is only recorded when all of them admit it, atomically, so
+// several checks require a storage implementing storage.MultiStorage
+// The decision reported is the rejection that resets last or, when admitted,
+// the check with the fewest requests remaining
+func decideAll(ctx context.Context, checks []limitCheck) (Decision, error) {
+	switch len(checks) {
+	case 0:
+		return Decision{Allowed: true}, nil
+	case 1:
+		decision, err := checks[0].limiter.Decide(ctx, checks[0].key)
+		decision.Policy, decision.Dimension = checks[0].policy, checks[0].dimension
+		return decision, err
+	}
+
+	// Checked one by one, a request rejected by a later check would still
+	// count against the earlier ones
+	multi, ok := checks[0].limiter.storage.(storage.MultiStorage)
+	if !ok {
+		return Decision{}, fmt.Errorf("%d limits: %w", len(checks), ErrMultiLimitNotSupported)
+	}
+
+	storageChecks := make([]storage.Check, len(checks))
+	for i, check := range checks {
+		storageChecks[i] = storage.Check{
+			Key:       check.key,
+			Algorithm: check.limiter.algorithm.Name(),
+			Limit:     check.limiter.Limit(),
+		}
+	}
+	results, err := multi.CheckAll(ctx, storageChecks)
+	if err != nil {
+		return Decision{}, err
+	}
+	decisions := make([]Decision, len(checks))
+	for i, check := range checks {
+		decisions[i] = check.limiter.decision(results[i])
+		decisions[i].Policy, decisions[i].Dimension = check.policy, check.dimension
+	}
+
+	decision := mostRestrictive(decisions)
+	if !decision.Allowed {
+		return decision, ErrLimitExceeded
+	}
+	return decision, nil
+}
+
+// CheckStorage returns ErrMultiLimitNotSupported when cfg counts requests
+// against several limits at once, with TOKEN_MODE=both or a per-IP ceiling of
+// a token, and store can't check them atomically
+// Per-IP ceilings of registered tokens are only found on their requests,
+// which then fail as the failure mode says
+func CheckStorage(store storage.Storage, cfg *config.Config) error {
+	if _, ok := store.(storage.MultiStorage); ok || !cfg.EnableTokenRateLimiter {
+		return nil
+	}
+	if cfg.EnableIPRateLimiter && cfg.TokenMode == config.TokenModeBoth {
+		return fmt.Errorf("token mode %s: %w", config.TokenModeBoth, ErrMultiLimitNotSupported)
+	}
+	for token, limit := range cfg.TokenLimits {
+		if limit.IPMaxRequests > 0 {
+			return fmt.Errorf("per-IP ceiling of token %s: %w", config.RedactToken(token), ErrMultiLimitNotSupported)
+		}
+	}
+	for tier, limit := range cfg.Tiers {
+		if limit.IPMaxRequests > 0 {
+			return fmt.Errorf("per-IP ceiling of tier %s: %w", tier, ErrMultiLimitNotSupported)
+		}
+	}
+	return nil
+}
+
+func mostRestrictive(decisions []Decision) Decision {
+	result := decisions[0]
+	for _, decision := range decisions[1:] {
+		switch {
+		case result.Allowed && !decision.Allowed:
+			result = decision
+		case !result.Allowed && !decision.Allowed && decision.ResetTime.After(result.ResetTime):
+			result = decision
+		case result.Allowed && decision.Allowed && decision.Remaining < result.Remaining:
+			result = decision
+		}
+	}
+	return result
+}
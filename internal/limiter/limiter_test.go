@@ -5,14 +5,14 @@ import (
 	"testing"
 	"time"
 
-	"fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
 )
 
 func TestRateLimiter_Check_FirstRequest(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 5, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 5, 1*time.Minute, 5*time.Minute)
 	
 	// First request should be allowed
 	allowed, resetTime, err := rl.Check(ctx, "test-key")
@@ -36,7 +36,7 @@ func TestRateLimiter_Check_WithinLimit(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 3, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 3, 1*time.Minute, 5*time.Minute)
 	
 	// Set initial count to 2 (below limit)
 	mockStore.Set(ctx, "test-key", 2, 1*time.Minute)
@@ -55,7 +55,7 @@ func TestRateLimiter_Check_AtLimit(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 3, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 3, 1*time.Minute, 5*time.Minute)
 	
 	// Set count to exactly the limit
 	resetTime := time.Now().Add(1 * time.Minute)
@@ -81,7 +81,7 @@ func TestRateLimiter_Check_ExceededLimit(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 3, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 3, 1*time.Minute, 5*time.Minute)
 	
 	// Set count above the limit
 	resetTime := time.Now().Add(1 * time.Minute)
@@ -104,7 +104,7 @@ func TestRateLimiter_Check_ExpiredReset(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 3, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 3, 1*time.Minute, 5*time.Minute)
 	
 	// Set count with expired reset time
 	expiredResetTime := time.Now().Add(-1 * time.Minute) // In the past
@@ -135,7 +135,7 @@ func TestRateLimiter_Increment_FirstRequest(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 5, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 5, 1*time.Minute, 5*time.Minute)
 	
 	// First increment
 	count, resetTime, err := rl.Increment(ctx, "test-key")
@@ -159,7 +159,7 @@ func TestRateLimiter_Increment_MultipleRequests(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 5, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 5, 1*time.Minute, 5*time.Minute)
 	
 	// Make multiple increments
 	expectedCount := 1
@@ -184,7 +184,7 @@ func TestRateLimiter_Increment_AfterExpiration(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 5, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 5, 1*time.Minute, 5*time.Minute)
 	
 	// Set expired entry
 	expiredResetTime := time.Now().Add(-1 * time.Minute)
@@ -213,7 +213,7 @@ func TestRateLimiter_Integration(t *testing.T) {
 	ctx := context.Background()
 	mockStore := newMockStorage()
 	
-	rl := NewRateLimiter(mockStore, 3, 1*time.Minute)
+	rl := NewRateLimiter(mockStore, 3, 1*time.Minute, 5*time.Minute)
 	
 	// Simulate workflow: Check, then Increment
 	// Request 1
@@ -276,3 +276,61 @@ func TestRateLimiter_Integration(t *testing.T) {
 		t.Error("Fourth request should be blocked (exceeded limit)")
 	}
 }
+
+func TestRateLimiter_Allow(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	rl := NewRateLimiter(mockStore, 3, 1*time.Minute, 5*time.Minute)
+
+	// First 3 requests should be allowed
+	for i := 0; i < 3; i++ {
+		allowed, resetTime, err := rl.Allow(ctx, "test-key")
+		if err != nil {
+			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
+		}
+		if !allowed {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+		if resetTime.IsZero() {
+			t.Error("Reset time should not be zero")
+		}
+	}
+
+	// 4th request should be blocked without incrementing the count
+	allowed, _, err := rl.Allow(ctx, "test-key")
+	if err != ErrLimitExceeded {
+		t.Errorf("Expected ErrLimitExceeded, got: %v", err)
+	}
+	if allowed {
+		t.Error("Fourth request should be blocked (exceeded limit)")
+	}
+	if mockStore.data["test-key"].Count != 3 {
+		t.Errorf("Expected count to stay at 3, got %d", mockStore.data["test-key"].Count)
+	}
+}
+
+func TestRateLimiter_Decide(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	rl := NewRateLimiter(mockStore, 3, 1*time.Minute, 0)
+
+	for i := 0; i < 3; i++ {
+		decision, err := rl.Decide(ctx, "test-key")
+		if err != nil {
+			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
+		}
+		if !decision.Allowed || decision.Limit != 3 || decision.Remaining != 2-i || decision.Window != time.Minute {
+			t.Errorf("Unexpected decision for request %d: %+v", i+1, decision)
+		}
+	}
+
+	decision, err := rl.Decide(ctx, "test-key")
+	if err != ErrLimitExceeded {
+		t.Errorf("Expected ErrLimitExceeded, got: %v", err)
+	}
+	if decision.Allowed || decision.Remaining != 0 || decision.ResetAfter(time.Now()) <= 0 {
+		t.Errorf("Unexpected decision for rejected request: %+v", decision)
+	}
+}
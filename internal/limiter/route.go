@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"context"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+// Route is the route rule a request matched, bound to the policy it was
+// matched in, so a reload never splits a request across two policies
+// The default route applies the default and token limits
+type Route struct {
+	policy *policy
+	route  *routeLimiter
+}
+
+// Name returns the name of the matched rule, or PolicyDefault
+func (r Route) Name() string {
+	if r.route == nil {
+		return PolicyDefault
+	}
+	return r.route.rule.Name
+}
+
+// Config returns the configuration the route was matched in
+func (r Route) Config() *config.Config {
+	return r.policy.config
+}
+
+// KeySource returns the key source of the route, falling back to the
+// policy's; nil means the API token headers
+func (r Route) KeySource() *config.KeySource {
+	if r.route != nil && r.route.rule.Key != nil {
+		return r.route.rule.Key
+	}
+	return r.policy.config.KeySource
+}
+
+// Upstream returns the name of the upstream the route's requests are
+// proxied to, config.DefaultUpstream unless the rule names another
+func (r Route) Upstream() string {
+	if r.route != nil && r.route.rule.Upstream != "" {
+		return r.route.rule.Upstream
+	}
+	return config.DefaultUpstream
+}
+
+// CheckAndIncrement checks and records a request on the route like
+// Service.CheckAndIncrement; exempt routes only apply the deny list
+func (r Route) CheckAndIncrement(ctx context.Context, ip, token string) (Decision, error) {
+	return r.policy.checkAndIncrement(ctx, r.route, ip, token)
+}
+
+// routeContextKey is the context key of the route a request matched
+type routeContextKey struct{}
+
+// ContextWithRoute returns ctx carrying the route a request matched, so the
+// handlers after the rate limiter see the same rule and policy
+func ContextWithRoute(ctx context.Context, route Route) context.Context {
+	return context.WithValue(ctx, routeContextKey{}, route)
+}
+
+// RouteFromContext returns the route carried by ctx, if any
+func RouteFromContext(ctx context.Context) (Route, bool) {
+	route, ok := ctx.Value(routeContextKey{}).(Route)
+	return route, ok
+}
@@ -2,106 +2,712 @@ package limiter
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"fc-tec-ch-02/internal/config"
-	"fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/route"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
 )
 
 // Service manages rate limiters for different criteria (IP, Token, etc.)
+// Its limits live in an immutable policy snapshot that Reload swaps atomically;
+// every request evaluates a single snapshot, so a reload never affects
+// requests already in flight
 type Service struct {
+	storage    storage.Storage
+	algorithms map[string]Algorithm
+	policy     atomic.Pointer[policy]
+	reloadMu   sync.Mutex
+	registry   registry.TokenRegistry
+	// tokenSecret keys the hashes tokens are stored under; it is fixed at
+	// start, as changing it would reset every token's count
+	// Without TOKEN_HASH_SECRET it is random, so only this process can match
+	// its counters to tokens
+	tokenSecret []byte
+	// local limits requests in memory when the storage fails and the
+	// failure mode is local, created when first needed
+	local *Service
+	// share divides the limits of a local service among the instances
+	share int
+}
+
+// policy is a snapshot of the configuration and the limiters built from it
+type policy struct {
+	config       *config.Config
 	ipLimiter    *RateLimiter
 	tokenLimiter *RateLimiter
-	storage      storage.Storage
-	config       *config.Config
+	tokens       map[string]tokenLimiter
+	tiers        map[string]tokenLimiter
+	routes       []routeLimiter
+	descriptors  []descriptorLimiter
+	registry     registry.TokenRegistry
+	tokenSecret  []byte
+	// limiterFor builds the limiter of a registered token's own limit
+	limiterFor func(limit config.TokenLimit) tokenLimiter
+	// fallback decides requests the storage failed to check when their
+	// failure mode is local
+	fallback *policy
+}
+
+// tokenLimiter is the limit of a token and its per-IP ceiling, if any
+type tokenLimiter struct {
+	limiter *RateLimiter
+	ceiling *RateLimiter
+}
+
+// resolvedToken is the token of a request with the limits it is counted
+// against; key identifies the token in storage
+type resolvedToken struct {
+	tokenLimiter
+	key    string
+	policy string
+	known  bool
+}
+
+// routeLimiter is a compiled route rule
+type routeLimiter struct {
+	rule    *config.RouteRule
+	pattern *route.Pattern
+	limiter *RateLimiter
 }
 
 // NewService creates a new rate limiter service
-func NewService(storage storage.Storage, cfg *config.Config) *Service {
-	ipLimiter := NewRateLimiter(storage, cfg.MaxRequestsPerSecond, cfg.BlockingTime)
-	
-	return &Service{
+func NewService(store storage.Storage, cfg *config.Config) *Service {
+	s := &Service{
+		storage:     store,
+		algorithms:  newAlgorithms(store),
+		tokenSecret: tokenSecret(cfg),
+	}
+
+	s.policy.Store(s.newPolicy(cfg))
+	return s
+}
+
+// tokenSecret returns the key of the token hashes, cfg's secret or a random
+// one when it has none
+func tokenSecret(cfg *config.Config) []byte {
+	if cfg.TokenHashSecret != "" {
+		return []byte(cfg.TokenHashSecret)
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret) // only fails when the system has no randomness at all
+	return secret
+}
+
+// newAlgorithms returns every algorithm evaluated on store
+func newAlgorithms(store storage.Storage) map[string]Algorithm {
+	algorithms := make(map[string]Algorithm, len(config.Algorithms))
+	for _, name := range config.Algorithms {
+		algorithm, err := NewAlgorithm(name, store)
+		if err != nil {
+			algorithm = &failedAlgorithm{name: name, err: err}
+		}
+		algorithms[name] = algorithm
+	}
+	return algorithms
+}
+
+// Config returns the configuration currently in effect
+func (s *Service) Config() *config.Config {
+	return s.policy.Load().config
+}
+
+// Reload atomically replaces the limits with those of cfg, which must already
+// be validated, and returns a description of what changed
+// Requests in flight keep using the limits they started with
+func (s *Service) Reload(cfg *config.Config) []string {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	changes := config.Diff(s.Config(), cfg)
+	s.policy.Store(s.newPolicy(cfg))
+	return changes
+}
+
+// SetTokenRegistry looks up tokens that have no configured limit in r
+// Registered tokens are limited by their own limit or their tier's, and
+// unknown, disabled or expired ones are handled as UNKNOWN_TOKEN_ACTION says
+func (s *Service) SetTokenRegistry(r registry.TokenRegistry) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.registry = r
+	s.policy.Store(s.newPolicy(s.Config()))
+}
+
+// newPolicy builds the limiters for cfg
+// A token or route limit without its own window, blocking time or algorithm
+// inherits the global one; its burst defaults to its own max requests
+func (s *Service) newPolicy(cfg *config.Config) *policy {
+	ipLimiter := NewAlgorithmRateLimiter(s.storage, s.algorithm(cfg, cfg.RateLimitAlgorithm), s.shareOf(storage.Limit{
+		MaxRequests: cfg.MaxRequestsPerSecond,
+		Window:      cfg.RateLimitWindow,
+		Burst:       cfg.RateLimitBurst,
+		BlockTime:   cfg.BlockingTime,
+	}))
+
+	p := &policy{
+		config:       cfg,
 		ipLimiter:    ipLimiter,
 		tokenLimiter: ipLimiter, // Default to same limiter for tokens
-		storage:      storage,
-		config:       cfg,
+		tokens:       make(map[string]tokenLimiter, len(cfg.TokenLimits)),
+		tiers:        make(map[string]tokenLimiter, len(cfg.Tiers)),
+		registry:     s.registry,
+		tokenSecret:  s.tokenSecret,
+		limiterFor: func(limit config.TokenLimit) tokenLimiter {
+			return s.tokenLimiterFor(cfg, limit)
+		},
+	}
+
+	for token, tokenLimit := range cfg.TokenLimits {
+		p.tokens[token] = s.tokenLimiterFor(cfg, tokenLimit)
+	}
+	for tier, tierLimit := range cfg.Tiers {
+		p.tiers[tier] = s.tokenLimiterFor(cfg, tierLimit)
+	}
+
+	for i := range cfg.Routes {
+		rule := &cfg.Routes[i]
+		pattern, err := route.Compile(rule.Pattern)
+		if err != nil {
+			// Rules are validated when loaded, so this only skips hand-built configs
+			continue
+		}
+		p.routes = append(p.routes, routeLimiter{
+			rule:    rule,
+			pattern: pattern,
+			limiter: s.limiterFor(cfg, rule.Limit),
+		})
+	}
+
+	for i := range cfg.Descriptors {
+		rule := &cfg.Descriptors[i]
+		p.descriptors = append(p.descriptors, descriptorLimiter{
+			rule:    rule,
+			limiter: s.limiterFor(cfg, rule.Limit),
+		})
+	}
+
+	p.fallback = s.fallbackPolicy(cfg)
+	return p
+}
+
+// fallbackPolicy returns the limits requests fall back to when the storage
+// fails, counted in this instance's memory, or nil when cfg never fails to
+// local limits
+// The local service is replaced when the number of instances changes
+func (s *Service) fallbackPolicy(cfg *config.Config) *policy {
+	if s.share > 0 || !usesLocalFailureMode(cfg) {
+		return nil
+	}
+	share := max(cfg.FailureLocalInstances, 1)
+	if s.local == nil || s.local.share != share {
+		if s.local != nil {
+			s.local.storage.Close()
+		}
+		store := storage.NewMemoryStorage(cfg.MemoryMaxKeys, cfg.MemoryCleanupInterval)
+		s.local = &Service{
+			storage:     store,
+			algorithms:  newAlgorithms(store),
+			tokenSecret: s.tokenSecret,
+			share:       share,
+		}
+	}
+	// The registry is kept in the failing storage: tokens are decided from
+	// what its cache remembers, or counted under the default token limit
+	s.local.registry = registry.Offline(s.registry)
+	return s.local.newPolicy(cfg)
+}
+
+// usesLocalFailureMode reports whether any request of cfg fails to local
+// limits
+func usesLocalFailureMode(cfg *config.Config) bool {
+	if cfg.FailureMode == config.FailureModeLocal {
+		return true
+	}
+	for _, rule := range cfg.Routes {
+		if rule.FailureMode == config.FailureModeLocal {
+			return true
+		}
+	}
+	return false
+}
+
+// shareOf returns the service's share of limit: all of it, or for a local
+// service an equal part of it per instance, rounded up
+func (s *Service) shareOf(limit storage.Limit) storage.Limit {
+	if s.share > 1 {
+		limit.MaxRequests = (limit.MaxRequests + s.share - 1) / s.share
+		limit.Burst = (limit.Burst + s.share - 1) / s.share
+	}
+	return limit
+}
+
+// tokenLimiterFor builds the limiters of a token or tier limit
+func (s *Service) tokenLimiterFor(cfg *config.Config, limit config.TokenLimit) tokenLimiter {
+	tl := tokenLimiter{limiter: s.limiterFor(cfg, limit)}
+	if limit.IPMaxRequests > 0 {
+		tl.ceiling = s.limiterFor(cfg, config.TokenLimit{
+			MaxRequests:  limit.IPMaxRequests,
+			Window:       limit.Window,
+			BlockingTime: limit.BlockingTime,
+			Algorithm:    limit.Algorithm,
+		})
 	}
+	return tl
+}
+
+// limiterFor builds the limiter of a token or route limit
+func (s *Service) limiterFor(cfg *config.Config, limit config.TokenLimit) *RateLimiter {
+	window := limit.Window
+	if window <= 0 {
+		window = cfg.RateLimitWindow
+	}
+	blockTime := limit.BlockingTime
+	if blockTime <= 0 {
+		blockTime = cfg.BlockingTime
+	}
+	return NewAlgorithmRateLimiter(s.storage, s.algorithm(cfg, limit.Algorithm), s.shareOf(storage.Limit{
+		MaxRequests: limit.MaxRequests,
+		Window:      window,
+		Burst:       limit.Burst,
+		BlockTime:   blockTime,
+	}))
+}
+
+// algorithm returns the algorithm registered under name, falling back to the
+// globally configured algorithm when name is empty
+func (s *Service) algorithm(cfg *config.Config, name string) Algorithm {
+	if name == "" {
+		name = cfg.RateLimitAlgorithm
+	}
+	if name == "" {
+		name = config.AlgorithmFixedWindow
+	}
+	if algorithm, exists := s.algorithms[name]; exists {
+		return algorithm
+	}
+	return &failedAlgorithm{name: name, err: fmt.Errorf("unknown rate limiting algorithm %q", name)}
 }
 
 // CheckIP checks if a request is allowed for the given IP address
 func (s *Service) CheckIP(ctx context.Context, ip string) (bool, time.Time, error) {
-	if !s.config.EnableIPRateLimiter {
+	p := s.policy.Load()
+	if !p.config.EnableIPRateLimiter {
 		return true, time.Time{}, nil
 	}
-	return s.ipLimiter.Check(ctx, "ip:"+ip)
+	return p.ipLimiter.Check(ctx, p.ipKey(ip))
 }
 
 // IncrementIP increments the request count for the given IP address
 func (s *Service) IncrementIP(ctx context.Context, ip string) (int, time.Time, error) {
-	if !s.config.EnableIPRateLimiter {
+	p := s.policy.Load()
+	if !p.config.EnableIPRateLimiter {
 		return 0, time.Time{}, nil
 	}
-	return s.ipLimiter.Increment(ctx, "ip:"+ip)
+	return p.ipLimiter.Increment(ctx, p.ipKey(ip))
 }
 
 // CheckToken checks if a request is allowed for the given token
 // Returns the specific limits for that token if configured
 func (s *Service) CheckToken(ctx context.Context, token string) (bool, time.Time, error) {
-	if !s.config.EnableTokenRateLimiter {
+	p := s.policy.Load()
+	if !p.config.EnableTokenRateLimiter {
 		return true, time.Time{}, nil
 	}
 
-	// Check if token has specific limits configured
-	if tokenLimit, exists := s.config.TokenLimits[token]; exists {
-		// Create a temporary limiter with token-specific limits
-		tokenLimiter := NewRateLimiter(s.storage, tokenLimit.MaxRequests, tokenLimit.TTL)
-		return tokenLimiter.Check(ctx, "token:"+token)
-	}
-
-	// Use default IP limiter limits for unconfigured tokens
-	return s.ipLimiter.Check(ctx, "token:"+token)
+	return p.limiterForToken(token).Check(ctx, p.tokenKey(token))
 }
 
 // IncrementToken increments the request count for the given token
 func (s *Service) IncrementToken(ctx context.Context, token string) (int, time.Time, error) {
-	if !s.config.EnableTokenRateLimiter {
+	p := s.policy.Load()
+	if !p.config.EnableTokenRateLimiter {
 		return 0, time.Time{}, nil
 	}
 
-	// Check if token has specific limits configured
-	if tokenLimit, exists := s.config.TokenLimits[token]; exists {
-		// Create a temporary limiter with token-specific limits
-		tokenLimiter := NewRateLimiter(s.storage, tokenLimit.MaxRequests, tokenLimit.TTL)
-		return tokenLimiter.Increment(ctx, "token:"+token)
-	}
+	return p.limiterForToken(token).Increment(ctx, p.tokenKey(token))
+}
 
-	// Use default limiter for unconfigured tokens
-	return s.ipLimiter.Increment(ctx, "token:"+token)
+// AllowIP atomically checks and increments the request count for the given IP address
+func (s *Service) AllowIP(ctx context.Context, ip string) (bool, time.Time, error) {
+	decision, err := s.policy.Load().decideIP(ctx, ip)
+	return decision.Allowed, decision.ResetTime, err
+}
+
+// AllowToken atomically checks and increments the request count for the given token
+func (s *Service) AllowToken(ctx context.Context, token string) (bool, time.Time, error) {
+	decision, err := s.policy.Load().decideToken(ctx, token)
+	return decision.Allowed, decision.ResetTime, err
+}
+
+// IsDenied reports whether the IP or token is on the deny list
+func (s *Service) IsDenied(ip, token string) bool {
+	return s.policy.Load().isDenied(ip, token)
+}
+
+// IsAllowListed reports whether the IP or token is on the allow list and
+// therefore exempt from rate limiting
+func (s *Service) IsAllowListed(ip, token string) bool {
+	return s.policy.Load().isAllowListed(ip, token)
 }
 
 // CheckAndIncrement checks both IP and Token, and increments the appropriate counter
-// Token limits override IP limits when a token is provided
-func (s *Service) CheckAndIncrement(ctx context.Context, ip, token string) (bool, time.Time, error) {
-	// If token is provided, check token first (token limits override IP limits)
-	if token != "" {
-		allowed, resetTime, err := s.CheckToken(ctx, token)
-		if !allowed {
-			return false, resetTime, err
+// How the token and IP limits combine depends on the token mode; when both
+// apply, the request is only counted if neither rejects it
+// The check and the increment happen in a single atomic storage operation, so
+// concurrent requests can never be admitted past the limit
+// A rejected request returns its decision along with ErrLimitExceeded; denied
+// IPs and tokens get ErrAccessDenied and allow-listed ones are never limited
+// Route rules are not applied; use MatchRoute for requests
+func (s *Service) CheckAndIncrement(ctx context.Context, ip, token string) (Decision, error) {
+	return s.policy.Load().checkAndIncrement(ctx, nil, ip, token)
+}
+
+// MatchRoute returns the first route rule matching the request, or the
+// default route when none does
+func (s *Service) MatchRoute(method, host, path string) Route {
+	p := s.policy.Load()
+	for i := range p.routes {
+		if p.routes[i].pattern.Match(method, host, path) {
+			return Route{policy: p, route: &p.routes[i]}
 		}
+	}
+	return Route{policy: p}
+}
 
-		// Increment token counter
-		_, _, _ = s.IncrementToken(ctx, token)
-		return true, resetTime, nil
+// checkAndIncrement decides a request on rl, or the default limits when rl
+// is nil, falling back to the failure mode when the storage fails
+func (p *policy) checkAndIncrement(ctx context.Context, rl *routeLimiter, ip, token string) (Decision, error) {
+	decision, err := p.decide(ctx, rl, ip, token)
+	switch {
+	case err == nil, errors.Is(err, ErrLimitExceeded), errors.Is(err, ErrAccessDenied), errors.Is(err, ErrInvalidToken):
+		return decision, err
+	case errors.Is(err, ErrMultiLimitNotSupported):
+		// A configuration the storage can't serve, not a storage failure the
+		// failure mode could absorb
+		return Decision{}, err
+	default:
+		return p.fail(ctx, rl, ip, token, err)
 	}
+}
 
-	// No token provided, check IP
-	allowed, resetTime, err := s.CheckIP(ctx, ip)
-	if !allowed {
-		return false, resetTime, err
+// fail decides a request the storage failed to check, as the failure mode of
+// rl says: allowed, limited by the fallback policy, or rejected with
+// ErrUnavailable until the circuit breaker's cooldown is over
+func (p *policy) fail(ctx context.Context, rl *routeLimiter, ip, token string, cause error) (Decision, error) {
+	mode := p.config.FailureMode
+	if rl != nil && rl.rule.FailureMode != "" {
+		mode = rl.rule.FailureMode
 	}
+	return p.failWith(mode, cause, func(fallback *policy) (Decision, error) {
+		return fallback.decide(ctx, fallback.sameRoute(rl), ip, token)
+	})
+}
 
-	// Increment IP counter
-	_, _, _ = s.IncrementIP(ctx, ip)
-	return true, resetTime, nil
+// failWith applies failure mode to a decision the storage failed to make;
+// decide makes it again on the fallback policy in local mode
+func (p *policy) failWith(mode string, cause error, decide func(fallback *policy) (Decision, error)) (Decision, error) {
+	switch mode {
+	case config.FailureModeOpen:
+		return Decision{Allowed: true, Degraded: true}, nil
+	case config.FailureModeLocal:
+		if p.fallback != nil {
+			decision, err := decide(p.fallback)
+			if err == nil || errors.Is(err, ErrLimitExceeded) {
+				decision.Degraded = true
+				return decision, err
+			}
+		}
+	}
+	return Decision{Degraded: true, ResetTime: time.Now().Add(p.config.CircuitBreakerCooldown)}, fmt.Errorf("%w: %v", ErrUnavailable, cause)
 }
 
+// sameRoute returns the route limiter p compiled from the rule of rl
+func (p *policy) sameRoute(rl *routeLimiter) *routeLimiter {
+	if rl == nil {
+		return nil
+	}
+	for i := range p.routes {
+		if p.routes[i].rule == rl.rule {
+			return &p.routes[i]
+		}
+	}
+	return nil
+}
+
+// decide checks and records a request on rl, or the default limits when rl
+// is nil or has no limit of its own
+func (p *policy) decide(ctx context.Context, rl *routeLimiter, ip, token string) (Decision, error) {
+	if p.isDenied(ip, token) {
+		return Decision{}, ErrAccessDenied
+	}
+	if p.isAllowListed(ip, token) {
+		return Decision{Allowed: true}, nil
+	}
+
+	if rl != nil && !rl.rule.AppliesDefaultLimits() {
+		return p.decideRoute(ctx, rl, ip, token)
+	}
+	resolved, err := p.resolveToken(ctx, token)
+	if err != nil {
+		return Decision{}, err
+	}
+	return decideAll(ctx, p.checks(ip, resolved))
+}
+
+// resolveToken returns the limits of token, or nil when the request is
+// limited as anonymous
+// Configured token limits take precedence over the token registry
+func (p *policy) resolveToken(ctx context.Context, token string) (*resolvedToken, error) {
+	if token == "" || !p.config.EnableTokenRateLimiter {
+		return nil, nil
+	}
+	if tl, exists := p.configuredToken(token); exists {
+		return &resolvedToken{tokenLimiter: tl, key: p.tokenKey(token), policy: PolicyToken, known: true}, nil
+	}
+
+	if p.registry != nil {
+		record, err := p.registry.Lookup(ctx, token)
+		if errors.Is(err, registry.ErrOffline) {
+			// Deciding locally, the token can't be told apart from an
+			// unregistered one: count it under the default token limit
+			return &resolvedToken{tokenLimiter: tokenLimiter{limiter: p.tokenLimiter}, key: p.tokenKey(token), policy: PolicyDefault}, nil
+		}
+		if err != nil && !errors.Is(err, registry.ErrNotFound) {
+			return nil, err
+		}
+		if err == nil && record.Active(time.Now()) {
+			return p.registered(record), nil
+		}
+	}
+
+	switch {
+	case p.config.UnknownTokenAction == config.UnknownTokenReject:
+		return nil, ErrInvalidToken
+	case p.registry != nil:
+		// Tokens are issued by the registry, so any other token is no token
+		return nil, nil
+	default:
+		return &resolvedToken{tokenLimiter: tokenLimiter{limiter: p.tokenLimiter}, key: p.tokenKey(token), policy: PolicyDefault}, nil
+	}
+}
+
+// registered returns the limits of a registered token: its own limit, else
+// its tier's, else the default token limit
+// Registered tokens are counted by ID, so rotating a secret keeps the count
+func (p *policy) registered(record *registry.Token) *resolvedToken {
+	resolved := &resolvedToken{key: "token:id:" + record.ID, policy: PolicyToken, known: true}
+	if tl, exists := p.tiers[record.Tier]; exists {
+		resolved.tokenLimiter, resolved.policy = tl, record.Tier
+	} else {
+		resolved.tokenLimiter = tokenLimiter{limiter: p.tokenLimiter}
+	}
+	if record.Limit != nil {
+		resolved.tokenLimiter, resolved.policy = p.limiterFor(record.Limit.TokenLimit()), PolicyToken
+	}
+	return resolved
+}
+
+// checks returns the limits a request outside any route is counted against
+func (p *policy) checks(ip string, token *resolvedToken) []limitCheck {
+	ipCheck := limitCheck{limiter: p.ipLimiter, key: p.ipKey(ip), policy: PolicyDefault, dimension: DimensionIP}
+	if token == nil {
+		if !p.config.EnableIPRateLimiter {
+			return nil
+		}
+		return []limitCheck{ipCheck}
+	}
+
+	tokenCheck := limitCheck{limiter: token.limiter, key: token.key, policy: token.policy, dimension: DimensionToken}
+	checks := p.combine(ipCheck, tokenCheck, token.known)
+
+	if token.ceiling != nil {
+		checks = append(checks, limitCheck{limiter: token.ceiling, key: token.key + ":" + p.ipKey(ip), policy: PolicyTokenIP, dimension: DimensionToken})
+	}
+	return checks
+}
+
+// combine applies the token mode to the IP and token checks of a request
+// carrying a token; known tokens have a limit of their own
+func (p *policy) combine(ipCheck, tokenCheck limitCheck, known bool) []limitCheck {
+	switch {
+	case p.config.TokenMode == config.TokenModeOverride || !p.config.EnableIPRateLimiter:
+		return []limitCheck{tokenCheck}
+	case p.config.TokenMode == config.TokenModeBoth:
+		return []limitCheck{ipCheck, tokenCheck}
+	case known:
+		return []limitCheck{tokenCheck}
+	default:
+		// Unknown tokens are limited like anonymous requests, so sending a
+		// new token with every request gains nothing
+		return []limitCheck{ipCheck}
+	}
+}
+
+// decideRoute applies a route's limit, counting it apart from the default
+// limits
+// Requests are keyed by the route's own key source when it has one, and
+// otherwise by token and IP according to the token mode
+func (p *policy) decideRoute(ctx context.Context, rl *routeLimiter, ip, token string) (Decision, error) {
+	if rl.rule.Exempt {
+		return Decision{Allowed: true}, nil
+	}
+
+	prefix := "route:" + rl.rule.Name + ":"
+	ipCheck := limitCheck{limiter: rl.limiter, key: prefix + p.ipKey(ip), policy: rl.rule.Name, dimension: DimensionIP}
+	tokenCheck := limitCheck{limiter: rl.limiter, key: prefix + p.tokenKey(token), policy: rl.rule.Name, dimension: DimensionToken}
+
+	var checks []limitCheck
+	switch {
+	case token == "" || !p.config.EnableTokenRateLimiter:
+		if p.config.EnableIPRateLimiter {
+			checks = []limitCheck{ipCheck}
+		}
+	case rl.rule.Key != nil:
+		checks = []limitCheck{tokenCheck}
+	default:
+		resolved, err := p.resolveToken(ctx, token)
+		if err != nil {
+			return Decision{}, err
+		}
+		if resolved == nil {
+			return p.decideRoute(ctx, rl, ip, "")
+		}
+		tokenCheck.key = prefix + resolved.key
+		checks = p.combine(ipCheck, tokenCheck, resolved.known)
+	}
+	return decideAll(ctx, checks)
+}
+
+func (p *policy) decideIP(ctx context.Context, ip string) (Decision, error) {
+	if !p.config.EnableIPRateLimiter {
+		return Decision{Allowed: true}, nil
+	}
+	decision, err := p.ipLimiter.Decide(ctx, p.ipKey(ip))
+	decision.Policy, decision.Dimension = PolicyDefault, DimensionIP
+	return decision, err
+}
+
+func (p *policy) decideToken(ctx context.Context, token string) (Decision, error) {
+	if !p.config.EnableTokenRateLimiter {
+		return Decision{Allowed: true}, nil
+	}
+	limiter, policyName := p.tokenLimiter, PolicyDefault
+	if tl, exists := p.configuredToken(token); exists {
+		limiter, policyName = tl.limiter, PolicyToken
+	}
+	decision, err := limiter.Decide(ctx, p.tokenKey(token))
+	decision.Policy, decision.Dimension = policyName, DimensionToken
+	return decision, err
+}
+
+// tokenKey returns the storage key for token: a keyed hash of it, so tokens
+// never reach the storage in the clear
+func (p *policy) tokenKey(token string) string {
+	return "token:" + p.hashValue(token)
+}
+
+// hashValue returns a keyed hash of value, for values that must not reach
+// the storage, the admin API or the logs in the clear
+func (p *policy) hashValue(value string) string {
+	mac := hmac.New(sha256.New, p.tokenSecret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// configuredToken returns the limits configured for token, either as is or
+// by its digest
+func (p *policy) configuredToken(token string) (tokenLimiter, bool) {
+	if tl, exists := p.tokens[token]; exists {
+		return tl, true
+	}
+	tl, exists := p.tokens[config.HashToken(token)]
+	return tl, exists
+}
+
+// ipKey returns the storage key for ip, aggregated to the configured prefixes
+func (p *policy) ipKey(ip string) string {
+	return "ip:" + NormalizeIP(ip, p.config.IPv4PrefixLength, p.config.IPv6PrefixLength)
+}
+
+// limiterForToken returns the limiter with the token-specific limits if configured,
+// falling back to the default limits otherwise
+func (p *policy) limiterForToken(token string) *RateLimiter {
+	if tl, exists := p.configuredToken(token); exists {
+		return tl.limiter
+	}
+	return p.tokenLimiter
+}
+
+func (p *policy) isDenied(ip, token string) bool {
+	return containsIP(p.config.DenyIPs, ip) || (token != "" && containsToken(p.config.DenyTokens, token))
+}
+
+func (p *policy) isAllowListed(ip, token string) bool {
+	return containsIP(p.config.AllowIPs, ip) || (token != "" && containsToken(p.config.AllowTokens, token))
+}
+
+// NormalizeIP returns the canonical form of ip, with IPv4-mapped IPv6
+// addresses unwrapped, aggregated to the given prefix lengths
+// An address shorter than its full length prefix becomes the network in CIDR
+// notation, e.g. "2001:db8:1:2::/64"; non-positive prefix lengths keep the
+// full address and values that aren't IP addresses are returned unchanged
+func NormalizeIP(ip string, ipv4PrefixLength, ipv6PrefixLength int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	bits, prefixLength := 128, ipv6PrefixLength
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed, bits, prefixLength = ip4, 32, ipv4PrefixLength
+	}
+	if prefixLength <= 0 || prefixLength >= bits {
+		return parsed.String()
+	}
+
+	ipNet := net.IPNet{IP: parsed.Mask(net.CIDRMask(prefixLength, bits)), Mask: net.CIDRMask(prefixLength, bits)}
+	return ipNet.String()
+}
+
+// containsIP reports whether ip belongs to any of the networks
+func containsIP(nets []*net.IPNet, ip string) bool {
+	if len(nets) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsToken reports whether token is listed, as is or by its digest
+func containsToken(tokens []string, token string) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	hash := config.HashToken(token)
+	for _, t := range tokens {
+		if t == token || t == hash {
+			return true
+		}
+	}
+	return false
+}
@@ -2,31 +2,45 @@ package limiter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"fc-tec-ch-02/internal/config"
-	"fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
 )
 
 // mockStorage is a mock implementation of storage.Storage for testing
 type mockStorage struct {
-	data          map[string]*storage.RateLimitInfo
-	incrementCalls map[string]int
-	getCalls       map[string]int
-	clearCalls     map[string]int
+	mu                     sync.Mutex
+	data                   map[string]*storage.RateLimitInfo
+	incrementCalls         map[string]int
+	checkAndIncrementCalls map[string]int
+	blocks                 map[string]time.Time
+	getCalls               map[string]int
+	clearCalls             map[string]int
 }
 
 func newMockStorage() *mockStorage {
 	return &mockStorage{
 		data:          make(map[string]*storage.RateLimitInfo),
 		incrementCalls: make(map[string]int),
+		checkAndIncrementCalls: make(map[string]int),
+		blocks:         make(map[string]time.Time),
 		getCalls:       make(map[string]int),
 		clearCalls:     make(map[string]int),
 	}
 }
 
 func (m *mockStorage) Increment(ctx context.Context, key string, ttl time.Duration) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.incrementCalls[key]++
 	
 	if info, exists := m.data[key]; exists {
@@ -51,7 +65,36 @@ func (m *mockStorage) Increment(ctx context.Context, key string, ttl time.Durati
 	return 1, resetTime, nil
 }
 
+func (m *mockStorage) CheckAndIncrement(ctx context.Context, key string, limit int, window, blockTime time.Duration) (*storage.RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkAndIncrementCalls[key]++
+
+	info, exists := m.data[key]
+	if !exists || time.Now().After(info.ResetTime) {
+		info = &storage.RateLimitInfo{ResetTime: time.Now().Add(window)}
+		m.data[key] = info
+	}
+
+	if blockedUntil, blocked := m.blocks[key]; blocked && time.Now().Before(blockedUntil) {
+		return &storage.RateLimitResult{Allowed: false, Blocked: true, Count: info.Count, ResetTime: blockedUntil}, nil
+	}
+
+	if info.Count >= limit {
+		if blockTime > 0 {
+			m.blocks[key] = time.Now().Add(blockTime)
+			return &storage.RateLimitResult{Allowed: false, Blocked: true, Count: info.Count, ResetTime: m.blocks[key]}, nil
+		}
+		return &storage.RateLimitResult{Allowed: false, Count: info.Count, ResetTime: info.ResetTime}, nil
+	}
+
+	info.Count++
+	return &storage.RateLimitResult{Allowed: true, Count: info.Count, ResetTime: info.ResetTime}, nil
+}
+
 func (m *mockStorage) Get(ctx context.Context, key string) (*storage.RateLimitInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.getCalls[key]++
 	
 	if info, exists := m.data[key]; exists {
@@ -66,6 +109,8 @@ func (m *mockStorage) Get(ctx context.Context, key string) (*storage.RateLimitIn
 }
 
 func (m *mockStorage) Set(ctx context.Context, key string, count int, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.data[key] = &storage.RateLimitInfo{
 		Count:     count,
 		ResetTime: time.Now().Add(ttl),
@@ -74,11 +119,26 @@ func (m *mockStorage) Set(ctx context.Context, key string, count int, ttl time.D
 }
 
 func (m *mockStorage) Clear(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.clearCalls[key]++
 	delete(m.data, key)
+	delete(m.blocks, key)
 	return nil
 }
 
+func (m *mockStorage) Keys(ctx context.Context, pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.data {
+		if storage.MatchPattern(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
 func (m *mockStorage) Ping(ctx context.Context) error {
 	return nil
 }
@@ -103,28 +163,28 @@ func TestService_CheckAndIncrement_IPOnly(t *testing.T) {
 	
 	// Test: First 5 requests should be allowed
 	for i := 0; i < 5; i++ {
-		allowed, _, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+		decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
 		if err != nil {
 			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
 		}
-		if !allowed {
+		if !decision.Allowed {
 			t.Errorf("Request %d should be allowed, but wasn't", i+1)
 		}
 	}
 	
 	// Test: 6th request should be blocked
-	allowed, resetTime, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "")
 	// Error is allowed when limit is exceeded (ErrLimitExceeded)
-	if allowed {
+	if decision.Allowed {
 		t.Error("6th request should be blocked, but wasn't")
 	}
-	if resetTime.IsZero() {
+	if decision.ResetTime.IsZero() {
 		t.Error("Reset time should not be zero")
 	}
 	
-	// Verify storage was called
-	if mockStore.getCalls["ip:192.168.1.1"] < 5 {
-		t.Errorf("Expected at least 5 Get calls, got %d", mockStore.getCalls["ip:192.168.1.1"])
+	// Verify storage was called once per request
+	if mockStore.checkAndIncrementCalls["ip:192.168.1.1"] != 6 {
+		t.Errorf("Expected 6 CheckAndIncrement calls, got %d", mockStore.checkAndIncrementCalls["ip:192.168.1.1"])
 	}
 }
 
@@ -137,6 +197,7 @@ func TestService_CheckAndIncrement_WithToken(t *testing.T) {
 		BlockingTime:            1 * time.Minute,
 		EnableIPRateLimiter:     true,
 		EnableTokenRateLimiter:  true,
+		TokenMode:               config.TokenModeOverride,
 		TokenLimits:             make(map[string]config.TokenLimit),
 	}
 	
@@ -147,33 +208,33 @@ func TestService_CheckAndIncrement_WithToken(t *testing.T) {
 	
 	// Make 5 requests with token
 	for i := 0; i < 5; i++ {
-		allowed, _, err := service.CheckAndIncrement(ctx, "192.168.1.1", token)
+		decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", token)
 		if err != nil {
 			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
 		}
-		if !allowed {
+		if !decision.Allowed {
 			t.Errorf("Request %d with token should be allowed, but wasn't", i+1)
 		}
 	}
 	
 	// 6th request with token should be blocked
-	allowed, _, err := service.CheckAndIncrement(ctx, "192.168.1.1", token)
+	decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", token)
 	// Error is allowed when limit is exceeded
-	if allowed {
+	if decision.Allowed {
 		t.Error("6th request with token should be blocked, but wasn't")
 	}
 	
 	// IP-based requests should still work (separate counter)
-	allowed, _, err = service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	decision, err = service.CheckAndIncrement(ctx, "192.168.1.1", "")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if !allowed {
+	if !decision.Allowed {
 		t.Error("IP-based request should be allowed (separate from token counter)")
 	}
 	
 	// Verify token storage was used
-	if mockStore.getCalls["token:test-token-123"] == 0 {
+	if mockStore.checkAndIncrementCalls[service.policy.Load().tokenKey("test-token-123")] == 0 {
 		t.Error("Expected token storage to be used")
 	}
 }
@@ -189,8 +250,9 @@ func TestService_CheckAndIncrement_TokenWithSpecificLimits(t *testing.T) {
 		EnableTokenRateLimiter:  true,
 		TokenLimits: map[string]config.TokenLimit{
 			"premium-token": {
-				MaxRequests: 10,
-				TTL:         2 * time.Minute,
+				MaxRequests:  10,
+				Window:       1 * time.Minute,
+				BlockingTime: 2 * time.Minute,
 			},
 		},
 	}
@@ -202,19 +264,19 @@ func TestService_CheckAndIncrement_TokenWithSpecificLimits(t *testing.T) {
 	
 	// Make 10 requests with premium token (should all be allowed)
 	for i := 0; i < 10; i++ {
-		allowed, _, err := service.CheckAndIncrement(ctx, "192.168.1.1", token)
+		decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", token)
 		if err != nil {
 			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
 		}
-		if !allowed {
+		if !decision.Allowed {
 			t.Errorf("Premium token request %d should be allowed, but wasn't", i+1)
 		}
 	}
 	
 	// 11th request should be blocked
-	allowed, _, _ := service.CheckAndIncrement(ctx, "192.168.1.1", token)
+	decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", token)
 	// Error is allowed when limit is exceeded
-	if allowed {
+	if decision.Allowed {
 		t.Error("11th request with premium token should be blocked, but wasn't")
 	}
 }
@@ -235,17 +297,17 @@ func TestService_CheckAndIncrement_IPRateLimiterDisabled(t *testing.T) {
 	
 	// Test: All requests should be allowed when rate limiter is disabled
 	for i := 0; i < 20; i++ {
-		allowed, _, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+		decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
 		if err != nil {
 			t.Fatalf("Unexpected error on request %d: %v", i+1, err)
 		}
-		if !allowed {
+		if !decision.Allowed {
 			t.Errorf("Request %d should be allowed when rate limiter is disabled, but wasn't", i+1)
 		}
 	}
 	
 	// Verify storage was not called
-	if len(mockStore.getCalls) > 0 {
+	if len(mockStore.checkAndIncrementCalls) > 0 {
 		t.Error("Storage should not be called when rate limiter is disabled")
 	}
 }
@@ -270,28 +332,28 @@ func TestService_CheckAndIncrement_DifferentIPs(t *testing.T) {
 	
 	// Exhaust IP1's limit
 	for i := 0; i < 3; i++ {
-		allowed, _, err := service.CheckAndIncrement(ctx, ip1, "")
+		decision, err := service.CheckAndIncrement(ctx, ip1, "")
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
-		if !allowed {
+		if !decision.Allowed {
 			t.Errorf("IP1 request %d should be allowed", i+1)
 		}
 	}
 	
 	// IP1 should now be blocked
-	allowed, _, err := service.CheckAndIncrement(ctx, ip1, "")
+	decision, err := service.CheckAndIncrement(ctx, ip1, "")
 	// Error is allowed when limit is exceeded
-	if allowed {
+	if decision.Allowed {
 		t.Error("IP1 should be blocked after 3 requests")
 	}
 	
 	// IP2 should still be allowed (separate counter)
-	allowed, _, err = service.CheckAndIncrement(ctx, ip2, "")
+	decision, err = service.CheckAndIncrement(ctx, ip2, "")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if !allowed {
+	if !decision.Allowed {
 		t.Error("IP2 should be allowed (separate counter from IP1)")
 	}
 }
@@ -305,6 +367,7 @@ func TestService_CheckAndIncrement_TokenOverridesIP(t *testing.T) {
 		BlockingTime:            1 * time.Minute,
 		EnableIPRateLimiter:     true,
 		EnableTokenRateLimiter:  true,
+		TokenMode:               config.TokenModeOverride,
 		TokenLimits:             make(map[string]config.TokenLimit),
 	}
 	
@@ -314,29 +377,872 @@ func TestService_CheckAndIncrement_TokenOverridesIP(t *testing.T) {
 	
 	// Exhaust IP limit
 	for i := 0; i < 3; i++ {
-		allowed, _, err := service.CheckAndIncrement(ctx, ip, "")
+		decision, err := service.CheckAndIncrement(ctx, ip, "")
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
-		if !allowed {
+		if !decision.Allowed {
 			t.Errorf("IP request %d should be allowed", i+1)
 		}
 	}
 	
 	// IP should be blocked
-	allowed, _, err := service.CheckAndIncrement(ctx, ip, "")
+	decision, err := service.CheckAndIncrement(ctx, ip, "")
 	// Error is allowed when limit is exceeded
-	if allowed {
+	if decision.Allowed {
 		t.Error("IP should be blocked after exhausting limit")
 	}
 	
 	// Same IP with token should still be allowed (token takes precedence)
-	allowed, _, err = service.CheckAndIncrement(ctx, ip, token)
+	decision, err = service.CheckAndIncrement(ctx, ip, token)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if !allowed {
+	if !decision.Allowed {
 		t.Error("Request with token should be allowed even if IP is blocked")
 	}
 }
 
+
+func TestService_CheckAndIncrement_ConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   10,
+		BlockingTime:           1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: false,
+		TokenLimits:            make(map[string]config.TokenLimit),
+	}
+
+	service := NewService(mockStore, cfg)
+
+	// Test: 200 parallel requests must never admit more than the limit
+	const requests = 200
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	wg.Add(requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			defer wg.Done()
+			decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+			if decision.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != cfg.MaxRequestsPerSecond {
+		t.Errorf("Expected exactly %d allowed requests, got %d", cfg.MaxRequestsPerSecond, allowed)
+	}
+
+	// Verify each request cost a single storage operation
+	if mockStore.checkAndIncrementCalls["ip:192.168.1.1"] != requests {
+		t.Errorf("Expected %d CheckAndIncrement calls, got %d", requests, mockStore.checkAndIncrementCalls["ip:192.168.1.1"])
+	}
+	if mockStore.getCalls["ip:192.168.1.1"] != 0 || mockStore.incrementCalls["ip:192.168.1.1"] != 0 {
+		t.Error("Expected no separate Get/Increment calls")
+	}
+}
+
+func TestService_CheckAndIncrement_WindowResetsCount(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   3,
+		RateLimitWindow:        50 * time.Millisecond,
+		BlockingTime:           0,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: false,
+		TokenLimits:            make(map[string]config.TokenLimit),
+	}
+
+	service := NewService(mockStore, cfg)
+
+	// Exhaust the window
+	for i := 0; i < 3; i++ {
+		decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+		if err != nil || !decision.Allowed {
+			t.Fatalf("Request %d should be allowed (err: %v)", i+1, err)
+		}
+	}
+	decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if decision.Allowed {
+		t.Error("4th request in the same window should be rejected")
+	}
+
+	// Once the window elapses the count starts over
+	time.Sleep(60 * time.Millisecond)
+	decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !decision.Allowed {
+		t.Error("Request in a new window should be allowed")
+	}
+}
+
+func TestService_CheckAndIncrement_BlockOutlivesWindow(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   2,
+		RateLimitWindow:        50 * time.Millisecond,
+		BlockingTime:           1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: false,
+		TokenLimits:            make(map[string]config.TokenLimit),
+	}
+
+	service := NewService(mockStore, cfg)
+
+	for i := 0; i < 2; i++ {
+		decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+		if err != nil || !decision.Allowed {
+			t.Fatalf("Request %d should be allowed (err: %v)", i+1, err)
+		}
+	}
+
+	// Exceeding the window limit blocks the key for the blocking time
+	decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if decision.Allowed {
+		t.Fatal("3rd request should be blocked")
+	}
+	if err != ErrLimitExceeded {
+		t.Errorf("Expected ErrLimitExceeded, got: %v", err)
+	}
+	if time.Until(decision.ResetTime) < 59*time.Second {
+		t.Errorf("Reset time should be the end of the blocking period, got %v", decision.ResetTime)
+	}
+
+	// The block still applies after the counting window has reset
+	time.Sleep(60 * time.Millisecond)
+	decision, _ = service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if decision.Allowed {
+		t.Error("Request should still be blocked after the window resets")
+	}
+}
+
+func TestService_CheckAndIncrement_TokenWindowAndBlock(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   1,
+		RateLimitWindow:        1 * time.Minute,
+		BlockingTime:           1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenLimits: map[string]config.TokenLimit{
+			"burst-token": {
+				MaxRequests:  2,
+				Window:       50 * time.Millisecond,
+				BlockingTime: 0,
+			},
+		},
+	}
+
+	service := NewService(mockStore, cfg)
+
+	// Token uses its own window rather than the global one
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 2; i++ {
+			decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "burst-token")
+			if err != nil || !decision.Allowed {
+				t.Fatalf("Round %d request %d should be allowed (err: %v)", round+1, i+1, err)
+			}
+		}
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	// Token without its own blocking time inherits the global one
+	for i := 0; i < 2; i++ {
+		service.CheckAndIncrement(ctx, "192.168.1.1", "burst-token")
+	}
+	decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "burst-token")
+	if decision.Allowed {
+		t.Fatal("Token should be blocked after exceeding its window limit")
+	}
+	if time.Until(decision.ResetTime) < 59*time.Second {
+		t.Errorf("Token should inherit the global blocking time, got reset %v", decision.ResetTime)
+	}
+}
+
+func TestService_CheckAndIncrement_AllowAndDenyLists(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	_, banned, _ := net.ParseCIDR("10.6.6.0/24")
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   1,
+		RateLimitWindow:        1 * time.Minute,
+		BlockingTime:           1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		AllowIPs:               []*net.IPNet{internal},
+		DenyIPs:                []*net.IPNet{banned},
+		AllowTokens:            []string{"trusted"},
+		DenyTokens:             []string{"revoked"},
+	}
+
+	service := NewService(mockStore, cfg)
+
+	// Allow-listed IPs and tokens are never limited or counted
+	for i := 0; i < 5; i++ {
+		if decision, err := service.CheckAndIncrement(ctx, "10.1.2.3", ""); err != nil || !decision.Allowed {
+			t.Fatalf("Allow-listed IP request %d should be allowed (err: %v)", i+1, err)
+		}
+		if decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "trusted"); err != nil || !decision.Allowed {
+			t.Fatalf("Allow-listed token request %d should be allowed (err: %v)", i+1, err)
+		}
+	}
+	if calls := len(mockStore.checkAndIncrementCalls); calls != 0 {
+		t.Errorf("Expected no storage calls for allow-listed requests, got %d keys", calls)
+	}
+
+	// Deny lists win over allow lists
+	if _, err := service.CheckAndIncrement(ctx, "10.6.6.6", ""); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied for denied IP, got %v", err)
+	}
+	if _, err := service.CheckAndIncrement(ctx, "10.1.2.3", "revoked"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied for denied token, got %v", err)
+	}
+
+	// Everyone else is limited as usual
+	service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", ""); decision.Allowed {
+		t.Error("Unlisted IP should be rate limited")
+	}
+}
+
+func TestService_Reload(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   1,
+		RateLimitWindow:        1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenLimits:            map[string]config.TokenLimit{},
+	}
+
+	service := NewService(mockStore, cfg)
+
+	service.CheckAndIncrement(ctx, "192.168.1.1", "abc")
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "abc"); decision.Allowed {
+		t.Fatal("Token should be limited to 1 request before the reload")
+	}
+
+	reloaded := *cfg
+	reloaded.TokenLimits = map[string]config.TokenLimit{"abc": {MaxRequests: 3}}
+	reloaded.DenyTokens = []string{"revoked"}
+
+	changes := service.Reload(&reloaded)
+	if len(changes) != 2 {
+		t.Errorf("Expected 2 changes, got %v", changes)
+	}
+	if service.Config() != &reloaded {
+		t.Error("Config should return the reloaded configuration")
+	}
+
+	// The token keeps its counter but gets the new limit
+	if decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "abc"); !decision.Allowed || err != nil {
+		t.Errorf("Token should be allowed under the reloaded limit (err: %v)", err)
+	}
+	if _, err := service.CheckAndIncrement(ctx, "192.168.1.1", "revoked"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied after the reload, got %v", err)
+	}
+}
+
+func TestService_CheckAndIncrement_DecisionPolicy(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        1 * time.Second,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenLimits: map[string]config.TokenLimit{
+			"premium": {MaxRequests: 100, Window: 10 * time.Second},
+		},
+		AllowTokens: []string{"trusted"},
+	}
+
+	service := NewService(mockStore, cfg)
+
+	tests := []struct {
+		token  string
+		limit  int
+		window time.Duration
+		policy string
+	}{
+		{"", 5, time.Second, PolicyDefault},
+		{"basic", 5, time.Second, PolicyDefault},
+		{"premium", 100, 10 * time.Second, PolicyToken},
+		{"trusted", 0, 0, ""},
+	}
+
+	for i, tt := range tests {
+		// Each request comes from its own IP, as unknown tokens are limited by IP
+		decision, err := service.CheckAndIncrement(ctx, fmt.Sprintf("192.168.1.%d", i+1), tt.token)
+		if err != nil {
+			t.Fatalf("Unexpected error for token %q: %v", tt.token, err)
+		}
+		if decision.Limit != tt.limit || decision.Window != tt.window || decision.Policy != tt.policy {
+			t.Errorf("Unexpected decision for token %q: %+v", tt.token, decision)
+		}
+		if tt.limit > 0 && decision.Remaining != tt.limit-1 {
+			t.Errorf("Expected %d remaining for token %q, got %d", tt.limit-1, tt.token, decision.Remaining)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		ip         string
+		ipv4Prefix int
+		ipv6Prefix int
+		want       string
+	}{
+		{"192.168.1.1", 32, 64, "192.168.1.1"},
+		{"192.168.1.1", 24, 64, "192.168.1.0/24"},
+		{"::ffff:192.168.1.1", 32, 64, "192.168.1.1"},
+		{"::ffff:192.168.1.1", 16, 64, "192.168.0.0/16"},
+		{"2001:DB8:0:0:1:2:3:4", 32, 128, "2001:db8::1:2:3:4"},
+		{"2001:db8:1:2:aaaa:bbbb:cccc:dddd", 32, 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:aaaa:bbbb:cccc:dddd", 32, 48, "2001:db8:1::/48"},
+		{"2001:db8::1", 32, 0, "2001:db8::1"},
+		{"not-an-ip", 32, 64, "not-an-ip"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeIP(tt.ip, tt.ipv4Prefix, tt.ipv6Prefix); got != tt.want {
+			t.Errorf("NormalizeIP(%q, %d, %d) = %q, want %q", tt.ip, tt.ipv4Prefix, tt.ipv6Prefix, got, tt.want)
+		}
+	}
+}
+
+func TestService_CheckAndIncrement_IPv6PrefixAggregation(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond: 2,
+		RateLimitWindow:      1 * time.Minute,
+		EnableIPRateLimiter:  true,
+		IPv4PrefixLength:     32,
+		IPv6PrefixLength:     64,
+	}
+
+	service := NewService(mockStore, cfg)
+
+	// Rotating addresses within the same /64 shares one counter
+	service.CheckAndIncrement(ctx, "2001:db8:1:2::1", "")
+	service.CheckAndIncrement(ctx, "2001:db8:1:2::2", "")
+	if decision, _ := service.CheckAndIncrement(ctx, "2001:db8:1:2:ffff::3", ""); decision.Allowed {
+		t.Error("Third request from the same /64 should be blocked")
+	}
+	if calls := mockStore.checkAndIncrementCalls["ip:2001:db8:1:2::/64"]; calls != 3 {
+		t.Errorf("Expected 3 calls for the /64 key, got %d", calls)
+	}
+
+	// Another /64 and IPv4-mapped addresses get their own counters
+	if decision, _ := service.CheckAndIncrement(ctx, "2001:db8:1:3::1", ""); !decision.Allowed {
+		t.Error("Request from another /64 should be allowed")
+	}
+	service.CheckAndIncrement(ctx, "::ffff:192.0.2.1", "")
+	if calls := mockStore.checkAndIncrementCalls["ip:192.0.2.1"]; calls != 1 {
+		t.Errorf("Expected the IPv4-mapped address to be unwrapped, got calls %v", mockStore.checkAndIncrementCalls)
+	}
+}
+
+func TestService_MatchRoute(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        1 * time.Second,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		Routes: []config.RouteRule{
+			{Name: "health", Pattern: "/health", Exempt: true},
+			{Name: "login", Pattern: "POST /login", Limit: config.TokenLimit{MaxRequests: 1, Window: time.Minute}},
+			{Name: "orders", Pattern: "/orders/{id}", Limit: config.TokenLimit{MaxRequests: 10}},
+			{Name: "orders-any", Pattern: "/orders/", Limit: config.TokenLimit{MaxRequests: 20}},
+		},
+	}
+
+	service := NewService(mockStore, cfg)
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/health", "health"},
+		{"POST", "/login", "login"},
+		{"GET", "/login", PolicyDefault},
+		{"GET", "/orders/42", "orders"},
+		{"GET", "/orders/42/items", "orders-any"},
+		{"GET", "/", PolicyDefault},
+	}
+
+	for _, tt := range tests {
+		if got := service.MatchRoute(tt.method, "example.com", tt.path).Name(); got != tt.want {
+			t.Errorf("MatchRoute(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	// Exempt routes are never counted
+	health := service.MatchRoute("GET", "example.com", "/health")
+	for i := 0; i < 10; i++ {
+		if decision, err := health.CheckAndIncrement(ctx, "192.168.1.1", ""); err != nil || !decision.Allowed {
+			t.Fatalf("Exempt route should always be allowed, got %+v, %v", decision, err)
+		}
+	}
+	if len(mockStore.checkAndIncrementCalls) != 0 {
+		t.Errorf("Exempt route should not touch storage, got calls %v", mockStore.checkAndIncrementCalls)
+	}
+
+	// Route limits are counted apart from the default limits and named after the rule
+	login := service.MatchRoute("POST", "example.com", "/login")
+	decision, err := login.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if err != nil || !decision.Allowed {
+		t.Fatalf("First login should be allowed, got %+v, %v", decision, err)
+	}
+	if decision.Policy != "login" || decision.Limit != 1 || decision.Window != time.Minute {
+		t.Errorf("Unexpected login decision: %+v", decision)
+	}
+	if decision, _ := login.CheckAndIncrement(ctx, "192.168.1.1", ""); decision.Allowed {
+		t.Error("Second login should be blocked")
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", ""); !decision.Allowed {
+		t.Error("Default limit should not be affected by the login route")
+	}
+	if calls := mockStore.checkAndIncrementCalls["route:login:ip:192.168.1.1"]; calls != 2 {
+		t.Errorf("Expected 2 calls for the login route key, got %d", calls)
+	}
+}
+
+func TestService_CheckAndIncrement_TokenModes(t *testing.T) {
+	ctx := context.Background()
+
+	newService := func(mode string) (*Service, *mockStorage) {
+		mockStore := newMockStorage()
+		return NewService(mockStore, &config.Config{
+			MaxRequestsPerSecond:   2,
+			RateLimitWindow:        1 * time.Minute,
+			EnableIPRateLimiter:    true,
+			EnableTokenRateLimiter: true,
+			TokenMode:              mode,
+			TokenLimits: map[string]config.TokenLimit{
+				"premium": {MaxRequests: 100},
+			},
+		}), mockStore
+	}
+
+	// Fallback: a new unknown token per request still hits the IP limit
+	service, mockStore := newService(config.TokenModeFallback)
+	for i := 0; i < 2; i++ {
+		if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", fmt.Sprintf("random-%d", i)); !decision.Allowed {
+			t.Errorf("Request %d with an unknown token should be allowed", i+1)
+		}
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "random-2"); decision.Allowed {
+		t.Error("Unknown tokens should share the IP limit")
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "premium"); !decision.Allowed || decision.Policy != PolicyToken {
+		t.Errorf("Known token should be limited by its own limit, got %+v", decision)
+	}
+	if calls := mockStore.checkAndIncrementCalls[service.policy.Load().tokenKey("random-0")]; calls != 0 {
+		t.Errorf("Unknown tokens should not get counters of their own, got %d calls", calls)
+	}
+
+	// Both: the IP limit applies to known tokens too, checked with the token
+	// limit in a single storage operation
+	memoryStore := storage.NewMemoryStorage(0, 0)
+	defer memoryStore.Close()
+	bothConfig := *service.Config()
+	bothConfig.TokenMode = config.TokenModeBoth
+	service = NewService(memoryStore, &bothConfig)
+	service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "premium"); decision.Allowed {
+		t.Error("Known token should be rejected once its IP is limited")
+	}
+
+	// Override: any token bypasses the IP limit
+	service, _ = newService(config.TokenModeOverride)
+	service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	service.CheckAndIncrement(ctx, "192.168.1.1", "")
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "random"); !decision.Allowed {
+		t.Error("Unknown token should get its own limit in override mode")
+	}
+}
+
+func TestService_CheckAndIncrement_TokenIPCeiling(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage(0, 0)
+	defer store.Close()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   10,
+		RateLimitWindow:        1 * time.Minute,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeFallback,
+		TokenLimits: map[string]config.TokenLimit{
+			"shared": {MaxRequests: 3, IPMaxRequests: 2},
+		},
+	}
+
+	service := NewService(store, cfg)
+
+	for i := 0; i < 2; i++ {
+		if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "shared"); !decision.Allowed {
+			t.Errorf("Request %d should be allowed", i+1)
+		}
+	}
+	decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "shared")
+	if !errors.Is(err, ErrLimitExceeded) || decision.Policy != PolicyTokenIP {
+		t.Errorf("Expected the per-IP ceiling to reject, got %+v, %v", decision, err)
+	}
+
+	// The rejection by the ceiling didn't consume the token's own limit
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.2", "shared"); !decision.Allowed || decision.Remaining != 0 {
+		t.Errorf("Expected the last request of the token from another IP, got %+v", decision)
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.3", "shared"); decision.Allowed || decision.Policy != PolicyToken {
+		t.Errorf("Expected the token limit to reject, got %+v", decision)
+	}
+}
+
+func TestService_CheckAndIncrement_BothModeIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage(0, 0)
+	defer store.Close()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   10,
+		RateLimitWindow:        1 * time.Minute,
+		RateLimitAlgorithm:     config.AlgorithmSlidingWindowLog,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeBoth,
+		TokenLimits: map[string]config.TokenLimit{
+			"token": {MaxRequests: 2},
+		},
+	}
+
+	service := NewService(store, cfg)
+
+	service.CheckAndIncrement(ctx, "192.168.1.1", "token")
+	service.CheckAndIncrement(ctx, "192.168.1.1", "token")
+
+	// The token rejects the request after the IP admitted it
+	decision, err := service.CheckAndIncrement(ctx, "192.168.1.2", "token")
+	if !errors.Is(err, ErrLimitExceeded) || decision.Policy != PolicyToken {
+		t.Fatalf("Expected the token limit to reject, got %+v, %v", decision, err)
+	}
+
+	// so the IP's counter was left untouched
+	decision, err = service.CheckAndIncrement(ctx, "192.168.1.2", "")
+	if err != nil || decision.Remaining != 9 {
+		t.Errorf("Expected the rejected request not to count against the IP, got %+v, %v", decision, err)
+	}
+}
+
+func TestService_CheckAndIncrement_MultiLimitNotSupported(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   10,
+		RateLimitWindow:        1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeBoth,
+		FailureMode:            config.FailureModeClosed,
+		TokenLimits: map[string]config.TokenLimit{
+			"token": {MaxRequests: 2},
+		},
+	}
+	if err := CheckStorage(mockStore, cfg); !errors.Is(err, ErrMultiLimitNotSupported) {
+		t.Errorf("Expected token mode both to be rejected on the mock storage, got %v", err)
+	}
+	memoryStore := storage.NewMemoryStorage(0, 0)
+	defer memoryStore.Close()
+	if err := CheckStorage(memoryStore, cfg); err != nil {
+		t.Errorf("Expected token mode both to be accepted on the memory storage, got %v", err)
+	}
+
+	ceiling := &config.Config{
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeFallback,
+		Tiers:                  map[string]config.TokenLimit{"pro": {MaxRequests: 5, IPMaxRequests: 2}},
+	}
+	if err := CheckStorage(mockStore, ceiling); !errors.Is(err, ErrMultiLimitNotSupported) {
+		t.Errorf("Expected a per-IP ceiling to be rejected on the mock storage, got %v", err)
+	}
+	ceiling.Tiers = nil
+	if err := CheckStorage(mockStore, ceiling); err != nil {
+		t.Errorf("Expected a single limit per request to be accepted, got %v", err)
+	}
+
+	// Checked one at a time, the IP would count requests the token rejects,
+	// so the request fails instead of being counted by either, whatever the
+	// failure mode
+	for _, mode := range []string{config.FailureModeClosed, config.FailureModeOpen} {
+		cfg.FailureMode = mode
+		decision, err := NewService(mockStore, cfg).CheckAndIncrement(ctx, "192.168.1.1", "token")
+		if !errors.Is(err, ErrMultiLimitNotSupported) || errors.Is(err, ErrUnavailable) || decision.Allowed || decision.Degraded {
+			t.Errorf("Expected the request to fail as unsupported with failure mode %s, got %+v, %v", mode, decision, err)
+		}
+	}
+	if len(mockStore.checkAndIncrementCalls) != 0 {
+		t.Errorf("Expected no counter to be touched, got %v", mockStore.checkAndIncrementCalls)
+	}
+	service := NewService(mockStore, cfg)
+
+	// A request counted by a single limit is still decided
+	if decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", ""); err != nil || !decision.Allowed {
+		t.Errorf("Expected an anonymous request to be allowed, got %+v, %v", decision, err)
+	}
+}
+
+func TestService_CheckAndIncrement_TokenRegistry(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   2,
+		RateLimitWindow:        1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeFallback,
+		UnknownTokenAction:     config.UnknownTokenIP,
+		TokenLimits: map[string]config.TokenLimit{
+			"configured": {MaxRequests: 50},
+		},
+		Tiers: map[string]config.TokenLimit{
+			"pro": {MaxRequests: 3},
+		},
+	}
+
+	tokens := registry.NewMemoryRegistry()
+	tokens.Put(ctx, &registry.Token{ID: "tok_pro", Hash: registry.HashSecret("pro-secret"), Tier: "pro"})
+	tokens.Put(ctx, &registry.Token{ID: "tok_custom", Hash: registry.HashSecret("custom-secret"), Tier: "pro", Limit: &config.LimitPolicy{MaxRequests: 5}})
+	tokens.Put(ctx, &registry.Token{ID: "tok_revoked", Hash: registry.HashSecret("revoked-secret"), Tier: "pro", Disabled: true})
+
+	service := NewService(mockStore, cfg)
+	service.SetTokenRegistry(tokens)
+
+	// Registered tokens are counted by ID under their tier's limit
+	for i := 0; i < 3; i++ {
+		if decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "pro-secret"); err != nil || decision.Policy != "pro" {
+			t.Errorf("Request %d should be allowed by the pro tier, got %+v, %v", i+1, decision, err)
+		}
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "pro-secret"); decision.Allowed {
+		t.Error("Request 4 should exceed the pro tier")
+	}
+	if calls := mockStore.checkAndIncrementCalls["token:id:tok_pro"]; calls != 4 {
+		t.Errorf("Expected 4 calls for the token ID, got %d", calls)
+	}
+
+	// A token's own limit takes precedence over its tier
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "custom-secret"); decision.Limit != 5 || decision.Policy != PolicyToken {
+		t.Errorf("Expected the token's own limit of 5, got %+v", decision)
+	}
+
+	// Configured tokens take precedence over the registry
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "configured"); decision.Limit != 50 {
+		t.Errorf("Expected the configured limit of 50, got %+v", decision)
+	}
+
+	// Revoked and unknown tokens are limited by IP
+	for _, token := range []string{"revoked-secret", "unknown"} {
+		if decision, err := service.CheckAndIncrement(ctx, "192.168.1.2", token); err != nil || decision.Policy != PolicyDefault {
+			t.Errorf("Expected %s to be limited by IP, got %+v, %v", token, decision, err)
+		}
+	}
+	if calls := mockStore.checkAndIncrementCalls["ip:192.168.1.2"]; calls != 2 {
+		t.Errorf("Expected 2 calls for the IP, got %d", calls)
+	}
+
+	// or rejected
+	rejecting := *cfg
+	rejecting.UnknownTokenAction = config.UnknownTokenReject
+	service.Reload(&rejecting)
+	for _, token := range []string{"revoked-secret", "unknown"} {
+		if _, err := service.CheckAndIncrement(ctx, "192.168.1.3", token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Expected ErrInvalidToken for %s, got %v", token, err)
+		}
+	}
+	if _, err := service.CheckAndIncrement(ctx, "192.168.1.3", ""); err != nil {
+		t.Errorf("Expected requests without a token to be limited by IP, got %v", err)
+	}
+}
+
+func TestService_CheckAndIncrement_HashedTokens(t *testing.T) {
+	ctx := context.Background()
+	mockStore := newMockStorage()
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:   2,
+		RateLimitWindow:        1 * time.Minute,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeFallback,
+		TokenHashSecret:        "pepper",
+		TokenLimits: map[string]config.TokenLimit{
+			config.HashToken("declared-by-hash"): {MaxRequests: 10},
+		},
+		AllowTokens: []string{config.HashToken("internal")},
+	}
+
+	service := NewService(mockStore, cfg)
+
+	decision, err := service.CheckAndIncrement(ctx, "192.168.1.1", "declared-by-hash")
+	if err != nil || decision.Limit != 10 || decision.Policy != PolicyToken {
+		t.Errorf("Expected the limit declared by hash, got %+v, %v", decision, err)
+	}
+	for key := range mockStore.checkAndIncrementCalls {
+		if strings.Contains(key, "declared-by-hash") {
+			t.Errorf("Expected the token to be hashed in storage keys, got %q", key)
+		}
+	}
+	if decision, _ := service.CheckAndIncrement(ctx, "192.168.1.1", "internal"); !decision.Allowed || decision.Limit != 0 {
+		t.Errorf("Expected the token allow-listed by hash to be exempt, got %+v", decision)
+	}
+
+	// Keys depend on the secret, so they can't be derived from a token alone
+	other := NewService(mockStore, &config.Config{TokenHashSecret: "salt"})
+	if service.policy.Load().tokenKey("token") == other.policy.Load().tokenKey("token") {
+		t.Error("Expected token keys to depend on the secret")
+	}
+
+	// Without a secret every service keys tokens with a random one of its own
+	unkeyed := NewService(mockStore, &config.Config{})
+	if key := unkeyed.policy.Load().tokenKey("token"); key == NewService(mockStore, &config.Config{}).policy.Load().tokenKey("token") {
+		t.Errorf("Expected services without a secret to key tokens differently, got %q twice", key)
+	}
+	key := unkeyed.policy.Load().tokenKey("token")
+	unkeyed.Reload(&config.Config{})
+	if reloaded := unkeyed.policy.Load().tokenKey("token"); reloaded != key {
+		t.Errorf("Expected a reload to keep the random secret, got %q then %q", key, reloaded)
+	}
+}
+
+func TestService_FailureModes(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	var down atomic.Bool
+	down.Store(true)
+	failing := storage.Intercept(store, func(operation string, call func() error) error {
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return call()
+	})
+
+	cfg := &config.Config{
+		MaxRequestsPerSecond:  5,
+		RateLimitWindow:       time.Minute,
+		RateLimitAlgorithm:    config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:   true,
+		FailureMode:           config.FailureModeClosed,
+		FailureLocalInstances: 2,
+		Routes: []config.RouteRule{
+			{Name: "public", Pattern: "/public/", Limit: config.TokenLimit{MaxRequests: 5}, FailureMode: config.FailureModeOpen},
+			{Name: "search", Pattern: "/search", Limit: config.TokenLimit{MaxRequests: 4}, FailureMode: config.FailureModeLocal},
+		},
+	}
+	service := NewService(failing, cfg)
+
+	decision, err := service.MatchRoute("GET", "", "/orders").CheckAndIncrement(ctx, "10.0.0.1", "")
+	if !errors.Is(err, ErrUnavailable) || decision.Allowed || !decision.Degraded {
+		t.Errorf("Expected a closed failure to be rejected, got %+v, %v", decision, err)
+	}
+
+	decision, err = service.MatchRoute("GET", "", "/public/page").CheckAndIncrement(ctx, "10.0.0.1", "")
+	if err != nil || !decision.Allowed || !decision.Degraded {
+		t.Errorf("Expected an open failure to be allowed, got %+v, %v", decision, err)
+	}
+
+	// Each of the 2 instances admits half of the limit
+	search := service.MatchRoute("GET", "", "/search")
+	for i := 0; i < 2; i++ {
+		decision, err := search.CheckAndIncrement(ctx, "10.0.0.1", "")
+		if err != nil || !decision.Allowed || !decision.Degraded || decision.Limit != 2 {
+			t.Fatalf("Expected request %d to be admitted by the local limit, got %+v, %v", i+1, decision, err)
+		}
+	}
+	if _, err := search.CheckAndIncrement(ctx, "10.0.0.1", ""); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Expected the local limit to be exceeded, got %v", err)
+	}
+
+	// Requests are checked against the storage again once it answers
+	down.Store(false)
+	if decision, err := search.CheckAndIncrement(ctx, "10.0.0.1", ""); err != nil || decision.Degraded || decision.Limit != 4 {
+		t.Errorf("Expected the storage's limit, got %+v, %v", decision, err)
+	}
+}
+
+func TestService_FailureModes_TokenRegistry(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	var down atomic.Bool
+	failing := storage.Intercept(store, func(operation string, call func() error) error {
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return call()
+	})
+
+	tokens := registry.NewMemoryRegistry()
+	tokens.Put(ctx, &registry.Token{ID: "tok_pro", Hash: registry.HashSecret("pro-secret"), Tier: "pro"})
+	service := NewService(failing, &config.Config{
+		MaxRequestsPerSecond:   2,
+		RateLimitWindow:        time.Minute,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		TokenMode:              config.TokenModeFallback,
+		UnknownTokenAction:     config.UnknownTokenReject,
+		FailureMode:            config.FailureModeLocal,
+		Tiers:                  map[string]config.TokenLimit{"pro": {MaxRequests: 3}},
+	})
+	service.SetTokenRegistry(registry.NewCachedRegistry(registry.NewStorageRegistry(tokens, failing), time.Minute))
+
+	if decision, err := service.CheckAndIncrement(ctx, "10.0.0.1", "pro-secret"); err != nil || decision.Policy != "pro" {
+		t.Fatalf("Expected the pro tier, got %+v, %v", decision, err)
+	}
+
+	// Locally, the cached token keeps its tier and a token never looked up
+	// is counted like an unregistered token instead of being rejected
+	down.Store(true)
+	if decision, err := service.CheckAndIncrement(ctx, "10.0.0.1", "pro-secret"); err != nil || !decision.Degraded || decision.Policy != "pro" {
+		t.Errorf("Expected the cached pro tier locally, got %+v, %v", decision, err)
+	}
+	if decision, err := service.CheckAndIncrement(ctx, "10.0.0.2", "new-secret"); err != nil || !decision.Allowed || !decision.Degraded || decision.Policy != PolicyDefault {
+		t.Errorf("Expected the default limits locally, got %+v, %v", decision, err)
+	}
+}
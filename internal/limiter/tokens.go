@@ -0,0 +1,103 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+)
+
+// Errors of the token management calls
+var (
+	ErrNoTokenRegistry = errors.New("no token registry is configured")
+	ErrUnknownTier     = errors.New("unknown tier")
+)
+
+// Tokens lists the tokens of the token registry, ordered by ID
+func (s *Service) Tokens(ctx context.Context) ([]*registry.Token, error) {
+	r, err := s.tokenRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return r.List(ctx)
+}
+
+// CreateToken registers a new token of owner, limited by tier's limits or
+// the default token limit when tier is empty
+// The secret is only returned here; the registry keeps its hash
+func (s *Service) CreateToken(ctx context.Context, owner, tier string) (*registry.Token, string, error) {
+	r, err := s.tokenRegistry()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.checkTier(tier); err != nil {
+		return nil, "", err
+	}
+
+	token, secret, err := registry.NewToken(owner, tier)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := r.Put(ctx, token); err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// RevokeToken disables the registered token id, which is then handled as
+// an unknown token; its record is kept
+func (s *Service) RevokeToken(ctx context.Context, id string) (*registry.Token, error) {
+	return s.updateToken(ctx, id, func(token *registry.Token) error {
+		token.Disabled = true
+		return nil
+	})
+}
+
+// SetTokenTier moves the registered token id to tier, or to the default
+// token limit when tier is empty; a limit of the token's own still wins
+func (s *Service) SetTokenTier(ctx context.Context, id, tier string) (*registry.Token, error) {
+	return s.updateToken(ctx, id, func(token *registry.Token) error {
+		if err := s.checkTier(tier); err != nil {
+			return err
+		}
+		token.Tier = tier
+		return nil
+	})
+}
+
+// updateToken changes the record of the registered token id with update
+func (s *Service) updateToken(ctx context.Context, id string, update func(token *registry.Token) error) (*registry.Token, error) {
+	r, err := s.tokenRegistry()
+	if err != nil {
+		return nil, err
+	}
+	token, err := r.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(token); err != nil {
+		return nil, err
+	}
+	if err := r.Put(ctx, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// tokenRegistry returns the token registry in use, or ErrNoTokenRegistry
+func (s *Service) tokenRegistry() (registry.TokenRegistry, error) {
+	r := s.policy.Load().registry
+	if r == nil {
+		return nil, ErrNoTokenRegistry
+	}
+	return r, nil
+}
+
+// checkTier returns ErrUnknownTier unless tier is empty or configured
+func (s *Service) checkTier(tier string) error {
+	if _, exists := s.Config().Tiers[tier]; tier != "" && !exists {
+		return fmt.Errorf("%w %q", ErrUnknownTier, tier)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Package metrics exports the rate limiter's metrics in the Prometheus text
+// exposition format
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+// Decision results
+const (
+	ResultAllowed      = "allowed"
+	ResultLimited      = "limited"
+	ResultDenied       = "denied"
+	ResultInvalidToken = "invalid_token"
+	ResultFailedOpen   = "failed_open" // allowed without a limit as the storage failed
+	ResultUnavailable  = "unavailable" // rejected as the storage failed
+	ResultError        = "error"
+)
+
+// dimensionNone labels decisions no limit applied to
+const dimensionNone = "none"
+
+// blockedKeysInterval is how often the blocked keys are counted; scrapes
+// report the latest count
+const blockedKeysInterval = 15 * time.Second
+
+// blockedKeysTimeout bounds a count of the blocked keys
+const blockedKeysTimeout = 5 * time.Second
+
+// Metrics holds the collectors of the rate limiter in their own registry
+// It observes the middleware's decisions as a middleware.Observer and times
+// storage operations through InstrumentStorage
+type Metrics struct {
+	registry       *prometheus.Registry
+	decisions      *prometheus.CounterVec
+	overhead       prometheus.Histogram
+	storageLatency *prometheus.HistogramVec
+	storageErrors  *prometheus.CounterVec
+}
+
+// New creates the rate limiter's metrics, along with the Go runtime and
+// process metrics
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimit_decisions_total",
+			Help: "Requests checked by the rate limiter, by result, the dimension of the deciding limit and rule.",
+		}, []string{"result", "dimension", "rule"}),
+		overhead: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ratelimit_middleware_duration_seconds",
+			Help:    "Time the rate limit middleware spent matching and checking a request.",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+		}),
+		storageLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ratelimit_storage_operation_duration_seconds",
+			Help:    "Latency of storage operations, by operation.",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+		}, []string{"operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimit_storage_errors_total",
+			Help: "Storage operations that failed, by operation.",
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(
+		m.decisions,
+		m.overhead,
+		m.storageLatency,
+		m.storageErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveDecision counts a decision of the rule
+func (m *Metrics) ObserveDecision(rule string, decision limiter.Decision, err error) {
+	dimension := decision.Dimension
+	if dimension == "" {
+		dimension = dimensionNone
+	}
+	m.decisions.WithLabelValues(result(decision, err), dimension, rule).Inc()
+}
+
+// ObserveOverhead records the time the middleware spent on a request
+func (m *Metrics) ObserveOverhead(d time.Duration) {
+	m.overhead.Observe(d.Seconds())
+}
+
+// WatchBlockedKeys exports the number of keys currently blocked in store,
+// counted now and then in the background until ctx is done rather than on
+// every scrape
+// store should be the storage itself, not the one the limiter uses through
+// InstrumentStorage and the circuit breaker, so that counting doesn't show
+// up as request traffic or trip the breaker
+func (m *Metrics) WatchBlockedKeys(ctx context.Context, store storage.Storage) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ratelimit_blocked_keys",
+		Help: "Keys currently blocked, or -1 when they couldn't be counted.",
+	})
+	m.registry.MustRegister(gauge)
+
+	gauge.Set(countBlockedKeys(ctx, store))
+	go func() {
+		ticker := time.NewTicker(blockedKeysInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				gauge.Set(countBlockedKeys(ctx, store))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// countBlockedKeys returns the number of keys blocked in store, or -1 when
+// the storage fails
+func countBlockedKeys(ctx context.Context, store storage.Storage) float64 {
+	ctx, cancel := context.WithTimeout(ctx, blockedKeysTimeout)
+	defer cancel()
+	blockKeys, err := store.Keys(ctx, storage.BlockKey("*"))
+	if err != nil {
+		return -1
+	}
+	count := 0
+	for _, blockKey := range blockKeys {
+		if _, ok := storage.BlockedKey(blockKey); ok {
+			count++
+		}
+	}
+	return float64(count)
+}
+
+// result returns the result label of a decision
+func result(decision limiter.Decision, err error) string {
+	switch {
+	case err == nil && decision.Degraded && decision.Limit == 0:
+		return ResultFailedOpen
+	case err == nil:
+		return ResultAllowed
+	case errors.Is(err, limiter.ErrLimitExceeded):
+		return ResultLimited
+	case errors.Is(err, limiter.ErrAccessDenied):
+		return ResultDenied
+	case errors.Is(err, limiter.ErrInvalidToken):
+		return ResultInvalidToken
+	case errors.Is(err, limiter.ErrUnavailable):
+		return ResultUnavailable
+	default:
+		return ResultError
+	}
+}
+
+// poolStatser is implemented by storages with a Redis connection pool
+type poolStatser interface {
+	PoolStats() *redis.PoolStats
+}
+
+// poolCollector exports the statistics of a Redis connection pool
+type poolCollector struct {
+	stats    func() *redis.PoolStats
+	hits     *prometheus.Desc
+	misses   *prometheus.Desc
+	timeouts *prometheus.Desc
+	conns    *prometheus.Desc
+}
+
+func newPoolCollector(stats func() *redis.PoolStats) *poolCollector {
+	return &poolCollector{
+		stats:    stats,
+		hits:     prometheus.NewDesc("ratelimit_redis_pool_hits_total", "Times a free connection was found in the Redis pool.", nil, nil),
+		misses:   prometheus.NewDesc("ratelimit_redis_pool_misses_total", "Times no free connection was found in the Redis pool.", nil, nil),
+		timeouts: prometheus.NewDesc("ratelimit_redis_pool_timeouts_total", "Times waiting for a Redis pool connection timed out.", nil, nil),
+		conns:    prometheus.NewDesc("ratelimit_redis_pool_connections", "Connections in the Redis pool, by state.", []string{"state"}, nil),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.conns
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(stats.TotalConns), "total")
+	ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(stats.IdleConns), "idle")
+	ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(stats.StaleConns), "stale")
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	return rr.Body.String()
+}
+
+func TestMetrics_Decisions(t *testing.T) {
+	m := New()
+	m.ObserveDecision("default", limiter.Decision{Allowed: true, Dimension: limiter.DimensionIP}, nil)
+	m.ObserveDecision("default", limiter.Decision{Dimension: limiter.DimensionIP}, limiter.ErrLimitExceeded)
+	m.ObserveDecision("login", limiter.Decision{Dimension: limiter.DimensionToken}, limiter.ErrLimitExceeded)
+	m.ObserveDecision("default", limiter.Decision{}, limiter.ErrAccessDenied)
+	m.ObserveDecision("default", limiter.Decision{}, errors.New("connection refused"))
+	m.ObserveOverhead(time.Millisecond)
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`ratelimit_decisions_total{dimension="ip",result="allowed",rule="default"} 1`,
+		`ratelimit_decisions_total{dimension="ip",result="limited",rule="default"} 1`,
+		`ratelimit_decisions_total{dimension="token",result="limited",rule="login"} 1`,
+		`ratelimit_decisions_total{dimension="none",result="denied",rule="default"} 1`,
+		`ratelimit_decisions_total{dimension="none",result="error",rule="default"} 1`,
+		`ratelimit_middleware_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s in:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetrics_InstrumentStorage(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	store := storage.NewMemoryStorage(0, 0)
+	defer store.Close()
+
+	instrumented := m.InstrumentStorage(store)
+	if _, ok := instrumented.(storage.AlgorithmStorage); !ok {
+		t.Error("Expected the instrumented storage to implement AlgorithmStorage")
+	}
+	if _, ok := instrumented.(storage.MultiStorage); !ok {
+		t.Error("Expected the instrumented storage to implement MultiStorage")
+	}
+
+	service := limiter.NewService(instrumented, &config.Config{
+		MaxRequestsPerSecond: 1,
+		RateLimitWindow:      time.Minute,
+		BlockingTime:         time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmSlidingWindowCounter,
+		EnableIPRateLimiter:  true,
+	})
+	service.CheckAndIncrement(ctx, "10.0.0.1", "")
+	service.CheckAndIncrement(ctx, "10.0.0.1", "")
+
+	// Blocked keys are counted on the storage itself, not as traffic
+	watchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	m.WatchBlockedKeys(watchCtx, store)
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`ratelimit_storage_operation_duration_seconds_count{operation="sliding_window_counter"} 2`,
+		`ratelimit_blocked_keys 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `operation="keys"`) {
+		t.Errorf("Expected counting blocked keys not to be instrumented, got:\n%s", body)
+	}
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+// InstrumentStorage returns store timing every operation into the storage
+// latency histogram and counting failed ones
+// The storage returned implements the optional storage interfaces store
+// does, and the pool statistics of a Redis storage are exported as well
+func (m *Metrics) InstrumentStorage(store storage.Storage) storage.Storage {
+	if pool, ok := store.(poolStatser); ok {
+		m.registry.MustRegister(newPoolCollector(pool.PoolStats))
+	}
+
+	return storage.Intercept(store, func(operation string, call func() error) error {
+		start := time.Now()
+		err := call()
+		m.storageLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.storageErrors.WithLabelValues(operation).Inc()
+		}
+		return err
+	})
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+)
+
+// AuthorizePath is the path of the forward auth endpoint
+const AuthorizePath = "/v1/authorize"
+
+// AuthorizeHandler creates the forward auth endpoint, which lets a reverse
+// proxy (nginx auth_request, Traefik ForwardAuth, Envoy's HTTP ext_authz)
+// ask whether to let a request through
+// The original request is rebuilt from the headers the proxy forwards and
+// checked as RateLimitMiddleware would: the answer is 200 with the rate
+// limit headers, or the middleware's rejection for the proxy to copy back
+// Limited requests get 429, or the status of the deny_status query
+// parameter, since nginx only passes 401 and 403 through
+func AuthorizeHandler(rateLimiterService *limiter.Service, observers ...Observer) http.Handler {
+	l := newRequestLimiter(rateLimiterService, observers)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limitedStatus := http.StatusTooManyRequests
+		if r.URL.Path == AuthorizePath && r.URL.Query().Has("deny_status") {
+			status, err := strconv.Atoi(r.URL.Query().Get("deny_status"))
+			if err != nil || status < 400 || status > 499 {
+				writeAuthorizeError(w, "Invalid deny_status (expected a 4xx status)")
+				return
+			}
+			limitedStatus = status
+		}
+
+		original, err := originalRequest(r, rateLimiterService.Config().TrustedProxies)
+		if err != nil {
+			writeAuthorizeError(w, err.Error())
+			return
+		}
+
+		if _, allowed := l.limit(w, original, limitedStatus); allowed {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// originalRequest rebuilds the request a proxy asks to authorize
+// The method comes from X-Original-Method, the URI from X-Original-URI and,
+// from trustedProxies only, the host from X-Forwarded-Host; X-Forwarded-Method
+// and X-Forwarded-Uri stand in for the X-Original ones from trustedProxies,
+// since a client could set them itself otherwise
+// Without them the authorization request stands for the original, as Envoy
+// sends it: same method and host, with the original path appended to
+// AuthorizePath. The client IP and the token are read from the forwarded
+// headers as for any request
+func originalRequest(r *http.Request, trustedProxies []*net.IPNet) (*http.Request, error) {
+	original := r.Clone(r.Context())
+	trusted := FromTrustedProxy(r, trustedProxies)
+	header := func(name, forwardedName string) string {
+		if value := firstHeader(r.Header, name); value != "" || !trusted {
+			return value
+		}
+		return firstHeader(r.Header, forwardedName)
+	}
+
+	if method := header("X-Original-Method", "X-Forwarded-Method"); method != "" {
+		original.Method = strings.ToUpper(method)
+	}
+
+	uri := header("X-Original-Uri", "X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+		if path, found := strings.CutPrefix(r.URL.Path, AuthorizePath); found && strings.HasPrefix(path, "/") {
+			uri = path
+			if r.URL.RawQuery != "" {
+				uri += "?" + r.URL.RawQuery
+			}
+		}
+	}
+	originalURL, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid forwarded URI %q", uri)
+	}
+	original.URL = originalURL
+	original.RequestURI = uri
+
+	if host := firstHeader(r.Header, "X-Forwarded-Host"); host != "" && trusted {
+		original.Host = host
+	} else if originalURL.Host != "" {
+		original.Host = originalURL.Host
+	}
+	return original, nil
+}
+
+// firstHeader returns the value of the first of names set in h
+func firstHeader(h http.Header, names ...string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(h.Get(name)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func writeAuthorizeError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func newTestAuthorizeHandler(t *testing.T, cfg *config.Config) http.Handler {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+
+	return AuthorizeHandler(limiter.NewService(store, cfg))
+}
+
+func TestAuthorizeHandler(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	handler := newTestAuthorizeHandler(t, &config.Config{
+		MaxRequestsPerSecond: 100,
+		RateLimitWindow:      time.Minute,
+		BlockingTime:         time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		TrustedProxies:       []*net.IPNet{proxies},
+		Routes: []config.RouteRule{
+			{Name: "login", Pattern: "POST /login", Limit: config.TokenLimit{MaxRequests: 1}},
+		},
+	})
+
+	// Traefik ForwardAuth
+	authorize := func(clientIP string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, AuthorizePath, nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		req.Header.Set("X-Forwarded-Method", "POST")
+		req.Header.Set("X-Forwarded-Uri", "/login?next=/home")
+		req.Header.Set("X-Forwarded-Host", "api.example.com")
+		req.Header.Set("X-Forwarded-For", clientIP)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := authorize("192.0.2.1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if policy := rec.Header().Get("RateLimit-Policy"); policy != `1;w=60;name="login"` {
+		t.Errorf("Expected the original request to match the login route, got %q", policy)
+	}
+	rec = authorize("192.0.2.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected 429 with Retry-After 60, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := authorize("192.0.2.2"); rec.Code != http.StatusOK {
+		t.Errorf("Expected another client to be limited on its own, got %d", rec.Code)
+	}
+
+	// nginx auth_request, which only passes 401 and 403 through
+	req := httptest.NewRequest(http.MethodGet, AuthorizePath+"?deny_status=403", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Original-Method", "POST")
+	req.Header.Set("X-Original-URI", "/login")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected 403 with the rate limit headers, got %d %v", rec.Code, rec.Header())
+	}
+
+	// Envoy HTTP ext_authz, appending the original path
+	req = httptest.NewRequest(http.MethodPost, AuthorizePath+"/login", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.3")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Policy") != `1;w=60;name="login"` {
+		t.Errorf("Expected the appended path to match the login route, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestAuthorizeHandler_ForwardedHeaders(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	handler := newTestAuthorizeHandler(t, &config.Config{
+		MaxRequestsPerSecond: 100,
+		RateLimitWindow:      time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		TrustedProxies:       []*net.IPNet{proxies},
+		Routes: []config.RouteRule{
+			{Name: "login", Pattern: "POST /login", Limit: config.TokenLimit{MaxRequests: 1}},
+		},
+	})
+
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		host    string
+		policy  string
+	}{
+		{"spoofed by an untrusted peer", "192.0.2.1:1234", map[string]string{"X-Forwarded-Method": "POST", "X-Forwarded-Uri": "/login", "X-Forwarded-Host": "api.example.com"}, "example.com", `100;w=60;name="default"`},
+		{"original headers from an untrusted peer", "192.0.2.2:1234", map[string]string{"X-Original-Method": "POST", "X-Original-URI": "/login"}, "example.com", `1;w=60;name="login"`},
+		{"original headers preferred", "10.0.0.2:1234", map[string]string{"X-Original-Method": "GET", "X-Original-URI": "/home", "X-Forwarded-Method": "POST", "X-Forwarded-Uri": "/login"}, "example.com", `100;w=60;name="default"`},
+		{"trusted proxy", "10.0.0.3:1234", map[string]string{"X-Forwarded-Method": "POST", "X-Forwarded-Uri": "/login", "X-Forwarded-Host": "api.example.com"}, "api.example.com", `1;w=60;name="login"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, AuthorizePath, nil)
+			req.RemoteAddr = tt.peer
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			original, err := originalRequest(req, []*net.IPNet{proxies})
+			if err != nil {
+				t.Fatalf("originalRequest failed: %v", err)
+			}
+			if original.Host != tt.host {
+				t.Errorf("Expected host %q, got %q", tt.host, original.Host)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if policy := rec.Header().Get("RateLimit-Policy"); rec.Code != http.StatusOK || policy != tt.policy {
+				t.Errorf("Expected 200 with policy %q, got %d %q", tt.policy, rec.Code, policy)
+			}
+		})
+	}
+}
+
+func TestAuthorizeHandler_BadRequest(t *testing.T) {
+	handler := newTestAuthorizeHandler(t, &config.Config{
+		MaxRequestsPerSecond: 10,
+		RateLimitWindow:      time.Second,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		uri    string
+	}{
+		{"invalid deny status", AuthorizePath + "?deny_status=200", ""},
+		{"relative URI", AuthorizePath, "login"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.uri != "" {
+				req.Header.Set("X-Original-URI", tt.uri)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400, got %d", rec.Code)
+			}
+		})
+	}
+}
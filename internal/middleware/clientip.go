@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+// getClientIP extracts the client IP address from the request
+// Forwarding headers are only honoured when RemoteAddr is a trusted proxy,
+// and only header, the one the proxies set (see config.TrustedProxyHeaders):
+// proxies pass the others on untouched, as the client sent them
+// The forwarding chain is walked right to left, skipping trusted hops, so a
+// client cannot spoof its address by prepending entries
+func getClientIP(r *http.Request, trustedProxies []*net.IPNet, header string) string {
+	remote := remoteIP(r)
+	if !FromTrustedProxy(r, trustedProxies) {
+		return remote
+	}
+
+	// The rightmost untrusted hop is the client; an unparseable hop (e.g. an
+	// obfuscated "unknown") ends the walk at the proxy that reported it
+	chain := forwardedChain(r, header)
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseIP(chain[i])
+		if ip == "" {
+			break
+		}
+		client = ip
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+	return client
+}
+
+// remoteIP returns the IP address of the connection's peer
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// FromTrustedProxy reports whether the connection's peer is one of
+// trustedProxies, whose forwarding headers can be believed
+func FromTrustedProxy(r *http.Request, trustedProxies []*net.IPNet) bool {
+	return isTrustedProxy(remoteIP(r), trustedProxies)
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedChain returns the client addresses the proxies recorded in header,
+// X-Forwarded-For when empty, from the original client to the nearest proxy
+func forwardedChain(r *http.Request, header string) []string {
+	switch header {
+	case config.TrustedProxyHeaderForwarded:
+		return parseForwarded(r.Header.Values("Forwarded"))
+	case config.TrustedProxyHeaderXRealIP:
+		// A single address, set by the nearest proxy
+		realIP := r.Header.Values("X-Real-IP")
+		if len(realIP) == 0 {
+			return nil
+		}
+		return realIP[len(realIP)-1:]
+	}
+
+	var chain []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			chain = append(chain, strings.TrimSpace(hop))
+		}
+	}
+	return chain
+}
+
+// parseForwarded returns the "for" parameter of every element of the RFC 7239
+// Forwarded headers; elements without one are recorded as empty hops
+func parseForwarded(headers []string) []string {
+	var chain []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+			chain = append(chain, hop)
+		}
+	}
+	return chain
+}
+
+// parseIP returns the canonical form of an address that may carry a port or
+// IPv6 brackets, or "" if it is not an IP address
+func parseIP(value string) string {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
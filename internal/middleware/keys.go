@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+// KeyExtractor extracts the rate limiting key of a request, such as an API
+// token, a user or a tenant
+// ok is false when the request doesn't carry the key
+type KeyExtractor interface {
+	Extract(r *http.Request) (key string, ok bool)
+}
+
+// KeyExtractorFunc adapts a function to a KeyExtractor
+type KeyExtractorFunc func(r *http.Request) (string, bool)
+
+func (f KeyExtractorFunc) Extract(r *http.Request) (string, bool) {
+	return f(r)
+}
+
+// DefaultKeyExtractor reads the API token from the API_KEY or X-API-Token
+// header, or a Bearer Authorization header
+var DefaultKeyExtractor KeyExtractor = FirstKey(
+	HeaderKey("API_KEY", ""),
+	HeaderKey("X-API-Token", ""),
+	HeaderKey("Authorization", "Bearer "),
+)
+
+// NewKeyExtractor builds the extractor described by a validated key source
+// A nil source returns DefaultKeyExtractor
+func NewKeyExtractor(source *config.KeySource) KeyExtractor {
+	if source == nil {
+		return DefaultKeyExtractor
+	}
+
+	switch source.Type {
+	case config.KeyHeader:
+		return HeaderKey(source.Name, source.Prefix)
+	case config.KeyQuery:
+		return QueryKey(source.Name)
+	case config.KeyCookie:
+		return CookieKey(source.Name)
+	case config.KeyJWTClaim:
+		header, prefix := source.Name, source.Prefix
+		if header == "" {
+			header, prefix = "Authorization", "Bearer "
+		}
+		return &JWTClaimKey{
+			Token:     HeaderKey(header, prefix),
+			Claim:     source.Claim,
+			Secret:    source.Secret,
+			PublicKey: source.PublicKey,
+		}
+	case config.KeyPathSegment:
+		return PathSegmentKey(source.Segment)
+	case config.KeyFirst, config.KeyComposite:
+		extractors := make([]KeyExtractor, 0, len(source.Sources))
+		for i := range source.Sources {
+			extractors = append(extractors, NewKeyExtractor(&source.Sources[i]))
+		}
+		if source.Type == config.KeyFirst {
+			return FirstKey(extractors...)
+		}
+		return CompositeKey(extractors...)
+	default:
+		return DefaultKeyExtractor
+	}
+}
+
+// HeaderKey extracts the value of a header, which must start with prefix
+// when one is given; the prefix is stripped from the key
+func HeaderKey(name, prefix string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		if prefix != "" {
+			var found bool
+			if value, found = strings.CutPrefix(value, prefix); !found {
+				return "", false
+			}
+		}
+		return value, value != ""
+	})
+}
+
+// QueryKey extracts the value of a query parameter
+func QueryKey(param string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		value := r.URL.Query().Get(param)
+		return value, value != ""
+	})
+}
+
+// CookieKey extracts the value of a cookie
+func CookieKey(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	})
+}
+
+// PathSegmentKey extracts the index-th segment of the URL path, counting
+// from zero, e.g. "acme" from /tenants/acme/orders with index 1
+func PathSegmentKey(index int) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if index < 0 || index >= len(segments) || segments[index] == "" {
+			return "", false
+		}
+		return segments[index], true
+	})
+}
+
+// FirstKey returns the key of the first extractor that yields one
+func FirstKey(extractors ...KeyExtractor) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		for _, extractor := range extractors {
+			if key, ok := extractor.Extract(r); ok {
+				return key, true
+			}
+		}
+		return "", false
+	})
+}
+
+// CompositeKey joins the keys of every extractor with "|", e.g. to limit
+// per user and tenant; it yields no key unless all of them do
+func CompositeKey(extractors ...KeyExtractor) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		keys := make([]string, 0, len(extractors))
+		for _, extractor := range extractors {
+			key, ok := extractor.Extract(r)
+			if !ok {
+				return "", false
+			}
+			keys = append(keys, key)
+		}
+		return strings.Join(keys, "|"), len(keys) > 0
+	})
+}
+
+// JWTClaimKey extracts a claim of the JWT read by Token
+// The signature is verified with Secret (HS256/384/512) or PublicKey
+// (RS256/384/512, ES256/384/512) when either is set, in which case expired
+// or not yet valid tokens yield no key; otherwise the claims are read without
+// verification, which is only safe when an upstream gateway verifies them
+type JWTClaimKey struct {
+	Token     KeyExtractor
+	Claim     string
+	Secret    []byte
+	PublicKey crypto.PublicKey
+}
+
+func (k *JWTClaimKey) Extract(r *http.Request) (string, bool) {
+	token, ok := k.Token.Extract(r)
+	if !ok {
+		return "", false
+	}
+
+	claims, err := k.parse(token)
+	if err != nil {
+		return "", false
+	}
+
+	switch value := claims[k.Claim].(type) {
+	case string:
+		return value, value != ""
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return fmt.Sprint(value), true
+	default:
+		return "", false
+	}
+}
+
+// parse decodes the claims of a compact JWS, verifying it if configured
+func (k *JWTClaimKey) parse(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if k.Secret == nil && k.PublicKey == nil {
+		return claims, nil
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if err := k.verify(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if expires, err := exp.Int64(); err != nil || now >= expires {
+			return nil, errors.New("token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if notBefore, err := nbf.Int64(); err != nil || now < notBefore {
+			return nil, errors.New("token not valid yet")
+		}
+	}
+	return claims, nil
+}
+
+// verify checks the signature of signed with the algorithm named by alg,
+// which must match the configured key
+func (k *JWTClaimKey) verify(alg, signed string, signature []byte) error {
+	var (
+		hashFunc crypto.Hash
+		newHash  func() hash.Hash
+	)
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hashFunc, newHash = crypto.SHA256, sha256.New
+	case strings.HasSuffix(alg, "384"):
+		hashFunc, newHash = crypto.SHA384, sha512.New384
+	case strings.HasSuffix(alg, "512"):
+		hashFunc, newHash = crypto.SHA512, sha512.New
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+
+	if strings.HasPrefix(alg, "HS") && k.Secret != nil {
+		mac := hmac.New(newHash, k.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+
+	h := newHash()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		return rsa.VerifyPKCS1v15(key, hashFunc, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") || len(signature)%2 != 0 {
+			break
+		}
+		half := len(signature) / 2
+		r, s := new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("JWT algorithm %q does not match the configured key", alg)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
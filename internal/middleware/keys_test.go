@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+func TestKeyExtractors(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/tenants/acme/orders?user=42", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s-1"})
+
+	tests := []struct {
+		name      string
+		source    *config.KeySource
+		want      string
+		wantFound bool
+	}{
+		{"default", nil, "secret-token", true},
+		{"header", &config.KeySource{Type: config.KeyHeader, Name: "X-Tenant"}, "acme", true},
+		{"header with prefix", &config.KeySource{Type: config.KeyHeader, Name: "Authorization", Prefix: "Bearer "}, "secret-token", true},
+		{"header with wrong prefix", &config.KeySource{Type: config.KeyHeader, Name: "Authorization", Prefix: "Basic "}, "", false},
+		{"missing header", &config.KeySource{Type: config.KeyHeader, Name: "X-User"}, "", false},
+		{"query", &config.KeySource{Type: config.KeyQuery, Name: "user"}, "42", true},
+		{"cookie", &config.KeySource{Type: config.KeyCookie, Name: "session"}, "s-1", true},
+		{"path segment", &config.KeySource{Type: config.KeyPathSegment, Segment: 1}, "acme", true},
+		{"path segment out of range", &config.KeySource{Type: config.KeyPathSegment, Segment: 5}, "", false},
+		{"first", &config.KeySource{Type: config.KeyFirst, Sources: []config.KeySource{
+			{Type: config.KeyHeader, Name: "X-User"},
+			{Type: config.KeyQuery, Name: "user"},
+		}}, "42", true},
+		{"composite", &config.KeySource{Type: config.KeyComposite, Sources: []config.KeySource{
+			{Type: config.KeyHeader, Name: "X-Tenant"},
+			{Type: config.KeyQuery, Name: "user"},
+		}}, "acme|42", true},
+		{"composite with a missing part", &config.KeySource{Type: config.KeyComposite, Sources: []config.KeySource{
+			{Type: config.KeyHeader, Name: "X-Tenant"},
+			{Type: config.KeyHeader, Name: "X-User"},
+		}}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, found := NewKeyExtractor(tt.source).Extract(req)
+			if key != tt.want || found != tt.wantFound {
+				t.Errorf("Expected (%q, %v), got (%q, %v)", tt.want, tt.wantFound, key, found)
+			}
+		})
+	}
+}
+
+func TestJWTClaimKey(t *testing.T) {
+	secret := []byte("jwt-secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	claims := map[string]interface{}{"sub": "user-1", "tenant_id": 7, "exp": time.Now().Add(time.Hour).Unix()}
+	expired := map[string]interface{}{"sub": "user-1", "exp": time.Now().Add(-time.Hour).Unix()}
+
+	tests := []struct {
+		name      string
+		token     string
+		source    config.KeySource
+		want      string
+		wantFound bool
+	}{
+		{"unverified", signJWT(t, "HS256", claims, []byte("any")), config.KeySource{Claim: "sub"}, "user-1", true},
+		{"numeric claim", signJWT(t, "HS256", claims, secret), config.KeySource{Claim: "tenant_id", Secret: secret}, "7", true},
+		{"HMAC", signJWT(t, "HS256", claims, secret), config.KeySource{Claim: "sub", Secret: secret}, "user-1", true},
+		{"HMAC wrong secret", signJWT(t, "HS256", claims, []byte("other")), config.KeySource{Claim: "sub", Secret: secret}, "", false},
+		{"HMAC expired", signJWT(t, "HS256", expired, secret), config.KeySource{Claim: "sub", Secret: secret}, "", false},
+		{"alg none", signJWT(t, "none", claims, nil), config.KeySource{Claim: "sub", Secret: secret}, "", false},
+		{"RSA", signJWT(t, "RS256", claims, rsaKey), config.KeySource{Claim: "sub", PublicKey: &rsaKey.PublicKey}, "user-1", true},
+		{"HMAC signed with RSA public key", signJWT(t, "HS256", claims, secret), config.KeySource{Claim: "sub", PublicKey: &rsaKey.PublicKey}, "", false},
+		{"ECDSA", signJWT(t, "ES256", claims, ecKey), config.KeySource{Claim: "sub", PublicKey: &ecKey.PublicKey}, "user-1", true},
+		{"missing claim", signJWT(t, "HS256", claims, secret), config.KeySource{Claim: "org", Secret: secret}, "", false},
+		{"malformed", "not-a-jwt", config.KeySource{Claim: "sub"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tt.source
+			source.Type = config.KeyJWTClaim
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			key, found := NewKeyExtractor(&source).Extract(req)
+			if key != tt.want || found != tt.wantFound {
+				t.Errorf("Expected (%q, %v), got (%q, %v)", tt.want, tt.wantFound, key, found)
+			}
+		})
+	}
+}
+
+// signJWT builds a compact JWS signed with key ([]byte for HMAC, or an RSA or ECDSA private key)
+func signJWT(t *testing.T, alg string, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Failed to encode JWT part: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("Failed to sign JWT: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
@@ -1,112 +1,248 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
 )
 
+// Observer is notified of the requests the rate limit middleware handles,
+// e.g. to export metrics
+type Observer interface {
+	// ObserveDecision is called with the outcome of checking a request
+	// against the rule it matched
+	ObserveDecision(rule string, decision limiter.Decision, err error)
+
+	// ObserveOverhead is called with the time the middleware spent matching
+	// and checking a request
+	ObserveOverhead(d time.Duration)
+}
+
 // RateLimitMiddleware creates a middleware that enforces rate limiting
-func RateLimitMiddleware(rateLimiterService *limiter.Service) func(http.Handler) http.Handler {
+// Requests are limited by the first route rule they match, or the default
+// limits; the token is extracted by the rule's or the policy's key source,
+// the API token headers by default
+func RateLimitMiddleware(rateLimiterService *limiter.Service, observers ...Observer) func(http.Handler) http.Handler {
+	l := newRequestLimiter(rateLimiterService, observers)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := r.Context()
-			
-			// Extract IP address
-			ip := getClientIP(r)
-			
-			// Extract token from header (check X-API-Token or Authorization header)
-			token := getTokenFromRequest(r)
-			
-			// Check rate limit and increment
-			allowed, resetTime, err := rateLimiterService.CheckAndIncrement(ctx, ip, token)
-			
-			// Check if rate limit is exceeded first (even if there's an error)
+			route, allowed := l.limit(w, r, http.StatusTooManyRequests)
 			if !allowed {
-				// Rate limit exceeded
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("X-RateLimit-Reset", resetTime.Format(time.RFC3339))
-				w.WriteHeader(http.StatusTooManyRequests)
-				
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"error":      "Rate limit exceeded",
-					"reset_time": resetTime.Format(time.RFC3339),
-				})
-				return
-			}
-			
-			// Only return 500 if there's an actual error (not rate limit exceeded)
-			if err != nil {
-				log.Printf("Rate limiter error: %v (IP: %s, Token: %s)", err, ip, token)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
-			
-			// Set rate limit headers
-			w.Header().Set("X-RateLimit-Reset", resetTime.Format(time.RFC3339))
-			
-			// Continue to next handler
-			next.ServeHTTP(w, r)
+
+			// Continue to next handler, with the route it matched
+			next.ServeHTTP(w, r.WithContext(limiter.ContextWithRoute(r.Context(), route)))
 		})
 	}
 }
 
-// getClientIP extracts the client IP address from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first (for proxies/load balancers)
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(forwarded, ",")
-		if len(ips) > 0 {
-			ip := strings.TrimSpace(ips[0])
-			if ip != "" {
-				return ip
-			}
-		}
+// requestLimiter checks requests against the rate limiter, for the
+// middleware and the forward auth endpoint
+type requestLimiter struct {
+	service   *limiter.Service
+	observers []Observer
+
+	// Extractors are rebuilt only when the configuration is reloaded
+	extractors atomic.Pointer[configKeyExtractors]
+}
+
+func newRequestLimiter(rateLimiterService *limiter.Service, observers []Observer) *requestLimiter {
+	return &requestLimiter{service: rateLimiterService, observers: observers}
+}
+
+// keyExtractor returns the key extractor of route
+func (l *requestLimiter) keyExtractor(route limiter.Route) KeyExtractor {
+	cfg := route.Config()
+	current := l.extractors.Load()
+	if current == nil || current.config != cfg {
+		current = newConfigKeyExtractors(cfg)
+		l.extractors.Store(current)
 	}
-	
-	// Check X-Real-IP header (another common proxy header)
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
+	return current.extractors[route.KeySource()]
+}
+
+// limit checks r and increments its counters, setting the rate limit
+// headers; it reports whether r is allowed, and otherwise writes the
+// rejection, with limitedStatus when the limit is exceeded
+func (l *requestLimiter) limit(w http.ResponseWriter, r *http.Request, limitedStatus int) (limiter.Route, bool) {
+	ctx := r.Context()
+	start := time.Now()
+
+	// Match the route rule; the configuration is the one it was matched in
+	route := l.service.MatchRoute(r.Method, r.Host, r.URL.Path)
+	cfg := route.Config()
+
+	// Extract IP address, trusting forwarding headers only from trusted proxies
+	ip := getClientIP(r, cfg.TrustedProxies, cfg.TrustedProxyHeader)
+
+	// Extract the token (API token headers unless the policy configures a key)
+	token, _ := l.keyExtractor(route).Extract(r)
+
+	// Check rate limit and increment
+	decision, err := route.CheckAndIncrement(ctx, ip, token)
+	overhead := time.Since(start)
+	for _, observer := range l.observers {
+		observer.ObserveDecision(route.Name(), decision, err)
+		observer.ObserveOverhead(overhead)
+	}
+
+	// The storage failed and the rule fails closed
+	if errors.Is(err, limiter.ErrUnavailable) {
+		log.Printf("Rate limiter unavailable: %v (rule: %s)", err, route.Name())
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(decision)))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "Rate limiter unavailable",
+		})
+		return route, false
 	}
-	
-	// Fallback to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	// Denied by the policy's deny list
+	if errors.Is(err, limiter.ErrAccessDenied) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "Access denied",
+		})
+		return route, false
+	}
+
+	// Unknown or revoked token, with UNKNOWN_TOKEN_ACTION=reject
+	if errors.Is(err, limiter.ErrInvalidToken) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "Invalid token",
+		})
+		return route, false
+	}
+
+	// Check if rate limit is exceeded first (even if there's an error)
+	if !decision.Allowed {
+		// Rate limit exceeded
+		setRateLimitHeaders(w, decision, cfg.LegacyRateLimitHeaders)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(decision)))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(limitedStatus)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      "Rate limit exceeded",
+			"rule":       route.Name(),
+			"reset_time": decision.ResetTime.Format(time.RFC3339),
+		})
+		return route, false
+	}
+
+	// Only return 500 if there's an actual error (not rate limit exceeded)
 	if err != nil {
-		return r.RemoteAddr
+		log.Printf("Rate limiter error: %v (rule: %s, IP: %s, Token: %s)", err, route.Name(), ip, config.RedactToken(token))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return route, false
 	}
-	
-	return ip
+
+	// Set rate limit headers
+	setRateLimitHeaders(w, decision, cfg.LegacyRateLimitHeaders)
+	return route, true
 }
 
-// getTokenFromRequest extracts the API token from the request headers
-func getTokenFromRequest(r *http.Request) string {
-	// Check API_KEY header first (as used in tests)
-	token := r.Header.Get("API_KEY")
-	if token != "" {
-		return token
+// configKeyExtractors are the key extractors built for a configuration, by
+// key source; the nil source is the API token headers
+type configKeyExtractors struct {
+	config     *config.Config
+	extractors map[*config.KeySource]KeyExtractor
+}
+
+func newConfigKeyExtractors(cfg *config.Config) *configKeyExtractors {
+	extractors := map[*config.KeySource]KeyExtractor{
+		nil:           DefaultKeyExtractor,
+		cfg.KeySource: NewKeyExtractor(cfg.KeySource),
 	}
-	
-	// Check X-API-Token header
-	token = r.Header.Get("X-API-Token")
-	if token != "" {
-		return token
+	for _, rule := range cfg.Routes {
+		if rule.Key != nil {
+			extractors[rule.Key] = NewKeyExtractor(rule.Key)
+		}
 	}
-	
-	// Check Authorization header (Bearer token)
-	auth := r.Header.Get("Authorization")
-	if strings.HasPrefix(auth, "Bearer ") {
-		return strings.TrimPrefix(auth, "Bearer ")
+	return &configKeyExtractors{config: cfg, extractors: extractors}
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of the IETF draft
+// (draft-ietf-httpapi-ratelimit-headers) and, when legacy is set, the
+// equivalent X-RateLimit-* headers; nothing is set when no limit applies
+func setRateLimitHeaders(w http.ResponseWriter, decision limiter.Decision, legacy bool) {
+	if decision.Limit <= 0 {
+		return
+	}
+
+	limit := strconv.Itoa(decision.Limit)
+	remaining := strconv.Itoa(decision.Remaining)
+	reset := strconv.Itoa(ceilSeconds(decision.ResetAfter(time.Now())))
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", limit)
+	h.Set("RateLimit-Remaining", remaining)
+	h.Set("RateLimit-Reset", reset)
+	policy := fmt.Sprintf("%d;w=%d", decision.Limit, ceilSeconds(decision.Window))
+	if decision.Policy != "" {
+		policy += fmt.Sprintf(";name=%q", decision.Policy)
+	}
+	h.Set("RateLimit-Policy", policy)
+
+	if legacy {
+		h.Set("X-RateLimit-Limit", limit)
+		h.Set("X-RateLimit-Remaining", remaining)
+		h.Set("X-RateLimit-Reset", decision.ResetTime.Format(time.RFC3339))
+	}
+}
+
+// retryAfterSeconds returns the Retry-After delay of a rejected request,
+// at least one second
+func retryAfterSeconds(decision limiter.Decision) int {
+	if seconds := ceilSeconds(decision.ResetAfter(time.Now())); seconds > 0 {
+		return seconds
 	}
-	
-	// No token found
-	return ""
+	return 1
 }
 
+// ceilSeconds rounds d up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// AdminAuthMiddleware only lets through requests carrying adminToken as a
+// Bearer token; every request is rejected when adminToken is empty
+func AdminAuthMiddleware(adminToken string) func(http.Handler) http.Handler {
+	return BearerAuthMiddleware(adminToken)
+}
+
+// BearerAuthMiddleware only lets through requests carrying token as a Bearer
+// token; every request is rejected with 401 when token is empty
+func BearerAuthMiddleware(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			provided, hasBearer := strings.CutPrefix(auth, "Bearer ")
+			if token == "" || !hasBearer || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error": "Unauthorized",
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+func newTestHandler(t *testing.T, cfg *config.Config) http.Handler {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+
+	service := limiter.NewService(store, cfg)
+	return RateLimitMiddleware(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	handler := newTestHandler(t, &config.Config{
+		MaxRequestsPerSecond: 2,
+		RateLimitWindow:      10 * time.Second,
+		BlockingTime:         time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+	})
+
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	want := map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "1",
+		"RateLimit-Reset":     "10",
+		"RateLimit-Policy":    `2;w=10;name="default"`,
+	}
+	for header, value := range want {
+		if got := rec.Header().Get(header); got != value {
+			t.Errorf("Expected %s %q, got %q", header, value, got)
+		}
+	}
+	if rec.Header().Get("X-RateLimit-Limit") != "" || rec.Header().Get("Retry-After") != "" {
+		t.Error("Legacy headers and Retry-After should not be set")
+	}
+
+	request()
+	rec = request()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected no remaining requests, got %q", rec.Header().Get("RateLimit-Remaining"))
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("Expected Retry-After of the blocking time, got %q", retryAfter)
+	}
+}
+
+func TestRateLimitMiddleware_LegacyHeaders(t *testing.T) {
+	handler := newTestHandler(t, &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        time.Second,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		LegacyRateLimitHeaders: true,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Header().Get("X-RateLimit-Limit") != "5" || rec.Header().Get("X-RateLimit-Remaining") != "4" {
+		t.Errorf("Unexpected legacy headers: %v", rec.Header())
+	}
+	if _, err := time.Parse(time.RFC3339, rec.Header().Get("X-RateLimit-Reset")); err != nil {
+		t.Errorf("X-RateLimit-Reset should be an RFC3339 timestamp: %v", err)
+	}
+}
+
+func TestRateLimitMiddleware_InvalidToken(t *testing.T) {
+	handler := newTestHandler(t, &config.Config{
+		MaxRequestsPerSecond:   5,
+		RateLimitWindow:        time.Second,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		UnknownTokenAction:     config.UnknownTokenReject,
+		TokenLimits: map[string]config.TokenLimit{
+			"known": {MaxRequests: 10},
+		},
+	})
+
+	request := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("API_KEY", token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request("unknown"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", code)
+	}
+	if code := request("known"); code != http.StatusOK {
+		t.Errorf("Expected 200 for a known token, got %d", code)
+	}
+	if code := request(""); code != http.StatusOK {
+		t.Errorf("Expected 200 without a token, got %d", code)
+	}
+}
+
+func TestRateLimitMiddleware_Routes(t *testing.T) {
+	handler := newTestHandler(t, &config.Config{
+		MaxRequestsPerSecond:   1,
+		RateLimitWindow:        time.Minute,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		EnableTokenRateLimiter: true,
+		Routes: []config.RouteRule{
+			{Name: "health", Pattern: "GET /health", Exempt: true},
+			{
+				Name:    "tenants",
+				Pattern: "/tenants/{tenant}/",
+				Limit:   config.TokenLimit{MaxRequests: 1},
+				Key:     &config.KeySource{Type: config.KeyPathSegment, Segment: 1},
+			},
+		},
+	})
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := request("/health"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Policy") != "" {
+			t.Fatalf("Exempt route should be allowed without limit headers, got %d %v", rec.Code, rec.Header())
+		}
+	}
+
+	// Each tenant is limited on its own, under the rule's name
+	rec := request("/tenants/acme/orders")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if policy := rec.Header().Get("RateLimit-Policy"); policy != `1;w=60;name="tenants"` {
+		t.Errorf("Expected the rule name in RateLimit-Policy, got %q", policy)
+	}
+	if rec := request("/tenants/acme/orders"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for the second acme request, got %d", rec.Code)
+	}
+	if rec := request("/tenants/globex/orders"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for another tenant, got %d", rec.Code)
+	}
+
+	// The default limit is counted apart from the routes
+	if rec := request("/other"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for the default route, got %d", rec.Code)
+	}
+}
+
+func TestRateLimitMiddleware_Unavailable(t *testing.T) {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+	failing := storage.Intercept(store, func(operation string, call func() error) error {
+		return errors.New("connection refused")
+	})
+	service := limiter.NewService(failing, &config.Config{
+		MaxRequestsPerSecond:   1,
+		RateLimitWindow:        time.Minute,
+		RateLimitAlgorithm:     config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:    true,
+		FailureMode:            config.FailureModeClosed,
+		CircuitBreakerCooldown: 5 * time.Second,
+	})
+	handler := RateLimitMiddleware(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected 503 with Retry-After 5, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+// recordingObserver records the decisions it observes
+type recordingObserver struct {
+	rules     []string
+	decisions []limiter.Decision
+	overheads int
+}
+
+func (o *recordingObserver) ObserveDecision(rule string, decision limiter.Decision, err error) {
+	o.rules = append(o.rules, rule)
+	o.decisions = append(o.decisions, decision)
+}
+
+func (o *recordingObserver) ObserveOverhead(d time.Duration) {
+	o.overheads++
+}
+
+func TestRateLimitMiddleware_Observer(t *testing.T) {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+	service := limiter.NewService(store, &config.Config{
+		MaxRequestsPerSecond: 1,
+		RateLimitWindow:      time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+	})
+	observer := &recordingObserver{}
+	handler := RateLimitMiddleware(service, observer)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(observer.decisions) != 2 || observer.overheads != 2 {
+		t.Fatalf("Expected 2 observed requests, got %d decisions and %d overheads", len(observer.decisions), observer.overheads)
+	}
+	if d := observer.decisions[0]; !d.Allowed || d.Dimension != limiter.DimensionIP || observer.rules[0] != limiter.PolicyDefault {
+		t.Errorf("Expected an allowed IP decision of the default rule, got %+v under %s", d, observer.rules[0])
+	}
+	if d := observer.decisions[1]; d.Allowed {
+		t.Errorf("Expected the second request to be limited, got %+v", d)
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	trusted := []*net.IPNet{
+		mustParseCIDR(t, "10.0.0.0/8"),
+		mustParseCIDR(t, "2001:db8:ffff::/48"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		headers    map[string][]string
+		want       string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "198.51.100.7:1234",
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "spoofed X-Forwarded-For from untrusted peer",
+			remoteAddr: "198.51.100.7:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "spoofed X-Real-IP from untrusted peer",
+			remoteAddr: "198.51.100.7:1234",
+			headers:    map[string][]string{"X-Real-IP": {"1.2.3.4"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "spoofed Forwarded from untrusted peer",
+			remoteAddr: "198.51.100.7:1234",
+			headers:    map[string][]string{"Forwarded": {"for=1.2.3.4"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "client prepends a spoofed entry behind a trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7, 10.1.1.1", "10.2.2.2"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "client spoofs a trusted address",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.9.9.9, 198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "garbage hop stops at the proxy that reported it",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, not-an-ip"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "X-Real-IP from trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     config.TrustedProxyHeaderXRealIP,
+			headers:    map[string][]string{"X-Real-IP": {"198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "Forwarded from trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     config.TrustedProxyHeaderForwarded,
+			headers: map[string][]string{
+				"Forwarded": {`for=1.2.3.4, for="[2001:db8:cafe::17]:4711";proto=https, for=10.3.3.3`},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:       "Forwarded obfuscated identifier",
+			remoteAddr: "10.0.0.1:1234",
+			header:     config.TrustedProxyHeaderForwarded,
+			headers:    map[string][]string{"Forwarded": {"for=unknown"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "client forges Forwarded behind a proxy setting X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			header:     config.TrustedProxyHeaderXForwardedFor,
+			headers: map[string][]string{
+				"Forwarded":       {"for=1.2.3.4"},
+				"X-Forwarded-For": {"198.51.100.7"},
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:       "client forges X-Real-IP behind a proxy setting X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-IP": {"1.2.3.4"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "client forges X-Forwarded-For behind a proxy setting Forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			header:     config.TrustedProxyHeaderForwarded,
+			headers: map[string][]string{
+				"Forwarded":       {"for=198.51.100.7"},
+				"X-Forwarded-For": {"1.2.3.4"},
+			},
+			want: "198.51.100.7",
+		},
+		{
+			name:       "IPv6 trusted proxy",
+			remoteAddr: "[2001:db8:ffff::1]:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7:5555"}},
+			want:       "198.51.100.7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for header, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(header, value)
+				}
+			}
+
+			if got := getClientIP(req, trusted, tt.header); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("Invalid CIDR %s: %v", cidr, err)
+	}
+	return ipNet
+}
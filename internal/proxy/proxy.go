@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/middleware"
+)
+
+// Handler proxies requests to the upstream of the route they matched,
+// turning the rate limiter into a gateway in front of the upstreams
+// Mounted behind middleware.RateLimitMiddleware, it reuses the route the
+// middleware matched; the upstreams are rebuilt whenever the configuration
+// is reloaded
+type Handler struct {
+	service   *limiter.Service
+	transport http.RoundTripper
+	upstreams atomic.Pointer[configUpstreams]
+}
+
+// configUpstreams are the upstreams built for a configuration, by name
+type configUpstreams struct {
+	config    *config.Config
+	upstreams map[string]*upstream
+}
+
+// upstream proxies requests round-robin across the targets of an upstream
+type upstream struct {
+	config.Upstream
+	next  atomic.Uint64
+	proxy *httputil.ReverseProxy
+}
+
+// NewHandler creates a handler proxying requests to the upstreams of
+// service's configuration
+func NewHandler(service *limiter.Service) *Handler {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	return &Handler{service: service, transport: transport}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := limiter.RouteFromContext(r.Context())
+	if !ok {
+		route = h.service.MatchRoute(r.Method, r.Host, r.URL.Path)
+	}
+
+	u := h.upstreamsFor(route.Config())[route.Upstream()]
+	if u == nil {
+		writeError(w, http.StatusNotFound, "No upstream for this route")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), u.Timeout)
+	defer cancel()
+	u.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// upstreamsFor returns the upstreams of cfg, building them on first use
+func (h *Handler) upstreamsFor(cfg *config.Config) map[string]*upstream {
+	current := h.upstreams.Load()
+	if current == nil || current.config != cfg {
+		current = &configUpstreams{config: cfg, upstreams: make(map[string]*upstream, len(cfg.Upstreams))}
+		for name, settings := range cfg.Upstreams {
+			current.upstreams[name] = h.newUpstream(name, settings, cfg.TrustedProxies)
+		}
+		h.upstreams.Store(current)
+	}
+	return current.upstreams
+}
+
+func (h *Handler) newUpstream(name string, settings config.Upstream, trustedProxies []*net.IPNet) *upstream {
+	u := &upstream{Upstream: settings}
+	u.proxy = &httputil.ReverseProxy{
+		Transport: h.transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if path, ok := stripPrefix(pr.Out.URL.Path, u.StripPrefix); ok {
+				pr.Out.URL.Path, pr.Out.URL.RawPath = path, ""
+			}
+			pr.SetURL(u.target())
+
+			// Extend the forwarding chain only when it comes from a trusted proxy
+			if middleware.FromTrustedProxy(pr.In, trustedProxies) {
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			}
+			pr.SetXForwarded()
+			u.RequestHeaders.Apply(pr.Out.Header)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			u.ResponseHeaders.Apply(resp.Header)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("Upstream %s timed out after %v: %s %s", name, u.Timeout, r.Method, r.URL.Path)
+				writeError(w, http.StatusGatewayTimeout, "Upstream timed out")
+				return
+			}
+			if errors.Is(err, context.Canceled) {
+				// The client went away; nobody reads the response
+				return
+			}
+			log.Printf("Upstream %s failed: %v", name, err)
+			writeError(w, http.StatusBadGateway, "Upstream unavailable")
+		},
+	}
+	return u
+}
+
+// target returns the next target, round-robin
+func (u *upstream) target() *url.URL {
+	return u.Targets[(u.next.Add(1)-1)%uint64(len(u.Targets))]
+}
+
+// stripPrefix removes prefix from path when path is below it, keeping the
+// leading slash: "/api" turns "/api/users" into "/users" but leaves "/apis"
+func stripPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return path, false
+	}
+	rest, found := strings.CutPrefix(path, prefix)
+	if !found || (rest != "" && rest[0] != '/') {
+		return path, false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": msg,
+	})
+}
+
+// Timeout returns the longest time a request may wait for an upstream of
+// cfg, e.g. to size the server's write timeout
+func Timeout(cfg *config.Config) time.Duration {
+	var longest time.Duration
+	for _, upstream := range cfg.Upstreams {
+		longest = max(longest, upstream.Timeout)
+	}
+	return longest
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/middleware"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+// newBackend starts an upstream answering with its name and the path and
+// headers it received
+func newBackend(t *testing.T, name string) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("X-Backend", name)
+		w.Header().Set("X-Powered-By", "test")
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Got-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Got-Api-Key", r.Header.Get("X-Api-Key"))
+		w.Header().Set("X-Got-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+	return target
+}
+
+func newTestProxy(t *testing.T, cfg *config.Config) http.Handler {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+
+	service := limiter.NewService(store, cfg)
+	return middleware.RateLimitMiddleware(service)(NewHandler(service))
+}
+
+func TestHandler(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	handler := newTestProxy(t, &config.Config{
+		MaxRequestsPerSecond: 100,
+		RateLimitWindow:      time.Second,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		TrustedProxies:       []*net.IPNet{trusted},
+		Routes: []config.RouteRule{
+			{Name: "auth", Pattern: "/auth/", Upstream: "auth"},
+		},
+		Upstreams: map[string]config.Upstream{
+			config.DefaultUpstream: {
+				Targets: []*url.URL{newBackend(t, "app-1"), newBackend(t, "app-2")},
+				Timeout: time.Second,
+			},
+			"auth": {
+				Targets:         []*url.URL{newBackend(t, "auth")},
+				Timeout:         time.Second,
+				StripPrefix:     "/auth",
+				RequestHeaders:  config.HeaderRewrite{Set: map[string]string{"X-Api-Key": "s3cret"}, Remove: []string{"Authorization"}},
+				ResponseHeaders: config.HeaderRewrite{Set: map[string]string{"X-Gateway": "ratelimiter"}, Remove: []string{"X-Powered-By"}},
+			},
+		},
+	})
+
+	request := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer abc")
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Requests are spread round-robin across the default upstream's targets
+	first, second := request("/users", "192.0.2.1:1234"), request("/users", "192.0.2.1:1234")
+	if first.Code != http.StatusOK || first.Header().Get("X-Path") != "/users" {
+		t.Fatalf("Expected /users to be proxied, got %d %q", first.Code, first.Header().Get("X-Path"))
+	}
+	if first.Header().Get("X-Backend") == second.Header().Get("X-Backend") {
+		t.Errorf("Expected two different targets, got %s twice", first.Header().Get("X-Backend"))
+	}
+	if first.Header().Get("X-Got-Authorization") != "Bearer abc" {
+		t.Error("Expected the request headers to be forwarded unchanged")
+	}
+	if got := first.Header().Get("X-Got-Forwarded-For"); got != "192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For from an untrusted client to be replaced, got %q", got)
+	}
+	if got := request("/users", "10.0.0.1:1234").Header().Get("X-Got-Forwarded-For"); got != "198.51.100.1, 10.0.0.1" {
+		t.Errorf("Expected X-Forwarded-For from a trusted proxy to be extended, got %q", got)
+	}
+
+	// The auth route goes to its own upstream, which rewrites the headers
+	rec := request("/auth/login", "192.0.2.1:1234")
+	if rec.Header().Get("X-Backend") != "auth" || rec.Header().Get("X-Path") != "/login" {
+		t.Errorf("Expected /login on the auth upstream, got %q on %q", rec.Header().Get("X-Path"), rec.Header().Get("X-Backend"))
+	}
+	if rec.Header().Get("X-Got-Authorization") != "" || rec.Header().Get("X-Got-Api-Key") != "s3cret" {
+		t.Errorf("Expected the request headers to be rewritten, got Authorization %q and X-Api-Key %q", rec.Header().Get("X-Got-Authorization"), rec.Header().Get("X-Got-Api-Key"))
+	}
+	if rec.Header().Get("X-Powered-By") != "" || rec.Header().Get("X-Gateway") != "ratelimiter" {
+		t.Errorf("Expected the response headers to be rewritten, got %v", rec.Header())
+	}
+	if rec.Header().Get("RateLimit-Limit") != "100" {
+		t.Errorf("Expected the route to apply the default limits, got %q", rec.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestHandler_Errors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	down, _ := url.Parse(closed.URL)
+
+	handler := newTestProxy(t, &config.Config{
+		Routes: []config.RouteRule{
+			{Name: "slow", Pattern: "/slow", Upstream: "app"},
+			{Name: "down", Pattern: "/down/", Upstream: "down"},
+		},
+		Upstreams: map[string]config.Upstream{
+			"app":  {Targets: []*url.URL{newBackend(t, "app")}, Timeout: 50 * time.Millisecond},
+			"down": {Targets: []*url.URL{down}, Timeout: time.Second},
+		},
+	})
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/slow", http.StatusGatewayTimeout},
+		{"/down/", http.StatusBadGateway},
+		{"/other", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("Expected %d for %s, got %d", tt.want, tt.path, rec.Code)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   string
+	}{
+		{"/api/users", "/api", "/users"},
+		{"/api/users", "/api/", "/users"},
+		{"/api", "/api", "/"},
+		{"/apis", "/api", "/apis"},
+		{"/other", "/api", "/other"},
+	}
+
+	for _, tt := range tests {
+		if got, _ := stripPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("Expected %s without %s to be %s, got %s", tt.path, tt.prefix, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOffline is returned by the registry of Offline for what it can't tell
+// without calling the storage
+var ErrOffline = errors.New("token registry offline")
+
+// cacheMaxEntries bounds the lookups a CachedRegistry remembers, as unknown
+// secrets are remembered too
+const cacheMaxEntries = 100000
+
+// CachedRegistry remembers the lookups of a registry for a short time,
+// unknown secrets included, so requests don't wait on the registry and a
+// flood of invalid tokens doesn't reach it
+// Tokens put or deleted through it are forgotten at once; changes made
+// elsewhere, e.g. by another instance, apply within the TTL
+type CachedRegistry struct {
+	TokenRegistry
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedLookup
+}
+
+// cachedLookup is the token a secret hash was found to belong to, nil for
+// an unknown secret
+type cachedLookup struct {
+	token   *Token
+	expires time.Time
+}
+
+// NewCachedRegistry caches the lookups of r for ttl
+func NewCachedRegistry(r TokenRegistry, ttl time.Duration) *CachedRegistry {
+	return &CachedRegistry{
+		TokenRegistry: r,
+		ttl:           ttl,
+		entries:       make(map[string]cachedLookup),
+	}
+}
+
+// Lookup returns the token whose secret is secret, from the cache unless
+// its entry has expired
+func (c *CachedRegistry) Lookup(ctx context.Context, secret string) (*Token, error) {
+	hash := HashSecret(secret)
+	if entry, ok := c.cached(hash); ok && time.Now().Before(entry.expires) {
+		return entry.result()
+	}
+
+	token, err := c.TokenRegistry.Lookup(ctx, secret)
+	switch {
+	case err == nil:
+		c.remember(hash, copyToken(token))
+	case errors.Is(err, ErrNotFound):
+		c.remember(hash, nil)
+	}
+	return token, err
+}
+
+// Put creates or replaces the token with the same ID
+func (c *CachedRegistry) Put(ctx context.Context, token *Token) error {
+	defer c.forget(token.ID, token.Hash)
+	return c.TokenRegistry.Put(ctx, token)
+}
+
+// Delete removes the token with the given ID
+func (c *CachedRegistry) Delete(ctx context.Context, id string) error {
+	defer c.forget(id, "")
+	return c.TokenRegistry.Delete(ctx, id)
+}
+
+func (c *CachedRegistry) cached(hash string) (cachedLookup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[hash]
+	return entry, ok
+}
+
+func (c *CachedRegistry) remember(hash string, token *Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, exists := c.entries[hash]; !exists && len(c.entries) >= cacheMaxEntries {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		// Still full of live entries: make room for this one
+		for key := range c.entries {
+			if len(c.entries) < cacheMaxEntries {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+	c.entries[hash] = cachedLookup{token: token, expires: now.Add(c.ttl)}
+}
+
+// forget drops the lookups of the token id and of the secret hash
+func (c *CachedRegistry) forget(id, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, hash)
+	for key, entry := range c.entries {
+		if entry.token != nil && entry.token.ID == id {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (e cachedLookup) result() (*Token, error) {
+	if e.token == nil {
+		return nil, ErrNotFound
+	}
+	return copyToken(e.token), nil
+}
+
+// Offline returns the registry to look tokens up in while the storage keeping
+// r fails: the cache of a CachedRegistry, expired entries included, or r
+// itself when it isn't kept in a storage
+// Its calls return ErrOffline for anything it can't tell without the storage
+func Offline(r TokenRegistry) TokenRegistry {
+	switch r := r.(type) {
+	case *CachedRegistry:
+		return &offlineRegistry{cache: r}
+	case *storageRegistry:
+		return &offlineRegistry{}
+	default:
+		return r
+	}
+}
+
+// offlineRegistry answers lookups from a cache, if any, without calling the
+// registry cached
+type offlineRegistry struct {
+	cache *CachedRegistry
+}
+
+func (o *offlineRegistry) Lookup(ctx context.Context, secret string) (*Token, error) {
+	if o.cache != nil {
+		if entry, ok := o.cache.cached(HashSecret(secret)); ok {
+			return entry.result()
+		}
+	}
+	return nil, ErrOffline
+}
+
+func (o *offlineRegistry) Get(ctx context.Context, id string) (*Token, error) {
+	return nil, ErrOffline
+}
+
+func (o *offlineRegistry) List(ctx context.Context) ([]*Token, error) {
+	return nil, ErrOffline
+}
+
+func (o *offlineRegistry) Put(ctx context.Context, token *Token) error {
+	return ErrOffline
+}
+
+func (o *offlineRegistry) Delete(ctx context.Context, id string) error {
+	return ErrOffline
+}
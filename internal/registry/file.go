@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// fileContents is the format of a registry file:
+//
+//	{"tokens": [{"id": "tok_1", "hash": "<hex sha256>", "owner": "acme", "tier": "pro"}]}
+type fileContents struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+// FileRegistry keeps tokens in a JSON file
+// The file is read into memory on creation and by Reload; changes made
+// through Put and Delete are written back to it atomically
+type FileRegistry struct {
+	*MemoryRegistry
+	path string
+}
+
+// NewFileRegistry loads the registry from path, which is created on the
+// first change if it doesn't exist
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	f := &FileRegistry{MemoryRegistry: NewMemoryRegistry(), path: path}
+	if err := f.Reload(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, e.g. after it was edited
+// An invalid file is rejected and the current tokens are kept
+func (f *FileRegistry) Reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var contents fileContents
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&contents); err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	for _, token := range contents.Tokens {
+		if err := token.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", f.path, err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replace(contents.Tokens); err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	return nil
+}
+
+// Put creates or replaces the token with the same ID and saves the file
+func (f *FileRegistry) Put(ctx context.Context, token *Token) error {
+	if err := token.Validate(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.put(copyToken(token)); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// Delete removes the token with the given ID and saves the file
+func (f *FileRegistry) Delete(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.remove(id); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// save writes every token to a temporary file renamed over the registry file,
+// so readers never see a partial file
+// Callers must hold f.mu
+func (f *FileRegistry) save() error {
+	contents := fileContents{Tokens: make([]*Token, 0, len(f.byID))}
+	for _, token := range f.byID {
+		contents.Tokens = append(contents.Tokens, token)
+	}
+	sortTokens(contents.Tokens)
+
+	data, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".tokens-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to save token registry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save token registry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save token registry: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return fmt.Errorf("failed to save token registry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to save token registry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryRegistry keeps tokens in process memory
+// Tokens are lost on restart, so it suits tests and local development
+type MemoryRegistry struct {
+	mu     sync.RWMutex
+	byID   map[string]*Token
+	byHash map[string]*Token
+}
+
+// NewMemoryRegistry creates an empty in-memory registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		byID:   make(map[string]*Token),
+		byHash: make(map[string]*Token),
+	}
+}
+
+// Lookup returns the token whose secret is secret
+func (m *MemoryRegistry) Lookup(ctx context.Context, secret string) (*Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, exists := m.byHash[HashSecret(secret)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return copyToken(token), nil
+}
+
+// Get returns the token with the given ID
+func (m *MemoryRegistry) Get(ctx context.Context, id string) (*Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, exists := m.byID[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return copyToken(token), nil
+}
+
+// List returns every token, ordered by ID
+func (m *MemoryRegistry) List(ctx context.Context) ([]*Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := make([]*Token, 0, len(m.byID))
+	for _, token := range m.byID {
+		tokens = append(tokens, copyToken(token))
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+// Put creates or replaces the token with the same ID
+func (m *MemoryRegistry) Put(ctx context.Context, token *Token) error {
+	if err := token.Validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.put(copyToken(token))
+}
+
+// Delete removes the token with the given ID
+func (m *MemoryRegistry) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.remove(id)
+}
+
+// put indexes token, which must not share its hash with another token
+// Callers must hold m.mu
+func (m *MemoryRegistry) put(token *Token) error {
+	if other, exists := m.byHash[token.Hash]; exists && other.ID != token.ID {
+		return fmt.Errorf("token %s: hash already used by token %s", token.ID, other.ID)
+	}
+	if previous, exists := m.byID[token.ID]; exists {
+		delete(m.byHash, previous.Hash)
+	}
+	m.byID[token.ID] = token
+	m.byHash[token.Hash] = token
+	return nil
+}
+
+// remove deletes the token with the given ID
+// Callers must hold m.mu
+func (m *MemoryRegistry) remove(id string) error {
+	token, exists := m.byID[id]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(m.byID, id)
+	delete(m.byHash, token.Hash)
+	return nil
+}
+
+// replace swaps every token for tokens
+// Callers must hold m.mu
+func (m *MemoryRegistry) replace(tokens []*Token) error {
+	byID, byHash := m.byID, m.byHash
+	m.byID = make(map[string]*Token, len(tokens))
+	m.byHash = make(map[string]*Token, len(tokens))
+	for _, token := range tokens {
+		if _, exists := m.byID[token.ID]; exists {
+			m.byID, m.byHash = byID, byHash
+			return fmt.Errorf("duplicate token id %s", token.ID)
+		}
+		if err := m.put(token); err != nil {
+			m.byID, m.byHash = byID, byHash
+			return err
+		}
+	}
+	return nil
+}
+
+// copyToken returns a copy of token that shares no memory with it
+func copyToken(token *Token) *Token {
+	c := *token
+	if token.Limit != nil {
+		limit := *token.Limit
+		c.Limit = &limit
+	}
+	if token.ExpiresAt != nil {
+		expiresAt := *token.ExpiresAt
+		c.ExpiresAt = &expiresAt
+	}
+	return &c
+}
+
+func sortTokens(tokens []*Token) {
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+}
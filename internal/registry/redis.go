@@ -0,0 +1,146 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Registry keys: the record of each token under its ID and the ID of each
+// token under its hash
+const (
+	redisTokenPrefix = "registry:token:"
+	redisHashPrefix  = "registry:hash:"
+)
+
+// RedisRegistry keeps tokens in Redis, shared by every instance
+type RedisRegistry struct {
+	client redis.UniversalClient
+}
+
+// NewRedisRegistry creates a registry stored with client
+func NewRedisRegistry(client redis.UniversalClient) *RedisRegistry {
+	return &RedisRegistry{client: client}
+}
+
+// Lookup returns the token whose secret is secret
+func (r *RedisRegistry) Lookup(ctx context.Context, secret string) (*Token, error) {
+	id, err := r.client.Get(ctx, redisHashPrefix+HashSecret(secret)).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up token: %w", err)
+	}
+	return r.Get(ctx, id)
+}
+
+// Get returns the token with the given ID
+func (r *RedisRegistry) Get(ctx context.Context, id string) (*Token, error) {
+	data, err := r.client.Get(ctx, redisTokenPrefix+id).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token %s: %w", id, err)
+	}
+	return decodeToken(id, data)
+}
+
+// List returns every token, ordered by ID
+func (r *RedisRegistry) List(ctx context.Context) ([]*Token, error) {
+	keys, err := storage.ScanKeys(ctx, r.client, redisTokenPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	tokens := make([]*Token, 0, len(keys))
+	for i, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue // deleted since the scan
+		}
+		token, err := decodeToken(strings.TrimPrefix(keys[i], redisTokenPrefix), data)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+// Put creates or replaces the token with the same ID
+func (r *RedisRegistry) Put(ctx context.Context, token *Token) error {
+	if err := token.Validate(); err != nil {
+		return err
+	}
+
+	owner, err := r.client.Get(ctx, redisHashPrefix+token.Hash).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to put token %s: %w", token.ID, err)
+	}
+	if err == nil && owner != token.ID {
+		return fmt.Errorf("token %s: hash already used by token %s", token.ID, owner)
+	}
+
+	previous, err := r.Get(ctx, token.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.Set(ctx, redisTokenPrefix+token.ID, data, 0)
+	pipe.Set(ctx, redisHashPrefix+token.Hash, token.ID, 0)
+	if previous != nil && previous.Hash != token.Hash {
+		pipe.Del(ctx, redisHashPrefix+previous.Hash)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to put token %s: %w", token.ID, err)
+	}
+	return nil
+}
+
+// Delete removes the token with the given ID
+func (r *RedisRegistry) Delete(ctx context.Context, id string) error {
+	token, err := r.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	// Deleted one at a time, as the keys may be in different cluster slots
+	pipe := r.client.Pipeline()
+	pipe.Del(ctx, redisTokenPrefix+id)
+	pipe.Del(ctx, redisHashPrefix+token.Hash)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete token %s: %w", id, err)
+	}
+	return nil
+}
+
+func decodeToken(id string, data []byte) (*Token, error) {
+	var token Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("invalid record for token %s: %w", id, err)
+	}
+	return &token, nil
+}
@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+var (
+	ErrNotFound = errors.New("token not found")
+)
+
+// Token is a registered API token
+// Only the SHA-256 hash of the secret is kept, so a leaked registry doesn't
+// leak usable tokens. The token is limited by Limit when set, otherwise by
+// the limits of its Tier
+type Token struct {
+	ID        string              `json:"id"`
+	Hash      string              `json:"hash"`
+	Owner     string              `json:"owner,omitempty"`
+	Tier      string              `json:"tier,omitempty"`
+	Limit     *config.LimitPolicy `json:"limit,omitempty"`
+	CreatedAt time.Time           `json:"created_at"`
+	ExpiresAt *time.Time          `json:"expires_at,omitempty"`
+	Disabled  bool                `json:"disabled,omitempty"`
+}
+
+// Active reports whether the token may be used at now: it is neither
+// disabled nor expired
+func (t *Token) Active(now time.Time) bool {
+	return !t.Disabled && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+// Validate checks the fields every stored token must have
+func (t *Token) Validate() error {
+	if t.ID == "" {
+		return errors.New("id is required")
+	}
+	if len(t.Hash) != hex.EncodedLen(sha256.Size) {
+		return fmt.Errorf("token %s: hash must be a hex SHA-256 digest", t.ID)
+	}
+	if t.Limit != nil {
+		if err := t.Limit.Validate(); err != nil {
+			return fmt.Errorf("token %s: limit: %w", t.ID, err)
+		}
+	}
+	return nil
+}
+
+// TokenRegistry stores token records
+// Revoking or upgrading a customer is a matter of updating its record
+type TokenRegistry interface {
+	// Lookup returns the token whose secret is secret, or ErrNotFound
+	Lookup(ctx context.Context, secret string) (*Token, error)
+
+	// Get returns the token with the given ID, or ErrNotFound
+	Get(ctx context.Context, id string) (*Token, error)
+
+	// List returns every token, ordered by ID
+	List(ctx context.Context) ([]*Token, error)
+
+	// Put creates or replaces the token with the same ID
+	Put(ctx context.Context, token *Token) error
+
+	// Delete removes the token with the given ID, or returns ErrNotFound
+	Delete(ctx context.Context, id string) error
+}
+
+// New creates the token registry selected by cfg: a FileRegistry, the
+// storage's Redis when it is a RedisStorage, or else a MemoryRegistry
+// A Redis registry is called through the interceptors of store, e.g. its
+// circuit breaker, and its lookups are cached for TOKEN_REGISTRY_CACHE_SECONDS
+func New(cfg *config.Config, store storage.Storage) (TokenRegistry, error) {
+	if cfg.TokenRegistry == config.TokenRegistryFile {
+		return NewFileRegistry(cfg.TokenRegistryFile)
+	}
+	if redisStorage, ok := storage.Unwrap(store).(*storage.RedisStorage); ok {
+		r := NewStorageRegistry(NewRedisRegistry(redisStorage.Client()), store)
+		if cfg.TokenRegistryCacheTTL <= 0 {
+			return r, nil
+		}
+		return NewCachedRegistry(r, cfg.TokenRegistryCacheTTL), nil
+	}
+	return NewMemoryRegistry(), nil
+}
+
+// HashSecret returns the hex SHA-256 digest of a token secret, as stored in
+// Token.Hash
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken creates a token with a random ID and secret
+// The secret is only returned here; the token keeps its hash
+func NewToken(owner, tier string) (*Token, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	encoded := "rl_" + base64.RawURLEncoding.EncodeToString(secret)
+	return &Token{
+		ID:        "tok_" + hex.EncodeToString(id),
+		Hash:      HashSecret(encoded),
+		Owner:     owner,
+		Tier:      tier,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}, encoded, nil
+}
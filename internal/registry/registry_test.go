@@ -0,0 +1,298 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage/storagetest"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	testRegistry(t, NewMemoryRegistry())
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	f, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("Expected a missing file to be accepted, got %v", err)
+	}
+	testRegistry(t, f)
+
+	// The tokens left by testRegistry were saved
+	loaded, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tokens, _ := loaded.List(context.Background())
+	if len(tokens) != 1 || tokens[0].ID != "tok_b" {
+		t.Errorf("Expected the saved token tok_b, got %+v", tokens)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the file to be saved with mode 0600, got %v (%v)", info.Mode().Perm(), err)
+	}
+}
+
+func TestRedisRegistry(t *testing.T) {
+	host, port := storagetest.RedisAddr(t)
+	client := redis.NewClient(&redis.Options{Addr: net.JoinHostPort(host, port)})
+	defer client.Close()
+
+	r := NewRedisRegistry(client)
+	testRegistry(t, r)
+	r.Delete(context.Background(), "tok_b")
+}
+
+// testRegistry exercises a registry, leaving only tok_b in it
+func testRegistry(t *testing.T, r TokenRegistry) {
+	ctx := context.Background()
+
+	if _, err := r.Lookup(ctx, "secret-a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown secret, got %v", err)
+	}
+
+	a := &Token{ID: "tok_a", Hash: HashSecret("secret-a"), Owner: "acme", Tier: "pro"}
+	b := &Token{ID: "tok_b", Hash: HashSecret("secret-b"), Limit: &config.LimitPolicy{MaxRequests: 7}}
+	for _, token := range []*Token{a, b} {
+		if err := r.Put(ctx, token); err != nil {
+			t.Fatalf("Expected no error putting %s, got %v", token.ID, err)
+		}
+	}
+
+	token, err := r.Lookup(ctx, "secret-a")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if token.ID != "tok_a" || token.Owner != "acme" || token.Tier != "pro" {
+		t.Errorf("Expected tok_a owned by acme on pro, got %+v", token)
+	}
+	if token, _ := r.Get(ctx, "tok_b"); token == nil || token.Limit == nil || token.Limit.MaxRequests != 7 {
+		t.Errorf("Expected tok_b with its limit, got %+v", token)
+	}
+
+	if err := r.Put(ctx, &Token{ID: "tok_c", Hash: a.Hash}); err == nil {
+		t.Error("Expected an error for a hash used by another token")
+	}
+	if err := r.Put(ctx, &Token{ID: "tok_c", Hash: "abc"}); err == nil {
+		t.Error("Expected an error for an invalid hash")
+	}
+
+	// Rotating the secret forgets the old one
+	a.Hash = HashSecret("secret-a2")
+	if err := r.Put(ctx, a); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := r.Lookup(ctx, "secret-a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the old secret to be forgotten, got %v", err)
+	}
+	if token, err := r.Lookup(ctx, "secret-a2"); err != nil || token.ID != "tok_a" {
+		t.Errorf("Expected the new secret to find tok_a, got %+v (%v)", token, err)
+	}
+
+	tokens, err := r.List(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(tokens) != 2 || tokens[0].ID != "tok_a" || tokens[1].ID != "tok_b" {
+		t.Errorf("Expected tok_a and tok_b, got %+v", tokens)
+	}
+
+	if err := r.Delete(ctx, "tok_a"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := r.Lookup(ctx, "secret-a2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a deleted token to be unknown, got %v", err)
+	}
+	if err := r.Delete(ctx, "tok_a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+	}
+}
+
+func TestFileRegistry_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	write := func(contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"tokens": [{"id": "tok_1", "hash": "` + HashSecret("one") + `", "tier": "free"}]}`)
+	f, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	write(`{"tokens": [{"id": "tok_1", "hash": "` + HashSecret("one") + `", "tier": "pro"}]}`)
+	if err := f.Reload(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if token, _ := f.Lookup(context.Background(), "one"); token == nil || token.Tier != "pro" {
+		t.Errorf("Expected the reloaded tier pro, got %+v", token)
+	}
+
+	invalid := []string{
+		`{"tokens": [{"id": "tok_1", "hash": "nope"}]}`,
+		`{"tokens": [{"id": "tok_1", "hash": "` + HashSecret("one") + `", "plan": "pro"}]}`,
+		`{"tokens": [{"id": "tok_1", "hash": "` + HashSecret("one") + `"}, {"id": "tok_1", "hash": "` + HashSecret("two") + `"}]}`,
+	}
+	for _, contents := range invalid {
+		write(contents)
+		if err := f.Reload(); err == nil {
+			t.Errorf("Expected an error for %s", contents)
+		}
+	}
+	if token, _ := f.Lookup(context.Background(), "one"); token == nil || token.Tier != "pro" {
+		t.Errorf("Expected invalid files to keep the current tokens, got %+v", token)
+	}
+}
+
+func TestToken_Active(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		token  Token
+		active bool
+	}{
+		{"no expiry", Token{}, true},
+		{"not expired", Token{ExpiresAt: &future}, true},
+		{"expired", Token{ExpiresAt: &past}, false},
+		{"disabled", Token{Disabled: true}, false},
+	}
+	for _, tt := range tests {
+		if active := tt.token.Active(now); active != tt.active {
+			t.Errorf("%s: Expected active %v, got %v", tt.name, tt.active, active)
+		}
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	token, secret, err := NewToken("acme", "pro")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := token.Validate(); err != nil {
+		t.Errorf("Expected a valid token, got %v", err)
+	}
+	if token.Hash != HashSecret(secret) {
+		t.Error("Expected the token to keep the hash of its secret")
+	}
+	if other, _, _ := NewToken("acme", "pro"); other.ID == token.ID {
+		t.Error("Expected random token IDs")
+	}
+}
+
+// countingRegistry counts the lookups reaching a registry
+type countingRegistry struct {
+	TokenRegistry
+	lookups int
+}
+
+func (c *countingRegistry) Lookup(ctx context.Context, secret string) (*Token, error) {
+	c.lookups++
+	return c.TokenRegistry.Lookup(ctx, secret)
+}
+
+func TestCachedRegistry(t *testing.T) {
+	testRegistry(t, NewCachedRegistry(NewMemoryRegistry(), time.Minute))
+
+	ctx := context.Background()
+	backend := &countingRegistry{TokenRegistry: NewMemoryRegistry()}
+	backend.Put(ctx, &Token{ID: "tok_a", Hash: HashSecret("secret-a")})
+	cached := NewCachedRegistry(backend, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if token, err := cached.Lookup(ctx, "secret-a"); err != nil || token.ID != "tok_a" {
+			t.Fatalf("Expected tok_a, got %+v (%v)", token, err)
+		}
+		if _, err := cached.Lookup(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	if backend.lookups != 2 {
+		t.Errorf("Expected 2 lookups to reach the registry, got %d", backend.lookups)
+	}
+
+	// Changes made elsewhere apply once the entry expires
+	backend.Put(ctx, &Token{ID: "tok_a", Hash: HashSecret("secret-a"), Disabled: true})
+	if token, _ := cached.Lookup(ctx, "secret-a"); token == nil || token.Disabled {
+		t.Errorf("Expected the cached token until it expires, got %+v", token)
+	}
+	for hash, entry := range cached.entries {
+		entry.expires = time.Now()
+		cached.entries[hash] = entry
+	}
+	if token, _ := cached.Lookup(ctx, "secret-a"); token == nil || !token.Disabled {
+		t.Errorf("Expected the revoked token once expired, got %+v", token)
+	}
+
+	// Offline, the cache answers whatever it remembers, expired or not
+	offline := Offline(cached)
+	if token, err := offline.Lookup(ctx, "secret-a"); err != nil || !token.Disabled {
+		t.Errorf("Expected the cached token offline, got %+v (%v)", token, err)
+	}
+	if _, err := offline.Lookup(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the cached unknown secret offline, got %v", err)
+	}
+	if _, err := offline.Lookup(ctx, "never-seen"); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected ErrOffline for a secret never looked up, got %v", err)
+	}
+	lookups := backend.lookups
+	if _, err := offline.Get(ctx, "tok_a"); !errors.Is(err, ErrOffline) || backend.lookups != lookups {
+		t.Errorf("Expected the registry not to be called offline, got %v", err)
+	}
+
+	memory := NewMemoryRegistry()
+	if Offline(memory) != memory {
+		t.Error("Expected a registry kept in process to stay in use offline")
+	}
+}
+
+func TestStorageRegistry(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	var operations []string
+	var down bool
+	intercepted := storage.NewCircuitBreaker(storage.Intercept(store, func(operation string, call func() error) error {
+		operations = append(operations, operation)
+		if down {
+			return errors.New("connection refused")
+		}
+		return call()
+	}), 2, time.Minute)
+
+	r := NewStorageRegistry(NewMemoryRegistry(), intercepted)
+	testRegistry(t, r)
+	if len(operations) == 0 || operations[0] != "registry_lookup" {
+		t.Errorf("Expected the registry's calls to be intercepted, got %v", operations)
+	}
+
+	// Unknown tokens are no failures of the storage
+	for i := 0; i < 3; i++ {
+		if _, err := r.Lookup(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected ErrNotFound, got %v", err)
+		}
+	}
+
+	down = true
+	for i := 0; i < 2; i++ {
+		r.Lookup(ctx, "secret-b")
+	}
+	if _, err := r.Lookup(ctx, "secret-b"); !errors.Is(err, storage.ErrCircuitOpen) {
+		t.Errorf("Expected the registry to fail fast with the storage, got %v", err)
+	}
+	if _, err := Offline(r).Lookup(ctx, "secret-b"); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected ErrOffline without a cache, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+// storageRegistry is a registry kept in the backend of a storage, whose
+// calls go through the storage's interceptors
+type storageRegistry struct {
+	registry TokenRegistry
+	store    storage.Storage
+}
+
+// NewStorageRegistry returns r, kept in the backend of store, calling it
+// through the interceptors of store: its calls are timed with the storage's
+// and fail fast while the storage's circuit breaker is open
+func NewStorageRegistry(r TokenRegistry, store storage.Storage) TokenRegistry {
+	return &storageRegistry{registry: r, store: store}
+}
+
+// run calls the registry through the storage's interceptors
+// Unknown tokens are no failure of the storage, so they don't count
+// towards opening its circuit breaker
+func (r *storageRegistry) run(operation string, call func() error) error {
+	var callErr error
+	err := storage.Run(r.store, operation, func() error {
+		callErr = call()
+		if errors.Is(callErr, ErrNotFound) {
+			return nil
+		}
+		return callErr
+	})
+	if err != nil {
+		return err
+	}
+	return callErr
+}
+
+func (r *storageRegistry) Lookup(ctx context.Context, secret string) (token *Token, err error) {
+	err = r.run("registry_lookup", func() error {
+		token, err = r.registry.Lookup(ctx, secret)
+		return err
+	})
+	return token, err
+}
+
+func (r *storageRegistry) Get(ctx context.Context, id string) (token *Token, err error) {
+	err = r.run("registry_get", func() error {
+		token, err = r.registry.Get(ctx, id)
+		return err
+	})
+	return token, err
+}
+
+func (r *storageRegistry) List(ctx context.Context) (tokens []*Token, err error) {
+	err = r.run("registry_list", func() error {
+		tokens, err = r.registry.List(ctx)
+		return err
+	})
+	return tokens, err
+}
+
+func (r *storageRegistry) Put(ctx context.Context, token *Token) error {
+	// An invalid token is no failure of the storage either
+	if err := token.Validate(); err != nil {
+		return err
+	}
+	return r.run("registry_put", func() error {
+		return r.registry.Put(ctx, token)
+	})
+}
+
+func (r *storageRegistry) Delete(ctx context.Context, id string) error {
+	return r.run("registry_delete", func() error {
+		return r.registry.Delete(ctx, id)
+	})
+}
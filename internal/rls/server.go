@@ -0,0 +1,146 @@
+package rls
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Observer is notified of the decisions made for descriptors, e.g. to
+// export metrics
+type Observer interface {
+	ObserveDecision(rule string, decision limiter.Decision, err error)
+}
+
+// Server implements Envoy's rate limit service
+// (envoy.service.ratelimit.v3.RateLimitService), so Envoy and Istio can use
+// the rate limiter in place of envoyproxy/ratelimit
+// Descriptors are decided by limiter.Service.CheckDescriptors; the request
+// is over the limit when any of them is
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	service   *limiter.Service
+	observers []Observer
+}
+
+// NewServer creates a rate limit service deciding with service
+func NewServer(service *limiter.Service, observers ...Observer) *Server {
+	return &Server{service: service, observers: observers}
+}
+
+// ShouldRateLimit decides a request from its descriptors
+// A storage failure the failure mode doesn't absorb is reported as
+// Unavailable, so Envoy applies its own failure_mode_deny setting
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain must not be empty")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "descriptor list must not be empty")
+	}
+
+	descriptors := make([][]config.DescriptorEntry, len(req.GetDescriptors()))
+	hits := make([]int, len(req.GetDescriptors()))
+	for i, descriptor := range req.GetDescriptors() {
+		for _, entry := range descriptor.GetEntries() {
+			descriptors[i] = append(descriptors[i], config.DescriptorEntry{Key: entry.GetKey(), Value: entry.GetValue()})
+		}
+		hits[i] = hitsAddend(req, descriptor)
+	}
+
+	decisions, errs := s.service.CheckDescriptors(ctx, req.GetDomain(), descriptors, hits)
+	now := time.Now()
+	response := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	for i, decision := range decisions {
+		rule := decision.Policy
+		if rule == "" {
+			rule = limiter.PolicyDefault
+		}
+		for _, observer := range s.observers {
+			observer.ObserveDecision(rule, decision, errs[i])
+		}
+
+		err := errs[i]
+		switch {
+		case errors.Is(err, limiter.ErrUnavailable):
+			return nil, status.Error(codes.Unavailable, err.Error())
+		case err != nil && !errors.Is(err, limiter.ErrLimitExceeded) && !errors.Is(err, limiter.ErrAccessDenied):
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+		if !decision.Allowed {
+			descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		if decision.Limit > 0 {
+			descriptorStatus.CurrentLimit = currentLimit(decision)
+			descriptorStatus.LimitRemaining = uint32(decision.Remaining)
+			descriptorStatus.DurationUntilReset = durationpb.New(decision.ResetAfter(now))
+		}
+		response.Statuses = append(response.Statuses, descriptorStatus)
+	}
+	return response, nil
+}
+
+// hitsAddend returns the number of requests a descriptor counts: its own
+// hits_addend when set, the request's otherwise, and one when neither is
+func hitsAddend(req *rlsv3.RateLimitRequest, descriptor *ratelimitv3.RateLimitDescriptor) int {
+	hits := uint64(req.GetHitsAddend())
+	if addend := descriptor.GetHitsAddend(); addend != nil {
+		hits = addend.GetValue()
+	}
+	return int(min(max(hits, 1), math.MaxInt32))
+}
+
+// units are the units a limit is reported in, longest first
+var units = []struct {
+	length time.Duration
+	unit   rlsv3.RateLimitResponse_RateLimit_Unit
+}{
+	{24 * time.Hour, rlsv3.RateLimitResponse_RateLimit_DAY},
+	{time.Hour, rlsv3.RateLimitResponse_RateLimit_HOUR},
+	{time.Minute, rlsv3.RateLimitResponse_RateLimit_MINUTE},
+	{time.Second, rlsv3.RateLimitResponse_RateLimit_SECOND},
+}
+
+// currentLimit reports the limit of decision in the longest unit its window
+// is a multiple of, e.g. 100 per 2m as 50 per minute; windows that aren't a
+// whole number of seconds are reported per second, rounded up
+func currentLimit(decision limiter.Decision) *rlsv3.RateLimitResponse_RateLimit {
+	length, unit := time.Second, rlsv3.RateLimitResponse_RateLimit_SECOND
+	for _, u := range units {
+		if decision.Window >= u.length && decision.Window%u.length == 0 {
+			length, unit = u.length, u.unit
+			break
+		}
+	}
+
+	requests := int64(decision.Limit)
+	if decision.Window > 0 {
+		requests = (int64(decision.Limit)*int64(length) + int64(decision.Window) - 1) / int64(decision.Window)
+	}
+	return &rlsv3.RateLimitResponse_RateLimit{
+		Name:            decision.Policy,
+		RequestsPerUnit: uint32(max(requests, 1)),
+		Unit:            unit,
+	}
+}
+
+// NewGRPCServer creates a gRPC server serving the rate limit service
+func NewGRPCServer(service *limiter.Service, observers ...Observer) *grpc.Server {
+	server := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(server, NewServer(service, observers...))
+	return server
+}
@@ -0,0 +1,180 @@
+package rls
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// newTestClient serves the rate limit service of store and cfg in memory
+// and returns a client connected to it
+func newTestClient(t *testing.T, store storage.Storage, cfg *config.Config) rlsv3.RateLimitServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	server := NewGRPCServer(limiter.NewService(store, cfg))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(entries ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return d
+}
+
+func TestServer_ShouldRateLimit(t *testing.T) {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+	client := newTestClient(t, store, &config.Config{
+		MaxRequestsPerSecond: 10,
+		RateLimitWindow:      time.Second,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		Descriptors: []config.DescriptorRule{
+			{
+				Name:    "per-user",
+				Entries: []config.DescriptorEntry{{Key: "user_id"}},
+				Limit:   config.TokenLimit{MaxRequests: 2, Window: 2 * time.Minute},
+			},
+		},
+	})
+
+	request := &rlsv3.RateLimitRequest{
+		Domain:      "mesh",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("user_id", "alice"), descriptor("remote_address", "192.0.2.1")},
+	}
+	ctx := context.Background()
+
+	response, err := client.ShouldRateLimit(ctx, request)
+	if err != nil {
+		t.Fatalf("ShouldRateLimit failed: %v", err)
+	}
+	if response.OverallCode != rlsv3.RateLimitResponse_OK || len(response.Statuses) != 2 {
+		t.Fatalf("Expected OK with 2 statuses, got %v", response)
+	}
+	user := response.Statuses[0]
+	if user.CurrentLimit.GetRequestsPerUnit() != 1 || user.CurrentLimit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_MINUTE || user.CurrentLimit.GetName() != "per-user" {
+		t.Errorf("Expected 2 per 2m to be reported as 1 per minute, got %v", user.CurrentLimit)
+	}
+	if user.LimitRemaining != 1 || user.DurationUntilReset.AsDuration() <= 0 {
+		t.Errorf("Expected 1 request remaining until the reset, got %d until %v", user.LimitRemaining, user.DurationUntilReset.AsDuration())
+	}
+	if ip := response.Statuses[1]; ip.CurrentLimit.GetRequestsPerUnit() != 10 || ip.CurrentLimit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_SECOND {
+		t.Errorf("Expected the default IP limit of 10 per second, got %v", ip.CurrentLimit)
+	}
+
+	client.ShouldRateLimit(ctx, request)
+	response, err = client.ShouldRateLimit(ctx, request)
+	if err != nil {
+		t.Fatalf("ShouldRateLimit failed: %v", err)
+	}
+	if response.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT || response.Statuses[0].Code != rlsv3.RateLimitResponse_OVER_LIMIT || response.Statuses[1].Code != rlsv3.RateLimitResponse_OK {
+		t.Errorf("Expected only the user descriptor over the limit, got %v", response)
+	}
+
+	if _, err := client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Descriptors: request.Descriptors}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without a domain, got %v", err)
+	}
+}
+
+func TestServer_ShouldRateLimit_HitsAddend(t *testing.T) {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+	client := newTestClient(t, store, &config.Config{
+		MaxRequestsPerSecond: 5,
+		RateLimitWindow:      time.Minute,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+	})
+	ctx := context.Background()
+
+	response, err := client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:      "mesh",
+		HitsAddend:  3,
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", "192.0.2.1")},
+	})
+	if err != nil {
+		t.Fatalf("ShouldRateLimit failed: %v", err)
+	}
+	if response.OverallCode != rlsv3.RateLimitResponse_OK || response.Statuses[0].LimitRemaining != 2 {
+		t.Errorf("Expected 3 hits to leave 2 of 5 requests, got %v", response)
+	}
+
+	// A descriptor's own hits_addend overrides the request's
+	overridden := descriptor("remote_address", "192.0.2.1")
+	overridden.HitsAddend = wrapperspb.UInt64(1)
+	response, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:      "mesh",
+		HitsAddend:  3,
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{overridden},
+	})
+	if err != nil {
+		t.Fatalf("ShouldRateLimit failed: %v", err)
+	}
+	if response.OverallCode != rlsv3.RateLimitResponse_OK || response.Statuses[0].LimitRemaining != 1 {
+		t.Errorf("Expected 1 hit to leave 1 request, got %v", response)
+	}
+
+	response, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:      "mesh",
+		HitsAddend:  2,
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", "192.0.2.1")},
+	})
+	if err != nil {
+		t.Fatalf("ShouldRateLimit failed: %v", err)
+	}
+	if response.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT || response.Statuses[0].LimitRemaining != 1 {
+		t.Errorf("Expected 2 hits not to fit in the 1 request left, got %v", response)
+	}
+}
+
+func TestServer_ShouldRateLimit_Unavailable(t *testing.T) {
+	store := storage.NewMemoryStorage(0, time.Minute)
+	t.Cleanup(func() { store.Close() })
+	failing := storage.Intercept(store, func(operation string, call func() error) error {
+		return errors.New("connection refused")
+	})
+	client := newTestClient(t, failing, &config.Config{
+		MaxRequestsPerSecond: 10,
+		RateLimitWindow:      time.Second,
+		RateLimitAlgorithm:   config.AlgorithmFixedWindow,
+		EnableIPRateLimiter:  true,
+		FailureMode:          config.FailureModeClosed,
+	})
+
+	_, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Domain:      "mesh",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", "192.0.2.1")},
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Pattern is a compiled route pattern in the http.ServeMux syntax of Go 1.22:
+// "[METHOD ][HOST]/[PATH]", where PATH segments may be wildcards such as
+// {id}, a final {rest...} matching the remainder of the path, or a final {$}
+// matching only the path with a trailing slash
+// As with http.ServeMux, a pattern ending in a slash matches every path below
+// it and GET also matches HEAD requests
+type Pattern struct {
+	Method   string
+	Host     string
+	segments []segment
+	prefix   bool // trailing slash: matches every path below
+	exact    bool // trailing {$}: matches only the path with a trailing slash
+}
+
+type segment struct {
+	literal  string
+	wildcard bool
+	rest     bool
+}
+
+// Compile parses a route pattern
+func Compile(pattern string) (*Pattern, error) {
+	p := &Pattern{}
+	rest := strings.TrimSpace(pattern)
+
+	if method, path, found := strings.Cut(rest, " "); found {
+		p.Method = method
+		rest = strings.TrimLeft(path, " \t")
+		if !isToken(method) {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+	}
+
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("path must start with /: %q", pattern)
+	}
+	p.Host, rest = rest[:i], rest[i+1:]
+
+	if rest == "" {
+		p.prefix = true
+		return p, nil
+	}
+
+	names := make(map[string]bool)
+	parts := strings.Split(rest, "/")
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch {
+		case part == "" && last:
+			p.prefix = true
+		case part == "{$}":
+			if !last {
+				return nil, fmt.Errorf("{$} must be the last segment of %q", pattern)
+			}
+			p.exact = true
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			seg := segment{wildcard: true}
+			if base, found := strings.CutSuffix(name, "..."); found {
+				if !last {
+					return nil, fmt.Errorf("%s must be the last segment of %q", part, pattern)
+				}
+				name, seg.rest = base, true
+			}
+			if !isIdentifier(name) {
+				return nil, fmt.Errorf("invalid wildcard name %q in %q", name, pattern)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("duplicate wildcard name %q in %q", name, pattern)
+			}
+			names[name] = true
+			p.segments = append(p.segments, seg)
+		case strings.ContainsAny(part, "{}"):
+			return nil, fmt.Errorf("wildcards must be full path segments in %q", pattern)
+		default:
+			p.segments = append(p.segments, segment{literal: part})
+		}
+	}
+
+	return p, nil
+}
+
+// Match reports whether a request for method, host and path matches the pattern
+func (p *Pattern) Match(method, host, path string) bool {
+	if p.Method != "" && p.Method != method && !(p.Method == "GET" && method == "HEAD") {
+		return false
+	}
+	if p.Host != "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(p.Host, host) {
+			return false
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, seg := range p.segments {
+		if i >= len(parts) {
+			return false
+		}
+		if seg.rest {
+			return true
+		}
+		if seg.wildcard {
+			if parts[i] == "" {
+				return false
+			}
+		} else if parts[i] != seg.literal {
+			return false
+		}
+	}
+
+	remaining := parts[len(p.segments):]
+	switch {
+	case p.prefix:
+		return len(remaining) > 0
+	case p.exact:
+		return len(remaining) == 1 && remaining[0] == ""
+	default:
+		return len(remaining) == 0
+	}
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && (i == 0 || !('0' <= c && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// isToken reports whether s is a valid HTTP method token
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package route
+
+import (
+	"testing"
+)
+
+func TestPattern_Match(t *testing.T) {
+	tests := []struct {
+		pattern string
+		method  string
+		host    string
+		path    string
+		want    bool
+	}{
+		{"/", "GET", "", "/", true},
+		{"/", "POST", "", "/anything/below", true},
+		{"/health", "GET", "", "/health", true},
+		{"/health", "GET", "", "/health/", false},
+		{"/health", "GET", "", "/healthz", false},
+		{"/static/", "GET", "", "/static/css/app.css", true},
+		{"/static/", "GET", "", "/static/", true},
+		{"/static/", "GET", "", "/static", false},
+		{"/static/{$}", "GET", "", "/static/", true},
+		{"/static/{$}", "GET", "", "/static/app.css", false},
+		{"GET /users/{id}", "GET", "", "/users/42", true},
+		{"GET /users/{id}", "HEAD", "", "/users/42", true},
+		{"GET /users/{id}", "POST", "", "/users/42", false},
+		{"GET /users/{id}", "GET", "", "/users/", false},
+		{"GET /users/{id}", "GET", "", "/users/42/orders", false},
+		{"POST /login", "POST", "", "/login", true},
+		{"/files/{path...}", "GET", "", "/files/a/b/c", true},
+		{"/files/{path...}", "GET", "", "/files/", true},
+		{"/files/{path...}", "GET", "", "/files", false},
+		{"api.example.com/", "GET", "api.example.com:8080", "/v1", true},
+		{"api.example.com/", "GET", "www.example.com", "/v1", false},
+		{"DELETE api.example.com/items/{id}", "DELETE", "API.example.com", "/items/1", true},
+	}
+
+	for _, tt := range tests {
+		p, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("Compile(%q): %v", tt.pattern, err)
+		}
+		if got := p.Match(tt.method, tt.host, tt.path); got != tt.want {
+			t.Errorf("%q.Match(%s, %q, %q) = %v, want %v", tt.pattern, tt.method, tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	for _, pattern := range []string{
+		"",
+		"users",
+		"GET users",
+		"/{bad",
+		"/users/{id}x",
+		"/users/{1id}",
+		"/{id}/{id}",
+		"/{rest...}/more",
+		"/{$}/more",
+		"G(ET /users",
+	} {
+		if _, err := Compile(pattern); err == nil {
+			t.Errorf("Compile(%q) should fail", pattern)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling a storage that keeps failing
+var ErrCircuitOpen = errors.New("storage circuit breaker is open")
+
+// circuitProbeTimeout bounds the ping probing a failed storage
+const circuitProbeTimeout = time.Second
+
+// circuitBreaker counts the consecutive failures of a storage
+type circuitBreaker struct {
+	store     Storage
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker returns store behind a circuit breaker that stops calling
+// it after threshold consecutive failures, so a dead backend doesn't slow
+// every request down
+// While open, operations fail at once with ErrCircuitOpen; after cooldown a
+// single caller pings the storage and closes the circuit when it answers,
+// or keeps it open for another cooldown
+// The storage returned implements the optional storage interfaces store
+// does; a non-positive threshold returns store as is
+func NewCircuitBreaker(store Storage, threshold int, cooldown time.Duration) Storage {
+	if threshold <= 0 {
+		return store
+	}
+	b := &circuitBreaker{store: store, threshold: threshold, cooldown: cooldown}
+	return Intercept(store, b.intercept)
+}
+
+func (b *circuitBreaker) intercept(operation string, call func() error) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	err := call()
+	b.record(err)
+	return err
+}
+
+// acquire returns ErrCircuitOpen unless the storage may be called, probing
+// it first once the cooldown is over
+func (b *circuitBreaker) acquire() error {
+	b.mu.Lock()
+	if b.failures < b.threshold {
+		b.mu.Unlock()
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		b.mu.Unlock()
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), circuitProbeTimeout)
+	defer cancel()
+	err := b.store.Ping(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil {
+		b.openUntil = time.Now().Add(b.cooldown)
+		return ErrCircuitOpen
+	}
+	log.Printf("Storage circuit breaker closed, storage recovered")
+	b.failures = 0
+	return nil
+}
+
+// record counts a failed call, opening the circuit at the threshold, and
+// resets the count on success
+// Calls given up by their caller don't say anything about the storage
+func (b *circuitBreaker) record(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures == b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("Storage circuit breaker opened after %d consecutive failures, retrying in %v: %v", b.failures, b.cooldown, err)
+	}
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyStorage returns a memory storage failing every operation while down
+// is set, and counting the operations reaching it
+func flakyStorage(t *testing.T, down *atomic.Bool, calls *atomic.Int32) Storage {
+	store := NewMemoryStorage(0, 0)
+	t.Cleanup(func() { store.Close() })
+	return Intercept(store, func(operation string, call func() error) error {
+		calls.Add(1)
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return call()
+	})
+}
+
+func TestIntercept_OptionalInterfaces(t *testing.T) {
+	var down atomic.Bool
+	var calls atomic.Int32
+	store := flakyStorage(t, &down, &calls)
+
+	if _, ok := store.(AlgorithmStorage); !ok {
+		t.Error("Expected the intercepted storage to implement AlgorithmStorage")
+	}
+	if _, ok := store.(MultiStorage); !ok {
+		t.Error("Expected the intercepted storage to implement MultiStorage")
+	}
+
+	store.(AlgorithmStorage).GCRA(context.Background(), "key", Limit{MaxRequests: 1, Window: time.Second})
+	if calls.Load() != 1 {
+		t.Errorf("Expected the operation to be intercepted, got %d calls", calls.Load())
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	var down atomic.Bool
+	var calls atomic.Int32
+	breaker := NewCircuitBreaker(flakyStorage(t, &down, &calls), 3, 50*time.Millisecond)
+
+	down.Store(true)
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Get(ctx, "key"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Expected the storage's error on call %d, got %v", i+1, err)
+		}
+	}
+
+	// Open: the storage isn't called any more
+	if _, err := breaker.Get(ctx, "key"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 calls to the storage, got %d", calls.Load())
+	}
+
+	// A failed probe keeps the circuit open for another cooldown
+	time.Sleep(60 * time.Millisecond)
+	if _, err := breaker.Get(ctx, "key"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen after a failed probe, got %v", err)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("Expected a single probe, got %d calls", calls.Load())
+	}
+
+	// A successful probe closes it
+	down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := breaker.Get(ctx, "key"); err != nil {
+		t.Errorf("Expected the circuit to close, got %v", err)
+	}
+	if _, err := breaker.Get(ctx, "key"); err != nil {
+		t.Errorf("Expected the circuit to stay closed, got %v", err)
+	}
+
+	store := NewMemoryStorage(0, 0)
+	defer store.Close()
+	if NewCircuitBreaker(store, 0, time.Second) != Storage(store) {
+		t.Error("Expected a zero threshold to disable the breaker")
+	}
+}
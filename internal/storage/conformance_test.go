@@ -0,0 +1,81 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage/storagetest"
+)
+
+func TestMemoryStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		store := storage.NewMemoryStorage(0, 0)
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestRedisStorage_Conformance(t *testing.T) {
+	host, port := storagetest.RedisAddr(t)
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		store, err := storage.NewRedisStorage(host, port)
+		if err != nil {
+			t.Fatalf("Failed to connect to Redis: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestNewRedisStorageFromConfig(t *testing.T) {
+	ctx := context.Background()
+	server := storagetest.NewRedis(t)
+	server.RequireUserAuth("limiter", "secret")
+
+	cfg := &config.Config{
+		RedisMode:     config.RedisModeStandalone,
+		RedisAddrs:    []string{server.Addr()},
+		RedisUsername: "limiter",
+		RedisPassword: "secret",
+		RedisDB:       3,
+	}
+	store, err := storage.NewRedisStorageFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	defer store.Close()
+	if err := store.Set(ctx, "ip:192.0.2.1", 4, time.Minute); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+
+	// The same database through REDIS_URL, and another one
+	for db, want := range map[int]int{3: 4, 0: 0} {
+		urlStore, err := storage.NewRedisStorageFromConfig(&config.Config{
+			RedisMode: config.RedisModeStandalone,
+			RedisURL:  fmt.Sprintf("redis://limiter:secret@%s/%d", server.Addr(), db),
+		})
+		if err != nil {
+			t.Fatalf("Failed to connect to Redis with REDIS_URL: %v", err)
+		}
+		defer urlStore.Close()
+
+		count := 0
+		if info, err := urlStore.Get(ctx, "ip:192.0.2.1"); err != nil {
+			t.Errorf("Failed to get key in DB %d: %v", db, err)
+		} else if info != nil {
+			count = info.Count
+		}
+		if count != want {
+			t.Errorf("Expected count %d in DB %d, got %d", want, db, count)
+		}
+	}
+
+	cfg.RedisPassword = "wrong"
+	if _, err := storage.NewRedisStorageFromConfig(cfg); err == nil {
+		t.Error("Expected an error for a wrong password")
+	}
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Interceptor wraps every operation of a storage: operation names it, e.g.
+// "get" or "check_all", and call performs it, returning its error
+// An interceptor may skip call and return an error of its own instead
+type Interceptor func(operation string, call func() error) error
+
+// Intercept returns store with every operation but Close going through
+// interceptor, e.g. to time operations or stop calling a failing backend
+// The storage returned implements AlgorithmStorage and MultiStorage whenever
+// store does
+func Intercept(store Storage, interceptor Interceptor) Storage {
+	base := &interceptedStorage{store: store, intercept: interceptor}
+	algorithms, isAlgorithmStorage := store.(AlgorithmStorage)
+	multi, isMultiStorage := store.(MultiStorage)
+	switch {
+	case isAlgorithmStorage && isMultiStorage:
+		return &struct {
+			*interceptedStorage
+			*interceptedAlgorithms
+			*interceptedMulti
+		}{base, &interceptedAlgorithms{algorithms, interceptor}, &interceptedMulti{multi, interceptor}}
+	case isAlgorithmStorage:
+		return &struct {
+			*interceptedStorage
+			*interceptedAlgorithms
+		}{base, &interceptedAlgorithms{algorithms, interceptor}}
+	case isMultiStorage:
+		return &struct {
+			*interceptedStorage
+			*interceptedMulti
+		}{base, &interceptedMulti{multi, interceptor}}
+	default:
+		return base
+	}
+}
+
+// interceptedStorage intercepts the operations of Storage
+type interceptedStorage struct {
+	store     Storage
+	intercept Interceptor
+}
+
+func (s *interceptedStorage) Increment(ctx context.Context, key string, ttl time.Duration) (count int, resetTime time.Time, err error) {
+	err = s.intercept("increment", func() error {
+		count, resetTime, err = s.store.Increment(ctx, key, ttl)
+		return err
+	})
+	return count, resetTime, err
+}
+
+func (s *interceptedStorage) CheckAndIncrement(ctx context.Context, key string, limit int, window, blockTime time.Duration) (result *RateLimitResult, err error) {
+	err = s.intercept("check_and_increment", func() error {
+		result, err = s.store.CheckAndIncrement(ctx, key, limit, window, blockTime)
+		return err
+	})
+	return result, err
+}
+
+func (s *interceptedStorage) Get(ctx context.Context, key string) (info *RateLimitInfo, err error) {
+	err = s.intercept("get", func() error {
+		info, err = s.store.Get(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (s *interceptedStorage) Set(ctx context.Context, key string, count int, ttl time.Duration) error {
+	return s.intercept("set", func() error {
+		return s.store.Set(ctx, key, count, ttl)
+	})
+}
+
+func (s *interceptedStorage) Clear(ctx context.Context, key string) error {
+	return s.intercept("clear", func() error {
+		return s.store.Clear(ctx, key)
+	})
+}
+
+func (s *interceptedStorage) Keys(ctx context.Context, pattern string) (keys []string, err error) {
+	err = s.intercept("keys", func() error {
+		keys, err = s.store.Keys(ctx, pattern)
+		return err
+	})
+	return keys, err
+}
+
+func (s *interceptedStorage) Ping(ctx context.Context) error {
+	return s.intercept("ping", func() error {
+		return s.store.Ping(ctx)
+	})
+}
+
+func (s *interceptedStorage) Close() error {
+	return s.store.Close()
+}
+
+// Run performs an operation on the storage's backend that isn't one of its
+// own, such as a token registry's, through the interceptors
+func (s *interceptedStorage) Run(operation string, call func() error) error {
+	return s.intercept(operation, func() error {
+		return Run(s.store, operation, call)
+	})
+}
+
+// Unwrap returns the storage intercepted
+func (s *interceptedStorage) Unwrap() Storage {
+	return s.store
+}
+
+// Run performs call, an operation on the backend of store that isn't one of
+// its own, through the interceptors of store, e.g. so it is timed and fails
+// fast with the storage's circuit breaker
+func Run(store Storage, operation string, call func() error) error {
+	if runner, ok := store.(interface {
+		Run(operation string, call func() error) error
+	}); ok {
+		return runner.Run(operation, call)
+	}
+	return call()
+}
+
+// Unwrap returns the storage store intercepts, or store itself when it
+// doesn't intercept another storage
+func Unwrap(store Storage) Storage {
+	for {
+		wrapper, ok := store.(interface{ Unwrap() Storage })
+		if !ok {
+			return store
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+// interceptedAlgorithms intercepts the operations of AlgorithmStorage
+type interceptedAlgorithms struct {
+	store     AlgorithmStorage
+	intercept Interceptor
+}
+
+func (s *interceptedAlgorithms) TokenBucket(ctx context.Context, key string, limit Limit) (result *RateLimitResult, err error) {
+	err = s.intercept("token_bucket", func() error {
+		result, err = s.store.TokenBucket(ctx, key, limit)
+		return err
+	})
+	return result, err
+}
+
+func (s *interceptedAlgorithms) SlidingWindowLog(ctx context.Context, key string, limit Limit) (result *RateLimitResult, err error) {
+	err = s.intercept("sliding_window_log", func() error {
+		result, err = s.store.SlidingWindowLog(ctx, key, limit)
+		return err
+	})
+	return result, err
+}
+
+func (s *interceptedAlgorithms) SlidingWindowCounter(ctx context.Context, key string, limit Limit) (result *RateLimitResult, err error) {
+	err = s.intercept("sliding_window_counter", func() error {
+		result, err = s.store.SlidingWindowCounter(ctx, key, limit)
+		return err
+	})
+	return result, err
+}
+
+func (s *interceptedAlgorithms) GCRA(ctx context.Context, key string, limit Limit) (result *RateLimitResult, err error) {
+	err = s.intercept("gcra", func() error {
+		result, err = s.store.GCRA(ctx, key, limit)
+		return err
+	})
+	return result, err
+}
+
+// interceptedMulti intercepts the operations of MultiStorage
+type interceptedMulti struct {
+	store     MultiStorage
+	intercept Interceptor
+}
+
+func (s *interceptedMulti) CheckAll(ctx context.Context, checks []Check) (results []*RateLimitResult, err error) {
+	err = s.intercept("check_all", func() error {
+		results, err = s.store.CheckAll(ctx, checks)
+		return err
+	})
+	return results, err
+}
+
+func (s *interceptedMulti) PeekAll(ctx context.Context, checks []Check) (results []*RateLimitResult, err error) {
+	err = s.intercept("peek_all", func() error {
+		results, err = s.store.PeekAll(ctx, checks)
+		return err
+	})
+	return results, err
+}
+
+func (s *interceptedMulti) CheckEach(ctx context.Context, checks []Check) (results []*RateLimitResult, err error) {
+	err = s.intercept("check_each", func() error {
+		results, err = s.store.CheckEach(ctx, checks)
+		return err
+	})
+	return results, err
+}
+
+func (s *interceptedMulti) PeekEach(ctx context.Context, checks []Check) (results []*RateLimitResult, err error) {
+	err = s.intercept("peek_each", func() error {
+		results, err = s.store.PeekEach(ctx, checks)
+		return err
+	})
+	return results, err
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+// TokenBucket evaluates the token bucket algorithm for a given key
+func (m *MemoryStorage) TokenBucket(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return m.runAlgorithm(ctx, key, tokenBucketSuffix, limit, tokenBucketStep)
+}
+
+func tokenBucketStep(shard *memoryShard, key string, entry *memoryEntry, limit Limit, cost int, now time.Time) (*RateLimitResult, time.Duration) {
+	burst := float64(limit.BurstOrMax())
+	interval := float64(limit.Window) / float64(limit.MaxRequests)
+
+	tokens := burst
+	if !entry.updatedAt.IsZero() {
+		tokens = math.Min(burst, entry.tokens+float64(now.Sub(entry.updatedAt))/interval)
+	}
+
+	if tokens < float64(cost) {
+		return reject(shard, key, int(burst-math.Floor(tokens)), time.Duration((float64(cost)-tokens)*interval), limit.BlockTime, now), 0
+	}
+
+	tokens -= float64(cost)
+	entry.tokens = tokens
+	entry.updatedAt = now
+	return &RateLimitResult{
+		Allowed:   true,
+		Count:     int(burst - math.Floor(tokens)),
+		ResetTime: now.Add(time.Duration((burst - tokens) * interval)),
+	}, time.Duration(burst * interval)
+}
+
+// SlidingWindowLog evaluates the sliding window log algorithm for a given key
+func (m *MemoryStorage) SlidingWindowLog(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return m.runAlgorithm(ctx, key, slidingWindowLogSuffix, limit, slidingWindowLogStep)
+}
+
+func slidingWindowLogStep(shard *memoryShard, key string, entry *memoryEntry, limit Limit, cost int, now time.Time) (*RateLimitResult, time.Duration) {
+	// Drop timestamps that left the window
+	cutoff := now.Add(-limit.Window)
+	kept := entry.log[:0]
+	for _, ts := range entry.log {
+		if ts.After(cutoff) {
+			kept = append(kept, ts)
+		}
+	}
+	entry.log = kept
+
+	if len(entry.log)+cost > limit.MaxRequests {
+		reset := limit.Window
+		if len(entry.log) > 0 {
+			reset = entry.log[0].Add(limit.Window).Sub(now)
+		}
+		return reject(shard, key, len(entry.log), reset, limit.BlockTime, now), 0
+	}
+
+	for i := 0; i < cost; i++ {
+		entry.log = append(entry.log, now)
+	}
+	return &RateLimitResult{
+		Allowed:   true,
+		Count:     len(entry.log),
+		ResetTime: entry.log[0].Add(limit.Window),
+	}, limit.Window
+}
+
+// SlidingWindowCounter evaluates the sliding window counter algorithm for a given key
+func (m *MemoryStorage) SlidingWindowCounter(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return m.runAlgorithm(ctx, key, slidingWindowCounterSuffix, limit, slidingWindowCounterStep)
+}
+
+func slidingWindowCounterStep(shard *memoryShard, key string, entry *memoryEntry, limit Limit, cost int, now time.Time) (*RateLimitResult, time.Duration) {
+	window := limit.Window.Milliseconds()
+	nowMs := now.UnixMilli()
+	idx := nowMs / window
+
+	curr, prev := 0, 0
+	switch entry.windowIdx {
+	case idx:
+		curr, prev = entry.count, entry.prevCount
+	case idx - 1:
+		prev = entry.count
+	}
+
+	elapsed := nowMs - idx*window
+	reset := time.Duration(window-elapsed) * time.Millisecond
+	weighted := float64(prev)*float64(window-elapsed)/float64(window) + float64(curr)
+	if weighted+float64(cost) > float64(limit.MaxRequests) {
+		return reject(shard, key, int(weighted), reset, limit.BlockTime, now), 0
+	}
+
+	entry.windowIdx = idx
+	entry.count = curr + cost
+	entry.prevCount = prev
+	return &RateLimitResult{
+		Allowed:   true,
+		Count:     int(weighted) + cost,
+		ResetTime: now.Add(reset),
+	}, 2 * limit.Window
+}
+
+// GCRA evaluates the generic cell rate algorithm for a given key
+func (m *MemoryStorage) GCRA(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return m.runAlgorithm(ctx, key, gcraSuffix, limit, gcraStep)
+}
+
+func gcraStep(shard *memoryShard, key string, entry *memoryEntry, limit Limit, cost int, now time.Time) (*RateLimitResult, time.Duration) {
+	interval := limit.Window / time.Duration(limit.MaxRequests)
+	burst := limit.BurstOrMax()
+
+	tat := entry.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(time.Duration(cost) * interval)
+	allowAt := newTat.Add(-time.Duration(burst) * interval)
+	if now.Before(allowAt) {
+		return reject(shard, key, burst, allowAt.Sub(now), limit.BlockTime, now), 0
+	}
+
+	entry.tat = newTat
+	return &RateLimitResult{
+		Allowed:   true,
+		Count:     int(math.Ceil(float64(newTat.Sub(now)) / float64(interval))),
+		ResetTime: newTat,
+	}, newTat.Sub(now)
+}
+
+// memoryStep evaluates an algorithm for key on its state entry, counting
+// cost requests, and updates the entry when they are allowed
+// It returns the result and, when the request was allowed, the TTL of the
+// updated state
+// Callers must hold shard.mu
+type memoryStep func(shard *memoryShard, key string, entry *memoryEntry, limit Limit, cost int, now time.Time) (*RateLimitResult, time.Duration)
+
+// memorySteps maps every algorithm to its step
+var memorySteps = map[string]memoryStep{
+	config.AlgorithmFixedWindow:          fixedWindowStep,
+	config.AlgorithmTokenBucket:          tokenBucketStep,
+	config.AlgorithmSlidingWindowLog:     slidingWindowLogStep,
+	config.AlgorithmSlidingWindowCounter: slidingWindowCounterStep,
+	config.AlgorithmGCRA:                 gcraStep,
+}
+
+// fixedWindowStep counts requests per window like CheckAndIncrement; it is
+// only used to evaluate fixed windows along with other checks
+func fixedWindowStep(shard *memoryShard, key string, entry *memoryEntry, limit Limit, cost int, now time.Time) (*RateLimitResult, time.Duration) {
+	if entry.resetTime.IsZero() {
+		entry.resetTime = now.Add(limit.Window)
+	}
+	if entry.count+cost > limit.MaxRequests {
+		return reject(shard, key, entry.count, entry.resetTime.Sub(now), limit.BlockTime, now), 0
+	}
+
+	entry.count += cost
+	return &RateLimitResult{Allowed: true, Count: entry.count, ResetTime: entry.resetTime}, entry.resetTime.Sub(now)
+}
+
+// runAlgorithm evaluates an algorithm step under the lock of the key's shard
+func (m *MemoryStorage) runAlgorithm(ctx context.Context, key, suffix string, limit Limit, step memoryStep) (*RateLimitResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if limit.MaxRequests <= 0 || limit.Window <= 0 {
+		return nil, fmt.Errorf("invalid limit for key %s: %d requests per %v", key, limit.MaxRequests, limit.Window)
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	if result := checkBlock(shard, key, limit.BurstOrMax(), now); result != nil {
+		return result, nil
+	}
+
+	stateKey := fmt.Sprintf("%s:%s", key, suffix)
+	entry := shard.get(stateKey, now)
+	if entry == nil {
+		entry = &memoryEntry{}
+	}
+
+	result, ttl := step(shard, key, entry, limit, 1, now)
+	if result.Allowed {
+		entry.expiresAt = now.Add(ttl)
+		shard.put(stateKey, entry)
+	}
+
+	return result, nil
+}
+
+// CheckAll evaluates every check under the locks of their shards and records
+// the request only when all of them allow it
+// Steps run on copies of the state entries, which replace them once every
+// check has passed
+func (m *MemoryStorage) CheckAll(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return m.checkAll(ctx, checks, true)
+}
+
+// PeekAll evaluates every check like CheckAll without recording the request
+// or blocking any key
+func (m *MemoryStorage) PeekAll(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return m.checkAll(ctx, withoutBlocking(checks), false)
+}
+
+// checkAll evaluates checks, storing their new state when commit is set and
+// every check allows the request
+func (m *MemoryStorage) checkAll(ctx context.Context, checks []Check, commit bool) ([]*RateLimitResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stateKeys := make([]string, len(checks))
+	shardIndexes := make([]int, 0, len(checks))
+	for i, check := range checks {
+		if check.Limit.MaxRequests <= 0 || check.Limit.Window <= 0 {
+			return nil, fmt.Errorf("invalid limit for key %s: %d requests per %v", check.Key, check.Limit.MaxRequests, check.Limit.Window)
+		}
+		state, err := stateKey(check.Key, check.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		stateKeys[i] = state
+		shardIndexes = append(shardIndexes, m.shardIndex(check.Key))
+	}
+
+	// Shards are locked in index order so concurrent calls can't deadlock
+	slices.Sort(shardIndexes)
+	for _, index := range slices.Compact(shardIndexes) {
+		shard := m.shards[index]
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+
+	now := m.now()
+	results := make([]*RateLimitResult, len(checks))
+	entries := make([]*memoryEntry, len(checks))
+	ttls := make([]time.Duration, len(checks))
+	allowed := true
+	for i, check := range checks {
+		shard := m.shard(check.Key)
+		if result := checkBlock(shard, check.Key, check.Limit.BurstOrMax(), now); result != nil {
+			results[i], allowed = result, false
+			continue
+		}
+
+		entry := &memoryEntry{}
+		if current := shard.get(stateKeys[i], now); current != nil {
+			*entry = *current
+			entry.log = slices.Clone(current.log)
+		}
+		results[i], ttls[i] = memorySteps[check.Algorithm](shard, check.Key, entry, check.Limit, check.cost(), now)
+		entries[i] = entry
+		allowed = allowed && results[i].Allowed
+	}
+
+	if commit && allowed {
+		for i, check := range checks {
+			entries[i].expiresAt = now.Add(ttls[i])
+			m.shard(check.Key).put(stateKeys[i], entries[i])
+		}
+	}
+
+	return results, nil
+}
+
+// CheckEach evaluates and records every check on its own
+func (m *MemoryStorage) CheckEach(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return m.checkEach(ctx, checks, true)
+}
+
+// PeekEach evaluates every check like CheckEach without recording any
+// request or blocking any key
+func (m *MemoryStorage) PeekEach(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return m.checkEach(ctx, withoutBlocking(checks), false)
+}
+
+// checkEach evaluates every check as a request of its own; there is no round
+// trip to save in memory
+func (m *MemoryStorage) checkEach(ctx context.Context, checks []Check, commit bool) ([]*RateLimitResult, error) {
+	results := make([]*RateLimitResult, len(checks))
+	for i, check := range checks {
+		result, err := m.checkAll(ctx, []Check{check}, commit)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result[0]
+	}
+	return results, nil
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryEntry holds the state for a single key in MemoryStorage
+// Only the fields used by the algorithm owning the key are set
+type memoryEntry struct {
+	key       string
+	count     int
+	resetTime time.Time
+	expiresAt time.Time
+
+	// token bucket
+	tokens    float64
+	updatedAt time.Time
+
+	// sliding window log
+	log []time.Time
+
+	// sliding window counter
+	windowIdx int64
+	prevCount int
+
+	// GCRA
+	tat time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+const (
+	// memoryShardCount is the number of independently locked shards
+	memoryShardCount = 32
+
+	// DefaultMemoryCleanupInterval is how often expired keys are evicted when
+	// no interval is configured
+	DefaultMemoryCleanupInterval = time.Minute
+)
+
+// memoryShard is a lock-protected slice of the keyspace with its own LRU list
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	maxKeys int
+}
+
+// get returns the live entry for key and marks it as recently used, dropping
+// it if expired
+// Callers must hold s.mu
+func (s *memoryShard) get(key string, now time.Time) *memoryEntry {
+	elem, exists := s.entries[key]
+	if !exists {
+		return nil
+	}
+	entry := elem.Value.(*memoryEntry)
+	if entry.expired(now) {
+		s.remove(key)
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return entry
+}
+
+// put stores entry under key, evicting the least recently used keys when the
+// shard is full
+// Callers must hold s.mu
+func (s *memoryShard) put(key string, entry *memoryEntry) {
+	entry.key = key
+	if elem, exists := s.entries[key]; exists {
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.maxKeys > 0 && s.lru.Len() > s.maxKeys {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
+
+// remove deletes key from the shard
+// Callers must hold s.mu
+func (s *memoryShard) remove(key string) {
+	if elem, exists := s.entries[key]; exists {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+	}
+}
+
+// removeExpired deletes every expired key from the shard
+func (s *memoryShard) removeExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, elem := range s.entries {
+		if elem.Value.(*memoryEntry).expired(now) {
+			s.lru.Remove(elem)
+			delete(s.entries, key)
+		}
+	}
+}
+
+// MemoryStorage implements the Storage interface in process memory
+// State is not shared between instances, so it only suits single-instance
+// deployments and local development
+// Keys are spread over lock-sharded maps; a key and its companions (block and
+// algorithm state) always live in the same shard so every operation on them is
+// atomic. Expired keys are evicted by a background janitor, and each shard is
+// bounded to its share of maxKeys with LRU eviction
+type MemoryStorage struct {
+	shards    []*memoryShard
+	clock     atomic.Pointer[func() time.Time]
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryStorage creates a new in-memory storage instance
+// A non-positive maxKeys leaves the storage unbounded; a non-positive
+// cleanupInterval falls back to DefaultMemoryCleanupInterval
+func NewMemoryStorage(maxKeys int, cleanupInterval time.Duration) *MemoryStorage {
+	if cleanupInterval <= 0 {
+		cleanupInterval = DefaultMemoryCleanupInterval
+	}
+
+	shardMaxKeys := 0
+	if maxKeys > 0 {
+		shardMaxKeys = (maxKeys + memoryShardCount - 1) / memoryShardCount
+	}
+
+	m := &MemoryStorage{
+		shards: make([]*memoryShard, memoryShardCount),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+			maxKeys: shardMaxKeys,
+		}
+	}
+
+	go m.janitor(cleanupInterval)
+
+	return m
+}
+
+// SetClock replaces the clock the storage reads the time from, e.g. to
+// simulate a sequence of requests without waiting; nil restores time.Now
+// The clock must never go backwards
+func (m *MemoryStorage) SetClock(now func() time.Time) {
+	if now == nil {
+		m.clock.Store(nil)
+		return
+	}
+	m.clock.Store(&now)
+}
+
+// now returns the current time of the storage's clock
+func (m *MemoryStorage) now() time.Time {
+	if clock := m.clock.Load(); clock != nil {
+		return (*clock)()
+	}
+	return time.Now()
+}
+
+// janitor periodically evicts expired keys until Close is called
+func (m *MemoryStorage) janitor(interval time.Duration) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			now := m.now()
+			for _, shard := range m.shards {
+				shard.removeExpired(now)
+			}
+		}
+	}
+}
+
+// shard returns the shard owning key and its companions
+func (m *MemoryStorage) shard(key string) *memoryShard {
+	return m.shards[m.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard owning key
+// A block key belongs to the shard of the key it blocks, so blocks set or
+// cleared directly are seen by the checks of that key
+func (m *MemoryStorage) shardIndex(key string) int {
+	if blocked, ok := BlockedKey(key); ok {
+		key = blocked
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % memoryShardCount)
+}
+
+// Len returns the number of keys currently held, including expired keys not
+// yet evicted
+func (m *MemoryStorage) Len() int {
+	total := 0
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		total += len(shard.entries)
+		shard.mu.Unlock()
+	}
+	return total
+}
+
+// Increment increments the request count for a given key
+func (m *MemoryStorage) Increment(ctx context.Context, key string, ttl time.Duration) (int, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	entry := shard.get(key, now)
+	if entry == nil {
+		entry = &memoryEntry{resetTime: now.Add(ttl), expiresAt: now.Add(ttl)}
+		shard.put(key, entry)
+	}
+	entry.count++
+
+	return entry.count, entry.resetTime, nil
+}
+
+// CheckAndIncrement atomically checks and increments the request count for a given key
+func (m *MemoryStorage) CheckAndIncrement(ctx context.Context, key string, limit int, window, blockTime time.Duration) (*RateLimitResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	if result := checkBlock(shard, key, limit, now); result != nil {
+		return result, nil
+	}
+
+	entry := shard.get(key, now)
+	if entry == nil {
+		entry = &memoryEntry{resetTime: now.Add(window), expiresAt: now.Add(window)}
+		shard.put(key, entry)
+	}
+
+	if entry.count >= limit {
+		return reject(shard, key, entry.count, entry.resetTime.Sub(now), blockTime, now), nil
+	}
+
+	entry.count++
+	return &RateLimitResult{Allowed: true, Count: entry.count, ResetTime: entry.resetTime}, nil
+}
+
+// Get retrieves the current rate limit info for a given key
+func (m *MemoryStorage) Get(ctx context.Context, key string) (*RateLimitInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.get(key, m.now())
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &RateLimitInfo{
+		Count:     entry.count,
+		ResetTime: entry.resetTime,
+	}, nil
+}
+
+// Set explicitly sets the count and TTL for a key
+func (m *MemoryStorage) Set(ctx context.Context, key string, count int, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := m.now()
+	shard.put(key, &memoryEntry{
+		count:     count,
+		resetTime: now.Add(ttl),
+		expiresAt: now.Add(ttl),
+	})
+
+	return nil
+}
+
+// Clear removes a key from storage
+func (m *MemoryStorage) Clear(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.remove(key)
+	for _, suffix := range []string{blockSuffix, tokenBucketSuffix, slidingWindowLogSuffix, slidingWindowCounterSuffix, gcraSuffix} {
+		shard.remove(fmt.Sprintf("%s:%s", key, suffix))
+	}
+
+	return nil
+}
+
+// Keys returns the live keys matching pattern
+func (m *MemoryStorage) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	now := m.now()
+	for _, shard := range m.shards {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		shard.mu.Lock()
+		for key, elem := range shard.entries {
+			if !elem.Value.(*memoryEntry).expired(now) && MatchPattern(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return keys, nil
+}
+
+// Ping checks if the storage is available
+func (m *MemoryStorage) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close stops the background janitor
+func (m *MemoryStorage) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		<-m.done
+	})
+	return nil
+}
+
+// checkBlock returns a rejection if key is currently blocked
+// Callers must hold shard.mu
+func checkBlock(shard *memoryShard, key string, count int, now time.Time) *RateLimitResult {
+	block := shard.get(BlockKey(key), now)
+	if block == nil {
+		return nil
+	}
+	return &RateLimitResult{Allowed: false, Blocked: true, Count: count, ResetTime: block.expiresAt}
+}
+
+// reject builds a rejection, blocking key for blockTime if set
+// Callers must hold shard.mu
+func reject(shard *memoryShard, key string, count int, reset, blockTime time.Duration, now time.Time) *RateLimitResult {
+	if blockTime > 0 {
+		blockedUntil := now.Add(blockTime)
+		shard.put(BlockKey(key), &memoryEntry{resetTime: blockedUntil, expiresAt: blockedUntil})
+		return &RateLimitResult{Allowed: false, Blocked: true, Count: count, ResetTime: blockedUntil}
+	}
+	return &RateLimitResult{Allowed: false, Count: count, ResetTime: now.Add(reset)}
+}
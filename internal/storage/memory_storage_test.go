@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+func TestMemoryStorage_LRUEviction(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(memoryShardCount, 0) // one key per shard
+	defer store.Close()
+
+	// Find two keys that land in the same shard
+	first := "key-0"
+	second := ""
+	for i := 1; second == ""; i++ {
+		candidate := fmt.Sprintf("key-%d", i)
+		if store.shard(candidate) == store.shard(first) {
+			second = candidate
+		}
+	}
+
+	if _, _, err := store.Increment(ctx, first, 1*time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := store.Increment(ctx, second, 1*time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The least recently used key was evicted to make room
+	if info, _ := store.Get(ctx, first); info != nil {
+		t.Errorf("Expected %s to be evicted, got %+v", first, info)
+	}
+	if info, _ := store.Get(ctx, second); info == nil || info.Count != 1 {
+		t.Errorf("Expected %s to be kept with count 1, got %+v", second, info)
+	}
+}
+
+func TestMemoryStorage_LRUKeepsRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(2*memoryShardCount, 0) // two keys per shard
+	defer store.Close()
+
+	keys := []string{"key-0"}
+	for i := 1; len(keys) < 3; i++ {
+		candidate := fmt.Sprintf("key-%d", i)
+		if store.shard(candidate) == store.shard(keys[0]) {
+			keys = append(keys, candidate)
+		}
+	}
+
+	store.Increment(ctx, keys[0], 1*time.Minute)
+	store.Increment(ctx, keys[1], 1*time.Minute)
+
+	// Touching the oldest key makes the other one the eviction candidate
+	store.Get(ctx, keys[0])
+	store.Increment(ctx, keys[2], 1*time.Minute)
+
+	if info, _ := store.Get(ctx, keys[0]); info == nil {
+		t.Errorf("Expected recently used %s to be kept", keys[0])
+	}
+	if info, _ := store.Get(ctx, keys[1]); info != nil {
+		t.Errorf("Expected %s to be evicted", keys[1])
+	}
+}
+
+func TestMemoryStorage_JanitorEvictsExpiredKeys(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(0, 10*time.Millisecond)
+	defer store.Close()
+
+	for i := 0; i < 100; i++ {
+		store.Increment(ctx, fmt.Sprintf("key-%d", i), 20*time.Millisecond)
+	}
+	store.Increment(ctx, "long-lived", 1*time.Minute)
+
+	deadline := time.Now().Add(1 * time.Second)
+	for store.Len() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := store.Len(); n != 1 {
+		t.Errorf("Expected the janitor to leave 1 key, got %d", n)
+	}
+}
+
+func TestMemoryStorage_CloseStopsJanitor(t *testing.T) {
+	store := NewMemoryStorage(0, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		store.Close()
+		store.Close() // Close is idempotent
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Close did not stop the janitor")
+	}
+
+	select {
+	case <-store.done:
+	default:
+		t.Error("Janitor goroutine still running after Close")
+	}
+}
+
+func TestMemoryStorage_CheckAll(t *testing.T) {
+	ctx := context.Background()
+
+	for _, algorithm := range config.Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			store := NewMemoryStorage(0, 0)
+			defer store.Close()
+
+			wide := Check{Key: "wide", Algorithm: algorithm, Limit: Limit{MaxRequests: 10, Window: time.Minute}}
+			narrow := Check{Key: "narrow", Algorithm: algorithm, Limit: Limit{MaxRequests: 2, Window: time.Minute}}
+
+			for i := 1; i <= 3; i++ {
+				results, err := store.CheckAll(ctx, []Check{wide, narrow})
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				// Each result is the verdict of its own check
+				if allowed := i <= 2; !results[0].Allowed || results[1].Allowed != allowed {
+					t.Errorf("Request %d: expected narrow allowed %v, got %+v %+v", i, allowed, results[0], results[1])
+				}
+			}
+
+			// The rejected request didn't consume the wide key's quota
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				results, err := store.CheckAll(ctx, []Check{wide})
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if results[0].Allowed {
+					allowed++
+				}
+			}
+			if allowed != 8 {
+				t.Errorf("Expected 8 requests left on the wide key, got %d", allowed)
+			}
+		})
+	}
+
+	store := NewMemoryStorage(0, 0)
+	defer store.Close()
+	if _, err := store.CheckAll(ctx, []Check{{Key: "key", Algorithm: "leaky", Limit: Limit{MaxRequests: 1, Window: time.Second}}}); err == nil {
+		t.Error("Expected error for unknown algorithm")
+	}
+}
+
+func TestMemoryStorage_PeekAll(t *testing.T) {
+	ctx := context.Background()
+
+	for _, algorithm := range config.Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			store := NewMemoryStorage(0, 0)
+			defer store.Close()
+
+			check := Check{Key: "key", Algorithm: algorithm, Limit: Limit{MaxRequests: 2, Window: time.Minute, BlockTime: time.Minute}}
+			for i := 0; i < 3; i++ {
+				results, err := store.PeekAll(ctx, []Check{check})
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if !results[0].Allowed {
+					t.Errorf("Peek %d: expected peeking to leave the quota untouched, got %+v", i, results[0])
+				}
+			}
+
+			for i := 0; i < 3; i++ {
+				store.CheckAll(ctx, []Check{check})
+			}
+			results, err := store.PeekAll(ctx, []Check{check})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if results[0].Allowed || !results[0].Blocked {
+				t.Errorf("Expected the blocked key to be reported, got %+v", results[0])
+			}
+		})
+	}
+}
+
+func TestMemoryStorage_CheckEach(t *testing.T) {
+	ctx := context.Background()
+
+	for _, algorithm := range config.Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			store := NewMemoryStorage(0, 0)
+			defer store.Close()
+
+			heavy := Check{Key: "heavy", Algorithm: algorithm, Limit: Limit{MaxRequests: 10, Window: time.Minute}, Cost: 4}
+			light := Check{Key: "light", Algorithm: algorithm, Limit: Limit{MaxRequests: 10, Window: time.Minute}}
+
+			// Each check is decided on its own, a rejection recording nothing
+			for i := 1; i <= 3; i++ {
+				results, err := store.CheckEach(ctx, []Check{heavy, light})
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if allowed := i <= 2; results[0].Allowed != allowed || !results[1].Allowed {
+					t.Errorf("Check %d: expected heavy allowed %v and light allowed, got %+v %+v", i, allowed, results[0], results[1])
+				}
+			}
+
+			heavy.Cost = 2
+			results, err := store.PeekEach(ctx, []Check{heavy, heavy})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !results[0].Allowed || !results[1].Allowed || results[0].Count != 10 {
+				t.Errorf("Expected peeks to fit the 2 requests left without recording them, got %+v %+v", results[0], results[1])
+			}
+			results, _ = store.CheckEach(ctx, []Check{heavy, heavy})
+			if !results[0].Allowed || results[1].Allowed {
+				t.Errorf("Expected only the first check to fit, got %+v %+v", results[0], results[1])
+			}
+		})
+	}
+}
+
+func TestMemoryStorage_BlockKey(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(0, 0)
+	defer store.Close()
+
+	// Blocks set directly apply to the key they block
+	if err := store.Set(ctx, BlockKey("key"), 1, time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	result, err := store.CheckAndIncrement(ctx, "key", 10, time.Minute, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Allowed || !result.Blocked {
+		t.Errorf("Expected the key to be blocked, got %+v", result)
+	}
+
+	if err := store.Clear(ctx, "key"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result, _ := store.CheckAndIncrement(ctx, "key", 10, time.Minute, 0); !result.Allowed {
+		t.Errorf("Expected clearing the key to lift its block, got %+v", result)
+	}
+}
+
+func TestMemoryStorage_SetClock(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(0, 0)
+	defer store.Close()
+
+	now := time.Now()
+	store.SetClock(func() time.Time { return now })
+
+	for i := 0; i < 2; i++ {
+		store.CheckAndIncrement(ctx, "key", 2, time.Minute, 0)
+	}
+	if result, _ := store.CheckAndIncrement(ctx, "key", 2, time.Minute, 0); result.Allowed {
+		t.Error("Expected the third request to be rejected")
+	}
+
+	// The window ends on the storage's clock, not the wall clock
+	now = now.Add(time.Minute)
+	if result, _ := store.CheckAndIncrement(ctx, "key", 2, time.Minute, 0); !result.Allowed {
+		t.Errorf("Expected a new window, got %+v", result)
+	}
+}
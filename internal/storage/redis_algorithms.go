@@ -0,0 +1,546 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Every algorithm script shares the same calling convention:
+// KEYS[1] = algorithm state key, KEYS[2] = block key,
+// ARGV[1] = max requests, ARGV[2] = window in milliseconds,
+// ARGV[3] = burst, ARGV[4] = block time in milliseconds.
+// Returns {count, reset in milliseconds, allowed, blocked}.
+// Time is read from the Redis server so replicas with skewed clocks agree.
+const algorithmPrelude = `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local block = tonumber(ARGV[4])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local blocked = redis.call('PTTL', KEYS[2])
+if blocked > 0 then
+	return {burst, blocked, 0, 1}
+end
+
+local function reject(count, reset)
+	if block > 0 then
+		redis.call('SET', KEYS[2], 1, 'PX', block)
+		return {count, block, 0, 1}
+	end
+	return {count, math.ceil(reset), 0, 0}
+end
+`
+
+var tokenBucketScript = redis.NewScript(algorithmPrelude + `
+local interval = window / limit
+local tokens = burst
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+if state[1] then
+	tokens = math.min(burst, tonumber(state[1]) + (now - tonumber(state[2])) / interval)
+end
+
+if tokens < 1 then
+	return reject(burst - math.floor(tokens), (1 - tokens) * interval)
+end
+
+tokens = tokens - 1
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * interval))
+return {burst - math.floor(tokens), math.ceil((burst - tokens) * interval), 1, 0}
+`)
+
+var slidingWindowLogScript = redis.NewScript(algorithmPrelude + `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return reject(count, tonumber(oldest[2]) + window - now)
+end
+
+redis.call('ZADD', KEYS[1], now, now .. '-' .. count)
+redis.call('PEXPIRE', KEYS[1], window)
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {count + 1, tonumber(oldest[2]) + window - now, 1, 0}
+`)
+
+var slidingWindowCounterScript = redis.NewScript(algorithmPrelude + `
+local idx = math.floor(now / window)
+local curr, prev = 0, 0
+local state = redis.call('HMGET', KEYS[1], 'idx', 'curr', 'prev')
+if state[1] then
+	local stateIdx = tonumber(state[1])
+	if stateIdx == idx then
+		curr = tonumber(state[2])
+		prev = tonumber(state[3])
+	elseif stateIdx == idx - 1 then
+		prev = tonumber(state[2])
+	end
+end
+
+local elapsed = now - idx * window
+local weighted = prev * (window - elapsed) / window + curr
+if weighted >= limit then
+	return reject(math.floor(weighted), window - elapsed)
+end
+
+redis.call('HSET', KEYS[1], 'idx', idx, 'curr', curr + 1, 'prev', prev)
+redis.call('PEXPIRE', KEYS[1], 2 * window)
+return {math.floor(weighted) + 1, window - elapsed, 1, 0}
+`)
+
+var gcraScript = redis.NewScript(algorithmPrelude + `
+local interval = window / limit
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local newTat = tat + interval
+local allowAt = newTat - burst * interval
+if now < allowAt then
+	return reject(burst, allowAt - now)
+end
+
+redis.call('SET', KEYS[1], newTat, 'PX', math.ceil(newTat - now))
+return {math.ceil((newTat - now) / interval), math.ceil(newTat - now), 1, 0}
+`)
+
+// Algorithm state lives next to the fixed window counter under its own suffix,
+// so switching algorithms never reads a value of the wrong type
+const (
+	tokenBucketSuffix          = "tb"
+	slidingWindowLogSuffix     = "swl"
+	slidingWindowCounterSuffix = "swc"
+	gcraSuffix                 = "gcra"
+)
+
+// algorithmSuffixes maps every algorithm to the suffix of its state key; the
+// fixed window counter is the key itself
+var algorithmSuffixes = map[string]string{
+	config.AlgorithmFixedWindow:          "",
+	config.AlgorithmTokenBucket:          tokenBucketSuffix,
+	config.AlgorithmSlidingWindowLog:     slidingWindowLogSuffix,
+	config.AlgorithmSlidingWindowCounter: slidingWindowCounterSuffix,
+	config.AlgorithmGCRA:                 gcraSuffix,
+}
+
+// stateKey returns the key holding the state of algorithm for key
+func stateKey(key, algorithm string) (string, error) {
+	suffix, exists := algorithmSuffixes[algorithm]
+	if !exists {
+		return "", fmt.Errorf("unknown rate limiting algorithm %q", algorithm)
+	}
+	if suffix == "" {
+		return key, nil
+	}
+	return fmt.Sprintf("%s:%s", key, suffix), nil
+}
+
+// TokenBucket evaluates the token bucket algorithm for a given key
+func (r *RedisStorage) TokenBucket(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return r.runAlgorithm(ctx, tokenBucketScript, key, tokenBucketSuffix, limit)
+}
+
+// SlidingWindowLog evaluates the sliding window log algorithm for a given key
+func (r *RedisStorage) SlidingWindowLog(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return r.runAlgorithm(ctx, slidingWindowLogScript, key, slidingWindowLogSuffix, limit)
+}
+
+// SlidingWindowCounter evaluates the sliding window counter algorithm for a given key
+func (r *RedisStorage) SlidingWindowCounter(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return r.runAlgorithm(ctx, slidingWindowCounterScript, key, slidingWindowCounterSuffix, limit)
+}
+
+// GCRA evaluates the generic cell rate algorithm for a given key
+func (r *RedisStorage) GCRA(ctx context.Context, key string, limit Limit) (*RateLimitResult, error) {
+	return r.runAlgorithm(ctx, gcraScript, key, gcraSuffix, limit)
+}
+
+// runAlgorithm runs an algorithm script and decodes its result
+func (r *RedisStorage) runAlgorithm(ctx context.Context, script *redis.Script, key, suffix string, limit Limit) (*RateLimitResult, error) {
+	if limit.MaxRequests <= 0 || limit.Window <= 0 {
+		return nil, fmt.Errorf("invalid limit for key %s: %d requests per %v", key, limit.MaxRequests, limit.Window)
+	}
+
+	keys := []string{r.key(fmt.Sprintf("%s:%s", key, suffix)), r.key(BlockKey(key))}
+	res, err := script.Run(ctx, r.client, keys,
+		limit.MaxRequests, limit.Window.Milliseconds(), limit.BurstOrMax(), limit.BlockTime.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate %s for key: %w", suffix, err)
+	}
+	if len(res) != 4 {
+		return nil, fmt.Errorf("unexpected script result for key %s: %v", key, res)
+	}
+
+	return &RateLimitResult{
+		Allowed:   res[2] == 1,
+		Blocked:   res[3] == 1,
+		Count:     int(res[0]),
+		ResetTime: time.Now().Add(time.Duration(res[1]) * time.Millisecond),
+	}, nil
+}
+
+// checkAllScript evaluates several checks and records the request on all of
+// them only when every one allows it. Each algorithm mirrors its single key
+// script but returns the writes of an admitted request as a function, run
+// once every check has passed.
+// KEYS[2i-1] = state key and KEYS[2i] = block key of check i,
+// ARGV[6i-5..6i] = algorithm, max requests, window in milliseconds, burst,
+// block time in milliseconds and cost of check i, and the last ARGV is 1 to
+// record the request or 0 to only evaluate the checks.
+// Returns {count, reset in milliseconds, allowed, blocked} for every check.
+var checkAllScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local algorithms = {}
+
+algorithms.fixed_window = function(key, limit, window, burst, cost)
+	local count = tonumber(redis.call('GET', key) or '0')
+	local reset = redis.call('PTTL', key)
+	if reset < 0 then
+		reset = window
+	end
+	if count + cost > limit then
+		return count, reset, false
+	end
+	return count + cost, reset, true, function()
+		redis.call('INCRBY', key, cost)
+		if redis.call('PTTL', key) < 0 then
+			redis.call('PEXPIRE', key, window)
+		end
+	end
+end
+
+algorithms.token_bucket = function(key, limit, window, burst, cost)
+	local interval = window / limit
+	local tokens = burst
+	local state = redis.call('HMGET', key, 'tokens', 'ts')
+	if state[1] then
+		tokens = math.min(burst, tonumber(state[1]) + (now - tonumber(state[2])) / interval)
+	end
+	if tokens < cost then
+		return burst - math.floor(tokens), (cost - tokens) * interval, false
+	end
+	tokens = tokens - cost
+	return burst - math.floor(tokens), (burst - tokens) * interval, true, function()
+		redis.call('HSET', key, 'tokens', tokens, 'ts', now)
+		redis.call('PEXPIRE', key, math.ceil(burst * interval))
+	end
+end
+
+algorithms.sliding_window_log = function(key, limit, window, burst, cost)
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+	local count = redis.call('ZCARD', key)
+	local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+	local reset = window
+	if oldest[2] then
+		reset = tonumber(oldest[2]) + window - now
+	end
+	if count + cost > limit then
+		return count, reset, false
+	end
+	return count + cost, reset, true, function()
+		for j = 0, cost - 1 do
+			redis.call('ZADD', key, now, now .. '-' .. (count + j))
+		end
+		redis.call('PEXPIRE', key, window)
+	end
+end
+
+algorithms.sliding_window_counter = function(key, limit, window, burst, cost)
+	local idx = math.floor(now / window)
+	local curr, prev = 0, 0
+	local state = redis.call('HMGET', key, 'idx', 'curr', 'prev')
+	if state[1] then
+		local stateIdx = tonumber(state[1])
+		if stateIdx == idx then
+			curr = tonumber(state[2])
+			prev = tonumber(state[3])
+		elseif stateIdx == idx - 1 then
+			prev = tonumber(state[2])
+		end
+	end
+	local elapsed = now - idx * window
+	local weighted = prev * (window - elapsed) / window + curr
+	if weighted + cost > limit then
+		return math.floor(weighted), window - elapsed, false
+	end
+	return math.floor(weighted) + cost, window - elapsed, true, function()
+		redis.call('HSET', key, 'idx', idx, 'curr', curr + cost, 'prev', prev)
+		redis.call('PEXPIRE', key, 2 * window)
+	end
+end
+
+algorithms.gcra = function(key, limit, window, burst, cost)
+	local interval = window / limit
+	local tat = tonumber(redis.call('GET', key) or now)
+	if tat < now then
+		tat = now
+	end
+	local newTat = tat + cost * interval
+	local allowAt = newTat - burst * interval
+	if now < allowAt then
+		return burst, allowAt - now, false
+	end
+	return math.ceil((newTat - now) / interval), newTat - now, true, function()
+		redis.call('SET', key, newTat, 'PX', math.ceil(newTat - now))
+	end
+end
+
+local results, commits = {}, {}
+local record = ARGV[#ARGV] == '1'
+local allowed = true
+for i = 1, #KEYS / 2 do
+	local key, blockKey = KEYS[2 * i - 1], KEYS[2 * i]
+	local name = ARGV[6 * i - 5]
+	local limit = tonumber(ARGV[6 * i - 4])
+	local window = tonumber(ARGV[6 * i - 3])
+	local burst = tonumber(ARGV[6 * i - 2])
+	local block = tonumber(ARGV[6 * i - 1])
+	local cost = tonumber(ARGV[6 * i])
+
+	local blocked = redis.call('PTTL', blockKey)
+	if blocked > 0 then
+		results[i] = {burst, blocked, 0, 1}
+		allowed = false
+	else
+		local count, reset, ok, commit = algorithms[name](key, limit, window, burst, cost)
+		if ok then
+			results[i] = {count, math.ceil(reset), 1, 0}
+			commits[#commits + 1] = commit
+		elseif block > 0 then
+			redis.call('SET', blockKey, 1, 'PX', block)
+			results[i] = {count, block, 0, 1}
+			allowed = false
+		else
+			results[i] = {count, math.ceil(reset), 0, 0}
+			allowed = false
+		end
+	end
+end
+
+if record and allowed then
+	for _, commit in ipairs(commits) do
+		commit()
+	end
+end
+
+local reply = {}
+for _, result in ipairs(results) do
+	for _, value in ipairs(result) do
+		reply[#reply + 1] = value
+	end
+end
+return reply
+`)
+
+// CheckAll evaluates every check in a single script, recording the request
+// only when all of them allow it
+func (r *RedisStorage) CheckAll(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return r.checkAll(ctx, checks, true)
+}
+
+// PeekAll evaluates every check like CheckAll without recording the request
+// or blocking any key
+func (r *RedisStorage) PeekAll(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return r.checkAll(ctx, withoutBlocking(checks), false)
+}
+
+// checkAll runs checkAllScript, recording the request when commit is set and
+// every check allows it
+// A script can only access the keys of a single cluster slot, so in a
+// cluster the checks of different keys are evaluated one key at a time and
+// the request is recorded once all of them allowed it; unlike a single
+// script, a concurrent request may be admitted in between
+func (r *RedisStorage) checkAll(ctx context.Context, checks []Check, commit bool) ([]*RateLimitResult, error) {
+	groups := r.slotGroups(checks)
+	if len(groups) == 1 {
+		return r.evalCheckAll(ctx, checks, commit)
+	}
+
+	results := make([]*RateLimitResult, len(checks))
+	run := func(commit bool) (bool, error) {
+		allowed := true
+		for _, group := range groups {
+			groupChecks := make([]Check, len(group))
+			for i, index := range group {
+				groupChecks[i] = checks[index]
+			}
+			groupResults, err := r.evalCheckAll(ctx, groupChecks, commit)
+			if err != nil {
+				return false, err
+			}
+			for i, index := range group {
+				results[index] = groupResults[i]
+				allowed = allowed && groupResults[i].Allowed
+			}
+		}
+		return allowed, nil
+	}
+
+	allowed, err := run(false)
+	if err != nil || !allowed || !commit {
+		return results, err
+	}
+	if _, err := run(true); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// slotGroups returns the indexes of checks grouped by the cluster slot of
+// their keys, in order; outside a cluster every check is in the same group
+func (r *RedisStorage) slotGroups(checks []Check) [][]int {
+	if !r.cluster {
+		indexes := make([]int, len(checks))
+		for i := range checks {
+			indexes[i] = i
+		}
+		return [][]int{indexes}
+	}
+
+	var groups [][]int
+	groupOf := make(map[string]int)
+	for i, check := range checks {
+		owner := OwnerKey(check.Key)
+		group, exists := groupOf[owner]
+		if !exists {
+			group = len(groups)
+			groupOf[owner] = group
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], i)
+	}
+	return groups
+}
+
+// evalCheckAll runs checkAllScript on checks whose keys share a slot
+func (r *RedisStorage) evalCheckAll(ctx context.Context, checks []Check, commit bool) ([]*RateLimitResult, error) {
+	keys, args, err := r.checkAllArgs(checks, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := checkAllScript.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check keys: %w", err)
+	}
+	return checkAllResults(res, len(checks), time.Now())
+}
+
+// checkAllArgs returns the keys and arguments of checkAllScript for checks
+func (r *RedisStorage) checkAllArgs(checks []Check, commit bool) ([]string, []interface{}, error) {
+	keys := make([]string, 0, 2*len(checks))
+	args := make([]interface{}, 0, 6*len(checks)+1)
+	for _, check := range checks {
+		limit := check.Limit
+		if limit.MaxRequests <= 0 || limit.Window <= 0 {
+			return nil, nil, fmt.Errorf("invalid limit for key %s: %d requests per %v", check.Key, limit.MaxRequests, limit.Window)
+		}
+		state, err := stateKey(check.Key, check.Algorithm)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, r.key(state), r.key(BlockKey(check.Key)))
+		args = append(args, check.Algorithm, limit.MaxRequests, limit.Window.Milliseconds(), limit.BurstOrMax(), limit.BlockTime.Milliseconds(), check.cost())
+	}
+
+	if commit {
+		args = append(args, 1)
+	} else {
+		args = append(args, 0)
+	}
+	return keys, args, nil
+}
+
+// checkAllResults decodes the reply of checkAllScript for n checks
+func checkAllResults(res []int64, n int, now time.Time) ([]*RateLimitResult, error) {
+	if len(res) != 4*n {
+		return nil, fmt.Errorf("unexpected script result for %d checks: %v", n, res)
+	}
+
+	results := make([]*RateLimitResult, n)
+	for i := range results {
+		values := res[4*i : 4*i+4]
+		results[i] = &RateLimitResult{
+			Allowed:   values[2] == 1,
+			Blocked:   values[3] == 1,
+			Count:     int(values[0]),
+			ResetTime: now.Add(time.Duration(values[1]) * time.Millisecond),
+		}
+	}
+	return results, nil
+}
+
+// CheckEach evaluates and records every check on its own, pipelining one
+// script per check
+func (r *RedisStorage) CheckEach(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return r.checkEach(ctx, checks, true)
+}
+
+// PeekEach evaluates every check like CheckEach without recording any
+// request or blocking any key
+func (r *RedisStorage) PeekEach(ctx context.Context, checks []Check) ([]*RateLimitResult, error) {
+	return r.checkEach(ctx, withoutBlocking(checks), false)
+}
+
+// checkEach runs checkAllScript for every check in a single pipeline; in a
+// cluster the client splits the pipeline by node
+// Scripts run by hash, so the checks of a node that doesn't know the script
+// yet are sent again once it is loaded
+func (r *RedisStorage) checkEach(ctx context.Context, checks []Check, commit bool) ([]*RateLimitResult, error) {
+	keys := make([][]string, len(checks))
+	args := make([][]interface{}, len(checks))
+	pending := make([]int, len(checks))
+	for i, check := range checks {
+		var err error
+		if keys[i], args[i], err = r.checkAllArgs([]Check{check}, commit); err != nil {
+			return nil, err
+		}
+		pending[i] = i
+	}
+
+	results := make([]*RateLimitResult, len(checks))
+	for attempt := 0; len(pending) > 0; attempt++ {
+		pipe := r.client.Pipeline()
+		cmds := make([]*redis.Cmd, len(pending))
+		for j, i := range pending {
+			cmds[j] = checkAllScript.EvalSha(ctx, pipe, keys[i], args[i]...)
+		}
+		pipe.Exec(ctx)
+
+		now := time.Now()
+		var unknown []int
+		for j, i := range pending {
+			res, err := cmds[j].Int64Slice()
+			if err != nil && attempt == 0 && redis.HasErrorPrefix(err, "NOSCRIPT") {
+				unknown = append(unknown, i)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to check key %s: %w", checks[i].Key, err)
+			}
+			result, err := checkAllResults(res, 1, now)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = result[0]
+		}
+
+		if len(unknown) > 0 {
+			if err := checkAllScript.Load(ctx, r.client).Err(); err != nil {
+				return nil, fmt.Errorf("failed to load the check script: %w", err)
+			}
+		}
+		pending = unknown
+	}
+	return results, nil
+}
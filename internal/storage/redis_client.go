@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient creates the client of the Redis deployment described by
+// cfg: a single server, a Sentinel-managed master or a Redis Cluster
+// REDIS_URL, when set, replaces the address, credentials and database
+// settings and is parsed as go-redis does for the deployment; the TLS files
+// are applied to it as well, since a URL can't carry them
+func newRedisClient(cfg *config.Config) (redis.UniversalClient, error) {
+	tlsConfig, err := redisTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RedisURL != "" {
+		return newRedisClientFromURL(cfg, tlsConfig)
+	}
+
+	opts := &redis.UniversalOptions{
+		Addrs:            cfg.RedisAddrs,
+		Username:         cfg.RedisUsername,
+		Password:         cfg.RedisPassword,
+		DB:               cfg.RedisDB,
+		MasterName:       cfg.RedisSentinelMaster,
+		SentinelUsername: cfg.RedisSentinelUsername,
+		SentinelPassword: cfg.RedisSentinelPassword,
+		TLSConfig:        tlsConfig,
+		PoolSize:         cfg.RedisPoolSize,
+		MinIdleConns:     cfg.RedisMinIdleConns,
+		DialTimeout:      cfg.RedisDialTimeout,
+		ReadTimeout:      cfg.RedisReadTimeout,
+		WriteTimeout:     cfg.RedisWriteTimeout,
+	}
+	if len(opts.Addrs) == 0 {
+		opts.Addrs = []string{net.JoinHostPort(cfg.RedisHost, cfg.RedisPort)}
+	}
+
+	switch cfg.RedisMode {
+	case config.RedisModeSentinel:
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case config.RedisModeCluster:
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return redis.NewClient(opts.Simple()), nil
+	}
+}
+
+// newRedisClientFromURL creates the client of cfg.RedisURL; pool sizes and
+// timeouts go in its query string, e.g. ?pool_size=20&read_timeout=500ms
+func newRedisClientFromURL(cfg *config.Config, tlsConfig *tls.Config) (redis.UniversalClient, error) {
+	switch cfg.RedisMode {
+	case config.RedisModeSentinel:
+		opts, err := redis.ParseFailoverURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		if tlsConfig != nil {
+			opts.TLSConfig = tlsConfig
+		}
+		return redis.NewFailoverClient(opts), nil
+	case config.RedisModeCluster:
+		opts, err := redis.ParseClusterURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		if tlsConfig != nil {
+			opts.TLSConfig = tlsConfig
+		}
+		return redis.NewClusterClient(opts), nil
+	default:
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		if tlsConfig != nil {
+			opts.TLSConfig = tlsConfig
+		}
+		return redis.NewClient(opts), nil
+	}
+}
+
+// redisTLSConfig returns the TLS configuration of cfg, or nil when TLS isn't
+// enabled; setting any TLS file or option enables it
+// A rediss:// REDIS_URL enables TLS on its own, with the system's CAs
+func redisTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	enabled := cfg.RedisTLS || cfg.RedisTLSCAFile != "" || cfg.RedisTLSCertFile != "" || cfg.RedisTLSServerName != "" || cfg.RedisTLSSkipVerify
+	if !enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.RedisTLSServerName,
+		InsecureSkipVerify: cfg.RedisTLSSkipVerify,
+	}
+	if cfg.RedisTLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.RedisTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read REDIS_TLS_CA_FILE: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in REDIS_TLS_CA_FILE %s", cfg.RedisTLSCAFile)
+		}
+	}
+	if cfg.RedisTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCertFile, cfg.RedisTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// ScanKeys returns the keys of client matching pattern, scanning every
+// master of a Redis Cluster
+func ScanKeys(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(ctx, client, pattern)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		nodeKeys, err := scanKeys(ctx, node, pattern)
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, nodeKeys...)
+		return err
+	})
+	return keys, err
+}
+
+// scanKeys scans the keyspace of a single server in batches, so Redis is
+// never blocked by a large listing
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// In a Redis Cluster, a key and its companions (block, algorithm state) must
+// be stored in the same slot so the scripts can access them together. Their
+// Redis key then wraps the owner key in a hash tag: "ip:1.2.3.4" is stored as
+// "{ip:1.2.3.4}" and its block key as "{ip:1.2.3.4}:block"
+
+// hashTag returns the Redis key of key in a Redis Cluster
+func hashTag(key string) string {
+	owner := OwnerKey(key)
+	return "{" + owner + "}" + key[len(owner):]
+}
+
+// stripHashTag returns the key a hash tagged Redis key was stored for
+// Companion suffixes never contain '}', so the tag ends at the last one
+func stripHashTag(redisKey string) string {
+	if !strings.HasPrefix(redisKey, "{") {
+		return redisKey
+	}
+	end := strings.LastIndex(redisKey, "}")
+	if end < 0 {
+		return redisKey
+	}
+	return redisKey[1:end] + redisKey[end+1:]
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"ip:192.0.2.1", "{ip:192.0.2.1}"},
+		{BlockKey("ip:192.0.2.1"), "{ip:192.0.2.1}:block"},
+		{"token:abc:tb", "{token:abc}:tb"},
+		{"route:api:a}b:gcra", "{route:api:a}b}:gcra"},
+	}
+
+	for _, tt := range tests {
+		if got := hashTag(tt.key); got != tt.want {
+			t.Errorf("Expected %s to be stored as %s, got %s", tt.key, tt.want, got)
+		}
+		if got := stripHashTag(hashTag(tt.key)); got != tt.key {
+			t.Errorf("Expected the tag of %s to be stripped, got %s", tt.want, got)
+		}
+	}
+}
+
+func TestRedisStorage_SlotGroups(t *testing.T) {
+	checks := []Check{{Key: "ip:192.0.2.1"}, {Key: "token:abc"}, {Key: "ip:192.0.2.1"}}
+
+	if groups := (&RedisStorage{}).slotGroups(checks); len(groups) != 1 || len(groups[0]) != 3 {
+		t.Errorf("Expected a single group outside a cluster, got %v", groups)
+	}
+	groups := (&RedisStorage{cluster: true}).slotGroups(checks)
+	if len(groups) != 2 || len(groups[0]) != 2 || groups[0][1] != 2 || groups[1][0] != 1 {
+		t.Errorf("Expected the checks grouped by key in a cluster, got %v", groups)
+	}
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	if tlsConfig, err := redisTLSConfig(&config.Config{}); tlsConfig != nil || err != nil {
+		t.Errorf("Expected TLS to be disabled, got %v, %v", tlsConfig, err)
+	}
+
+	tlsConfig, err := redisTLSConfig(&config.Config{RedisTLSServerName: "redis.internal"})
+	if err != nil || tlsConfig == nil || tlsConfig.ServerName != "redis.internal" {
+		t.Errorf("Expected a server name to enable TLS, got %v, %v", tlsConfig, err)
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	if _, err := redisTLSConfig(&config.Config{RedisTLSCAFile: notPEM}); err == nil || !strings.Contains(err.Error(), "no certificate") {
+		t.Errorf("Expected an error for a CA file without certificates, got %v", err)
+	}
+	if _, err := redisTLSConfig(&config.Config{RedisTLS: true, RedisTLSCertFile: notPEM, RedisTLSKeyFile: notPEM}); err == nil {
+		t.Error("Expected an error for an invalid client certificate")
+	}
+}
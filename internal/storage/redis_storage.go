@@ -2,85 +2,170 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+
 	"github.com/redis/go-redis/v9"
 )
 
+// checkAndIncrementScript evaluates the block state and the window limit and
+// increments the counter in a single round trip so concurrent callers can never
+// push a key past its limit.
+// KEYS[1] = counter key, KEYS[2] = block key,
+// ARGV[1] = limit, ARGV[2] = window in milliseconds, ARGV[3] = block time in milliseconds.
+// Returns {count, pttl, allowed, blocked}.
+var checkAndIncrementScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local block = tonumber(ARGV[3])
+
+local blocked = redis.call('PTTL', KEYS[2])
+if blocked > 0 then
+	return {tonumber(redis.call('GET', KEYS[1]) or '0'), blocked, 0, 1}
+end
+
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count >= limit then
+	if block > 0 then
+		redis.call('SET', KEYS[2], 1, 'PX', block)
+		return {count, block, 0, 1}
+	end
+	local pttl = redis.call('PTTL', KEYS[1])
+	if pttl < 0 then
+		redis.call('PEXPIRE', KEYS[1], window)
+		pttl = window
+	end
+	return {count, pttl, 0, 0}
+end
+
+count = redis.call('INCR', KEYS[1])
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], window)
+	pttl = window
+end
+return {count, pttl, 1, 0}
+`)
+
 // RedisStorage implements the Storage interface using Redis
+// It runs against a single server, a Sentinel-managed master or a Redis
+// Cluster, where keys are hash tagged so each key and its companions share a
+// slot
 type RedisStorage struct {
-	client *redis.Client
+	client  redis.UniversalClient
+	cluster bool
 }
 
 // NewRedisStorage creates a new Redis storage instance
 func NewRedisStorage(host, port string) (*RedisStorage, error) {
-	redisURL := fmt.Sprintf("%s:%s", host, port)
-	
-	client := redis.NewClient(&redis.Options{
-		Addr:     redisURL,
-		Password: "", // No password
-		DB:       0,  // Default DB
-	})
+	return newRedisStorage(redis.NewClient(&redis.Options{
+		Addr: net.JoinHostPort(host, port),
+	}))
+}
 
+// NewRedisStorageFromConfig creates a Redis storage connected as cfg says:
+// credentials, TLS, database, pool and timeouts, on a single server,
+// through Sentinel or to a Redis Cluster
+func NewRedisStorageFromConfig(cfg *config.Config) (*RedisStorage, error) {
+	client, err := newRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newRedisStorage(client)
+}
+
+// NewRedisStorageFromClient creates a Redis storage on an existing client,
+// which is closed with the storage
+func NewRedisStorageFromClient(client redis.UniversalClient) (*RedisStorage, error) {
+	return newRedisStorage(client)
+}
+
+func newRedisStorage(client redis.UniversalClient) (*RedisStorage, error) {
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisStorage{client: client}, nil
+	_, cluster := client.(*redis.ClusterClient)
+	return &RedisStorage{client: client, cluster: cluster}, nil
+}
+
+// Client returns the Redis client, e.g. to store the token registry next to
+// the counters
+func (r *RedisStorage) Client() redis.UniversalClient {
+	return r.client
+}
+
+// key returns the Redis key key is stored under, hash tagged in a cluster
+func (r *RedisStorage) key(key string) string {
+	if r.cluster {
+		return hashTag(key)
+	}
+	return key
 }
 
 // Increment increments the request count for a given key
+// The TTL is only set when the key is created, so the reset time is preserved
+// across increments and derived from the key's remaining TTL
 func (r *RedisStorage) Increment(ctx context.Context, key string, ttl time.Duration) (int, time.Time, error) {
+	key = r.key(key)
 	pipe := r.client.Pipeline()
 	
-	// Increment the count
+	// Increment the count and read the remaining TTL
 	incrCmd := pipe.Incr(ctx, key)
+	pttlCmd := pipe.PTTL(ctx, key)
 	
-	// Set expiration if this is a new key
-	pipe.Expire(ctx, key, ttl)
-	
-	_, err := pipe.Exec(ctx)
-	if err != nil && err != redis.Nil {
+	if _, err := pipe.Exec(ctx); err != nil {
 		return 0, time.Time{}, fmt.Errorf("failed to increment key: %w", err)
 	}
 
-	// Get current count
-	count, err := incrCmd.Result()
-	if err != nil {
-		count = 1
-	}
-
-	// Try to get existing reset time from a separate key
-	resetTime := time.Now().Add(ttl)
-	infoKey := fmt.Sprintf("%s:info", key)
-	infoStr, err := r.client.Get(ctx, infoKey).Result()
-	if err == nil {
-		var info RateLimitInfo
-		if json.Unmarshal([]byte(infoStr), &info) == nil {
-			resetTime = info.ResetTime
+	// Set expiration if this is a new key (or one left without a TTL)
+	pttl := pttlCmd.Val()
+	if pttl < 0 {
+		if err := r.client.PExpire(ctx, key, ttl).Err(); err != nil {
+			return 0, time.Time{}, fmt.Errorf("failed to set key expiration: %w", err)
 		}
+		pttl = ttl
 	}
 
-	// Update reset time info
-	info := RateLimitInfo{
-		Count:     int(count),
-		ResetTime: resetTime,
+	return int(incrCmd.Val()), time.Now().Add(pttl), nil
+}
+
+// CheckAndIncrement atomically checks and increments the request count for a given key
+func (r *RedisStorage) CheckAndIncrement(ctx context.Context, key string, limit int, window, blockTime time.Duration) (*RateLimitResult, error) {
+	keys := []string{r.key(key), r.key(BlockKey(key))}
+	res, err := checkAndIncrementScript.Run(ctx, r.client, keys, limit, window.Milliseconds(), blockTime.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check and increment key: %w", err)
+	}
+	if len(res) != 4 {
+		return nil, fmt.Errorf("unexpected script result for key %s: %v", key, res)
 	}
-	infoData, _ := json.Marshal(info)
-	r.client.Set(ctx, infoKey, string(infoData), ttl)
 
-	return int(count), resetTime, nil
+	return &RateLimitResult{
+		Allowed:   res[2] == 1,
+		Blocked:   res[3] == 1,
+		Count:     int(res[0]),
+		ResetTime: time.Now().Add(time.Duration(res[1]) * time.Millisecond),
+	}, nil
 }
 
 // Get retrieves the current rate limit info for a given key
 func (r *RedisStorage) Get(ctx context.Context, key string) (*RateLimitInfo, error) {
-	countStr, err := r.client.Get(ctx, key).Result()
+	key = r.key(key)
+	pipe := r.client.Pipeline()
+	getCmd := pipe.Get(ctx, key)
+	pttlCmd := pipe.PTTL(ctx, key)
+
+	_, err := pipe.Exec(ctx)
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -89,19 +174,14 @@ func (r *RedisStorage) Get(ctx context.Context, key string) (*RateLimitInfo, err
 	}
 
 	count := 0
-	if countStr != "" {
+	if countStr := getCmd.Val(); countStr != "" {
 		_, _ = fmt.Sscanf(countStr, "%d", &count)
 	}
 
-	// Try to get reset time info
+	// The reset time is when the key expires
 	resetTime := time.Now()
-	infoKey := fmt.Sprintf("%s:info", key)
-	infoStr, err := r.client.Get(ctx, infoKey).Result()
-	if err == nil {
-		var info RateLimitInfo
-		if json.Unmarshal([]byte(infoStr), &info) == nil {
-			resetTime = info.ResetTime
-		}
+	if pttl := pttlCmd.Val(); pttl > 0 {
+		resetTime = resetTime.Add(pttl)
 	}
 
 	return &RateLimitInfo{
@@ -112,38 +192,66 @@ func (r *RedisStorage) Get(ctx context.Context, key string) (*RateLimitInfo, err
 
 // Set explicitly sets the count and TTL for a key
 func (r *RedisStorage) Set(ctx context.Context, key string, count int, ttl time.Duration) error {
-	// Set the count
-	if err := r.client.Set(ctx, key, count, ttl).Err(); err != nil {
+	if err := r.client.Set(ctx, r.key(key), count, ttl).Err(); err != nil {
 		return fmt.Errorf("failed to set key: %w", err)
 	}
 
-	// Set reset time info
-	resetTime := time.Now().Add(ttl)
-	info := RateLimitInfo{
-		Count:     count,
-		ResetTime: resetTime,
-	}
-	infoData, _ := json.Marshal(info)
-	infoKey := fmt.Sprintf("%s:info", key)
-	if err := r.client.Set(ctx, infoKey, string(infoData), ttl).Err(); err != nil {
-		return fmt.Errorf("failed to set info key: %w", err)
-	}
-
 	return nil
 }
 
 // Clear removes a key from storage
 func (r *RedisStorage) Clear(ctx context.Context, key string) error {
+	key = r.key(key)
 	if err := r.client.Del(ctx, key).Err(); err != nil {
 		return fmt.Errorf("failed to delete key: %w", err)
 	}
 	
-	infoKey := fmt.Sprintf("%s:info", key)
-	r.client.Del(ctx, infoKey)
+	// Remove the companion keys: legacy info, block and per-algorithm state
+	companions := []string{"info", blockSuffix, tokenBucketSuffix, slidingWindowLogSuffix, slidingWindowCounterSuffix, gcraSuffix}
+	companionKeys := make([]string, 0, len(companions))
+	for _, suffix := range companions {
+		companionKeys = append(companionKeys, fmt.Sprintf("%s:%s", key, suffix))
+	}
+	r.client.Del(ctx, companionKeys...)
 	
 	return nil
 }
 
+// Keys returns the keys matching pattern, scanning the keyspace in batches so
+// Redis is never blocked by a large listing
+// In a cluster every master is scanned for the hash tagged keys starting
+// with the pattern's literal prefix, and their tags are stripped
+func (r *RedisStorage) Keys(ctx context.Context, pattern string) ([]string, error) {
+	if !r.cluster {
+		keys, err := ScanKeys(ctx, r.client, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan keys: %w", err)
+		}
+		return keys, nil
+	}
+
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+		prefix = pattern[:i]
+	}
+	redisKeys, err := ScanKeys(ctx, r.client, "{"+globEscaper.Replace(prefix)+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan keys: %w", err)
+	}
+
+	var keys []string
+	for _, redisKey := range redisKeys {
+		if key := stripHashTag(redisKey); MatchPattern(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// globEscaper escapes the characters special to Redis patterns but not to
+// Keys patterns
+var globEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`)
+
 // Ping checks if the storage is available
 func (r *RedisStorage) Ping(ctx context.Context) error {
 	return r.client.Ping(ctx).Err()
@@ -154,3 +262,8 @@ func (r *RedisStorage) Close() error {
 	return r.client.Close()
 }
 
+// PoolStats returns the statistics of the Redis connection pool
+func (r *RedisStorage) PoolStats() *redis.PoolStats {
+	return r.client.PoolStats()
+}
+
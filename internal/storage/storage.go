@@ -2,21 +2,69 @@ package storage
 
 import (
 	"context"
+	"strings"
 	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
 )
 
+// New creates the storage backend selected by cfg
+func New(cfg *config.Config) (Storage, error) {
+	switch cfg.StorageBackend {
+	case config.StorageBackendMemory:
+		return NewMemoryStorage(cfg.MemoryMaxKeys, cfg.MemoryCleanupInterval), nil
+	default:
+		return NewRedisStorageFromConfig(cfg)
+	}
+}
+
 // RateLimitInfo represents the information about rate limiting for a key
 type RateLimitInfo struct {
 	Count     int
 	ResetTime time.Time
 }
 
+// RateLimitResult represents the outcome of an atomic check-and-increment
+// When Blocked is set, ResetTime is the end of the blocking period rather
+// than the end of the current window
+type RateLimitResult struct {
+	Allowed   bool
+	Blocked   bool
+	Count     int
+	ResetTime time.Time
+}
+
+// Limit describes the limit enforced for a key by a rate limiting algorithm
+// MaxRequests are allowed per Window; Burst is the bucket capacity for the
+// token bucket and GCRA algorithms and defaults to MaxRequests when zero.
+// Once a request is rejected the key is blocked for BlockTime, if set
+type Limit struct {
+	MaxRequests int
+	Window      time.Duration
+	Burst       int
+	BlockTime   time.Duration
+}
+
+// BurstOrMax returns the configured burst, falling back to MaxRequests
+func (l Limit) BurstOrMax() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.MaxRequests
+}
+
 // Storage defines the interface for rate limiter storage
 type Storage interface {
 	// Increment increments the request count for a given key
 	// Returns the current count and expiration time
 	Increment(ctx context.Context, key string, ttl time.Duration) (int, time.Time, error)
 
+	// CheckAndIncrement atomically checks the count for a given key against limit
+	// and increments it only when the request is allowed. The count resets every
+	// window; once the limit is exceeded the key is blocked for blockTime,
+	// regardless of window resets
+	CheckAndIncrement(ctx context.Context, key string, limit int, window, blockTime time.Duration) (*RateLimitResult, error)
+
 	// Get retrieves the current rate limit info for a given key
 	Get(ctx context.Context, key string) (*RateLimitInfo, error)
 
@@ -26,6 +74,12 @@ type Storage interface {
 	// Clear removes a key from storage
 	Clear(ctx context.Context, key string) error
 
+	// Keys returns the keys matching pattern, where * matches any run of
+	// characters and ? a single one, e.g. "ip:*"
+	// Keys are enumerated incrementally, so keys created or removed meanwhile
+	// may or may not be returned
+	Keys(ctx context.Context, pattern string) ([]string, error)
+
 	// Ping checks if the storage is available
 	Ping(ctx context.Context) error
 
@@ -34,3 +88,127 @@ type Storage interface {
 }
 
 
+
+// AlgorithmStorage is implemented by storages that can evaluate the rate
+// limiting algorithms atomically on the backend
+// Each method checks the block state, evaluates the algorithm and records the
+// request only when it is allowed
+type AlgorithmStorage interface {
+	// TokenBucket refills Burst tokens at MaxRequests per Window and
+	// consumes one token per request
+	TokenBucket(ctx context.Context, key string, limit Limit) (*RateLimitResult, error)
+
+	// SlidingWindowLog keeps the timestamp of every request within the last
+	// Window and allows at most MaxRequests of them
+	SlidingWindowLog(ctx context.Context, key string, limit Limit) (*RateLimitResult, error)
+
+	// SlidingWindowCounter weights the previous fixed window's count by its
+	// overlap with the sliding window and adds the current window's count
+	SlidingWindowCounter(ctx context.Context, key string, limit Limit) (*RateLimitResult, error)
+
+	// GCRA implements the generic cell rate algorithm, emitting one request
+	// every Window/MaxRequests with a tolerance of Burst requests
+	GCRA(ctx context.Context, key string, limit Limit) (*RateLimitResult, error)
+}
+
+// Check is one of the limits a request is checked against: Key is limited by
+// Limit under Algorithm, one of config.Algorithms
+// Cost is the number of requests the check counts, one when zero
+type Check struct {
+	Key       string
+	Algorithm string
+	Limit     Limit
+	Cost      int
+}
+
+// cost returns the number of requests the check counts
+func (c Check) cost() int {
+	return max(c.Cost, 1)
+}
+
+// MultiStorage is implemented by storages that can check a request against
+// several keys atomically, such as a per-IP and a per-token limit
+type MultiStorage interface {
+	// CheckAll evaluates every check and records the request on all of them
+	// only when each one allows it, so a key rejecting the request never
+	// consumes the quota of the others. Rejecting keys are blocked as usual
+	// Each result is the verdict of its own check, in the order of checks
+	CheckAll(ctx context.Context, checks []Check) ([]*RateLimitResult, error)
+
+	// PeekAll evaluates every check like CheckAll without recording the
+	// request or blocking any key, reporting how a request would be judged
+	PeekAll(ctx context.Context, checks []Check) ([]*RateLimitResult, error)
+
+	// CheckEach evaluates and records every check on its own, as CheckAll
+	// does a single check, so the checks of unrelated requests share a round
+	// trip without a rejection keeping the others from being recorded
+	CheckEach(ctx context.Context, checks []Check) ([]*RateLimitResult, error)
+
+	// PeekEach evaluates every check like CheckEach without recording any
+	// request or blocking any key
+	PeekEach(ctx context.Context, checks []Check) ([]*RateLimitResult, error)
+}
+
+// blockSuffix is the suffix of the key marking a key as blocked
+const blockSuffix = "block"
+
+// BlockKey returns the key marking key as blocked; it expires when the block
+// ends, so setting it with a TTL blocks key for that long
+func BlockKey(key string) string {
+	return key + ":" + blockSuffix
+}
+
+// BlockedKey returns the key blocked by blockKey, if it is a block key
+func BlockedKey(blockKey string) (string, bool) {
+	return strings.CutSuffix(blockKey, ":"+blockSuffix)
+}
+
+// OwnerKey returns the key a block or algorithm state key belongs to; any
+// other key is returned unchanged
+func OwnerKey(key string) string {
+	if blocked, ok := BlockedKey(key); ok {
+		return blocked
+	}
+	for _, suffix := range algorithmSuffixes {
+		if owner, ok := strings.CutSuffix(key, ":"+suffix); ok && suffix != "" {
+			return owner
+		}
+	}
+	return key
+}
+
+// MatchPattern reports whether key matches a Keys pattern
+func MatchPattern(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// Try every split of key for the rest of the pattern
+			for i := len(key); i >= 0; i-- {
+				if MatchPattern(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// withoutBlocking returns a copy of checks that never block their key
+func withoutBlocking(checks []Check) []Check {
+	peeks := make([]Check, len(checks))
+	for i, check := range checks {
+		check.Limit.BlockTime = 0
+		peeks[i] = check
+	}
+	return peeks
+}
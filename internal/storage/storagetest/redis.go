@@ -0,0 +1,69 @@
+package storagetest
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// RedisAddr returns the address of a Redis server for tests
+// It uses REDIS_ADDR when set, otherwise it starts an in-process server with
+// NewRedis
+func RedisAddr(t *testing.T) (host, port string) {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = NewRedis(t).Addr()
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("Invalid Redis address %q: %v", addr, err)
+	}
+	return host, port
+}
+
+// clockStep is how often the in-process server's TTLs follow the clock
+const clockStep = 5 * time.Millisecond
+
+// NewRedis starts an in-process Redis server on a random local port, stopped
+// when the test finishes
+// It runs Lua scripts, so the algorithm scripts of storage.RedisStorage are
+// evaluated as on a real server, and its keys expire with the clock
+func NewRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	server := miniredis.NewMiniRedis()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start Redis: %v", err)
+	}
+
+	// TTLs only run down as the server's time is moved forward
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(clockStep)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				server.FastForward(now.Sub(last))
+				last = now
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+		server.Close()
+	})
+	return server
+}
@@ -0,0 +1,608 @@
+// Package storagetest provides a conformance test suite that every
+// storage.Storage implementation must pass.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+)
+
+// Factory creates a fresh storage instance for a single test
+// Implementations should register any cleanup with t.Cleanup
+type Factory func(t *testing.T) storage.Storage
+
+// timeTolerance absorbs the millisecond rounding of backend TTLs and scheduling jitter
+const timeTolerance = 25 * time.Millisecond
+
+// Run exercises the storage returned by factory against the storage.Storage contract
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store storage.Storage, key string)
+	}{
+		{"IncrementNewKey", testIncrementNewKey},
+		{"IncrementCounts", testIncrementCounts},
+		{"ResetTimePreserved", testResetTimePreserved},
+		{"TTLExpiry", testTTLExpiry},
+		{"GetMissingKey", testGetMissingKey},
+		{"SetAndGet", testSetAndGet},
+		{"SetThenIncrement", testSetThenIncrement},
+		{"Clear", testClear},
+		{"Keys", testKeys},
+		{"ConcurrentIncrements", testConcurrentIncrements},
+		{"ContextCancellation", testContextCancellation},
+		{"CheckAndIncrement", testCheckAndIncrement},
+		{"CheckAndIncrementBlocks", testCheckAndIncrementBlocks},
+		{"ConcurrentCheckAndIncrement", testConcurrentCheckAndIncrement},
+		{"CheckAll", testCheckAll},
+		{"CheckEach", testCheckEach},
+		{"ConcurrentCheckAll", testConcurrentCheckAll},
+		{"ConcurrentCheckEach", testConcurrentCheckEach},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := factory(t)
+			key := fmt.Sprintf("storagetest:%s:%d", tt.name, time.Now().UnixNano())
+			t.Cleanup(func() {
+				store.Clear(context.Background(), key)
+				store.Clear(context.Background(), storage.BlockKey(key))
+			})
+			tt.run(t, store, key)
+		})
+	}
+}
+
+// assertTimeNear fails the test when got is not within timeTolerance of want
+func assertTimeNear(t *testing.T, what string, got, want time.Time) {
+	t.Helper()
+	if diff := got.Sub(want); diff > timeTolerance || diff < -timeTolerance {
+		t.Errorf("%s: got %v, want %v (off by %v)", what, got, want, diff)
+	}
+}
+
+func testIncrementNewKey(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	start := time.Now()
+	count, resetTime, err := store.Increment(ctx, key, 1*time.Minute)
+	if err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected count 1, got %d", count)
+	}
+	assertTimeNear(t, "reset time", resetTime, start.Add(1*time.Minute))
+}
+
+func testIncrementCounts(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		count, _, err := store.Increment(ctx, key, 1*time.Minute)
+		if err != nil {
+			t.Fatalf("Increment %d failed: %v", i, err)
+		}
+		if count != i {
+			t.Errorf("Increment %d: expected count %d, got %d", i, i, count)
+		}
+	}
+
+	info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info == nil || info.Count != 5 {
+		t.Errorf("Expected count 5, got %+v", info)
+	}
+}
+
+func testResetTimePreserved(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+	ttl := 300 * time.Millisecond
+
+	_, firstReset, err := store.Increment(ctx, key, ttl)
+	if err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+
+	// Later increments must not extend the window
+	time.Sleep(100 * time.Millisecond)
+	_, secondReset, err := store.Increment(ctx, key, ttl)
+	if err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	assertTimeNear(t, "reset time after second increment", secondReset, firstReset)
+
+	info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info == nil {
+		t.Fatal("Expected key to exist")
+	}
+	assertTimeNear(t, "reset time from Get", info.ResetTime, firstReset)
+
+	// Once the original reset time passes a new window starts
+	time.Sleep(time.Until(firstReset) + timeTolerance)
+	count, _, err := store.Increment(ctx, key, ttl)
+	if err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected a new window with count 1, got %d", count)
+	}
+}
+
+func testTTLExpiry(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	if _, _, err := store.Increment(ctx, key, 100*time.Millisecond); err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info != nil {
+		t.Errorf("Expected key to expire, got %+v", info)
+	}
+}
+
+func testGetMissingKey(t *testing.T, store storage.Storage, key string) {
+	info, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info != nil {
+		t.Errorf("Expected nil info for missing key, got %+v", info)
+	}
+}
+
+func testSetAndGet(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := store.Set(ctx, key, 7, 1*time.Minute); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info == nil {
+		t.Fatal("Expected key to exist")
+	}
+	if info.Count != 7 {
+		t.Errorf("Expected count 7, got %d", info.Count)
+	}
+	assertTimeNear(t, "reset time", info.ResetTime, start.Add(1*time.Minute))
+}
+
+func testSetThenIncrement(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	if err := store.Set(ctx, key, 3, 1*time.Minute); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	count, _, err := store.Increment(ctx, key, 1*time.Minute)
+	if err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("Expected count 4, got %d", count)
+	}
+}
+
+func testClear(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	if _, _, err := store.Increment(ctx, key, 1*time.Minute); err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	if err := store.Clear(ctx, key); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+
+	info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info != nil {
+		t.Errorf("Expected key to be cleared, got %+v", info)
+	}
+
+	// Clearing a missing key is not an error
+	if err := store.Clear(ctx, key); err != nil {
+		t.Errorf("Clear of missing key failed: %v", err)
+	}
+
+	count, _, err := store.Increment(ctx, key, 1*time.Minute)
+	if err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected count to restart at 1, got %d", count)
+	}
+}
+
+func testKeys(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	for _, k := range []string{key + ":a", key + ":b", storage.BlockKey(key)} {
+		if err := store.Set(ctx, k, 1, 1*time.Minute); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		t.Cleanup(func() { store.Clear(ctx, k) })
+	}
+
+	keys, err := store.Keys(ctx, key+":?")
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	slices.Sort(keys)
+	if want := []string{key + ":a", key + ":b"}; !slices.Equal(keys, want) {
+		t.Errorf("Expected %v, got %v", want, keys)
+	}
+
+	keys, err = store.Keys(ctx, "*:block")
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	if !slices.Contains(keys, storage.BlockKey(key)) {
+		t.Errorf("Expected %s among the blocked keys, got %v", storage.BlockKey(key), keys)
+	}
+}
+
+func testConcurrentIncrements(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	const workers = 50
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		counts = make(map[int]bool)
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			count, _, err := store.Increment(ctx, key, 1*time.Minute)
+			if err != nil {
+				t.Errorf("Increment failed: %v", err)
+				return
+			}
+			mu.Lock()
+			counts[count] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Every increment observed a distinct count
+	for i := 1; i <= workers; i++ {
+		if !counts[i] {
+			t.Errorf("No increment returned count %d", i)
+		}
+	}
+
+	info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info == nil || info.Count != workers {
+		t.Errorf("Expected count %d, got %+v", workers, info)
+	}
+}
+
+func testContextCancellation(t *testing.T, store storage.Storage, key string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := store.Increment(ctx, key, 1*time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("Increment: expected context.Canceled, got %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get: expected context.Canceled, got %v", err)
+	}
+	if err := store.Set(ctx, key, 1, 1*time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("Set: expected context.Canceled, got %v", err)
+	}
+	if err := store.Clear(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("Clear: expected context.Canceled, got %v", err)
+	}
+
+	// Nothing was written
+	info, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info != nil {
+		t.Errorf("Expected no state after cancelled calls, got %+v", info)
+	}
+}
+
+func testCheckAndIncrement(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 1; i <= 3; i++ {
+		result, err := store.CheckAndIncrement(ctx, key, 3, 1*time.Minute, 0)
+		if err != nil {
+			t.Fatalf("CheckAndIncrement %d failed: %v", i, err)
+		}
+		if !result.Allowed || result.Blocked {
+			t.Errorf("Request %d: expected to be allowed, got %+v", i, result)
+		}
+		if result.Count != i {
+			t.Errorf("Request %d: expected count %d, got %d", i, i, result.Count)
+		}
+		assertTimeNear(t, "reset time", result.ResetTime, start.Add(1*time.Minute))
+	}
+
+	// Rejected requests are not counted and don't block without a block time
+	for i := 0; i < 2; i++ {
+		result, err := store.CheckAndIncrement(ctx, key, 3, 1*time.Minute, 0)
+		if err != nil {
+			t.Fatalf("CheckAndIncrement failed: %v", err)
+		}
+		if result.Allowed || result.Blocked {
+			t.Errorf("Expected an unblocked rejection, got %+v", result)
+		}
+		if result.Count != 3 {
+			t.Errorf("Expected count to stay at 3, got %d", result.Count)
+		}
+		assertTimeNear(t, "reset time", result.ResetTime, start.Add(1*time.Minute))
+	}
+
+	info, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if info == nil || info.Count != 3 {
+		t.Errorf("Expected count 3, got %+v", info)
+	}
+}
+
+func testCheckAndIncrementBlocks(t *testing.T, store storage.Storage, key string) {
+	ctx := context.Background()
+	blockTime := 200 * time.Millisecond
+
+	if _, err := store.CheckAndIncrement(ctx, key, 1, 100*time.Millisecond, blockTime); err != nil {
+		t.Fatalf("CheckAndIncrement failed: %v", err)
+	}
+
+	start := time.Now()
+	result, err := store.CheckAndIncrement(ctx, key, 1, 100*time.Millisecond, blockTime)
+	if err != nil {
+		t.Fatalf("CheckAndIncrement failed: %v", err)
+	}
+	if result.Allowed || !result.Blocked {
+		t.Fatalf("Expected the key to be blocked, got %+v", result)
+	}
+	assertTimeNear(t, "blocked until", result.ResetTime, start.Add(blockTime))
+
+	// The block outlives the window
+	time.Sleep(100*time.Millisecond + timeTolerance)
+	result, err = store.CheckAndIncrement(ctx, key, 1, 100*time.Millisecond, blockTime)
+	if err != nil {
+		t.Fatalf("CheckAndIncrement failed: %v", err)
+	}
+	if result.Allowed || !result.Blocked {
+		t.Errorf("Expected the key to stay blocked, got %+v", result)
+	}
+
+	time.Sleep(time.Until(start.Add(blockTime)) + timeTolerance)
+	result, err = store.CheckAndIncrement(ctx, key, 1, 100*time.Millisecond, blockTime)
+	if err != nil {
+		t.Fatalf("CheckAndIncrement failed: %v", err)
+	}
+	if !result.Allowed || result.Blocked {
+		t.Errorf("Expected the block to end, got %+v", result)
+	}
+}
+
+func testConcurrentCheckAndIncrement(t *testing.T, store storage.Storage, key string) {
+	const limit = 10
+	admitted := admitConcurrently(t, func() (bool, error) {
+		result, err := store.CheckAndIncrement(context.Background(), key, limit, 1*time.Minute, 0)
+		if err != nil {
+			return false, err
+		}
+		return result.Allowed, nil
+	})
+	if admitted != limit {
+		t.Errorf("Expected exactly %d requests admitted, got %d", limit, admitted)
+	}
+}
+
+// multiStorage returns store as a storage.MultiStorage, skipping the test
+// when it isn't one
+func multiStorage(t *testing.T, store storage.Storage) storage.MultiStorage {
+	t.Helper()
+	multi, ok := store.(storage.MultiStorage)
+	if !ok {
+		t.Skip("storage does not implement storage.MultiStorage")
+	}
+	return multi
+}
+
+// forEachAlgorithm runs fn in a subtest per algorithm, with its own key
+func forEachAlgorithm(t *testing.T, key string, fn func(t *testing.T, algorithm, key string)) {
+	for _, algorithm := range config.Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			fn(t, algorithm, key+":"+algorithm)
+		})
+	}
+}
+
+func testCheckAll(t *testing.T, store storage.Storage, key string) {
+	multi := multiStorage(t, store)
+	ctx := context.Background()
+
+	forEachAlgorithm(t, key, func(t *testing.T, algorithm, key string) {
+		loose := storage.Check{Key: key + ":loose", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: 5, Window: 1 * time.Minute}}
+		strict := storage.Check{Key: key + ":strict", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: 2, Window: 1 * time.Minute}}
+
+		for i := 1; i <= 2; i++ {
+			results, err := multi.CheckAll(ctx, []storage.Check{loose, strict})
+			if err != nil {
+				t.Fatalf("CheckAll %d failed: %v", i, err)
+			}
+			if len(results) != 2 || !results[0].Allowed || !results[1].Allowed {
+				t.Fatalf("Request %d: expected both checks to allow, got %+v", i, results)
+			}
+		}
+
+		// A rejection by one check doesn't consume the quota of the other
+		for i := 0; i < 3; i++ {
+			results, err := multi.CheckAll(ctx, []storage.Check{loose, strict})
+			if err != nil {
+				t.Fatalf("CheckAll failed: %v", err)
+			}
+			if results[1].Allowed {
+				t.Fatalf("Expected the strict check to reject, got %+v", results[1])
+			}
+		}
+
+		admitted := 0
+		for i := 0; i < 5; i++ {
+			results, err := multi.CheckAll(ctx, []storage.Check{loose})
+			if err != nil {
+				t.Fatalf("CheckAll failed: %v", err)
+			}
+			if results[0].Allowed {
+				admitted++
+			}
+		}
+		if admitted != 3 {
+			t.Errorf("Expected the loose check to admit 3 more requests, got %d", admitted)
+		}
+	})
+}
+
+func testCheckEach(t *testing.T, store storage.Storage, key string) {
+	multi := multiStorage(t, store)
+	ctx := context.Background()
+
+	forEachAlgorithm(t, key, func(t *testing.T, algorithm, key string) {
+		loose := storage.Check{Key: key + ":loose", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: 5, Window: 1 * time.Minute}}
+		strict := storage.Check{Key: key + ":strict", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: 2, Window: 1 * time.Minute}}
+
+		// Every check counts the request on its own
+		looseAdmitted, strictAdmitted := 0, 0
+		for i := 0; i < 5; i++ {
+			results, err := multi.CheckEach(ctx, []storage.Check{loose, strict})
+			if err != nil {
+				t.Fatalf("CheckEach failed: %v", err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("Expected 2 results, got %d", len(results))
+			}
+			if results[0].Allowed {
+				looseAdmitted++
+			}
+			if results[1].Allowed {
+				strictAdmitted++
+			}
+		}
+		if looseAdmitted != 5 || strictAdmitted != 2 {
+			t.Errorf("Expected 5 and 2 requests admitted, got %d and %d", looseAdmitted, strictAdmitted)
+		}
+	})
+}
+
+func testConcurrentCheckAll(t *testing.T, store storage.Storage, key string) {
+	multi := multiStorage(t, store)
+
+	forEachAlgorithm(t, key, func(t *testing.T, algorithm, key string) {
+		const limit = 10
+		checks := []storage.Check{
+			{Key: key + ":ip", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: 2 * limit, Window: 1 * time.Minute}},
+			{Key: key + ":token", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: limit, Window: 1 * time.Minute}},
+		}
+		admitted := admitConcurrently(t, func() (bool, error) {
+			results, err := multi.CheckAll(context.Background(), checks)
+			if err != nil {
+				return false, err
+			}
+			return results[0].Allowed && results[1].Allowed, nil
+		})
+		if admitted != limit {
+			t.Errorf("Expected exactly %d requests admitted, got %d", limit, admitted)
+		}
+	})
+}
+
+func testConcurrentCheckEach(t *testing.T, store storage.Storage, key string) {
+	multi := multiStorage(t, store)
+
+	forEachAlgorithm(t, key, func(t *testing.T, algorithm, key string) {
+		const limit = 10
+		checks := []storage.Check{
+			{Key: key + ":a", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: limit, Window: 1 * time.Minute}},
+			{Key: key + ":b", Algorithm: algorithm, Limit: storage.Limit{MaxRequests: limit, Window: 1 * time.Minute}},
+		}
+		var mu sync.Mutex
+		admittedB := 0
+		admittedA := admitConcurrently(t, func() (bool, error) {
+			results, err := multi.CheckEach(context.Background(), checks)
+			if err != nil {
+				return false, err
+			}
+			if results[1].Allowed {
+				mu.Lock()
+				admittedB++
+				mu.Unlock()
+			}
+			return results[0].Allowed, nil
+		})
+		if admittedA != limit || admittedB != limit {
+			t.Errorf("Expected exactly %d requests admitted per key, got %d and %d", limit, admittedA, admittedB)
+		}
+	})
+}
+
+// admitConcurrently calls check from many goroutines at once and returns how
+// many of the requests it admitted
+func admitConcurrently(t *testing.T, check func() (bool, error)) int {
+	t.Helper()
+
+	const workers = 50
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		admitted int
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			allowed, err := check()
+			if err != nil {
+				t.Errorf("Check failed: %v", err)
+				return
+			}
+			if allowed {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return admitted
+}
@@ -4,17 +4,22 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"fc-tec-ch-02/internal/config"
-	"fc-tec-ch-02/internal/handlers"
-	"fc-tec-ch-02/internal/limiter"
-	"fc-tec-ch-02/internal/middleware"
-	"fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/handlers"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/metrics"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/middleware"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/proxy"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/registry"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/rls"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
 )
 
 func main() {
@@ -24,10 +29,10 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Initialize storage (Redis)
-	storageInstance, err := storage.NewRedisStorage(cfg.RedisHost, cfg.RedisPort)
+	// Initialize storage
+	storageInstance, err := storage.New(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatalf("Failed to initialize %s storage: %v", cfg.StorageBackend, err)
 	}
 	defer storageInstance.Close()
 
@@ -35,43 +40,211 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := storageInstance.Ping(ctx); err != nil {
-		log.Fatalf("Failed to ping Redis: %v", err)
+		log.Fatalf("Failed to ping %s storage: %v", cfg.StorageBackend, err)
+	}
+	log.Printf("Using %s storage", cfg.StorageBackend)
+	if err := limiter.CheckStorage(storageInstance, cfg); err != nil {
+		log.Fatalf("Invalid configuration for %s storage: %v", cfg.StorageBackend, err)
+	}
+	if cfg.EnableTokenRateLimiter && cfg.TokenHashSecret == "" {
+		log.Printf("WARNING: TOKEN_HASH_SECRET is not set; token counters are keyed with a random key of this process and start over on restart")
+	}
+
+	// Initialize rate limiter service, timing its storage operations and
+	// failing fast while the storage is down
+	metricsInstance := metrics.New()
+	limiterStorage := storage.NewCircuitBreaker(metricsInstance.InstrumentStorage(storageInstance), cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown)
+	rateLimiterService := limiter.NewService(limiterStorage, cfg)
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	metricsInstance.WatchBlockedKeys(watchCtx, storageInstance)
+
+	// Look up tokens without a configured limit in the token registry
+	if cfg.TokenRegistry != "" {
+		tokenRegistry, err := newTokenRegistry(watchCtx, cfg, limiterStorage)
+		if err != nil {
+			log.Fatalf("Failed to load token registry: %v", err)
+		}
+		rateLimiterService.SetTokenRegistry(tokenRegistry)
+		log.Printf("Using %s token registry (unknown tokens: %s)", cfg.TokenRegistry, cfg.UnknownTokenAction)
 	}
-	log.Println("Successfully connected to Redis")
 
-	// Initialize rate limiter service
-	rateLimiterService := limiter.NewService(storageInstance, cfg)
+	// The server's write timeout is sized for the upstream timeouts at
+	// startup, so a reload can't raise them
+	upstreamTimeout := proxy.Timeout(cfg)
+
+	// Reload the policy on SIGHUP, when the policy file changes and on POST /admin/reload
+	// An invalid policy is rejected and the current limits stay in effect
+	reload := func(source string) ([]string, error) {
+		newCfg, err := config.LoadConfig()
+		if err == nil {
+			err = limiter.CheckStorage(storageInstance, newCfg)
+		}
+		if err == nil && len(cfg.Upstreams) > 0 && proxy.Timeout(newCfg) > upstreamTimeout {
+			err = fmt.Errorf("upstream timeout %v exceeds %v, the longest at startup; raising it requires a restart", proxy.Timeout(newCfg), upstreamTimeout)
+		}
+		if err != nil {
+			log.Printf("Policy reload (%s) rejected, keeping current limits: %v", source, err)
+			return nil, err
+		}
+		changes := rateLimiterService.Reload(newCfg)
+		log.Printf("Policy reloaded (%s): %d change(s)", source, len(changes))
+		for _, change := range changes {
+			log.Printf("  %s", change)
+		}
+		return changes, nil
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				reload("SIGHUP")
+			case <-watchCtx.Done():
+				return
+			}
+		}
+	}()
+
+	if cfg.PolicyFile != "" {
+		go config.WatchFile(watchCtx, cfg.PolicyFile, cfg.PolicyReloadInterval, func() {
+			reload("policy file changed")
+		})
+	}
 
 	// Setup routes
 	mux := http.NewServeMux()
 
-	// Test endpoint
-	mux.HandleFunc("/health", handlers.HealthHandler)
-	mux.HandleFunc("/test", handlers.TestHandler)
+	writeTimeout := 15 * time.Second
+	var handler http.Handler = middleware.RateLimitMiddleware(rateLimiterService, metricsInstance)(mux)
+	if len(cfg.Upstreams) > 0 {
+		// Proxy mode: every request goes to the upstream of its route, so the
+		// server must wait at least as long as the slowest upstream
+		mux.Handle("/", proxy.NewHandler(rateLimiterService))
+		writeTimeout = max(writeTimeout, upstreamTimeout+5*time.Second)
+	} else {
+		// Test endpoint
+		mux.HandleFunc("/test", handlers.TestHandler)
 
-	// Create server with middleware
-	handler := middleware.RateLimitMiddleware(rateLimiterService)(mux)
+		// Health check and forward auth endpoint, outside the middleware; the
+		// forward auth endpoint checks the requests of a reverse proxy itself
+		authorize := middleware.AuthorizeHandler(rateLimiterService, metricsInstance)
+		root := http.NewServeMux()
+		root.HandleFunc("/health", handlers.HealthHandler)
+		root.Handle(middleware.AuthorizePath, authorize)
+		root.Handle(middleware.AuthorizePath+"/", authorize)
+		root.Handle("/", handler)
+		handler = root
+	}
 
+	// Create server with middleware
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%s", cfg.ServerPort),
 		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// Admin endpoints listen on their own port, are authenticated with
+	// ADMIN_TOKEN and are not rate limited
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/admin/reload", handlers.ReloadHandler(func() ([]string, error) {
+		return reload("admin API")
+	}))
+	adminMux.Handle("/admin/state", handlers.StateHandler(rateLimiterService))
+	adminMux.Handle("/admin/reset", handlers.ResetHandler(rateLimiterService))
+	adminMux.Handle("/admin/block", handlers.BlockHandler(rateLimiterService))
+	adminMux.Handle("/admin/unblock", handlers.UnblockHandler(rateLimiterService))
+	adminMux.Handle("/admin/blocked", handlers.BlockedHandler(rateLimiterService))
+	adminMux.Handle("/admin/top", handlers.TopHandler(rateLimiterService))
+	adminMux.Handle("/admin/policy", handlers.PolicyHandler(rateLimiterService))
+	adminMux.Handle("/admin/tokens", handlers.TokensHandler(rateLimiterService))
+	adminMux.Handle("/admin/tokens/revoke", handlers.RevokeTokenHandler(rateLimiterService))
+	adminMux.Handle("/admin/tokens/tier", handlers.TokenTierHandler(rateLimiterService))
+	adminMux.Handle("/metrics", metricsInstance.Handler())
+
+	// The health check is served on the admin port too, unauthenticated, so
+	// it can be probed in proxy mode, where every path of the server port is
+	// proxied
+	adminRoot := http.NewServeMux()
+	adminRoot.HandleFunc("/health", handlers.HealthHandler)
+	adminRoot.Handle("/", middleware.AdminAuthMiddleware(cfg.AdminToken)(adminMux))
+
+	adminServer := &http.Server{
+		Addr:         fmt.Sprintf(":%s", cfg.AdminPort),
+		Handler:      adminRoot,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// Decision API, for callers that aren't HTTP requests, when DECISION_PORT
+	// is set; it counts against any key it is sent, so it listens on its own
+	// port and is authenticated with DECISION_TOKEN
+	decisionMux := http.NewServeMux()
+	decisionMux.Handle(handlers.CheckPath, handlers.CheckHandler(rateLimiterService, metricsInstance))
+	decisionMux.Handle(handlers.CheckBatchPath, handlers.CheckBatchHandler(rateLimiterService, metricsInstance))
+
+	decisionServer := &http.Server{
+		Addr:         fmt.Sprintf(":%s", cfg.DecisionPort),
+		Handler:      middleware.BearerAuthMiddleware(cfg.DecisionToken)(decisionMux),
+		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	// Start server in a goroutine
+	// Start servers in goroutines
 	go func() {
 		log.Printf("Server starting on port %s", cfg.ServerPort)
 		log.Printf("Rate limiter configured: IP=%v, Token=%v", cfg.EnableIPRateLimiter, cfg.EnableTokenRateLimiter)
-		log.Printf("Max requests per second: %d", cfg.MaxRequestsPerSecond)
+		log.Printf("Max requests per window: %d (window: %v)", cfg.MaxRequestsPerSecond, cfg.RateLimitWindow)
 		log.Printf("Blocking time: %v", cfg.BlockingTime)
+		log.Printf("Algorithm: %s", cfg.RateLimitAlgorithm)
+		log.Printf("Failure mode: %s", cfg.FailureMode)
+		for name, upstream := range cfg.Upstreams {
+			log.Printf("Proxying to upstream %s: %s", name, upstream)
+		}
 		
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
 
+	go func() {
+		log.Printf("Admin API starting on port %s", cfg.AdminPort)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Admin server failed to start: %v", err)
+		}
+	}()
+
+	if cfg.DecisionPort != "" {
+		go func() {
+			log.Printf("Decision API starting on port %s", cfg.DecisionPort)
+			if err := decisionServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Decision server failed to start: %v", err)
+			}
+		}()
+	}
+
+	// Envoy's rate limit service (gRPC), when RLS_PORT is set
+	rlsServer := rls.NewGRPCServer(rateLimiterService, metricsInstance)
+	if cfg.RLSPort != "" {
+		go func() {
+			listener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.RLSPort))
+			if err != nil {
+				log.Fatalf("Rate limit service failed to start: %v", err)
+			}
+			log.Printf("Rate limit service (gRPC) starting on port %s", cfg.RLSPort)
+			if err := rlsServer.Serve(listener); err != nil {
+				log.Fatalf("Rate limit service failed: %v", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -82,6 +255,13 @@ func main() {
 	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	rlsServer.GracefulStop()
+	if err := adminServer.Shutdown(ctx); err != nil {
+		log.Printf("Admin server forced to shutdown: %v", err)
+	}
+	if err := decisionServer.Shutdown(ctx); err != nil {
+		log.Printf("Decision server forced to shutdown: %v", err)
+	}
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
@@ -89,4 +269,22 @@ func main() {
 	log.Println("Server exited successfully")
 }
 
+// newTokenRegistry creates the token registry selected by the configuration
+// A file registry is reloaded whenever the file changes, until ctx is done
+func newTokenRegistry(ctx context.Context, cfg *config.Config, store storage.Storage) (registry.TokenRegistry, error) {
+	tokenRegistry, err := registry.New(cfg, store)
+	if err != nil {
+		return nil, err
+	}
 
+	if fileRegistry, ok := tokenRegistry.(*registry.FileRegistry); ok {
+		go config.WatchFile(ctx, cfg.TokenRegistryFile, cfg.PolicyReloadInterval, func() {
+			if err := fileRegistry.Reload(); err != nil {
+				log.Printf("Token registry reload rejected, keeping current tokens: %v", err)
+				return
+			}
+			log.Printf("Token registry reloaded")
+		})
+	}
+	return tokenRegistry, nil
+}
@@ -0,0 +1,163 @@
+// Package api holds the decision API shared by the server, the ratelimit
+// package and its client: decisions, check requests, their errors and the
+// wire format. It depends on nothing else in the module, so clients of the
+// API stay small
+package api
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Paths of the decision API
+const (
+	CheckPath      = "/v1/check"
+	CheckBatchPath = "/v1/check/batch"
+)
+
+// MaxBatchChecks is the largest number of checks a batch may carry
+const MaxBatchChecks = 1000
+
+// Errors returned with decisions
+var (
+	ErrLimitExceeded = errors.New("rate limit exceeded")
+	ErrAccessDenied  = errors.New("access denied")
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrUnavailable   = errors.New("rate limiter unavailable")
+
+	// ErrInvalidCheck is returned for a check request without a key, with
+	// an unknown dimension or policy, or costing more than its limit ever
+	// admits
+	ErrInvalidCheck = errors.New("invalid check")
+)
+
+// Dimensions a decision's limit counts requests by
+const (
+	DimensionIP    = "ip"
+	DimensionToken = "token"
+	DimensionKey   = "key" // any key of the caller's, see CheckRequest
+)
+
+// Decision is the outcome of checking a request against a rate limit
+// Limit requests are admitted per Window, of which Remaining are left until
+// ResetTime; Limit is zero when no limit applies, e.g. for allow-listed
+// clients or a disabled limiter
+// Dimension is what the deciding limit counts by, DimensionIP,
+// DimensionToken or DimensionKey, and is empty when no limit applies
+// Degraded decisions were made by the failure mode, as the storage failed
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Window    time.Duration
+	ResetTime time.Time
+	Policy    string
+	Dimension string
+	Degraded  bool
+}
+
+// ResetAfter returns the time left until ResetTime, never negative
+func (d Decision) ResetAfter(now time.Time) time.Duration {
+	if d.ResetTime.IsZero() || !d.ResetTime.After(now) {
+		return 0
+	}
+	return d.ResetTime.Sub(now)
+}
+
+// CheckRequest asks to count Cost requests of Key against a limit, for
+// callers that aren't HTTP requests, such as queue consumers or cron jobs
+// Key is a client IP for DimensionIP, an API token for DimensionToken, and
+// any key of the caller's, e.g. a tenant, for DimensionKey, the default
+// Policy names the route or descriptor rule whose limit applies; without
+// one IPs and tokens get the default limits and keys are rejected. Cost
+// defaults to one request
+type CheckRequest struct {
+	Key       string
+	Dimension string
+	Policy    string
+	Cost      int
+}
+
+// Checker decides check requests: a ratelimit.Limiter decides them itself
+// and the client package through the decision API of a server
+type Checker interface {
+	// Check decides and counts every request on its own
+	Check(ctx context.Context, requests ...CheckRequest) ([]Decision, []error)
+
+	// Peek decides every request on its own without counting anything
+	Peek(ctx context.Context, requests ...CheckRequest) ([]Decision, []error)
+}
+
+// Error codes of the decision API, stable across releases unlike the
+// messages they come with
+const (
+	CodeLimitExceeded = "limit_exceeded"
+	CodeAccessDenied  = "access_denied"
+	CodeInvalidToken  = "invalid_token"
+	CodeInvalidCheck  = "invalid_check"
+	CodeUnavailable   = "unavailable"
+	CodeInternal      = "internal"
+)
+
+var codeErrors = []struct {
+	code string
+	err  error
+}{
+	{CodeLimitExceeded, ErrLimitExceeded},
+	{CodeAccessDenied, ErrAccessDenied},
+	{CodeInvalidToken, ErrInvalidToken},
+	{CodeInvalidCheck, ErrInvalidCheck},
+	{CodeUnavailable, ErrUnavailable},
+}
+
+// ErrorCode returns the code reporting err, empty for a nil error
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range codeErrors {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
+
+// CodeError returns the error a code reports, with the message it came with
+// The error matches the code's sentinel error with errors.Is; messages
+// without a known code come back as plain errors, and nil without either
+func CodeError(code, msg string) error {
+	if code == "" && msg == "" {
+		return nil
+	}
+	var codeErr error
+	for _, c := range codeErrors {
+		if c.code == code {
+			codeErr = c.err
+		}
+	}
+	switch {
+	case codeErr == nil:
+		return errors.New(msg)
+	case msg == "" || strings.EqualFold(msg, codeErr.Error()):
+		return codeErr
+	default:
+		return &codedError{err: codeErr, msg: msg}
+	}
+}
+
+// codedError is a sentinel error with the message the server gave it
+type codedError struct {
+	err error
+	msg string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
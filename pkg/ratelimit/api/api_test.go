@@ -0,0 +1,39 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{nil, ""},
+		{ErrLimitExceeded, CodeLimitExceeded},
+		{fmt.Errorf("%w: no key", ErrInvalidCheck), CodeInvalidCheck},
+		{fmt.Errorf("%w: connection refused", ErrUnavailable), CodeUnavailable},
+		{errors.New("boom"), CodeInternal},
+	}
+	for _, tt := range tests {
+		code := ErrorCode(tt.err)
+		if code != tt.code {
+			t.Errorf("Expected code %q for %v, got %q", tt.code, tt.err, code)
+		}
+		if tt.err == nil || code == CodeInternal {
+			continue
+		}
+		if err := CodeError(code, "Message"); !errors.Is(err, errors.Unwrap(tt.err)) && !errors.Is(err, tt.err) {
+			t.Errorf("Expected code %q to come back as %v, got %v", code, tt.err, err)
+		}
+	}
+
+	if err := CodeError(CodeLimitExceeded, "Rate limit exceeded"); err != ErrLimitExceeded {
+		t.Errorf("Expected the sentinel error itself, got %#v", err)
+	}
+	if err := CodeError("", ""); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
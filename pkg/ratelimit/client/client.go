@@ -0,0 +1,303 @@
+// Package client calls the decision API of a rate limiter server, deciding
+// work the way an embedded ratelimit.Limiter would
+//
+//	c := client.New("http://ratelimiter:9091", client.WithBearerToken(token), client.WithTimeout(200*time.Millisecond))
+//	decisions, errs := c.Check(ctx, api.CheckRequest{Key: "acme", Policy: "exports"})
+//
+// The client only depends on the api package, not on the limiter. While the
+// server can't be reached it fails open by default: decisions are allowed
+// and marked Degraded
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/pkg/ratelimit/api"
+)
+
+// DefaultTimeout bounds a call to the decision API unless WithTimeout says
+// otherwise
+const DefaultTimeout = time.Second
+
+// maxIdleConnsPerHost is how many connections to the server are kept open
+// for reuse, so concurrent callers don't dial for every check
+const maxIdleConnsPerHost = 64
+
+// failureMode is how a client decides checks while the server is
+// unavailable
+type failureMode int
+
+const (
+	failOpen   failureMode = iota // allow the checks
+	failClosed                    // reject the checks with ErrUnavailable
+	failLocal                     // decide the checks with a local checker
+)
+
+// Client decides check requests through the decision API of a server; it is
+// safe for concurrent use and reuses its connections
+type Client struct {
+	baseURL     string
+	token       string
+	client      *http.Client
+	timeout     time.Duration
+	failureMode failureMode
+	local       api.Checker
+}
+
+// Option changes a setting of a client, see New
+type Option func(*Client)
+
+// WithHTTPClient sends the calls with client, e.g. for its transport's TLS
+// settings; the client's connections should be reused
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.client = client
+	}
+}
+
+// WithBearerToken authenticates the calls with token, the server's
+// DECISION_TOKEN
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithTimeout bounds every call to the decision API by d, after which the
+// server is considered unavailable; zero leaves calls to the context
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithFailClosed rejects the checks with ErrUnavailable while the server
+// can't be reached, instead of allowing them
+func WithFailClosed() Option {
+	return func(c *Client) {
+		c.failureMode, c.local = failClosed, nil
+	}
+}
+
+// WithLocalFallback decides the checks with local, e.g. a ratelimit.Limiter
+// in memory, while the server can't be reached; its decisions are marked
+// Degraded
+func WithLocalFallback(local api.Checker) Option {
+	return func(c *Client) {
+		c.failureMode, c.local = failLocal, local
+	}
+}
+
+// New creates a client of the server at baseURL, e.g.
+// "http://ratelimiter:9091"
+func New(baseURL string, opts ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+
+	c := &Client{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		client:      &http.Client{Transport: transport},
+		timeout:     DefaultTimeout,
+		failureMode: failOpen,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Check decides and counts every request on its own, as the server's
+// Limiter.Check does, in as few calls as the batch size allows
+// A decision and an error are returned per request; the error is
+// ErrUnavailable when the server's failure mode rejected the check
+func (c *Client) Check(ctx context.Context, requests ...api.CheckRequest) ([]api.Decision, []error) {
+	return c.decide(ctx, requests, false)
+}
+
+// Peek decides every request as Check does without counting anything
+func (c *Client) Peek(ctx context.Context, requests ...api.CheckRequest) ([]api.Decision, []error) {
+	return c.decide(ctx, requests, true)
+}
+
+func (c *Client) decide(ctx context.Context, requests []api.CheckRequest, peek bool) ([]api.Decision, []error) {
+	decisions := make([]api.Decision, len(requests))
+	errs := make([]error, len(requests))
+	for start := 0; start < len(requests); start += api.MaxBatchChecks {
+		end := min(start+api.MaxBatchChecks, len(requests))
+		batch := requests[start:end]
+
+		err := c.post(ctx, batch, peek, decisions[start:end], errs[start:end])
+		var unavailable *unavailableError
+		switch {
+		case errors.As(err, &unavailable) && ctx.Err() == nil:
+			c.fail(ctx, batch, peek, unavailable.cause, decisions[start:end], errs[start:end])
+		case err != nil:
+			for i := start; i < end; i++ {
+				decisions[i], errs[i] = api.Decision{}, err
+			}
+		}
+	}
+	return decisions, errs
+}
+
+// unavailableError is a call that failed for want of a server: it couldn't
+// be reached, timed out or answered with a server error
+type unavailableError struct {
+	cause error
+}
+
+func (e *unavailableError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.cause
+}
+
+// post sends a batch of checks to the decision API, filling decisions and
+// errs from its response
+func (c *Client) post(ctx context.Context, requests []api.CheckRequest, peek bool, decisions []api.Decision, errs []error) error {
+	body := batchRequest{Checks: make([]checkRequest, len(requests)), Peek: peek}
+	for i, request := range requests {
+		body.Checks[i] = checkRequest(request)
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+api.CheckBatchPath, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &unavailableError{err}
+	}
+	defer func() {
+		// Drain the body so the connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		err := fmt.Errorf("decision API: %s", resp.Status)
+		if cause := api.CodeError(failure.Code, failure.Error); cause != nil {
+			err = fmt.Errorf("decision API: %s: %w", resp.Status, cause)
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return &unavailableError{err}
+		}
+		return err
+	}
+
+	var result struct {
+		Decisions []decisionResponse `json:"decisions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return &unavailableError{fmt.Errorf("decision API: invalid response: %w", err)}
+	}
+	if len(result.Decisions) != len(requests) {
+		return &unavailableError{fmt.Errorf("decision API: %d decisions for %d checks", len(result.Decisions), len(requests))}
+	}
+	now := time.Now()
+	for i, decision := range result.Decisions {
+		decisions[i], errs[i] = decision.decision(now)
+	}
+	return nil
+}
+
+// fail decides requests while the server is unavailable, as the failure
+// mode says
+func (c *Client) fail(ctx context.Context, requests []api.CheckRequest, peek bool, cause error, decisions []api.Decision, errs []error) {
+	switch c.failureMode {
+	case failClosed:
+		for i := range requests {
+			decisions[i], errs[i] = api.Decision{}, fmt.Errorf("%w: %v", api.ErrUnavailable, cause)
+		}
+	case failLocal:
+		var local []api.Decision
+		var localErrs []error
+		if peek {
+			local, localErrs = c.local.Peek(ctx, requests...)
+		} else {
+			local, localErrs = c.local.Check(ctx, requests...)
+		}
+		for i := range requests {
+			decisions[i], errs[i] = local[i], localErrs[i]
+			decisions[i].Degraded = true
+		}
+	default:
+		for i := range requests {
+			decisions[i], errs[i] = api.Decision{Allowed: true, Degraded: true}, nil
+		}
+	}
+}
+
+// batchRequest is the body of a decision API batch
+type batchRequest struct {
+	Checks []checkRequest `json:"checks"`
+	Peek   bool           `json:"peek"`
+}
+
+// checkRequest is the JSON form of a check in the decision API
+type checkRequest struct {
+	Key       string `json:"key"`
+	Dimension string `json:"dimension,omitempty"`
+	Policy    string `json:"policy,omitempty"`
+	Cost      int    `json:"cost,omitempty"`
+}
+
+// decisionResponse is the JSON form of a decision in the decision API
+type decisionResponse struct {
+	Allowed      bool   `json:"allowed"`
+	Degraded     bool   `json:"degraded"`
+	Policy       string `json:"policy"`
+	Dimension    string `json:"dimension"`
+	Limit        int    `json:"limit"`
+	Remaining    int    `json:"remaining"`
+	Window       string `json:"window"`
+	ResetAfterMS *int64 `json:"reset_after_ms"`
+	Error        string `json:"error"`
+	Code         string `json:"code"`
+}
+
+// decision returns the decision and its error, dating the reset from now
+func (d decisionResponse) decision(now time.Time) (api.Decision, error) {
+	decision := api.Decision{
+		Allowed:   d.Allowed,
+		Limit:     d.Limit,
+		Remaining: d.Remaining,
+		Policy:    d.Policy,
+		Dimension: d.Dimension,
+		Degraded:  d.Degraded,
+	}
+	decision.Window, _ = time.ParseDuration(d.Window)
+	if d.ResetAfterMS != nil {
+		decision.ResetTime = now.Add(time.Duration(*d.ResetAfterMS) * time.Millisecond)
+	}
+	return decision, api.CodeError(d.Code, d.Error)
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/middleware"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/pkg/ratelimit"
+)
+
+// newTestServer serves the decision API of a limiter admitting maxRequests
+// per minute, counting the connections it accepts
+func newTestServer(t *testing.T, maxRequests int) (*httptest.Server, *atomic.Int32) {
+	l, err := ratelimit.New(ratelimit.WithLimit(maxRequests, time.Minute), ratelimit.WithBlockTime(0))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(l.DecisionHandler())
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+func TestClient_Check(t *testing.T) {
+	server, conns := newTestServer(t, 3)
+	c := New(server.URL)
+	ctx := context.Background()
+	ip := ratelimit.CheckRequest{Key: "192.0.2.1", Dimension: ratelimit.DimensionIP}
+
+	decisions, errs := c.Check(ctx, ratelimit.CheckRequest{Key: "192.0.2.1", Dimension: ratelimit.DimensionIP, Cost: 2})
+	if errs[0] != nil || !decisions[0].Allowed || decisions[0].Limit != 3 || decisions[0].Remaining != 1 || decisions[0].Window != time.Minute {
+		t.Errorf("Expected 1 of 3 requests left, got %+v, %v", decisions[0], errs[0])
+	}
+	if decisions[0].ResetAfter(time.Now()) <= 0 || decisions[0].Degraded {
+		t.Errorf("Expected a reset time from the server, got %+v", decisions[0])
+	}
+
+	decisions, errs = c.Peek(ctx, ip)
+	if errs[0] != nil || decisions[0].Remaining != 1 {
+		t.Errorf("Expected peeking to leave 1 request, got %+v, %v", decisions[0], errs[0])
+	}
+
+	decisions, errs = c.Check(ctx, ip, ip, ratelimit.CheckRequest{Key: "acme"})
+	if errs[0] != nil || !errors.Is(errs[1], ratelimit.ErrLimitExceeded) || decisions[1].Allowed {
+		t.Errorf("Expected only the first check to be allowed, got %+v, %v", decisions, errs)
+	}
+	if !errors.Is(errs[2], ratelimit.ErrInvalidCheck) {
+		t.Errorf("Expected a key without a policy to be invalid, got %v", errs[2])
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected the client to reuse its connection, got %d connections", n)
+	}
+}
+
+func TestClient_Check_ErrorCodes(t *testing.T) {
+	// Errors are told apart by their code, whatever the server's wording
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"decisions": [
+			{"allowed": false, "error": "Slow down", "code": "limit_exceeded"},
+			{"allowed": false, "error": "Go away", "code": "access_denied"},
+			{"allowed": false, "error": "Something new", "code": "unheard_of"}
+		]}`))
+	}))
+	defer server.Close()
+	ip := ratelimit.CheckRequest{Key: "192.0.2.1", Dimension: ratelimit.DimensionIP}
+
+	_, errs := New(server.URL).Check(context.Background(), ip, ip, ip)
+	if !errors.Is(errs[0], ratelimit.ErrLimitExceeded) || errs[0].Error() != "Slow down" {
+		t.Errorf("Expected ErrLimitExceeded with the server's message, got %v", errs[0])
+	}
+	if !errors.Is(errs[1], ratelimit.ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied, got %v", errs[1])
+	}
+	if errs[2] == nil || errors.Is(errs[2], ratelimit.ErrLimitExceeded) {
+		t.Errorf("Expected a plain error for an unknown code, got %v", errs[2])
+	}
+}
+
+func TestClient_Check_LargeBatch(t *testing.T) {
+	server, _ := newTestServer(t, 10)
+	requests := make([]ratelimit.CheckRequest, 1500)
+	for i := range requests {
+		requests[i] = ratelimit.CheckRequest{Key: "192.0.2.1", Dimension: ratelimit.DimensionIP}
+	}
+
+	_, errs := New(server.URL).Check(context.Background(), requests...)
+	limited := 0
+	for _, err := range errs {
+		if errors.Is(err, ratelimit.ErrLimitExceeded) {
+			limited++
+		}
+	}
+	if limited != 1490 {
+		t.Errorf("Expected 1490 checks over the limit across batches, got %d", limited)
+	}
+}
+
+func TestClient_BearerToken(t *testing.T) {
+	l, err := ratelimit.New(ratelimit.WithLimit(10, time.Minute))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer l.Close()
+	server := httptest.NewServer(middleware.BearerAuthMiddleware("secret")(l.DecisionHandler()))
+	defer server.Close()
+	ip := ratelimit.CheckRequest{Key: "192.0.2.1", Dimension: ratelimit.DimensionIP}
+	ctx := context.Background()
+
+	decisions, errs := New(server.URL).Check(ctx, ip)
+	if errs[0] == nil || decisions[0].Allowed {
+		t.Errorf("Expected an unauthenticated check to fail, got %+v, %v", decisions[0], errs[0])
+	}
+
+	decisions, errs = New(server.URL, WithBearerToken("secret")).Check(ctx, ip)
+	if errs[0] != nil || !decisions[0].Allowed || decisions[0].Remaining != 9 {
+		t.Errorf("Expected the first request to count, got %+v, %v", decisions[0], errs[0])
+	}
+}
+
+func TestClient_Unavailable(t *testing.T) {
+	server, _ := newTestServer(t, 10)
+	server.Close()
+	ip := ratelimit.CheckRequest{Key: "192.0.2.1", Dimension: ratelimit.DimensionIP}
+	ctx := context.Background()
+
+	decisions, errs := New(server.URL).Check(ctx, ip)
+	if errs[0] != nil || !decisions[0].Allowed || !decisions[0].Degraded {
+		t.Errorf("Expected to fail open, got %+v, %v", decisions[0], errs[0])
+	}
+
+	_, errs = New(server.URL, WithFailClosed()).Check(ctx, ip)
+	if !errors.Is(errs[0], ratelimit.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable when failing closed, got %v", errs[0])
+	}
+
+	local, err := ratelimit.New(ratelimit.WithLimit(1, time.Minute))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer local.Close()
+	decisions, errs = New(server.URL, WithLocalFallback(local)).Check(ctx, ip, ip)
+	if errs[0] != nil || !decisions[0].Degraded || !errors.Is(errs[1], ratelimit.ErrLimitExceeded) {
+		t.Errorf("Expected the local limit to apply, got %+v, %v", decisions, errs)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	ip := ratelimit.CheckRequest{Key: "192.0.2.1", Dimension: ratelimit.DimensionIP}
+
+	start := time.Now()
+	decisions, errs := New(server.URL, WithTimeout(20*time.Millisecond)).Check(context.Background(), ip)
+	if errs[0] != nil || !decisions[0].Allowed || !decisions[0].Degraded {
+		t.Errorf("Expected a slow server to fail open, got %+v, %v", decisions[0], errs[0])
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the call to time out, took %v", elapsed)
+	}
+
+	// Giving up is the caller's decision, not the server's failure
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, errs := New(server.URL).Check(ctx, ip); !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("Expected the caller's cancellation, got %v", errs[0])
+	}
+}
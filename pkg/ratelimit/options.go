@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+)
+
+// Option changes a setting of a limiter, see New
+type Option func(*options) error
+
+type options struct {
+	config  *config.Config
+	storage Storage
+}
+
+// defaultConfig returns the server's defaults, with the memory storage
+func defaultConfig() *config.Config {
+	return &config.Config{
+		StorageBackend:          config.StorageBackendMemory,
+		MemoryMaxKeys:           100000,
+		MemoryCleanupInterval:   time.Minute,
+		MaxRequestsPerSecond:    10,
+		RateLimitWindow:         time.Second,
+		BlockingTime:            5 * time.Minute,
+		RateLimitAlgorithm:      config.AlgorithmFixedWindow,
+		TokenLimits:             make(map[string]config.TokenLimit),
+		EnableIPRateLimiter:     true,
+		EnableTokenRateLimiter:  true,
+		TokenMode:               config.TokenModeFallback,
+		UnknownTokenAction:      config.UnknownTokenIP,
+		IPv4PrefixLength:        32,
+		IPv6PrefixLength:        64,
+		TrustedProxyHeader:      config.TrustedProxyHeaderXForwardedFor,
+		FailureMode:             config.FailureModeClosed,
+		FailureLocalInstances:   1,
+		CircuitBreakerThreshold: 5,
+		CircuitBreakerCooldown:  5 * time.Second,
+	}
+}
+
+// LoadConfig reads the settings from the environment and the policy file, as
+// the server does, for WithConfig
+func LoadConfig() (*Config, error) {
+	return config.LoadConfig()
+}
+
+// WithConfig starts from cfg instead of the defaults, e.g. as returned by
+// LoadConfig; the options after it change cfg's settings
+// Without WithStorage the limiter creates the storage cfg selects
+func WithConfig(cfg *Config) Option {
+	return func(o *options) error {
+		copied := *cfg
+		copied.TokenLimits = maps.Clone(cfg.TokenLimits)
+		if copied.TokenLimits == nil {
+			copied.TokenLimits = make(map[string]config.TokenLimit)
+		}
+		o.config = &copied
+		return nil
+	}
+}
+
+// WithStorage keeps the counters in store, e.g. a Redis storage shared with
+// other instances
+func WithStorage(store Storage) Option {
+	return func(o *options) error {
+		o.storage = store
+		return nil
+	}
+}
+
+// WithLimit admits maxRequests per window from each IP, and from tokens
+// without a limit of their own
+func WithLimit(maxRequests int, window time.Duration) Option {
+	return func(o *options) error {
+		o.config.MaxRequestsPerSecond = maxRequests
+		o.config.RateLimitWindow = window
+		return nil
+	}
+}
+
+// WithBlockTime blocks a client for d once it exceeds its limit; zero
+// rejects requests only until the window resets
+func WithBlockTime(d time.Duration) Option {
+	return func(o *options) error {
+		o.config.BlockingTime = d
+		return nil
+	}
+}
+
+// WithAlgorithm selects the rate limiting algorithm, e.g.
+// AlgorithmTokenBucket
+func WithAlgorithm(name string) Option {
+	return func(o *options) error {
+		o.config.RateLimitAlgorithm = name
+		return nil
+	}
+}
+
+// WithBurst sets the bucket capacity of the token bucket and GCRA
+// algorithms, which defaults to the limit's max requests
+func WithBurst(burst int) Option {
+	return func(o *options) error {
+		o.config.RateLimitBurst = burst
+		return nil
+	}
+}
+
+// WithTokenLimit gives token a limit of its own; the window, blocking time
+// and algorithm default to the limiter's
+func WithTokenLimit(token string, limit TokenLimit) Option {
+	return func(o *options) error {
+		if limit.MaxRequests < 1 {
+			return fmt.Errorf("invalid limit of %d requests for token %s", limit.MaxRequests, config.RedactToken(token))
+		}
+		o.config.TokenLimits[token] = limit
+		return nil
+	}
+}
+
+// WithTokenMode sets how token limits combine with the IP limit, e.g.
+// TokenModeBoth
+func WithTokenMode(mode string) Option {
+	return func(o *options) error {
+		o.config.TokenMode = mode
+		return nil
+	}
+}
+
+// WithIPLimiter enables or disables limiting by IP
+func WithIPLimiter(enabled bool) Option {
+	return func(o *options) error {
+		o.config.EnableIPRateLimiter = enabled
+		return nil
+	}
+}
+
+// WithTokenLimiter enables or disables limiting by token
+func WithTokenLimiter(enabled bool) Option {
+	return func(o *options) error {
+		o.config.EnableTokenRateLimiter = enabled
+		return nil
+	}
+}
+
+// WithTokenHashSecret keys the hashes tokens are counted under with secret,
+// which limiters and servers sharing a storage must have in common; it is
+// required to limit tokens in a storage other than memory, where a random key
+// of the process is used by default
+func WithTokenHashSecret(secret string) Option {
+	return func(o *options) error {
+		o.config.TokenHashSecret = secret
+		return nil
+	}
+}
+
+// WithTrustedProxies trusts the forwarding headers of requests from proxies,
+// IP addresses or CIDRs, when the middleware finds the client IP
+func WithTrustedProxies(proxies ...string) Option {
+	return func(o *options) error {
+		o.config.TrustedProxies = nil
+		for _, proxy := range proxies {
+			ipNet, err := config.ParseIPNet(proxy)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy: %w", err)
+			}
+			o.config.TrustedProxies = append(o.config.TrustedProxies, ipNet)
+		}
+		return nil
+	}
+}
+
+// WithTrustedProxyHeader reads the client IP of requests from trusted proxies
+// in header, the one they set, e.g. TrustedProxyHeaderForwarded; the
+// default is X-Forwarded-For
+func WithTrustedProxyHeader(header string) Option {
+	return func(o *options) error {
+		o.config.TrustedProxyHeader = strings.ToLower(header)
+		return nil
+	}
+}
+
+// WithPolicyFile applies the policy file at path, JSON or YAML, as the
+// server's POLICY_FILE; the options after it override its settings
+// Unlike the server, the limiter ignores the environment
+func WithPolicyFile(path string) Option {
+	return func(o *options) error {
+		policy, err := config.LoadPolicyFile(path)
+		if err != nil {
+			return fmt.Errorf("invalid policy file:\n%w", err)
+		}
+		policy.ApplyAll(o.config)
+		return nil
+	}
+}
+
+// WithFailureMode sets how requests are decided when the storage fails,
+// e.g. FailureModeOpen
+func WithFailureMode(mode string) Option {
+	return func(o *options) error {
+		o.config.FailureMode = mode
+		return nil
+	}
+}
+
+// WithCircuitBreaker stops calling the storage for cooldown after threshold
+// consecutive failures; a threshold of zero disables the breaker
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(o *options) error {
+		o.config.CircuitBreakerThreshold = threshold
+		o.config.CircuitBreakerCooldown = cooldown
+		return nil
+	}
+}
@@ -0,0 +1,274 @@
+// Package ratelimit embeds the rate limiter in other Go services: the same
+// limits, algorithms, storages and HTTP middleware the server runs, set up
+// with functional options instead of environment variables
+//
+//	limiter, err := ratelimit.New(
+//		ratelimit.WithStorage(store),
+//		ratelimit.WithTokenHashSecret(os.Getenv("TOKEN_HASH_SECRET")),
+//		ratelimit.WithLimit(100, time.Minute),
+//		ratelimit.WithPolicyFile("policy.yaml"),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	defer limiter.Close()
+//	http.ListenAndServe(":8080", limiter.Middleware(mux))
+//
+// The client package calls the decision API of a remote server instead, and
+// the api package holds the types both share
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/config"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/handlers"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/limiter"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/middleware"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/pkg/ratelimit/api"
+)
+
+type (
+	// Decision is the outcome of checking a request against a rate limit
+	Decision = api.Decision
+
+	// CheckRequest asks to count Cost requests of Key against a limit, see
+	// Limiter.Check
+	CheckRequest = api.CheckRequest
+
+	// Checker decides check requests: a Limiter decides them itself and the
+	// client package through the decision API of a server
+	Checker = api.Checker
+
+	// TokenLimit is the limit of a token, see WithTokenLimit
+	TokenLimit = config.TokenLimit
+
+	// Config holds every setting of the limiter, as the server reads them
+	// from the environment, see WithConfig
+	Config = config.Config
+)
+
+// Errors returned with decisions
+var (
+	ErrLimitExceeded = api.ErrLimitExceeded
+	ErrAccessDenied  = api.ErrAccessDenied
+	ErrInvalidToken  = api.ErrInvalidToken
+	ErrInvalidCheck  = api.ErrInvalidCheck
+	ErrUnavailable   = api.ErrUnavailable
+)
+
+// Dimensions a decision's limit counts requests by
+const (
+	DimensionIP    = api.DimensionIP
+	DimensionToken = api.DimensionToken
+	DimensionKey   = api.DimensionKey
+)
+
+// Rate limiting algorithms
+const (
+	AlgorithmFixedWindow          = config.AlgorithmFixedWindow
+	AlgorithmTokenBucket          = config.AlgorithmTokenBucket
+	AlgorithmSlidingWindowLog     = config.AlgorithmSlidingWindowLog
+	AlgorithmSlidingWindowCounter = config.AlgorithmSlidingWindowCounter
+	AlgorithmGCRA                 = config.AlgorithmGCRA
+)
+
+// Failure modes: how requests are decided when the storage fails
+const (
+	FailureModeOpen   = config.FailureModeOpen
+	FailureModeClosed = config.FailureModeClosed
+	FailureModeLocal  = config.FailureModeLocal
+)
+
+// Token modes: how the limits of requests carrying a token combine with the
+// IP limit
+const (
+	TokenModeOverride = config.TokenModeOverride
+	TokenModeFallback = config.TokenModeFallback
+	TokenModeBoth     = config.TokenModeBoth
+)
+
+// Trusted proxy headers: the header trusted proxies report the client IP in
+const (
+	TrustedProxyHeaderXForwardedFor = config.TrustedProxyHeaderXForwardedFor
+	TrustedProxyHeaderForwarded     = config.TrustedProxyHeaderForwarded
+	TrustedProxyHeaderXRealIP       = config.TrustedProxyHeaderXRealIP
+)
+
+// Limiter is a rate limiter running in the calling process
+// Limiters sharing a Redis storage share their counts with each other and
+// with servers on the same storage
+type Limiter struct {
+	service *limiter.Service
+	store   Storage
+	owned   bool
+}
+
+// New creates a limiter with the server's defaults, 10 requests per second
+// per IP blocked for 5 minutes once exceeded, in memory, changed by opts
+// A storage created by New is closed by Close; one passed with WithStorage
+// is left to the caller
+func New(opts ...Option) (*Limiter, error) {
+	o := &options{config: defaultConfig()}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := validate(o.config); err != nil {
+		return nil, err
+	}
+	if o.config.EnableTokenRateLimiter && o.config.TokenHashSecret == "" && sharedStorage(o) {
+		return nil, errors.New("a token hash secret is required to limit tokens in a shared storage, see WithTokenHashSecret")
+	}
+
+	store, owned := o.storage, false
+	if store == nil {
+		var err error
+		if store, err = storage.New(o.config); err != nil {
+			return nil, fmt.Errorf("failed to initialize %s storage: %w", o.config.StorageBackend, err)
+		}
+		owned = true
+	}
+	if err := limiter.CheckStorage(store, o.config); err != nil {
+		if owned {
+			store.Close()
+		}
+		return nil, err
+	}
+
+	return &Limiter{
+		service: limiter.NewService(storage.NewCircuitBreaker(store, o.config.CircuitBreakerThreshold, o.config.CircuitBreakerCooldown), o.config),
+		store:   store,
+		owned:   owned,
+	}, nil
+}
+
+// Allow decides and counts a request of the client at ip, carrying token
+// if not empty, as the middleware does for HTTP requests
+// A nil error means the request is allowed; ErrLimitExceeded,
+// ErrAccessDenied and ErrInvalidToken come with the decision rejecting it
+func (l *Limiter) Allow(ctx context.Context, ip, token string) (Decision, error) {
+	return l.service.CheckAndIncrement(ctx, ip, token)
+}
+
+// Check decides and counts every request on its own, as if made by separate
+// callers, in a single storage operation
+// A decision and an error are returned per request; keys limited by a route
+// rule share their count with the HTTP requests the rule keys the same way
+func (l *Limiter) Check(ctx context.Context, requests ...CheckRequest) ([]Decision, []error) {
+	return l.service.Check(ctx, requests, false)
+}
+
+// Peek decides every request as Check does without counting anything; the
+// decisions report the quota remaining before the requests
+func (l *Limiter) Peek(ctx context.Context, requests ...CheckRequest) ([]Decision, []error) {
+	return l.service.Check(ctx, requests, true)
+}
+
+// Middleware rate limits the requests to next, answering 429 Too Many
+// Requests to the rejected ones, with the rate limit headers
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return middleware.RateLimitMiddleware(l.service)(next)
+}
+
+// DecisionHandler serves the decision API, POST api.CheckPath and
+// api.CheckBatchPath, which the client package calls
+// It doesn't authenticate its callers, who can count against any key, so
+// it must be served behind authentication or on a private network
+func (l *Limiter) DecisionHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(handlers.CheckPath, handlers.CheckHandler(l.service))
+	mux.Handle(handlers.CheckBatchPath, handlers.CheckBatchHandler(l.service))
+	return mux
+}
+
+// Reload applies opts to the limiter's current settings; an invalid result
+// is rejected and the current limits stay in effect
+// Existing counters are kept; the storage and token hash secret can't be
+// changed
+func (l *Limiter) Reload(opts ...Option) error {
+	current := *l.service.Config()
+	current.TokenLimits = maps.Clone(current.TokenLimits)
+	o := &options{config: &current}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return err
+		}
+	}
+	if o.storage != nil {
+		return errors.New("the storage of a limiter can't be changed")
+	}
+	if o.config.TokenHashSecret != l.service.Config().TokenHashSecret {
+		return errors.New("the token hash secret of a limiter can't be changed")
+	}
+	if err := validate(o.config); err != nil {
+		return err
+	}
+	if err := limiter.CheckStorage(l.store, o.config); err != nil {
+		return err
+	}
+	l.service.Reload(o.config)
+	return nil
+}
+
+// Close closes the storage, if New created it
+func (l *Limiter) Close() error {
+	if !l.owned {
+		return nil
+	}
+	return l.store.Close()
+}
+
+// validate checks the settings the service relies on
+func validate(cfg *config.Config) error {
+	if cfg.MaxRequestsPerSecond < 1 || cfg.RateLimitWindow <= 0 {
+		return fmt.Errorf("invalid limit of %d requests per %s", cfg.MaxRequestsPerSecond, cfg.RateLimitWindow)
+	}
+	if !config.IsValidAlgorithm(cfg.RateLimitAlgorithm) {
+		return fmt.Errorf("invalid algorithm %q (valid: %s)", cfg.RateLimitAlgorithm, strings.Join(config.Algorithms, ", "))
+	}
+	for token, limit := range cfg.TokenLimits {
+		if limit.Algorithm != "" && !config.IsValidAlgorithm(limit.Algorithm) {
+			return fmt.Errorf("invalid algorithm %q for token %s (valid: %s)", limit.Algorithm, config.RedactToken(token), strings.Join(config.Algorithms, ", "))
+		}
+	}
+	if !isValidTokenMode(cfg.TokenMode) {
+		return fmt.Errorf("invalid token mode %q (valid: %s)", cfg.TokenMode, strings.Join(config.TokenModes, ", "))
+	}
+	if !config.IsValidFailureMode(cfg.FailureMode) {
+		return fmt.Errorf("invalid failure mode %q (valid: %s)", cfg.FailureMode, strings.Join(config.FailureModes, ", "))
+	}
+	if !config.IsValidTrustedProxyHeader(cfg.TrustedProxyHeader) {
+		return fmt.Errorf("invalid trusted proxy header %q (valid: %s)", cfg.TrustedProxyHeader, strings.Join(config.TrustedProxyHeaders, ", "))
+	}
+	if cfg.IPv4PrefixLength < 1 || cfg.IPv4PrefixLength > 32 || cfg.IPv6PrefixLength < 1 || cfg.IPv6PrefixLength > 128 {
+		return fmt.Errorf("invalid IP prefix lengths /%d and /%d", cfg.IPv4PrefixLength, cfg.IPv6PrefixLength)
+	}
+	return nil
+}
+
+// sharedStorage reports whether the limiter's counters may be shared with
+// other processes, i.e. aren't kept in memory
+func sharedStorage(o *options) bool {
+	if o.storage == nil {
+		return o.config.StorageBackend != config.StorageBackendMemory
+	}
+	_, inMemory := storage.Unwrap(o.storage).(*storage.MemoryStorage)
+	return !inMemory
+}
+
+func isValidTokenMode(mode string) bool {
+	for _, valid := range config.TokenModes {
+		if valid == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage/storagetest"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNew(t *testing.T) {
+	store := NewMemoryStorage(0)
+	defer store.Close()
+
+	l, err := New(
+		WithStorage(store),
+		WithLimit(2, time.Minute),
+		WithBlockTime(0),
+		WithTokenLimit("premium-token", TokenLimit{MaxRequests: 5}),
+	)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer l.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := l.Allow(ctx, "192.0.2.1", ""); err != nil {
+			t.Fatalf("Request %d: expected to be allowed, got %v", i, err)
+		}
+	}
+	decision, err := l.Allow(ctx, "192.0.2.1", "")
+	if !errors.Is(err, ErrLimitExceeded) || decision.Limit != 2 || decision.Window != time.Minute {
+		t.Errorf("Expected the third request to exceed 2 per minute, got %+v, %v", decision, err)
+	}
+	if decision, err := l.Allow(ctx, "192.0.2.1", "premium-token"); err != nil || decision.Limit != 5 {
+		t.Errorf("Expected the token limit to apply, got %+v, %v", decision, err)
+	}
+
+	decisions, errs := l.Peek(ctx, CheckRequest{Key: "premium-token", Dimension: DimensionToken})
+	if errs[0] != nil || decisions[0].Remaining != 4 {
+		t.Errorf("Expected 4 requests left on the token, got %+v, %v", decisions[0], errs[0])
+	}
+
+	if err := l.Reload(WithLimit(3, time.Minute)); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, err := l.Allow(ctx, "192.0.2.1", ""); err != nil {
+		t.Errorf("Expected the reloaded limit to admit a third request, got %v", err)
+	}
+	if err := l.Reload(WithAlgorithm("leaky")); err == nil {
+		t.Error("Expected an invalid reload to fail")
+	}
+
+	// The caller's storage outlives the limiter
+	l.Close()
+	if err := store.Ping(ctx); err != nil {
+		t.Errorf("Expected the storage to stay open, got %v", err)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"no requests", WithLimit(0, time.Second)},
+		{"no window", WithLimit(10, 0)},
+		{"algorithm", WithAlgorithm("leaky")},
+		{"token mode", WithTokenMode("ip")},
+		{"failure mode", WithFailureMode("retry")},
+		{"trusted proxy", WithTrustedProxies("10.0.0.0/33")},
+		{"trusted proxy header", WithTrustedProxyHeader("X-Client-IP")},
+		{"token limit", WithTokenLimit("token", TokenLimit{})},
+		{"policy file", WithPolicyFile(filepath.Join(t.TempDir(), "missing.json"))},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.opt); err == nil {
+			t.Errorf("%s: expected New to fail", tt.name)
+		}
+	}
+}
+
+func TestNew_TokenHashSecret(t *testing.T) {
+	store, err := NewRedisStorage(redis.NewClient(&redis.Options{Addr: storagetest.NewRedis(t).Addr()}))
+	if err != nil {
+		t.Fatalf("Failed to create the storage: %v", err)
+	}
+	defer store.Close()
+
+	// Counters shared in Redis need the secret every limiter keys tokens with
+	if _, err := New(WithStorage(store)); err == nil || !strings.Contains(err.Error(), "WithTokenHashSecret") {
+		t.Errorf("Expected New to require a token hash secret, got %v", err)
+	}
+	if l, err := New(WithStorage(store), WithTokenLimiter(false)); err != nil {
+		t.Errorf("Expected New to accept a limiter without tokens, got %v", err)
+	} else {
+		l.Close()
+	}
+
+	l, err := New(WithStorage(store), WithTokenHashSecret("pepper"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer l.Close()
+	if _, err := l.Allow(context.Background(), "192.0.2.1", "token"); err != nil {
+		t.Errorf("Expected the request to be allowed, got %v", err)
+	}
+	if err := l.Reload(WithTokenHashSecret("salt")); err == nil {
+		t.Error("Expected Reload to refuse another token hash secret")
+	}
+}
+
+func TestNew_MultiLimitStorage(t *testing.T) {
+	memory := NewMemoryStorage(0)
+	defer memory.Close()
+	// A storage of its own, which can only check one limit at a time
+	store := struct{ Storage }{memory}
+
+	if _, err := New(WithStorage(store), WithTokenHashSecret("pepper"), WithTokenMode(TokenModeBoth)); err == nil {
+		t.Error("Expected New to reject token mode both on a storage checking one limit at a time")
+	}
+
+	l, err := New(WithStorage(store), WithTokenHashSecret("pepper"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer l.Close()
+	if err := l.Reload(WithTokenLimit("token", TokenLimit{MaxRequests: 10, IPMaxRequests: 2})); err == nil {
+		t.Error("Expected Reload to reject a per-IP ceiling on a storage checking one limit at a time")
+	}
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "default:\n  max_requests: 100\n  window: 1m\nroutes:\n  - name: login\n    pattern: POST /login\n    max_requests: 1\n    window: 1m\n"
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Options after the policy file override it
+	l, err := New(WithPolicyFile(path), WithTrustedProxies("10.0.0.1"), WithBlockTime(0))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer l.Close()
+
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	login := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := login(); code != http.StatusNoContent {
+		t.Errorf("Expected the first login to pass, got %d", code)
+	}
+	if code := login(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second login to be limited, got %d", code)
+	}
+
+	// The same rule is counted by the decision API
+	rec := httptest.NewRecorder()
+	l.DecisionHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/check",
+		strings.NewReader(`{"key": "192.0.2.1", "dimension": "ip", "policy": "login", "peek": true}`)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"allowed":false`) {
+		t.Errorf("Expected the decision API to report the login limit, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,27 @@
+package ratelimit
+
+import (
+	"github.com/gilbertopsantosjr/fc-tec-ch-02/internal/storage"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Storage keeps the counters of a limiter
+type Storage = storage.Storage
+
+// NewMemoryStorage keeps the counters in process, for a single instance;
+// the least recently used keys are evicted beyond maxKeys, unless zero
+func NewMemoryStorage(maxKeys int) Storage {
+	return storage.NewMemoryStorage(maxKeys, storage.DefaultMemoryCleanupInterval)
+}
+
+// NewRedisStorage keeps the counters in Redis, shared by every instance and
+// server using it; client may be a single server, Sentinel or Cluster
+// client and is closed with the storage
+func NewRedisStorage(client redis.UniversalClient) (Storage, error) {
+	store, err := storage.NewRedisStorageFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}